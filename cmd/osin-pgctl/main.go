@@ -0,0 +1,104 @@
+// Command osin-pgctl is an administration tool for the osin postgres storage.
+//
+// Usage:
+//
+//	osin-pgctl [-dsn url] <command> [args]
+//
+// The database url defaults to the DATABASE_URL environment variable. Commands are:
+//
+//	selftest                exercise a full synthetic oauth2 flow against the database in a rolled back transaction
+//	import-clients <file>   create or update the clients listed in a JSON (*.json) or YAML file, - reads YAML from stdin
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	_ "github.com/lib/pq"
+
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+func main() {
+	dsn := flag.String("dsn", os.Getenv("DATABASE_URL"), "postgres connection url")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-dsn url] <command> [args]\n\nCommands:\n  selftest\t\texercise a full synthetic flow against the database\n  import-clients <file>\tcreate or update the clients listed in a JSON or YAML file\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || *dsn == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("postgres", *dsn)
+	if err != nil {
+		fatalf("Could not open database: %s", err)
+	}
+
+	var code int
+	switch flag.Arg(0) {
+	case "selftest":
+		code = selftest(db)
+	case "import-clients":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			code = 2
+			break
+		}
+		code = importClients(db, flag.Arg(1))
+	default:
+		flag.Usage()
+		code = 2
+	}
+
+	db.Close()
+	os.Exit(code)
+}
+
+func selftest(db *sql.DB) int {
+	report, err := postgres.SelfTest(db)
+	if err != nil {
+		fatalf("Could not run self test: %s", err)
+	}
+
+	fmt.Print(report)
+	if report.Failed() {
+		return 1
+	}
+	return 0
+}
+
+func importClients(db *sql.DB, path string) int {
+	var r io.Reader = os.Stdin
+	format := postgres.ImportYAML
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fatalf("Could not open %s: %s", path, err)
+		}
+		defer f.Close()
+		r = f
+		if filepath.Ext(path) == ".json" {
+			format = postgres.ImportJSON
+		}
+	}
+
+	counts, err := postgres.New(db).ImportClients(r, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not import clients: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%d created, %d updated\n", counts.Created, counts.Updated)
+	return 0
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,244 @@
+// Package faulty is a decorator which injects errors, latency and partial failures into the operations of a storage,
+// to test how an authorization server behaves under storage faults.
+//
+//	store := faulty.New(memory.New())
+//	store.Inject(faulty.SaveRefresh, faulty.Fault{Err: errors.New("disk full")})
+//	server := osin.NewServer(osin.NewServerConfig(), store)
+//
+// Operations without an injected fault are passed to the decorated storage unchanged.
+package faulty
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+
+	"github.com/optimisticninja/osin-postgres/storage"
+)
+
+// ErrInjected is returned by faults without an error.
+var ErrInjected = errors.New("Injected fault")
+
+// Operation is a storage operation faults can be injected into.
+type Operation string
+
+// The operations of storage.Storage. SaveRefresh is the part of SaveAccess which stores the refresh token.
+const (
+	GetClient       Operation = "GetClient"
+	CreateClient    Operation = "CreateClient"
+	UpdateClient    Operation = "UpdateClient"
+	RemoveClient    Operation = "RemoveClient"
+	SaveAuthorize   Operation = "SaveAuthorize"
+	LoadAuthorize   Operation = "LoadAuthorize"
+	RemoveAuthorize Operation = "RemoveAuthorize"
+	SaveAccess      Operation = "SaveAccess"
+	SaveRefresh     Operation = "SaveRefresh"
+	LoadAccess      Operation = "LoadAccess"
+	RemoveAccess    Operation = "RemoveAccess"
+	LoadRefresh     Operation = "LoadRefresh"
+	RemoveRefresh   Operation = "RemoveRefresh"
+)
+
+// Fault describes how an operation fails.
+type Fault struct {
+	// Err is returned by the operation. Defaults to ErrInjected. Set Latency only to slow the operation down
+	// without failing it.
+	Err error
+
+	// Latency delays the operation.
+	Latency time.Duration
+
+	// Partial applies the operation to the decorated storage before Err is returned, i.e. the write succeeded, but
+	// the caller sees an error. For SaveRefresh the access token is saved without its refresh token.
+	Partial bool
+
+	// After is the number of calls after Inject which pass before the fault is injected.
+	After int
+
+	// Times is the number of calls the fault is injected into. Zero injects it into all following calls.
+	Times int
+}
+
+// Storage is a storage.Storage decorated with fault injection. It is safe for concurrent use.
+type Storage struct {
+	storage.Storage
+
+	mu     sync.Mutex
+	faults map[Operation]*injected
+	calls  map[Operation]int
+}
+
+// New returns next decorated with fault injection. No faults are injected until Inject is called.
+func New(next storage.Storage) *Storage {
+	return &Storage{Storage: next, faults: map[Operation]*injected{}, calls: map[Operation]int{}}
+}
+
+// Inject replaces the fault of op with f.
+func (s *Storage) Inject(op Operation, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Err == nil && f.Latency == 0 {
+		f.Err = ErrInjected
+	}
+	s.faults[op] = &injected{Fault: f, start: s.calls[op]}
+}
+
+// Clear removes the fault of op.
+func (s *Storage) Clear(op Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.faults, op)
+}
+
+// Reset removes all faults and call counts.
+func (s *Storage) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = map[Operation]*injected{}
+	s.calls = map[Operation]int{}
+}
+
+// Calls returns how often op was called, including failed calls.
+func (s *Storage) Calls(op Operation) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+// Clone returns the storage itself, so that faults apply to the clones osin creates per request.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// GetClient loads the client by id.
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	if err := s.fail(GetClient, nil, nil); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetClient(id)
+}
+
+// CreateClient stores the client.
+func (s *Storage) CreateClient(c osin.Client) error {
+	return s.apply(CreateClient, func() error { return s.Storage.CreateClient(c) })
+}
+
+// UpdateClient updates the client.
+func (s *Storage) UpdateClient(c osin.Client) error {
+	return s.apply(UpdateClient, func() error { return s.Storage.UpdateClient(c) })
+}
+
+// RemoveClient removes the client.
+func (s *Storage) RemoveClient(id string) error {
+	return s.apply(RemoveClient, func() error { return s.Storage.RemoveClient(id) })
+}
+
+// SaveAuthorize saves authorize data.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	return s.apply(SaveAuthorize, func() error { return s.Storage.SaveAuthorize(data) })
+}
+
+// LoadAuthorize looks up authorize data by code.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	if err := s.fail(LoadAuthorize, nil, nil); err != nil {
+		return nil, err
+	}
+	return s.Storage.LoadAuthorize(code)
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	return s.apply(RemoveAuthorize, func() error { return s.Storage.RemoveAuthorize(code) })
+}
+
+// SaveAccess writes access data. A fault of SaveRefresh only applies if data has a refresh token.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	save := func() error { return s.Storage.SaveAccess(data) }
+	if data.RefreshToken != "" {
+		// Without a refresh token, the decorated storage saves the access token only.
+		withoutRefresh := func() error {
+			access := *data
+			access.RefreshToken = ""
+			return s.Storage.SaveAccess(&access)
+		}
+		refresh := save
+		save = func() error { return s.fail(SaveRefresh, withoutRefresh, refresh) }
+	}
+	return s.apply(SaveAccess, save)
+}
+
+// LoadAccess retrieves access data by token.
+func (s *Storage) LoadAccess(token string) (*osin.AccessData, error) {
+	if err := s.fail(LoadAccess, nil, nil); err != nil {
+		return nil, err
+	}
+	return s.Storage.LoadAccess(token)
+}
+
+// RemoveAccess revokes or deletes the access token.
+func (s *Storage) RemoveAccess(token string) error {
+	return s.apply(RemoveAccess, func() error { return s.Storage.RemoveAccess(token) })
+}
+
+// LoadRefresh retrieves refresh access data.
+func (s *Storage) LoadRefresh(token string) (*osin.AccessData, error) {
+	if err := s.fail(LoadRefresh, nil, nil); err != nil {
+		return nil, err
+	}
+	return s.Storage.LoadRefresh(token)
+}
+
+// RemoveRefresh revokes or deletes the refresh token.
+func (s *Storage) RemoveRefresh(token string) error {
+	return s.apply(RemoveRefresh, func() error { return s.Storage.RemoveRefresh(token) })
+}
+
+// apply runs the write op, unless a fault is injected into it. A partial fault runs write before it fails.
+func (s *Storage) apply(op Operation, write func() error) error {
+	return s.fail(op, write, write)
+}
+
+// fail counts the call of op and waits for the latency of its fault. If the fault fails the call, partial is run
+// for partial faults and the error of the fault is returned. Otherwise pass is run, if it is not nil.
+func (s *Storage) fail(op Operation, partial, pass func() error) error {
+	f, failing := s.fault(op)
+	if f != nil && f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	if !failing {
+		if pass == nil {
+			return nil
+		}
+		return pass()
+	}
+	if f.Partial && partial != nil {
+		if err := partial(); err != nil {
+			return err
+		}
+	}
+	return f.Err
+}
+
+// fault counts the call of op and returns its fault, if the call is affected by it, and whether the call fails.
+func (s *Storage) fault(op Operation) (*Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[op]++
+	f, ok := s.faults[op]
+	if !ok {
+		return nil, false
+	}
+	n := s.calls[op] - f.start - f.After
+	if n <= 0 || f.Times > 0 && n > f.Times {
+		return nil, false
+	}
+	return &f.Fault, f.Err != nil
+}
+
+// injected is a fault and the number of calls of its operation when it was injected.
+type injected struct {
+	Fault
+	start int
+}
@@ -0,0 +1,91 @@
+package faulty
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/optimisticninja/osin-postgres/storage/memory"
+)
+
+func newStore(t *testing.T) (*Storage, *osin.DefaultClient) {
+	store := New(memory.New())
+	client := &osin.DefaultClient{Id: "client", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, store.CreateClient(client))
+	return store, client
+}
+
+func TestInjectError(t *testing.T) {
+	store, _ := newStore(t)
+	diskFull := errors.New("disk full")
+
+	store.Inject(GetClient, Fault{})
+	_, err := store.GetClient("client")
+	assert.Equal(t, ErrInjected, err)
+
+	store.Inject(GetClient, Fault{Err: diskFull})
+	_, err = store.GetClient("client")
+	assert.Equal(t, diskFull, err)
+
+	store.Clear(GetClient)
+	_, err = store.GetClient("client")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, store.Calls(GetClient))
+}
+
+func TestInjectAfterAndTimes(t *testing.T) {
+	store, _ := newStore(t)
+	store.GetClient("client")
+
+	store.Inject(GetClient, Fault{After: 1, Times: 2})
+	var failed []bool
+	for i := 0; i < 4; i++ {
+		_, err := store.GetClient("client")
+		failed = append(failed, err != nil)
+	}
+	assert.Equal(t, []bool{false, true, true, false}, failed)
+}
+
+func TestInjectLatency(t *testing.T) {
+	store, _ := newStore(t)
+	store.Inject(GetClient, Fault{Latency: 20 * time.Millisecond})
+
+	start := time.Now()
+	_, err := store.GetClient("client")
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
+
+func TestInjectPartialWrite(t *testing.T) {
+	store, client := newStore(t)
+	store.Inject(SaveAuthorize, Fault{Partial: true})
+
+	err := store.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "code", ExpiresIn: 60, CreatedAt: time.Now()})
+	assert.Equal(t, ErrInjected, err)
+	_, err = store.LoadAuthorize("code")
+	assert.Nil(t, err, "partial write must be applied")
+}
+
+func TestInjectSaveRefresh(t *testing.T) {
+	store, client := newStore(t)
+	access := &osin.AccessData{Client: client, AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 60, CreatedAt: time.Now()}
+
+	store.Inject(SaveRefresh, Fault{Times: 1})
+	assert.Equal(t, ErrInjected, store.SaveAccess(access))
+	_, err := store.LoadAccess("access")
+	assert.NotNil(t, err, "access token must not be saved")
+
+	store.Inject(SaveRefresh, Fault{Partial: true})
+	assert.Equal(t, ErrInjected, store.SaveAccess(access))
+	_, err = store.LoadAccess("access")
+	assert.Nil(t, err, "access token must be saved")
+	_, err = store.LoadRefresh("refresh")
+	assert.NotNil(t, err, "refresh token must not be saved")
+
+	assert.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: "other", ExpiresIn: 60, CreatedAt: time.Now()}),
+		"access without refresh token is not affected")
+}
@@ -0,0 +1,486 @@
+// Package memory is a osin storage implementation which keeps all data in maps. It is meant for unit tests and
+// local development.
+//
+// It implements postgres.AdminStorage with the semantics of a postgres storage created without options: it
+// returns the same errors, stores UserData as string and resolves clients, authorize data and previous access data
+// on load, so tests written against it hold for such a postgres storage as well. There are no equivalents of
+// postgres.WithClock, postgres.WithRefreshGracePeriod and postgres.WithRefreshExpiry: it reads the time with
+// time.Now, refresh tokens are removed right away and never expire, and Introspect reports refresh tokens as
+// active until they are removed. All data is lost when the process exits.
+package memory
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+// The *Row types mirror the rows of the postgres tables. Referenced entities are stored by key.
+
+type clientRow struct {
+	id, secret, redirectURI, extra string
+}
+
+type authorizeRow struct {
+	client, code, scope, redirectURI, state, extra string
+	codeChallenge, codeChallengeMethod             string
+	expiresIn                                      int32
+	createdAt                                      time.Time
+}
+
+type accessRow struct {
+	client, authorize, previous, accessToken, refreshToken, scope, redirectURI, extra string
+	expiresIn                                                                         int32
+	createdAt                                                                         time.Time
+}
+
+// Storage implements interface "github.com/openshift/osin".Storage and interface "github.com/optimisticninja/osin-postgres/storage".Storage
+type Storage struct {
+	mu        sync.RWMutex
+	clients   map[string]clientRow
+	authorize map[string]authorizeRow
+	access    map[string]accessRow
+	refresh   map[string]string
+}
+
+// New returns a new, empty in-memory storage instance.
+func New() *Storage {
+	return &Storage{
+		clients:   map[string]clientRow{},
+		authorize: map[string]authorizeRow{},
+		access:    map[string]accessRow{},
+		refresh:   map[string]string{},
+	}
+}
+
+// Reset removes all data.
+func (s *Storage) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = map[string]clientRow{}
+	s.authorize = map[string]authorizeRow{}
+	s.access = map[string]accessRow{}
+	s.refresh = map[string]string{}
+}
+
+// Clone the storage if needed. For example, using mgo, you can clone the session with session.Clone
+// to avoid concurrent access problems.
+// This is to avoid cloning the connection at each method access.
+// Can return itself if not a problem.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// Close the resources the Storage potentially holds (using Clone for example). The data is kept.
+func (s *Storage) Close() {
+}
+
+// GetClient loads the client by id. Returns postgres.ErrClientNotFound if the client does not exist.
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getClient(id)
+}
+
+func (s *Storage) getClient(id string) (osin.Client, error) {
+	c, ok := s.clients[id]
+	if !ok {
+		return nil, postgres.ErrClientNotFound
+	}
+	return &osin.DefaultClient{Id: c.id, Secret: c.secret, RedirectUri: c.redirectURI, UserData: c.extra}, nil
+}
+
+// UpdateClient updates the client (identified by it's id) and replaces the values with the values of client.
+// The secret is kept if client implements postgres.SecretKeepingClient.
+// Returns postgres.ErrClientNotFound if the client does not exist.
+func (s *Storage) UpdateClient(c osin.Client) error {
+	data, err := assertToString(c.GetUserData())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row, ok := s.clients[c.GetId()]
+	if !ok {
+		return postgres.ErrClientNotFound
+	}
+	secret := row.secret
+	if !postgres.KeepsSecret(c) {
+		secret = c.GetSecret()
+	}
+	s.clients[c.GetId()] = clientRow{id: c.GetId(), secret: secret, redirectURI: c.GetRedirectUri(), extra: data}
+	return nil
+}
+
+// CreateClient stores the client and returns an error, if something went wrong.
+// Returns postgres.ErrDuplicateKey if a client with the same id exists.
+func (s *Storage) CreateClient(c osin.Client) error {
+	data, err := assertToString(c.GetUserData())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[c.GetId()]; ok {
+		return duplicateKey("client", c.GetId())
+	}
+	s.clients[c.GetId()] = clientRow{id: c.GetId(), secret: c.GetSecret(), redirectURI: c.GetRedirectUri(), extra: data}
+	return nil
+}
+
+// RemoveClient removes a client (identified by id). Removing a client which does not exist is not an error.
+func (s *Storage) RemoveClient(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, id)
+	return nil
+}
+
+// ImportClients reads a list of clients from r and creates or updates them, see postgres.Storage.ImportClients.
+// Either all clients are imported or none.
+func (s *Storage) ImportClients(r io.Reader, format postgres.ImportFormat) (*postgres.ImportCounts, error) {
+	clients, err := postgres.DecodeClients(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := &postgres.ImportCounts{}
+	for _, c := range clients {
+		if _, ok := s.clients[c.ID]; ok {
+			counts.Updated++
+		} else {
+			counts.Created++
+		}
+		s.clients[c.ID] = clientRow{id: c.ID, secret: c.Secret, redirectURI: c.RedirectURI, extra: c.UserData}
+	}
+	return counts, nil
+}
+
+// SaveAuthorize saves authorize data. Returns postgres.ErrDuplicateKey if the code exists.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	extra, err := assertToString(data.UserData)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.authorize[data.Code]; ok {
+		return duplicateKey("authorize", data.Code)
+	}
+	s.authorize[data.Code] = authorizeRow{
+		client:      data.Client.GetId(),
+		code:        data.Code,
+		expiresIn:   data.ExpiresIn,
+		scope:       data.Scope,
+		redirectURI: data.RedirectUri,
+		state:       data.State,
+		createdAt:   data.CreatedAt,
+		extra:       extra,
+
+		codeChallenge:       data.CodeChallenge,
+		codeChallengeMethod: data.CodeChallengeMethod,
+	}
+	return nil
+}
+
+// LoadAuthorize looks up AuthorizeData by a code. Returns postgres.ErrTokenNotFound if the code does not exist.
+// Client information MUST be loaded together.
+// Optionally can return error if expired.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loadAuthorize(code)
+}
+
+func (s *Storage) loadAuthorize(code string) (*osin.AuthorizeData, error) {
+	row, ok := s.authorize[code]
+	if !ok {
+		return nil, postgres.ErrTokenNotFound
+	}
+
+	c, err := s.getClient(row.client)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &osin.AuthorizeData{
+		Client:      c,
+		Code:        row.code,
+		ExpiresIn:   row.expiresIn,
+		Scope:       row.scope,
+		RedirectUri: row.redirectURI,
+		State:       row.state,
+		CreatedAt:   row.createdAt,
+		UserData:    row.extra,
+
+		CodeChallenge:       row.codeChallenge,
+		CodeChallengeMethod: row.codeChallengeMethod,
+	}
+	if data.ExpireAt().Before(time.Now()) {
+		return nil, errors.Errorf("Token expired at %s.", data.ExpireAt().String())
+	}
+	return data, nil
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.authorize, code)
+	return nil
+}
+
+// SaveAccess writes AccessData.
+// If RefreshToken is not blank, it must save in a way that can be loaded using LoadRefresh.
+// Returns postgres.ErrDuplicateKey if the access or refresh token exists.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	prev := ""
+	authorizeData := &osin.AuthorizeData{}
+
+	if data.AccessData != nil {
+		prev = data.AccessData.AccessToken
+	}
+
+	if data.AuthorizeData != nil {
+		authorizeData = data.AuthorizeData
+	}
+
+	extra, err := assertToString(data.UserData)
+	if err != nil {
+		return err
+	}
+
+	if data.Client == nil {
+		return errors.New("data.Client must not be nil")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.access[data.AccessToken]; ok {
+		return duplicateKey("access", data.AccessToken)
+	}
+	if _, ok := s.refresh[data.RefreshToken]; ok && data.RefreshToken != "" {
+		return duplicateKey("refresh", data.RefreshToken)
+	}
+
+	if data.RefreshToken != "" {
+		s.refresh[data.RefreshToken] = data.AccessToken
+	}
+	s.access[data.AccessToken] = accessRow{
+		client:       data.Client.GetId(),
+		authorize:    authorizeData.Code,
+		previous:     prev,
+		accessToken:  data.AccessToken,
+		refreshToken: data.RefreshToken,
+		expiresIn:    data.ExpiresIn,
+		scope:        data.Scope,
+		redirectURI:  data.RedirectUri,
+		createdAt:    data.CreatedAt,
+		extra:        extra,
+	}
+	return nil
+}
+
+// LoadAccess retrieves access data by token. Returns postgres.ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
+// AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
+// Optionally can return error if expired.
+func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loadAccess(code)
+}
+
+func (s *Storage) loadAccess(code string) (*osin.AccessData, error) {
+	row, ok := s.access[code]
+	if !ok {
+		return nil, postgres.ErrTokenNotFound
+	}
+
+	client, err := s.getClient(row.client)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &osin.AccessData{
+		Client:       client,
+		AccessToken:  row.accessToken,
+		RefreshToken: row.refreshToken,
+		ExpiresIn:    row.expiresIn,
+		Scope:        row.scope,
+		RedirectUri:  row.redirectURI,
+		CreatedAt:    row.createdAt,
+		UserData:     row.extra,
+	}
+	if row.authorize != "" {
+		result.AuthorizeData, _ = s.loadAuthorize(row.authorize)
+	}
+	if row.previous != "" {
+		result.AccessData, _ = s.loadAccess(row.previous)
+	}
+	return result, nil
+}
+
+// RemoveAccess revokes or deletes an AccessData.
+func (s *Storage) RemoveAccess(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.access, code)
+	return nil
+}
+
+// LoadRefresh retrieves refresh AccessData. Returns postgres.ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
+// AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
+// Optionally can return error if expired.
+func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	access, ok := s.refresh[code]
+	if !ok {
+		return nil, postgres.ErrTokenNotFound
+	}
+	return s.loadAccess(access)
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData.
+func (s *Storage) RemoveRefresh(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refresh, code)
+	return nil
+}
+
+// Introspect resolves an access or refresh token, see postgres.Storage.Introspect.
+func (s *Storage) Introspect(token string) (*postgres.Introspection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokenType := postgres.TokenTypeAccess
+	row, ok := s.access[token]
+	if !ok {
+		tokenType = postgres.TokenTypeRefresh
+		if row, ok = s.access[s.refresh[token]]; !ok {
+			return nil, postgres.ErrTokenNotFound
+		}
+	}
+
+	i := &postgres.Introspection{Active: true, TokenType: tokenType, ClientID: row.client, Scope: row.scope, IssuedAt: row.createdAt}
+	if tokenType == postgres.TokenTypeAccess {
+		i.ExpiresAt = row.createdAt.Add(time.Duration(row.expiresIn) * time.Second)
+		i.Active = i.ExpiresAt.After(time.Now())
+	}
+	return i, nil
+}
+
+// RevokeToken removes the access or refresh token as described in RFC 7009. Revoking a refresh token does not
+// revoke the access token it was issued with. Returns postgres.ErrTokenNotFound if the token does not exist.
+func (s *Storage) RevokeToken(token string) error {
+	i, err := s.Introspect(token)
+	if err != nil {
+		return err
+	}
+	if i.TokenType == postgres.TokenTypeRefresh {
+		return s.RemoveRefresh(token)
+	}
+	return s.RemoveAccess(token)
+}
+
+// RevokeAllByClient removes all access tokens, refresh tokens and authorize codes issued to the client. The
+// client itself is not removed.
+func (s *Storage) RevokeAllByClient(clientID string) (*postgres.RevokeCounts, error) {
+	return s.revokeAll(func(client, extra string) bool { return client == clientID }), nil
+}
+
+// RevokeAllByUser removes all access tokens, refresh tokens and authorize codes whose UserData equals userRef.
+func (s *Storage) RevokeAllByUser(userRef string) (*postgres.RevokeCounts, error) {
+	return s.revokeAll(func(client, extra string) bool { return extra == userRef }), nil
+}
+
+// revokeAll removes all access tokens, authorize codes and refresh tokens of access tokens which match.
+func (s *Storage) revokeAll(match func(client, extra string) bool) *postgres.RevokeCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := &postgres.RevokeCounts{}
+	for token, access := range s.refresh {
+		if row, ok := s.access[access]; ok && match(row.client, row.extra) {
+			delete(s.refresh, token)
+			counts.Refresh++
+		}
+	}
+	for token, row := range s.access {
+		if match(row.client, row.extra) {
+			delete(s.access, token)
+			counts.Access++
+		}
+	}
+	for code, row := range s.authorize {
+		if match(row.client, row.extra) {
+			delete(s.authorize, code)
+			counts.Authorize++
+		}
+	}
+	return counts
+}
+
+// PurgeExpiredTokens removes all expired authorize codes and all expired access tokens which cannot be refreshed
+// anymore, because they have no refresh token left.
+func (s *Storage) PurgeExpiredTokens() (*postgres.RevokeCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	refreshable := map[string]bool{}
+	for _, access := range s.refresh {
+		refreshable[access] = true
+	}
+
+	counts := &postgres.RevokeCounts{}
+	for code, row := range s.authorize {
+		if expired(row.createdAt, row.expiresIn, now) {
+			delete(s.authorize, code)
+			counts.Authorize++
+		}
+	}
+	for token, row := range s.access {
+		if expired(row.createdAt, row.expiresIn, now) && !refreshable[token] {
+			delete(s.access, token)
+			counts.Access++
+		}
+	}
+	return counts, nil
+}
+
+func expired(createdAt time.Time, expiresIn int32, now time.Time) bool {
+	return createdAt.Add(time.Duration(expiresIn) * time.Second).Before(now)
+}
+
+// duplicateKey returns an error matching postgres.ErrDuplicateKey.
+func duplicateKey(table, key string) error {
+	return errors.New(fmt.Errorf("%w: %s %q exists", postgres.ErrDuplicateKey, table, key))
+}
+
+func assertToString(in interface{}) (string, error) {
+	var ok bool
+	var data string
+	if in == nil {
+		return "", nil
+	} else if data, ok = in.(string); ok {
+		return data, nil
+	} else if str, ok := in.(fmt.Stringer); ok {
+		return str.String(), nil
+	}
+	return "", errors.Errorf(`Could not assert "%v" to string`, in)
+}
@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/optimisticninja/osin-postgres/storage/osintest"
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+var _ postgres.AdminStorage = (*Storage)(nil)
+
+func TestClientOperations(t *testing.T) {
+	s := New()
+	client := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: "{}"}
+	require.Nil(t, s.CreateClient(client))
+	assert.True(t, errors.Is(s.CreateClient(client), postgres.ErrDuplicateKey))
+
+	client.Secret = "rotated"
+	require.Nil(t, s.UpdateClient(client))
+	loaded, err := s.GetClient("1")
+	require.Nil(t, err)
+	assert.EqualValues(t, client, loaded)
+
+	require.Nil(t, s.RemoveClient("1"))
+	_, err = s.GetClient("1")
+	assert.Equal(t, postgres.ErrClientNotFound, err)
+	assert.Equal(t, postgres.ErrClientNotFound, s.UpdateClient(client))
+	assert.NotNil(t, s.CreateClient(&osin.DefaultClient{Id: "2", UserData: 42}))
+}
+
+func TestTokenOperations(t *testing.T) {
+	s := New()
+	client := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, s.CreateClient(client))
+
+	authorize := &osin.AuthorizeData{Client: client, Code: "code", ExpiresIn: 60, Scope: "scope", CreatedAt: time.Now(), UserData: "user"}
+	require.Nil(t, s.SaveAuthorize(authorize))
+	loadedAuthorize, err := s.LoadAuthorize("code")
+	require.Nil(t, err)
+	assert.Equal(t, authorize, loadedAuthorize)
+
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 60, CreatedAt: time.Now(), UserData: "user"}
+	require.Nil(t, s.SaveAccess(access))
+	assert.True(t, errors.Is(s.SaveAccess(access), postgres.ErrDuplicateKey))
+
+	refreshed := &osin.AccessData{Client: client, AccessData: access, AccessToken: "access2", ExpiresIn: 60, CreatedAt: time.Now(), UserData: "user"}
+	require.Nil(t, s.SaveAccess(refreshed))
+	loaded, err := s.LoadAccess("access2")
+	require.Nil(t, err)
+	assert.Equal(t, "access", loaded.AccessData.AccessToken)
+	assert.Equal(t, "code", loaded.AccessData.AuthorizeData.Code)
+
+	i, err := s.Introspect("refresh")
+	require.Nil(t, err)
+	assert.Equal(t, postgres.TokenTypeRefresh, i.TokenType)
+	require.Nil(t, s.RevokeToken("refresh"))
+	_, err = s.LoadRefresh("refresh")
+	assert.Equal(t, postgres.ErrTokenNotFound, err)
+
+	counts, err := s.RevokeAllByUser("user")
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.RevokeCounts{Access: 2, Authorize: 1}, counts)
+	_, err = s.Introspect("access")
+	assert.True(t, errors.Is(err, postgres.ErrNotFound))
+}
+
+func TestPurgeAndImport(t *testing.T) {
+	s := New()
+	counts, err := s.ImportClients(strings.NewReader(`[{"id": "import-1"}]`), postgres.ImportJSON)
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.ImportCounts{Created: 1}, counts)
+	client, err := s.GetClient("import-1")
+	require.Nil(t, err)
+
+	old := time.Now().Add(-time.Hour)
+	require.Nil(t, s.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "expired", ExpiresIn: 60, CreatedAt: old}))
+	require.Nil(t, s.SaveAccess(&osin.AccessData{Client: client, AccessToken: "expired", ExpiresIn: 60, CreatedAt: old}))
+	require.Nil(t, s.SaveAccess(&osin.AccessData{Client: client, AccessToken: "refreshable", RefreshToken: "r", ExpiresIn: 60, CreatedAt: old}))
+	_, err = s.LoadAuthorize("expired")
+	assert.NotNil(t, err)
+
+	purged, err := s.PurgeExpiredTokens()
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.RevokeCounts{Authorize: 1, Access: 1}, purged)
+}
+
+func TestAdminHandler(t *testing.T) {
+	server := httptest.NewServer(postgres.NewAdminHandler(New()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/clients/unknown")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestOsinFlows(t *testing.T) {
+	osintest.Run(t, New())
+}
@@ -0,0 +1,509 @@
+// Package mysql is a osin storage implementation for MySQL.
+//
+// It implements the same storage.Storage interface and returns the same errors as the postgres package, and it
+// implements postgres.AdminStorage, so the admin API of the postgres package and the admingrpc package work with
+// it. Times are stored in UTC, so open the database with parseTime=true and loc=UTC:
+//
+//	db, err := sql.Open("mysql", "user:password@tcp(localhost:3306)/osin?parseTime=true&loc=UTC")
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/optimisticninja/osin"
+
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+// Keys are varchar(255), as MySQL cannot index text columns without a prefix length.
+var schemas = []string{`CREATE TABLE IF NOT EXISTS client (
+	id           varchar(255) NOT NULL PRIMARY KEY,
+	secret       text NOT NULL,
+	extra        text NOT NULL,
+	redirect_uri text NOT NULL
+) DEFAULT CHARSET=utf8mb4`, `CREATE TABLE IF NOT EXISTS authorize (
+	client       varchar(255) NOT NULL,
+	code         varchar(255) NOT NULL PRIMARY KEY,
+	expires_in   int NOT NULL,
+	scope        text,
+	redirect_uri text,
+	state        text,
+	extra        text NOT NULL,
+	created_at   datetime(6) NOT NULL,
+	code_challenge        text,
+	code_challenge_method varchar(16),
+	INDEX authorize_client_idx (client)
+) DEFAULT CHARSET=utf8mb4`, `CREATE TABLE IF NOT EXISTS access (
+	client        varchar(255) NOT NULL,
+	authorize     varchar(255),
+	previous      varchar(255),
+	access_token  varchar(255) NOT NULL PRIMARY KEY,
+	refresh_token varchar(255),
+	expires_in    int NOT NULL,
+	scope         text,
+	redirect_uri  text,
+	extra         text NOT NULL,
+	created_at    datetime(6) NOT NULL,
+	INDEX access_client_idx (client)
+) DEFAULT CHARSET=utf8mb4`, `CREATE TABLE IF NOT EXISTS refresh (
+	token         varchar(255) NOT NULL PRIMARY KEY,
+	access        varchar(255) NOT NULL,
+	INDEX refresh_access_idx (access)
+) DEFAULT CHARSET=utf8mb4`}
+
+// expired is the condition for expired rows of the authorize and access tables.
+const expired = "created_at + INTERVAL expires_in SECOND < UTC_TIMESTAMP(6)"
+
+// Storage implements interface "github.com/openshift/osin".Storage and interface "github.com/optimisticninja/osin-postgres/storage".Storage
+type Storage struct {
+	db *sql.DB
+}
+
+// New returns a new mysql storage instance.
+func New(db *sql.DB) *Storage {
+	return &Storage{db: db}
+}
+
+// CreateSchemas creates the schemata, if they do not exist yet in the database. Returns an error if something went wrong.
+// It can be run any number of times. MySQL commits schema changes implicitly, so a failing statement leaves the
+// previous statements applied.
+func (s *Storage) CreateSchemas() error {
+	for k, schema := range schemas {
+		if _, err := s.db.Exec(schema); err != nil {
+			log.Printf("Error creating schema %d: %s", k, schema)
+			return errors.New(err)
+		}
+	}
+	return nil
+}
+
+// Clone the storage if needed. For example, using mgo, you can clone the session with session.Clone
+// to avoid concurrent access problems.
+// This is to avoid cloning the connection at each method access.
+// Can return itself if not a problem.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// Close the resources the Storage potentially holds (using Clone for example). The database is not closed.
+func (s *Storage) Close() {
+}
+
+// GetClient loads the client by id. Returns postgres.ErrClientNotFound if the client does not exist.
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	var c osin.DefaultClient
+	var extra string
+	if err := s.db.QueryRow("SELECT id, secret, redirect_uri, extra FROM client WHERE id=?", id).Scan(&c.Id, &c.Secret, &c.RedirectUri, &extra); err == sql.ErrNoRows {
+		return nil, postgres.ErrClientNotFound
+	} else if err != nil {
+		return nil, classify(err)
+	}
+	c.UserData = extra
+	return &c, nil
+}
+
+// UpdateClient updates the client (identified by it's id) and replaces the values with the values of client.
+// The secret is kept if client implements postgres.SecretKeepingClient.
+// Returns postgres.ErrClientNotFound if the client does not exist.
+func (s *Storage) UpdateClient(c osin.Client) error {
+	data, err := assertToString(c.GetUserData())
+	if err != nil {
+		return err
+	}
+	var secret interface{} = c.GetSecret()
+	if postgres.KeepsSecret(c) {
+		secret = nil
+	}
+
+	// MySQL reports matched instead of changed rows only with clientFoundRows, so check for existence explicitly.
+	return s.inTx(func(tx *sql.Tx) error {
+		var exists int
+		if err := tx.QueryRow("SELECT 1 FROM client WHERE id=? FOR UPDATE", c.GetId()).Scan(&exists); err == sql.ErrNoRows {
+			return postgres.ErrClientNotFound
+		} else if err != nil {
+			return classify(err)
+		}
+		if _, err := tx.Exec("UPDATE client SET secret=COALESCE(?, secret), redirect_uri=?, extra=? WHERE id=?", secret, c.GetRedirectUri(), data, c.GetId()); err != nil {
+			return classify(err)
+		}
+		return nil
+	})
+}
+
+// CreateClient stores the client in the database and returns an error, if something went wrong.
+// Returns postgres.ErrDuplicateKey if a client with the same id exists.
+func (s *Storage) CreateClient(c osin.Client) error {
+	data, err := assertToString(c.GetUserData())
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec("INSERT INTO client (id, secret, redirect_uri, extra) VALUES (?, ?, ?, ?)", c.GetId(), c.GetSecret(), c.GetRedirectUri(), data); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// RemoveClient removes a client (identified by id) from the database. Returns an error if something went wrong.
+// Removing a client which does not exist is not an error.
+func (s *Storage) RemoveClient(id string) error {
+	if _, err := s.db.Exec("DELETE FROM client WHERE id=?", id); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// ImportClients reads a list of clients from r and creates or updates them in one transaction, see
+// postgres.Storage.ImportClients.
+func (s *Storage) ImportClients(r io.Reader, format postgres.ImportFormat) (*postgres.ImportCounts, error) {
+	clients, err := postgres.DecodeClients(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := &postgres.ImportCounts{}
+	if err := s.inTx(func(tx *sql.Tx) error {
+		for _, c := range clients {
+			// The affected rows are 1 for an inserted row, 2 for an updated row and 0 for an unchanged row.
+			n, err := execCount(tx, "INSERT INTO client (id, secret, redirect_uri, extra) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE secret=VALUES(secret), redirect_uri=VALUES(redirect_uri), extra=VALUES(extra)", c.ID, c.Secret, c.RedirectURI, c.UserData)
+			if err != nil {
+				return err
+			}
+			if n == 1 {
+				counts.Created++
+			} else {
+				counts.Updated++
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// SaveAuthorize saves authorize data.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	extra, err := assertToString(data.UserData)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(
+		"INSERT INTO authorize (client, code, expires_in, scope, redirect_uri, state, created_at, extra, code_challenge, code_challenge_method) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		data.Client.GetId(),
+		data.Code,
+		data.ExpiresIn,
+		nullString(data.Scope),
+		nullString(data.RedirectUri),
+		nullString(data.State),
+		data.CreatedAt.UTC(),
+		extra,
+		nullString(data.CodeChallenge),
+		nullString(data.CodeChallengeMethod),
+	); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// LoadAuthorize looks up AuthorizeData by a code. Returns postgres.ErrTokenNotFound if the code does not exist.
+// Client information MUST be loaded together.
+// Optionally can return error if expired.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	var data osin.AuthorizeData
+	var extra string
+	var cid string
+	if err := s.db.QueryRow("SELECT client, code, expires_in, COALESCE(scope, ''), COALESCE(redirect_uri, ''), COALESCE(state, ''), created_at, extra, COALESCE(code_challenge, ''), COALESCE(code_challenge_method, '') FROM authorize WHERE code=? LIMIT 1", code).Scan(&cid, &data.Code, &data.ExpiresIn, &data.Scope, &data.RedirectUri, &data.State, &data.CreatedAt, &extra, &data.CodeChallenge, &data.CodeChallengeMethod); err == sql.ErrNoRows {
+		return nil, postgres.ErrTokenNotFound
+	} else if err != nil {
+		return nil, classify(err)
+	}
+	data.UserData = extra
+
+	c, err := s.GetClient(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.ExpireAt().Before(time.Now()) {
+		return nil, errors.Errorf("Token expired at %s.", data.ExpireAt().String())
+	}
+
+	data.Client = c
+	return &data, nil
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	if _, err := s.db.Exec("DELETE FROM authorize WHERE code=?", code); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// SaveAccess writes AccessData.
+// If RefreshToken is not blank, it must save in a way that can be loaded using LoadRefresh.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	prev := ""
+	authorizeData := &osin.AuthorizeData{}
+
+	if data.AccessData != nil {
+		prev = data.AccessData.AccessToken
+	}
+
+	if data.AuthorizeData != nil {
+		authorizeData = data.AuthorizeData
+	}
+
+	extra, err := assertToString(data.UserData)
+	if err != nil {
+		return err
+	}
+
+	if data.Client == nil {
+		return errors.New("data.Client must not be nil")
+	}
+
+	return s.inTx(func(tx *sql.Tx) error {
+		if data.RefreshToken != "" {
+			if _, err := tx.Exec("INSERT INTO refresh (token, access) VALUES (?, ?)", data.RefreshToken, data.AccessToken); err != nil {
+				return classify(err)
+			}
+		}
+
+		if _, err := tx.Exec("INSERT INTO access (client, authorize, previous, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, extra) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", data.Client.GetId(), nullString(authorizeData.Code), nullString(prev), data.AccessToken, nullString(data.RefreshToken), data.ExpiresIn, nullString(data.Scope), nullString(data.RedirectUri), data.CreatedAt.UTC(), extra); err != nil {
+			return classify(err)
+		}
+		return nil
+	})
+}
+
+// LoadAccess retrieves access data by token. Returns postgres.ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
+// AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
+// Optionally can return error if expired.
+func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	var extra, cid, prevAccessToken, authorizeCode string
+	var result osin.AccessData
+
+	if err := s.db.QueryRow(
+		"SELECT client, COALESCE(authorize, ''), COALESCE(previous, ''), access_token, COALESCE(refresh_token, ''), expires_in, COALESCE(scope, ''), COALESCE(redirect_uri, ''), created_at, extra FROM access WHERE access_token=? LIMIT 1",
+		code,
+	).Scan(
+		&cid,
+		&authorizeCode,
+		&prevAccessToken,
+		&result.AccessToken,
+		&result.RefreshToken,
+		&result.ExpiresIn,
+		&result.Scope,
+		&result.RedirectUri,
+		&result.CreatedAt,
+		&extra,
+	); err == sql.ErrNoRows {
+		return nil, postgres.ErrTokenNotFound
+	} else if err != nil {
+		return nil, classify(err)
+	}
+
+	result.UserData = extra
+	client, err := s.GetClient(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Client = client
+	if authorizeCode != "" {
+		result.AuthorizeData, _ = s.LoadAuthorize(authorizeCode)
+	}
+	if prevAccessToken != "" {
+		result.AccessData, _ = s.LoadAccess(prevAccessToken)
+	}
+	return &result, nil
+}
+
+// RemoveAccess revokes or deletes an AccessData.
+func (s *Storage) RemoveAccess(code string) error {
+	if _, err := s.db.Exec("DELETE FROM access WHERE access_token=?", code); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// LoadRefresh retrieves refresh AccessData. Returns postgres.ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
+// AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
+// Optionally can return error if expired.
+func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
+	var access string
+	if err := s.db.QueryRow("SELECT access FROM refresh WHERE token=? LIMIT 1", code).Scan(&access); err == sql.ErrNoRows {
+		return nil, postgres.ErrTokenNotFound
+	} else if err != nil {
+		return nil, classify(err)
+	}
+	return s.LoadAccess(access)
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData.
+func (s *Storage) RemoveRefresh(code string) error {
+	if _, err := s.db.Exec("DELETE FROM refresh WHERE token=?", code); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// Introspect resolves an access or refresh token with a single query, see postgres.Storage.Introspect.
+func (s *Storage) Introspect(token string) (*postgres.Introspection, error) {
+	var i postgres.Introspection
+	var expiresIn int32
+	if err := s.db.QueryRow(`SELECT 'access_token', client, COALESCE(scope, ''), created_at, expires_in FROM access WHERE access_token=?
+UNION ALL
+SELECT 'refresh_token', a.client, COALESCE(a.scope, ''), a.created_at, a.expires_in FROM refresh r JOIN access a ON a.access_token=r.access WHERE r.token=?
+LIMIT 1`, token, token).Scan(&i.TokenType, &i.ClientID, &i.Scope, &i.IssuedAt, &expiresIn); err == sql.ErrNoRows {
+		return nil, postgres.ErrTokenNotFound
+	} else if err != nil {
+		return nil, classify(err)
+	}
+
+	i.Active = true
+	if i.TokenType == postgres.TokenTypeAccess {
+		i.ExpiresAt = i.IssuedAt.Add(time.Duration(expiresIn) * time.Second)
+		i.Active = i.ExpiresAt.After(time.Now())
+	}
+	return &i, nil
+}
+
+// RevokeToken removes the access or refresh token as described in RFC 7009. Revoking a refresh token does not
+// revoke the access token it was issued with. Returns postgres.ErrTokenNotFound if the token does not exist.
+func (s *Storage) RevokeToken(token string) error {
+	i, err := s.Introspect(token)
+	if err != nil {
+		return err
+	}
+	if i.TokenType == postgres.TokenTypeRefresh {
+		return s.RemoveRefresh(token)
+	}
+	return s.RemoveAccess(token)
+}
+
+// RevokeAllByClient removes all access tokens, refresh tokens and authorize codes issued to the client in one
+// transaction. The client itself is not removed.
+func (s *Storage) RevokeAllByClient(clientID string) (*postgres.RevokeCounts, error) {
+	return s.revokeAll("client", clientID)
+}
+
+// RevokeAllByUser removes all access tokens, refresh tokens and authorize codes whose UserData equals userRef
+// in one transaction.
+func (s *Storage) RevokeAllByUser(userRef string) (*postgres.RevokeCounts, error) {
+	return s.revokeAll("extra", userRef)
+}
+
+// revokeAll removes all rows where column equals value. column must be a column of both access and authorize.
+func (s *Storage) revokeAll(column, value string) (*postgres.RevokeCounts, error) {
+	counts := &postgres.RevokeCounts{}
+	if err := s.inTx(func(tx *sql.Tx) (err error) {
+		if counts.Refresh, err = execCount(tx, "DELETE refresh FROM refresh JOIN access ON refresh.access=access.access_token WHERE access."+column+"=?", value); err != nil {
+			return err
+		}
+		if counts.Access, err = execCount(tx, "DELETE FROM access WHERE "+column+"=?", value); err != nil {
+			return err
+		}
+		counts.Authorize, err = execCount(tx, "DELETE FROM authorize WHERE "+column+"=?", value)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// PurgeExpiredTokens removes all expired authorize codes and all expired access tokens which cannot be refreshed
+// anymore, because they have no refresh token left.
+func (s *Storage) PurgeExpiredTokens() (*postgres.RevokeCounts, error) {
+	counts := &postgres.RevokeCounts{}
+	if err := s.inTx(func(tx *sql.Tx) (err error) {
+		if counts.Authorize, err = execCount(tx, "DELETE FROM authorize WHERE "+expired); err != nil {
+			return err
+		}
+		counts.Access, err = execCount(tx, "DELETE FROM access WHERE "+expired+" AND NOT EXISTS (SELECT 1 FROM refresh WHERE refresh.access=access.access_token)")
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// inTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise.
+func (s *Storage) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return classify(err)
+	}
+	if err := fn(tx); err != nil {
+		if rbe := tx.Rollback(); rbe != nil {
+			return errors.New(rbe)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// execCount executes query and returns the number of affected rows.
+func execCount(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, classify(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	return n, nil
+}
+
+// mysqlErrorKinds maps MySQL error numbers to the errors of the postgres package.
+var mysqlErrorKinds = map[uint16]error{
+	1062: postgres.ErrDuplicateKey,
+	1451: postgres.ErrForeignKeyViolation,
+	1452: postgres.ErrForeignKeyViolation,
+	1205: postgres.ErrConflict,
+	1213: postgres.ErrConflict,
+}
+
+// classify wraps err and maps MySQL errors to the errors of the postgres package.
+func classify(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		if kind, ok := mysqlErrorKinds[mysqlErr.Number]; ok {
+			return errors.New(fmt.Errorf("%w: %w", kind, err))
+		}
+	}
+	return errors.New(err)
+}
+
+func assertToString(in interface{}) (string, error) {
+	var ok bool
+	var data string
+	if in == nil {
+		return "", nil
+	} else if data, ok = in.(string); ok {
+		return data, nil
+	} else if str, ok := in.(fmt.Stringer); ok {
+		return str.String(), nil
+	}
+	return "", errors.Errorf(`Could not assert "%v" to string`, in)
+}
+
+// nullString maps the empty string to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
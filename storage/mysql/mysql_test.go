@@ -0,0 +1,127 @@
+package mysql
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ory-am/dockertest.v2"
+
+	"github.com/optimisticninja/osin-postgres/storage/osintest"
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+var _ postgres.AdminStorage = (*Storage)(nil)
+
+var store *Storage
+
+func TestMain(m *testing.M) {
+	var db *sql.DB
+	c, err := dockertest.ConnectToMySQL(30, time.Second, func(url string) bool {
+		url, err := dockertest.SetUpMySQLDatabase("osin", url+"&loc=UTC")
+		if err != nil {
+			return false
+		}
+		if db, err = sql.Open("mysql", url); err != nil {
+			return false
+		}
+		return db.Ping() == nil
+	})
+	if err != nil {
+		log.Fatalf("Could not connect to database: %s", err)
+	}
+
+	store = New(db)
+	if err = store.CreateSchemas(); err != nil {
+		log.Fatalf("Could not create schemas: %v", err)
+	}
+
+	retCode := m.Run()
+	c.KillRemove()
+	os.Exit(retCode)
+}
+
+func TestClientOperations(t *testing.T) {
+	client := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: "{}"}
+	require.Nil(t, store.CreateClient(client))
+	assert.True(t, errors.Is(store.CreateClient(client), postgres.ErrDuplicateKey))
+
+	client.Secret = "rotated"
+	require.Nil(t, store.UpdateClient(client))
+	require.Nil(t, store.UpdateClient(client))
+	loaded, err := store.GetClient("1")
+	require.Nil(t, err)
+	assert.EqualValues(t, client, loaded)
+
+	require.Nil(t, store.RemoveClient("1"))
+	_, err = store.GetClient("1")
+	assert.Equal(t, postgres.ErrClientNotFound, err)
+	assert.Equal(t, postgres.ErrClientNotFound, store.UpdateClient(client))
+}
+
+func TestTokenOperations(t *testing.T) {
+	client := &osin.DefaultClient{Id: "2", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, store.CreateClient(client))
+
+	authorize := &osin.AuthorizeData{Client: client, Code: "code", ExpiresIn: 60, Scope: "scope", CreatedAt: time.Now().Round(time.Second), UserData: "user"}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	loadedAuthorize, err := store.LoadAuthorize("code")
+	require.Nil(t, err)
+	assert.True(t, authorize.CreatedAt.Equal(loadedAuthorize.CreatedAt))
+
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 60, CreatedAt: time.Now(), UserData: "user"}
+	require.Nil(t, store.SaveAccess(access))
+	loaded, err := store.LoadRefresh("refresh")
+	require.Nil(t, err)
+	assert.Equal(t, "access", loaded.AccessToken)
+
+	i, err := store.Introspect("refresh")
+	require.Nil(t, err)
+	assert.Equal(t, postgres.TokenTypeRefresh, i.TokenType)
+	require.Nil(t, store.RevokeToken("refresh"))
+	_, err = store.LoadRefresh("refresh")
+	assert.Equal(t, postgres.ErrTokenNotFound, err)
+
+	counts, err := store.RevokeAllByUser("user")
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.RevokeCounts{Access: 1, Authorize: 1}, counts)
+}
+
+func TestImportAndPurge(t *testing.T) {
+	counts, err := store.ImportClients(strings.NewReader(`[{"id": "import-1"}, {"id": "import-2"}]`), postgres.ImportJSON)
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.ImportCounts{Created: 2}, counts)
+	counts, err = store.ImportClients(strings.NewReader(`[{"id": "import-2", "secret": "rotated"}]`), postgres.ImportJSON)
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.ImportCounts{Updated: 1}, counts)
+
+	client, err := store.GetClient("import-1")
+	require.Nil(t, err)
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: "expired", ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Hour)}))
+	purged, err := store.PurgeExpiredTokens()
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), purged.Access)
+}
+
+func TestAdminHandler(t *testing.T) {
+	server := httptest.NewServer(postgres.NewAdminHandler(store))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/clients/unknown")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestOsinFlows(t *testing.T) {
+	osintest.Run(t, store)
+}
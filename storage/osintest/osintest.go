@@ -0,0 +1,212 @@
+// Package osintest is an integration test harness which wires a storage into a real osin.Server and runs the
+// authorization_code, refresh_token, client_credentials and PKCE flows over HTTP against it. Run it from the tests
+// of a storage implementation:
+//
+//	func TestOsinFlows(t *testing.T) {
+//		osintest.Run(t, store)
+//	}
+package osintest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/optimisticninja/osin"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/optimisticninja/osin-postgres/storage"
+)
+
+const redirectURI = "http://localhost/callback"
+
+// Run runs all flows against store as subtests. Every flow uses its own client, which is removed afterwards.
+func Run(t *testing.T, store storage.Storage) {
+	t.Run("AuthorizationCode", func(t *testing.T) { AuthorizationCode(t, store) })
+	t.Run("RefreshToken", func(t *testing.T) { RefreshToken(t, store) })
+	t.Run("ClientCredentials", func(t *testing.T) { ClientCredentials(t, store) })
+	t.Run("PKCE", func(t *testing.T) { PKCE(t, store) })
+}
+
+// AuthorizationCode exchanges an authorization code for tokens and checks that the code is consumed.
+func AuthorizationCode(t *testing.T, store storage.Storage) {
+	h := newHarness(t, store)
+	code := h.authorize(t, nil)
+	tokens := h.token(t, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}})
+	require.NotEmpty(t, tokens.AccessToken, tokens.Error)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, "read", tokens.Scope)
+
+	access, err := store.LoadAccess(tokens.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, h.client.Id, access.Client.GetId())
+	assert.Equal(t, "user", access.UserData)
+	_, err = store.LoadAuthorize(code)
+	assert.NotNil(t, err, "authorization code must be consumed")
+
+	replayed := h.token(t, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}})
+	assert.Equal(t, "invalid_grant", replayed.Error)
+}
+
+// RefreshToken refreshes an access token and checks that the previous tokens are removed.
+func RefreshToken(t *testing.T, store storage.Storage) {
+	h := newHarness(t, store)
+	code := h.authorize(t, nil)
+	first := h.token(t, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}})
+	require.NotEmpty(t, first.RefreshToken, first.Error)
+
+	second := h.token(t, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	require.NotEmpty(t, second.AccessToken, second.Error)
+	assert.NotEqual(t, first.AccessToken, second.AccessToken)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	refreshed, err := store.LoadRefresh(second.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, second.AccessToken, refreshed.AccessToken)
+	_, err = store.LoadAccess(first.AccessToken)
+	assert.NotNil(t, err, "previous access token must be removed")
+	_, err = store.LoadRefresh(first.RefreshToken)
+	assert.NotNil(t, err, "previous refresh token must be removed")
+
+	reused := h.token(t, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	assert.Equal(t, "invalid_grant", reused.Error)
+}
+
+// ClientCredentials issues a token to a client authenticating with its secret.
+func ClientCredentials(t *testing.T, store storage.Storage) {
+	h := newHarness(t, store)
+	tokens := h.token(t, url.Values{"grant_type": {"client_credentials"}})
+	require.NotEmpty(t, tokens.AccessToken, tokens.Error)
+
+	access, err := store.LoadAccess(tokens.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, h.client.Id, access.Client.GetId())
+
+	h.secret = "wrong"
+	assert.Equal(t, "unauthorized_client", h.token(t, url.Values{"grant_type": {"client_credentials"}}).Error)
+}
+
+// PKCE runs the authorization code flow with a S256 code challenge, which the storage must persist.
+func PKCE(t *testing.T, store storage.Storage) {
+	h := newHarness(t, store)
+	verifier := strings.Repeat("v", 43)
+	hash := sha256.Sum256([]byte(verifier))
+	code := h.authorize(t, url.Values{"code_challenge": {base64.RawURLEncoding.EncodeToString(hash[:])}, "code_challenge_method": {"S256"}})
+
+	authorize, err := store.LoadAuthorize(code)
+	require.Nil(t, err)
+	assert.Equal(t, "S256", authorize.CodeChallengeMethod)
+
+	wrong := h.token(t, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "code_verifier": {strings.Repeat("w", 43)}})
+	assert.Equal(t, "invalid_grant", wrong.Error)
+	missing := h.token(t, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}})
+	assert.Equal(t, "invalid_request", missing.Error)
+
+	tokens := h.token(t, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "code_verifier": {verifier}})
+	assert.NotEmpty(t, tokens.AccessToken, tokens.Error)
+}
+
+// harness is an osin server backed by the storage under test and a client registered in it.
+type harness struct {
+	server *httptest.Server
+	client *osin.DefaultClient
+
+	// secret is the plain text secret of client. osin expects the stored secret to be an Argon2 hash.
+	secret string
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func newHarness(t *testing.T, store storage.Storage) *harness {
+	config := osin.NewServerConfig()
+	config.AllowedAccessTypes = osin.AllowedAccessType{osin.AUTHORIZATION_CODE, osin.REFRESH_TOKEN, osin.CLIENT_CREDENTIALS}
+	config.ErrorStatusCode = http.StatusBadRequest
+	server := osin.NewServer(config, store)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		resp := server.NewResponse()
+		defer resp.Close()
+		if ar := server.HandleAuthorizeRequest(resp, r); ar != nil {
+			// The user approves every request.
+			ar.Authorized = true
+			ar.UserData = "user"
+			server.FinishAuthorizeRequest(resp, r, ar)
+		}
+		osin.OutputJSON(resp, w, r)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		resp := server.NewResponse()
+		defer resp.Close()
+		if ar := server.HandleAccessRequest(resp, r); ar != nil {
+			ar.Authorized = true
+			server.FinishAccessRequest(resp, r, ar)
+		}
+		osin.OutputJSON(resp, w, r)
+	})
+
+	secret := uuid.New()
+	hash, err := osin.GenerateArgon2(secret, &osin.Argon2Params{Memory: 16 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	require.Nil(t, err)
+
+	h := &harness{
+		server: httptest.NewServer(mux),
+		client: &osin.DefaultClient{Id: "osintest-" + uuid.New(), Secret: hash, RedirectUri: redirectURI, UserData: ""},
+		secret: secret,
+	}
+	require.Nil(t, store.CreateClient(h.client))
+	t.Cleanup(func() {
+		h.server.Close()
+		store.RemoveClient(h.client.Id)
+	})
+	return h
+}
+
+// authorize requests an authorization code with the read scope and returns it.
+func (h *harness) authorize(t *testing.T, params url.Values) string {
+	query := url.Values{"response_type": {"code"}, "client_id": {h.client.Id}, "redirect_uri": {redirectURI}, "state": {"state"}, "scope": {"read"}}
+	for k, v := range params {
+		query[k] = v
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(h.server.URL + "/authorize?" + query.Encode())
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.Nil(t, err)
+	assert.Equal(t, "state", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code, "redirect without code: %s", location)
+	return code
+}
+
+// token posts params to the token endpoint with the credentials of the client.
+func (h *harness) token(t *testing.T, params url.Values) *tokenResponse {
+	req, err := http.NewRequest(http.MethodPost, h.server.URL+"/token", strings.NewReader(params.Encode()))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(h.client.Id, h.secret)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&tokens))
+	return &tokens
+}
@@ -0,0 +1,383 @@
+package postgres
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+
+	"github.com/optimisticninja/osin-postgres/storage"
+)
+
+// AdminClient is the JSON representation of a client in the admin API. The secret is accepted when creating or
+// updating a client but never returned. Updates without secret keep the secret of the client. Disabled and
+// DeletedAt are returned but never accepted.
+type AdminClient struct {
+	ID          string     `json:"id"`
+	Secret      *string    `json:"secret,omitempty"`
+	RedirectURI string     `json:"redirect_uri"`
+	UserData    string     `json:"user_data,omitempty"`
+	Disabled    bool       `json:"disabled,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+// AdminToken is the JSON representation of an access or refresh token in the admin API.
+type AdminToken struct {
+	Active         bool       `json:"active"`
+	TokenType      string     `json:"token_type"`
+	ClientID       string     `json:"client_id"`
+	Scope          string     `json:"scope,omitempty"`
+	IssuedAt       time.Time  `json:"issued_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	DPoPThumbprint string     `json:"dpop_jkt,omitempty"`
+	CertThumbprint string     `json:"x5t#S256,omitempty"`
+}
+
+// AdminAccessSummary is the JSON representation of an AccessSummary in the admin API.
+type AdminAccessSummary struct {
+	ClientID    string    `json:"client_id"`
+	MaskedToken string    `json:"masked_token"`
+	TokenHash   string    `json:"token_hash"`
+	HasRefresh  bool      `json:"has_refresh"`
+	Scope       string    `json:"scope,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// AdminRevokeCounts is the JSON representation of RevokeCounts in the admin API.
+type AdminRevokeCounts struct {
+	Access    int64 `json:"access"`
+	Refresh   int64 `json:"refresh"`
+	Authorize int64 `json:"authorize"`
+}
+
+// AdminSecretRotation is the JSON representation of a SecretRotation in the admin API.
+type AdminSecretRotation struct {
+	SecretHash string    `json:"secret_hash"`
+	Actor      string    `json:"actor,omitempty"`
+	RotatedAt  time.Time `json:"rotated_at"`
+}
+
+// AdminStorage is the storage administered by NewAdminHandler and the admingrpc package. It is implemented by
+// Storage and by the storages of the mysql and memory packages.
+type AdminStorage interface {
+	storage.Storage
+	RevokeAllByClient(clientID string) (*RevokeCounts, error)
+	RevokeAllByUser(userRef string) (*RevokeCounts, error)
+	Introspect(token string) (*Introspection, error)
+	RevokeToken(token string) error
+}
+
+// ClientLifecycle is implemented by storages which can disable and soft-delete clients, like Storage. The admin
+// API serves the routes to disable, enable, soft-delete and restore clients only for such storages.
+type ClientLifecycle interface {
+	LookupClient(id string) (*Client, error)
+	DisableClient(id string) error
+	EnableClient(id string) error
+	SoftDeleteClient(id string) error
+	RestoreClient(id string) error
+}
+
+// VersionedClientUpdater is implemented by storages which detect concurrent updates of clients, like Storage. The
+// admin API returns the version of clients in the ETag header for such storages and updates clients only if their
+// version still matches the If-Match header, if set.
+type VersionedClientUpdater interface {
+	UpdateClientIfVersion(c osin.Client, version int64) error
+}
+
+// AccessLister is implemented by storages which list the access tokens of clients and users, like Storage. The
+// admin API serves the routes to search tokens only for such storages.
+type AccessLister interface {
+	ListAccessByClient(clientID string, opts AccessListOptions) ([]*AccessSummary, error)
+	ListAccessByUser(userRef string, opts AccessListOptions) ([]*AccessSummary, error)
+}
+
+// SecretHistory is implemented by storages which record the secret rotations of clients, like Storage. The admin
+// API serves the secret history of clients only for such storages.
+type SecretHistory interface {
+	ListSecretRotations(clientID string) ([]*SecretRotation, error)
+}
+
+// NewAdminHandler returns a handler exposing a JSON admin API for the storage. It does not authenticate
+// requests, so mount it behind your own authentication, e.g. with http.StripPrefix("/admin", handler):
+//
+//	POST   /clients               create a client from an AdminClient
+//	GET    /clients/{id}          load a client
+//	PUT    /clients/{id}          update a client from an AdminClient, if it still matches If-Match
+//	DELETE /clients/{id}          remove a client, or soft-delete it with ?soft=true
+//	POST   /clients/{id}/disable  disable a client
+//	POST   /clients/{id}/enable   re-enable a disabled client
+//	POST   /clients/{id}/restore  restore a soft-deleted client
+//	GET    /clients/{id}/secrets  list the secret rotations of a client, newest first
+//	GET    /clients/{id}/tokens   list the access tokens issued to a client, see AccessListOptions
+//	DELETE /clients/{id}/tokens   revoke all tokens and codes issued to a client
+//	GET    /users/{ref}/tokens    list the access tokens of a user, see ListAccessByUser
+//	DELETE /users/{ref}/tokens    revoke all tokens and codes of a user, see RevokeAllByUser
+//	POST   /tokens/introspect     look up the token {"token": "..."}
+//	POST   /tokens/revoke         revoke the token {"token": "..."}
+//
+// The routes to disable, enable, soft-delete and restore clients require a storage implementing ClientLifecycle,
+// which is also used to load disabled and soft-deleted clients. The secret history requires a storage implementing
+// SecretHistory and the token lists a storage implementing AccessLister. The token lists accept the query
+// parameters scope, include_expired, offset and limit. Tokens are passed in the body rather than the path to keep them out of access logs. Errors are
+// returned as {"error": "..."} with status 404 for ErrNotFound, 409 for ErrDuplicateKey, 412 if the client was
+// updated since the version in If-Match, 503 for ErrUnavailable and ErrClosed and 500 otherwise.
+func NewAdminHandler(s AdminStorage) http.Handler {
+	return &adminHandler{s: s}
+}
+
+type adminHandler struct {
+	s AdminStorage
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	lifecycle, _ := h.s.(ClientLifecycle)
+	history, _ := h.s.(SecretHistory)
+	lister, _ := h.s.(AccessLister)
+	switch {
+	case len(path) == 2 && path[0] == "clients" && r.Method == http.MethodGet && lifecycle != nil:
+		client, err := lifecycle.LookupClient(path[1])
+		h.respondClient(w, client, err)
+	case len(path) == 2 && path[0] == "clients" && r.Method == http.MethodDelete && r.URL.Query().Get("soft") == "true" && lifecycle != nil:
+		h.respond(w, http.StatusNoContent, nil, lifecycle.SoftDeleteClient(path[1]))
+	case len(path) == 3 && path[0] == "clients" && path[2] == "disable" && r.Method == http.MethodPost && lifecycle != nil:
+		h.respond(w, http.StatusNoContent, nil, lifecycle.DisableClient(path[1]))
+	case len(path) == 3 && path[0] == "clients" && path[2] == "enable" && r.Method == http.MethodPost && lifecycle != nil:
+		h.respond(w, http.StatusNoContent, nil, lifecycle.EnableClient(path[1]))
+	case len(path) == 3 && path[0] == "clients" && path[2] == "restore" && r.Method == http.MethodPost && lifecycle != nil:
+		h.respond(w, http.StatusNoContent, nil, lifecycle.RestoreClient(path[1]))
+	case len(path) == 3 && path[0] == "clients" && path[2] == "secrets" && r.Method == http.MethodGet && history != nil:
+		h.secretRotations(w, history, path[1])
+	case len(path) == 3 && path[0] == "clients" && path[2] == "tokens" && r.Method == http.MethodGet && lister != nil:
+		h.listAccess(w, r, lister.ListAccessByClient, path[1])
+	case len(path) == 3 && path[0] == "users" && path[2] == "tokens" && r.Method == http.MethodGet && lister != nil:
+		h.listAccess(w, r, lister.ListAccessByUser, path[1])
+	case len(path) == 1 && path[0] == "clients" && r.Method == http.MethodPost:
+		h.createClient(w, r)
+	case len(path) == 2 && path[0] == "clients" && r.Method == http.MethodGet:
+		h.getClient(w, path[1])
+	case len(path) == 2 && path[0] == "clients" && r.Method == http.MethodPut:
+		h.updateClient(w, r, path[1])
+	case len(path) == 2 && path[0] == "clients" && r.Method == http.MethodDelete:
+		h.respond(w, http.StatusNoContent, nil, h.s.RemoveClient(path[1]))
+	case len(path) == 3 && path[0] == "clients" && path[2] == "tokens" && r.Method == http.MethodDelete:
+		h.revokeAll(w, h.s.RevokeAllByClient, path[1])
+	case len(path) == 3 && path[0] == "users" && path[2] == "tokens" && r.Method == http.MethodDelete:
+		h.revokeAll(w, h.s.RevokeAllByUser, path[1])
+	case len(path) == 2 && path[0] == "tokens" && path[1] == "introspect" && r.Method == http.MethodPost:
+		h.introspect(w, r)
+	case len(path) == 2 && path[0] == "tokens" && path[1] == "revoke" && r.Method == http.MethodPost:
+		h.revoke(w, r)
+	default:
+		h.respond(w, http.StatusNotFound, nil, errors.Errorf("No route for %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (h *adminHandler) createClient(w http.ResponseWriter, r *http.Request) {
+	var c AdminClient
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		h.respond(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	client := &osin.DefaultClient{Id: c.ID, RedirectUri: c.RedirectURI, UserData: c.UserData}
+	if c.Secret != nil {
+		client.Secret = *c.Secret
+	}
+	h.respond(w, http.StatusCreated, adminClient(client), h.s.CreateClient(client))
+}
+
+func (h *adminHandler) getClient(w http.ResponseWriter, id string) {
+	client, err := h.s.GetClient(id)
+	h.respondClient(w, client, err)
+}
+
+func (h *adminHandler) respondClient(w http.ResponseWriter, client osin.Client, err error) {
+	if err != nil {
+		h.respond(w, 0, nil, err)
+		return
+	}
+	if c, ok := client.(*Client); ok {
+		w.Header().Set("ETag", `"`+strconv.FormatInt(c.Version, 10)+`"`)
+	}
+	h.respond(w, http.StatusOK, adminClient(client), nil)
+}
+
+func (h *adminHandler) updateClient(w http.ResponseWriter, r *http.Request, id string) {
+	var c AdminClient
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		h.respond(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	client := &adminUpdatedClient{DefaultClient: osin.DefaultClient{Id: id, RedirectUri: c.RedirectURI, UserData: c.UserData}, keepSecret: c.Secret == nil}
+	if c.Secret != nil {
+		client.Secret = *c.Secret
+	}
+	updater, ok := h.s.(VersionedClientUpdater)
+	if match := r.Header.Get("If-Match"); ok && match != "" {
+		version, err := strconv.ParseInt(strings.Trim(match, `"`), 10, 64)
+		if err != nil {
+			h.respond(w, http.StatusPreconditionFailed, nil, errors.Errorf("Invalid If-Match %s", match))
+			return
+		}
+		err = updater.UpdateClientIfVersion(client, version)
+		if errors.Is(err, ErrConflict) {
+			h.respond(w, http.StatusPreconditionFailed, nil, err)
+			return
+		}
+		h.respond(w, http.StatusOK, adminClient(client), err)
+		return
+	}
+	h.respond(w, http.StatusOK, adminClient(client), h.s.UpdateClient(client))
+}
+
+func (h *adminHandler) secretRotations(w http.ResponseWriter, history SecretHistory, id string) {
+	rotations, err := history.ListSecretRotations(id)
+	if err != nil {
+		h.respond(w, 0, nil, err)
+		return
+	}
+	result := make([]AdminSecretRotation, len(rotations))
+	for i, r := range rotations {
+		result[i] = AdminSecretRotation{SecretHash: r.SecretHash, Actor: r.Actor, RotatedAt: r.RotatedAt}
+	}
+	h.respond(w, http.StatusOK, result, nil)
+}
+
+// adminUpdatedClient is a client updated through the admin API, which keeps its secret if the update has none.
+type adminUpdatedClient struct {
+	osin.DefaultClient
+	keepSecret bool
+}
+
+// KeepsSecret implements SecretKeepingClient.
+func (c *adminUpdatedClient) KeepsSecret() bool {
+	return c.keepSecret
+}
+
+func (h *adminHandler) listAccess(w http.ResponseWriter, r *http.Request, list func(string, AccessListOptions) ([]*AccessSummary, error), value string) {
+	q := r.URL.Query()
+	opts := AccessListOptions{Scope: q.Get("scope"), IncludeExpired: q.Get("include_expired") == "true"}
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"offset", &opts.Offset}, {"limit", &opts.Limit}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				h.respond(w, http.StatusBadRequest, nil, errors.Errorf("Invalid %s %s", p.name, v))
+				return
+			}
+			*p.value = n
+		}
+	}
+
+	summaries, err := list(value, opts)
+	if err != nil {
+		h.respond(w, 0, nil, err)
+		return
+	}
+	result := make([]AdminAccessSummary, len(summaries))
+	for i, a := range summaries {
+		result[i] = AdminAccessSummary{ClientID: a.ClientID, MaskedToken: a.MaskedToken, TokenHash: a.TokenHash, HasRefresh: a.HasRefresh, Scope: a.Scope, CreatedAt: a.CreatedAt, ExpiresAt: a.ExpiresAt}
+	}
+	h.respond(w, http.StatusOK, result, nil)
+}
+
+func (h *adminHandler) revokeAll(w http.ResponseWriter, revoke func(string) (*RevokeCounts, error), value string) {
+	counts, err := revoke(value)
+	if err != nil {
+		h.respond(w, 0, nil, err)
+		return
+	}
+	h.respond(w, http.StatusOK, &AdminRevokeCounts{Access: counts.Access, Refresh: counts.Refresh, Authorize: counts.Authorize}, nil)
+}
+
+func (h *adminHandler) introspect(w http.ResponseWriter, r *http.Request) {
+	token, ok := h.token(w, r)
+	if !ok {
+		return
+	}
+	i, err := h.s.Introspect(token)
+	if err != nil {
+		h.respond(w, 0, nil, err)
+		return
+	}
+	t := &AdminToken{Active: i.Active, TokenType: i.TokenType, ClientID: i.ClientID, Scope: i.Scope, IssuedAt: i.IssuedAt, DPoPThumbprint: i.DPoPThumbprint, CertThumbprint: i.CertificateThumbprint}
+	if !i.ExpiresAt.IsZero() {
+		t.ExpiresAt = &i.ExpiresAt
+	}
+	h.respond(w, http.StatusOK, t, nil)
+}
+
+func (h *adminHandler) revoke(w http.ResponseWriter, r *http.Request) {
+	token, ok := h.token(w, r)
+	if !ok {
+		return
+	}
+	h.respond(w, http.StatusNoContent, nil, h.s.RevokeToken(token))
+}
+
+// token decodes the token from the request body. It responds with an error and returns false if that fails.
+func (h *adminHandler) token(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		h.respond(w, http.StatusBadRequest, nil, err)
+		return "", false
+	} else if body.Token == "" {
+		h.respond(w, http.StatusBadRequest, nil, errors.New("Missing token"))
+		return "", false
+	}
+	return body.Token, true
+}
+
+// respond writes v with status if err is nil and the error otherwise. The error status is derived from err
+// unless status is an error status itself.
+func (h *adminHandler) respond(w http.ResponseWriter, status int, v interface{}, err error) {
+	if err != nil {
+		if status < http.StatusBadRequest {
+			status = adminErrorStatus(err)
+		}
+		v = map[string]string{"error": err.Error()}
+	}
+
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateKey):
+		return http.StatusConflict
+	case errors.Is(err, ErrUnavailable), errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrReadOnly):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func adminClient(c osin.Client) *AdminClient {
+	data, _ := assertToString(c.GetUserData())
+	client := &AdminClient{ID: c.GetId(), RedirectURI: c.GetRedirectUri(), UserData: data}
+	if c, ok := c.(*Client); ok {
+		client.Disabled = c.Disabled
+		if !c.DeletedAt.IsZero() {
+			client.DeletedAt = &c.DeletedAt
+		}
+	}
+	return client
+}
@@ -0,0 +1,149 @@
+// Package admingrpc is a gRPC admin service for the osin-postgres storage. The service is defined in admin.proto.
+//
+// Register it with a grpc server:
+//
+//	admingrpc.RegisterAdminServiceServer(server, admingrpc.NewServer(store))
+//
+// The server does not authenticate calls. Use interceptors or transport credentials to protect it.
+package admingrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
+
+import (
+	"context"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server implements AdminServiceServer backed by a storage.
+type Server struct {
+	UnimplementedAdminServiceServer
+	s postgres.AdminStorage
+}
+
+// NewServer returns a server administering s.
+func NewServer(s postgres.AdminStorage) *Server {
+	return &Server{s: s}
+}
+
+// CreateClient creates a client.
+func (srv *Server) CreateClient(ctx context.Context, req *CreateClientRequest) (*Client, error) {
+	c := req.GetClient()
+	if c.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing client id")
+	}
+	client := &osin.DefaultClient{Id: c.GetId(), Secret: c.GetSecret(), RedirectUri: c.GetRedirectUri(), UserData: c.GetUserData()}
+	if err := srv.s.CreateClient(client); err != nil {
+		return nil, statusError(err)
+	}
+	return clientMessage(client), nil
+}
+
+// GetClient loads a client.
+func (srv *Server) GetClient(ctx context.Context, req *GetClientRequest) (*Client, error) {
+	client, err := srv.s.GetClient(req.GetId())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return clientMessage(client), nil
+}
+
+// UpdateClient replaces the redirect uri and user data of a client, and its secret unless the secret is empty.
+func (srv *Server) UpdateClient(ctx context.Context, req *UpdateClientRequest) (*Client, error) {
+	c := req.GetClient()
+	client := &updatedClient{DefaultClient: osin.DefaultClient{Id: c.GetId(), Secret: c.GetSecret(), RedirectUri: c.GetRedirectUri(), UserData: c.GetUserData()}}
+	if err := srv.s.UpdateClient(client); err != nil {
+		return nil, statusError(err)
+	}
+	return clientMessage(client), nil
+}
+
+// updatedClient is a client updated through the service, which keeps its secret if the update has none.
+type updatedClient struct {
+	osin.DefaultClient
+}
+
+// KeepsSecret implements postgres.SecretKeepingClient.
+func (c *updatedClient) KeepsSecret() bool {
+	return c.Secret == ""
+}
+
+// DeleteClient removes a client.
+func (srv *Server) DeleteClient(ctx context.Context, req *DeleteClientRequest) (*DeleteClientResponse, error) {
+	if err := srv.s.RemoveClient(req.GetId()); err != nil {
+		return nil, statusError(err)
+	}
+	return &DeleteClientResponse{}, nil
+}
+
+// IntrospectToken looks up an access or refresh token.
+func (srv *Server) IntrospectToken(ctx context.Context, req *IntrospectTokenRequest) (*Token, error) {
+	i, err := srv.s.Introspect(req.GetToken())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	t := &Token{
+		Active:    i.Active,
+		TokenType: i.TokenType,
+		ClientId:  i.ClientID,
+		Scope:     i.Scope,
+		IssuedAt:  timestamppb.New(i.IssuedAt),
+	}
+	if !i.ExpiresAt.IsZero() {
+		t.ExpiresAt = timestamppb.New(i.ExpiresAt)
+	}
+	return t, nil
+}
+
+// RevokeToken removes an access or refresh token.
+func (srv *Server) RevokeToken(ctx context.Context, req *RevokeTokenRequest) (*RevokeTokenResponse, error) {
+	if err := srv.s.RevokeToken(req.GetToken()); err != nil {
+		return nil, statusError(err)
+	}
+	return &RevokeTokenResponse{}, nil
+}
+
+// RevokeClientTokens removes all tokens and codes issued to a client.
+func (srv *Server) RevokeClientTokens(ctx context.Context, req *RevokeClientTokensRequest) (*RevokeCounts, error) {
+	return revokeCounts(srv.s.RevokeAllByClient(req.GetClientId()))
+}
+
+// RevokeUserTokens removes all tokens and codes of the user, see postgres.Storage.RevokeAllByUser.
+func (srv *Server) RevokeUserTokens(ctx context.Context, req *RevokeUserTokensRequest) (*RevokeCounts, error) {
+	return revokeCounts(srv.s.RevokeAllByUser(req.GetUserRef()))
+}
+
+func revokeCounts(counts *postgres.RevokeCounts, err error) (*RevokeCounts, error) {
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &RevokeCounts{Access: counts.Access, Refresh: counts.Refresh, Authorize: counts.Authorize}, nil
+}
+
+func clientMessage(c osin.Client) *Client {
+	data, _ := c.GetUserData().(string)
+	return &Client{Id: c.GetId(), RedirectUri: c.GetRedirectUri(), UserData: data}
+}
+
+// statusError maps the errors of the storage to gRPC status codes.
+func statusError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, postgres.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, postgres.ErrDuplicateKey):
+		code = codes.AlreadyExists
+	case errors.Is(err, postgres.ErrConflict):
+		code = codes.Aborted
+	case errors.Is(err, postgres.ErrUnavailable), errors.Is(err, postgres.ErrClosed):
+		code = codes.Unavailable
+	case errors.Is(err, postgres.ErrReadOnly):
+		code = codes.FailedPrecondition
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,47 @@
+package admingrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/optimisticninja/osin-postgres/storage/memory"
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusError(t *testing.T) {
+	assert.Equal(t, codes.NotFound, status.Code(statusError(postgres.ErrClientNotFound)))
+	assert.Equal(t, codes.NotFound, status.Code(statusError(errors.New(postgres.ErrTokenNotFound))))
+	assert.Equal(t, codes.Unavailable, status.Code(statusError(postgres.ErrUnavailable)))
+	assert.Equal(t, codes.Unavailable, status.Code(statusError(postgres.ErrClosed)))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(statusError(postgres.ErrReadOnly)))
+	assert.Equal(t, codes.Internal, status.Code(statusError(errors.New("boom"))))
+}
+
+func TestCreateClientRequiresID(t *testing.T) {
+	_, err := NewServer(nil).CreateClient(context.Background(), &CreateClientRequest{Client: &Client{Secret: "secret"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUpdateClientKeepsSecret(t *testing.T) {
+	s := memory.New()
+	assert.Nil(t, s.CreateClient(&osin.DefaultClient{Id: "client", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}))
+	srv := NewServer(s)
+
+	_, err := srv.UpdateClient(context.Background(), &UpdateClientRequest{Client: &Client{Id: "client", RedirectUri: "http://example.com/"}})
+	assert.Nil(t, err)
+	c, err := s.GetClient("client")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", c.GetSecret())
+	assert.Equal(t, "http://example.com/", c.GetRedirectUri())
+
+	_, err = srv.UpdateClient(context.Background(), &UpdateClientRequest{Client: &Client{Id: "client", Secret: "rotated", RedirectUri: "http://example.com/"}})
+	assert.Nil(t, err)
+	c, err = s.GetClient("client")
+	assert.Nil(t, err)
+	assert.Equal(t, "rotated", c.GetSecret())
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"strconv"
+	"time"
+)
+
+// The columns of the tables which are archived if archiving is enabled with WithArchive.
+const (
+	accessColumns    = "client, authorize, previous, access_token, refresh_token, expires_in, scope, redirect_uri, extra, created_at, issued_ip, user_agent, dpop_jkt, x5t_s256, resources, authorization_details, user_ref"
+	authorizeColumns = "client, code, expires_in, scope, redirect_uri, state, extra, created_at, code_challenge, code_challenge_method, issued_ip, user_agent, resources, authorization_details"
+)
+
+// archivedColumns maps the archived tables to their columns.
+var archivedColumns = map[string]string{
+	"access":    accessColumns,
+	"authorize": authorizeColumns,
+}
+
+// WithArchive moves removed and purged access tokens and authorize codes into the access_archive and
+// authorize_archive tables instead of deleting them, to keep them for forensics. The archive tables record the
+// time of archival in archived_at. Use PurgeArchive to remove archived rows after the retention period.
+func WithArchive() Option {
+	return func(s *Storage) {
+		s.archive = true
+	}
+}
+
+// archivedColumns returns the archived columns of table, including tenant_id with WithMultiTenancy, and whether
+// the table is archived at all.
+func (s *Storage) archivedColumns(table string) (string, bool) {
+	columns, ok := archivedColumns[table]
+	if ok && s.multiTenant {
+		columns = "tenant_id, " + columns
+	}
+	return columns, ok
+}
+
+// deleteQuery returns a statement which removes the rows of table matching where and returns the columns in
+// returning, if not empty, together with the arguments of the statement. args are the arguments of where. If
+// archiving is enabled, the removed rows are moved into the archive table.
+func (s *Storage) deleteQuery(table, where, returning string, args ...interface{}) (string, []interface{}) {
+	columns, ok := s.archivedColumns(table)
+	if !s.archive || !ok {
+		if returning == "" {
+			return "DELETE FROM " + table + " WHERE " + where, args
+		}
+		return "DELETE FROM " + table + " WHERE " + where + " RETURNING " + returning, args
+	}
+
+	args = append(args, s.now())
+	archive := "INSERT INTO " + table + "_archive (" + columns + ", archived_at) SELECT " + columns + ", $" + strconv.Itoa(len(args)) + "::timestamptz FROM moved"
+	moved := "WITH moved AS (DELETE FROM " + table + " WHERE " + where + " RETURNING " + columns + ")"
+	if returning == "" {
+		return moved + " " + archive, args
+	}
+	return moved + ", archived AS (" + archive + ") SELECT " + returning + " FROM moved", args
+}
+
+// PurgeExpiredTokens removes all expired authorize codes, all rotated refresh tokens whose grace period is over
+// (see WithRefreshGracePeriod), all expired refresh tokens (see WithRefreshExpiry) and all expired access tokens which cannot be refreshed anymore, because they have
+// no refresh token left. If archiving is enabled, the authorize codes and access tokens are archived instead.
+func (s *Storage) PurgeExpiredTokens() (*RevokeCounts, error) {
+	counts := &RevokeCounts{}
+	if err := s.inTx("PurgeExpiredTokens", func(tx dbtx) error {
+		for i, n := range []*int64{&counts.Refresh, &counts.Authorize, &counts.Access} {
+			query, args := s.expiredTokenPurges()[i].query(s, 0)
+			var err error
+			if *n, err = execCount(tx, query, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// PurgeArchive removes the rows archived more than olderThan ago from the archive tables and returns the
+// number of removed rows.
+func (s *Storage) PurgeArchive(olderThan time.Duration) (*RevokeCounts, error) {
+	counts := &RevokeCounts{}
+	if err := s.inTx("PurgeArchive", func(tx dbtx) error {
+		for i, n := range []*int64{&counts.Authorize, &counts.Access} {
+			query, args := s.archivePurges(olderThan)[i].query(s, 0)
+			var err error
+			if *n, err = execCount(tx, query, args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,164 @@
+package postgres
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Audit event types recorded if auditing is enabled with WithAudit.
+const (
+	AuditClientCreated     = "client.created"
+	AuditClientUpdated     = "client.updated"
+	AuditClientDeleted     = "client.deleted"
+	AuditAuthorizeIssued   = "authorize.issued"
+	AuditAuthorizeConsumed = "authorize.consumed"
+	AuditAccessIssued      = "access.issued"
+	AuditAccessRefreshed   = "access.refreshed"
+	AuditAccessRevoked     = "access.revoked"
+	AuditRefreshRevoked    = "refresh.revoked"
+)
+
+// AuditEvent is an entry of the append-only audit log.
+type AuditEvent struct {
+	// ID is assigned by the database and increases monotonically.
+	ID int64
+
+	// Type is one of the Audit* constants.
+	Type string
+
+	// Actor is the actor set with AuditAs, e.g. the id of an administrator or the remote address of a request.
+	Actor string
+
+	// ClientID is the id of the affected client. It is empty for revocations of codes and tokens by value.
+	ClientID string
+
+	// Subject identifies the affected entity: the client id for client events and the SHA-256 hash of the code or
+	// token for all other events. Codes and tokens are never recorded in plain text.
+	Subject string
+
+	// Metadata is the request metadata set with AuditAs.
+	Metadata map[string]string
+
+	// CreatedAt is the time the event was recorded.
+	CreatedAt time.Time
+}
+
+// AuditFilter restricts the events returned by ListAuditEvents. Zero values do not restrict the result.
+type AuditFilter struct {
+	Type     string
+	Actor    string
+	ClientID string
+	Subject  string
+	Since    time.Time
+	Until    time.Time
+
+	// AfterID returns only events with an id greater than AfterID, which can be used for pagination.
+	AfterID int64
+
+	// Limit is the maximum number of events returned. Defaults to 100.
+	Limit int
+}
+
+// AuditAs returns a copy of the storage which records actor and metadata with all audit events.
+func (s *Storage) AuditAs(actor string, metadata map[string]string) *Storage {
+	c := *s
+	c.borrowed = true
+	c.actor = actor
+	c.auditMetadata = metadata
+	return &c
+}
+
+// ListAuditEvents returns the audit events matching filter ordered by id.
+func (s *Storage) ListAuditEvents(filter AuditFilter) ([]*AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	add("id > ?", filter.AfterID)
+	if filter.Type != "" {
+		add("type = ?", filter.Type)
+	}
+	if filter.Actor != "" {
+		add("actor = ?", filter.Actor)
+	}
+	if filter.ClientID != "" {
+		add("client = ?", filter.ClientID)
+	}
+	if filter.Subject != "" {
+		add("subject = ?", filter.Subject)
+	}
+	if !filter.Since.IsZero() {
+		add("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add("created_at < ?", filter.Until)
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	args = append(args, filter.Limit)
+
+	var events []*AuditEvent
+	err := s.read("ListAuditEvents", func(conn dbtx) error {
+		// The statements differ in their conditions, so they are not prepared.
+		rows, err := conn.(ctxConn).unprepared().Query("SELECT id, type, actor, client, subject, metadata, created_at FROM audit WHERE "+strings.Join(where, " AND ")+" ORDER BY id LIMIT $"+strconv.Itoa(len(args)), args...)
+		if err != nil {
+			return errors.New(err)
+		}
+		defer rows.Close()
+
+		events = nil
+		for rows.Next() {
+			var e AuditEvent
+			var metadata []byte
+			if err := rows.Scan(&e.ID, &e.Type, &e.Actor, &e.ClientID, &e.Subject, &metadata, &e.CreatedAt); err != nil {
+				return errors.New(err)
+			}
+			if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+				return errors.New(err)
+			}
+			events = append(events, &e)
+		}
+		if err := rows.Err(); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// recordAudit appends an event to the audit log if auditing is enabled.
+func (s *Storage) recordAudit(conn dbtx, typ, clientID, subject string) error {
+	if !s.audit {
+		return nil
+	}
+
+	metadata := s.auditMetadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	if _, err := conn.Exec("INSERT INTO audit (type, actor, client, subject, metadata, created_at) VALUES ($1, $2, $3, $4, $5, $6)", typ, s.actor, clientID, subject, encoded, s.now()); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a code or token, as used for the subject of audit events.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
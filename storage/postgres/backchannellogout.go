@@ -0,0 +1,112 @@
+package postgres
+
+import (
+	"database/sql"
+	"net/url"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// BackchannelLogout is the OpenID Connect back-channel logout registration of a client.
+type BackchannelLogout struct {
+	// URI is the backchannel_logout_uri logout tokens are posted to. Empty disables back-channel logout.
+	URI string
+
+	// SessionRequired is backchannel_logout_session_required: the client requires the sid claim in logout tokens.
+	SessionRequired bool
+}
+
+// LogoutTarget is a client which must receive a back-channel logout token for a terminated session.
+type LogoutTarget struct {
+	ClientID string
+	BackchannelLogout
+
+	// SID and UserRef are the session id and user of the terminated session, for the sid and sub claims.
+	SID     string
+	UserRef string
+}
+
+// SetClientBackchannelLogout stores the back-channel logout registration of the client. Returns an error if the URI
+// is not absolute and ErrClientNotFound if the client does not exist.
+func (s *Storage) SetClientBackchannelLogout(clientID string, logout BackchannelLogout) error {
+	if logout.URI != "" {
+		if u, err := url.Parse(logout.URI); err != nil || !u.IsAbs() || u.Fragment != "" {
+			return errors.Errorf("Invalid back-channel logout URI %q", logout.URI)
+		}
+	}
+
+	if err := s.mutate("SetClientBackchannelLogout", AuditClientUpdated, clientID, clientID, func(conn dbtx) error {
+		if n, err := execCount(conn, "UPDATE client SET backchannel_logout_uri=$2, backchannel_logout_session_required=$3 WHERE id=$1", clientID, nullString(logout.URI), logout.SessionRequired); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrClientNotFound
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.afterCommit(func() {
+		s.evictClient(clientID)
+		s.hooks.clientChanged(clientID)
+	})
+	return nil
+}
+
+// GetClientBackchannelLogout loads the back-channel logout registration of the client. Returns ErrClientNotFound if
+// the client does not exist.
+func (s *Storage) GetClientBackchannelLogout(clientID string) (*BackchannelLogout, error) {
+	var logout BackchannelLogout
+	var uri sql.NullString
+	if err := s.read("GetClientBackchannelLogout", func(conn dbtx) error {
+		return conn.QueryRow("SELECT backchannel_logout_uri, backchannel_logout_session_required FROM client WHERE id=$1", clientID).Scan(&uri, &logout.SessionRequired)
+	}); err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	logout.URI = uri.String
+	return &logout, nil
+}
+
+// LogoutTargets returns the clients of the session, e.g. as returned by TerminateSession, which registered for
+// back-channel logout, ordered by client id. Clients removed in the meantime are skipped.
+func (s *Storage) LogoutTargets(session *Session) ([]*LogoutTarget, error) {
+	var targets []*LogoutTarget
+	err := s.read("LogoutTargets", func(conn dbtx) (err error) {
+		targets, err = queryLogoutTargets(conn, session)
+		return err
+	})
+	return targets, err
+}
+
+// TerminateSessionWithLogout is TerminateSession combined with LogoutTargets in one transaction.
+func (s *Storage) TerminateSessionWithLogout(sid string) (*Session, []*LogoutTarget, error) {
+	var session *Session
+	var targets []*LogoutTarget
+	err := s.inTx("TerminateSessionWithLogout", func(tx dbtx) (err error) {
+		if session, err = scanSession(tx.QueryRow("DELETE FROM session WHERE sid=$1 RETURNING "+sessionColumns, sid)); err != nil {
+			return err
+		}
+		targets, err = queryLogoutTargets(tx, session)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, targets, nil
+}
+
+func queryLogoutTargets(conn dbtx, session *Session) ([]*LogoutTarget, error) {
+	var targets []*LogoutTarget
+	err := queryRows(conn, func(row scanner) error {
+		t := &LogoutTarget{SID: session.SID, UserRef: session.UserRef}
+		if err := row.Scan(&t.ClientID, &t.URI, &t.SessionRequired); err != nil {
+			return err
+		}
+		targets = append(targets, t)
+		return nil
+	}, "SELECT id, backchannel_logout_uri, backchannel_logout_session_required FROM client WHERE id=ANY($1) AND backchannel_logout_uri IS NOT NULL ORDER BY id", pq.Array(nonNil(session.Clients)))
+	return targets, err
+}
@@ -0,0 +1,137 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+)
+
+// batchSize is the number of rows inserted per statement by SaveAccessBatch. It keeps the number of parameters
+// far below the limit of 65535 per statement.
+const batchSize = 500
+
+// SaveAccessBatch saves many access tokens and their refresh tokens in a single transaction with multi-row
+// inserts, e.g. for bulk migrations and offline issuance. Unlike SaveAccess it neither rotates the access tokens
+// the tokens were refreshed from nor inherits their absolute refresh expiry. Either all tokens are saved or none.
+// With WithIdempotentSaves existing tokens are skipped; audit events are recorded and hooks run for the saved
+// tokens only.
+func (s *Storage) SaveAccessBatch(batch []*osin.AccessData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	extras := make([]string, len(batch))
+	for i, data := range batch {
+		if data.Client == nil {
+			return errors.New("data.Client must not be nil")
+		}
+		if err := s.limitLifetime(&data.ExpiresIn); err != nil {
+			return err
+		}
+		var err error
+		if extras[i], err = assertToString(data.UserData); err != nil {
+			return err
+		}
+	}
+
+	var saved []*osin.AccessData
+	if err := s.inTx("SaveAccessBatch", func(tx dbtx) error {
+		saved = nil
+		// The statements differ in their number of rows, so they are not prepared.
+		conn := tx.(ctxConn).unprepared()
+		for start := 0; start < len(batch); start += batchSize {
+			end := start + batchSize
+			if end > len(batch) {
+				end = len(batch)
+			}
+			chunk, err := s.saveAccessChunk(conn, batch[start:end], extras[start:end])
+			if err != nil {
+				return err
+			}
+			saved = append(saved, chunk...)
+		}
+		for _, data := range saved {
+			event := AuditAccessIssued
+			if data.AccessData != nil {
+				event = AuditAccessRefreshed
+			}
+			if err := s.recordAudit(tx, event, data.Client.GetId(), HashToken(data.AccessToken)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.afterCommit(func() {
+		for _, data := range saved {
+			s.hooks.accessSaved(data)
+		}
+	})
+	return nil
+}
+
+// saveAccessChunk inserts the access and refresh rows of at most batchSize tokens and returns the saved tokens.
+func (s *Storage) saveAccessChunk(conn dbtx, chunk []*osin.AccessData, extras []string) ([]*osin.AccessData, error) {
+	var defaultExpiry sql.NullTime
+	if s.refreshTTL.absolute > 0 {
+		defaultExpiry = sql.NullTime{Time: s.now().Add(s.refreshTTL.absolute), Valid: true}
+	}
+
+	var accessRows, refreshRows []string
+	var accessArgs, refreshArgs []interface{}
+	for i, data := range chunk {
+		var prev, code string
+		if data.AccessData != nil {
+			prev = data.AccessData.AccessToken
+		}
+		if data.AuthorizeData != nil {
+			code = data.AuthorizeData.Code
+		}
+
+		n := len(accessArgs)
+		accessRows = append(accessRows, fmt.Sprintf(
+			"($%d, $%[2]d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, (SELECT resources FROM authorize WHERE code=$%[2]d LIMIT 1), (SELECT authorization_details FROM authorize WHERE code=$%[2]d LIMIT 1), $%d)",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11,
+		))
+		accessArgs = append(accessArgs, data.Client.GetId(), nullString(code), nullString(prev), data.AccessToken, nullString(data.RefreshToken), data.ExpiresIn, nullString(data.Scope), nullString(data.RedirectUri), data.CreatedAt, extras[i], nullString(s.userRefOf("", data.UserData)))
+
+		if data.RefreshToken != "" {
+			n := len(refreshArgs)
+			refreshRows = append(refreshRows, fmt.Sprintf(
+				"($%d, $%d, $%[3]d, COALESCE($%[3]d + (SELECT refresh_ttl FROM client WHERE id=$%d) * interval '1 second', $%d))",
+				n+1, n+2, n+3, n+4, n+5,
+			))
+			refreshArgs = append(refreshArgs, data.RefreshToken, data.AccessToken, s.now(), data.Client.GetId(), defaultExpiry)
+		}
+	}
+
+	if len(refreshRows) > 0 {
+		if _, err := conn.Exec("INSERT INTO refresh (token, access, last_used_at, absolute_expiry) VALUES "+strings.Join(refreshRows, ", ")+s.onConflict(), refreshArgs...); err != nil {
+			return nil, errors.New(err)
+		}
+	}
+	inserted, err := queryStrings(conn, "INSERT INTO access (client, authorize, previous, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, extra, resources, authorization_details, user_ref) VALUES "+strings.Join(accessRows, ", ")+s.onConflict()+" RETURNING access_token", accessArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(inserted) == len(chunk) {
+		return chunk, nil
+	}
+	insertedTokens := make(map[string]bool, len(inserted))
+	for _, token := range inserted {
+		insertedTokens[token] = true
+	}
+	saved := make([]*osin.AccessData, 0, len(inserted))
+	for _, data := range chunk {
+		if insertedTokens[data.AccessToken] {
+			saved = append(saved, data)
+		}
+	}
+	return saved, nil
+}
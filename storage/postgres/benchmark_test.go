@@ -0,0 +1,90 @@
+package postgres
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/optimisticninja/osin"
+	"github.com/stretchr/testify/require"
+)
+
+// The benchmarks of the hot paths run against tables with benchRows unrelated tokens and against refresh chains of
+// benchDepths previous access tokens, which LoadAccess follows. Run them with
+//
+//	go test -run '^$' -bench . -benchmem ./storage/postgres/
+//
+// or against a fresh database with docker compose run --rm bench.
+var (
+	benchRows   = []int{0, 10000, 100000}
+	benchDepths = []int{0, 1, 5, 20}
+)
+
+func BenchmarkSaveAccess(b *testing.B) {
+	for _, rows := range benchRows {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			client := benchSetup(b, rows)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				token := fmt.Sprintf("bench-%d", i)
+				if err := store.SaveAccess(&osin.AccessData{Client: client, AccessToken: token, RefreshToken: token, ExpiresIn: 3600, CreatedAt: time.Now()}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLoadAccess(b *testing.B) {
+	benchChains(b, func(token string) (*osin.AccessData, error) { return store.LoadAccess(token) })
+}
+
+func BenchmarkLoadRefresh(b *testing.B) {
+	benchChains(b, func(token string) (*osin.AccessData, error) { return store.LoadRefresh(token) })
+}
+
+// benchChains benchmarks load with the token at the end of a refresh chain for all table sizes and depths. Access
+// and refresh tokens of the chain are equal, so that load can be LoadAccess or LoadRefresh.
+func benchChains(b *testing.B, load func(token string) (*osin.AccessData, error)) {
+	for _, rows := range benchRows {
+		for _, depth := range benchDepths {
+			b.Run(fmt.Sprintf("rows=%d/depth=%d", rows, depth), func(b *testing.B) {
+				client := benchSetup(b, rows)
+				var prev *osin.AccessData
+				for i := 0; i <= depth; i++ {
+					token := fmt.Sprintf("bench-chain-%d", i)
+					data := &osin.AccessData{Client: client, AccessData: prev, AccessToken: token, RefreshToken: token, ExpiresIn: 3600, CreatedAt: time.Now()}
+					require.Nil(b, store.SaveAccess(data))
+					prev = data
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := load(prev.AccessToken); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// benchSetup creates the benchmark client and rows filler access and refresh tokens. They are removed when b
+// completes.
+func benchSetup(b *testing.B, rows int) osin.Client {
+	client := &osin.DefaultClient{Id: "bench", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(b, store.CreateClient(client))
+	b.Cleanup(func() {
+		db.Exec("DELETE FROM refresh WHERE token LIKE 'bench-%'")
+		db.Exec("DELETE FROM access WHERE client=$1", client.Id)
+		store.RemoveClient(client.Id)
+	})
+
+	_, err := db.Exec("INSERT INTO access (client, access_token, refresh_token, expires_in, extra, created_at) SELECT $1, 'bench-filler-' || i, 'bench-filler-' || i, 3600, '', now() FROM generate_series(1, $2) i", client.Id, rows)
+	require.Nil(b, err)
+	_, err = db.Exec("INSERT INTO refresh (token, access) SELECT 'bench-filler-' || i, 'bench-filler-' || i FROM generate_series(1, $1) i", rows)
+	require.Nil(b, err)
+	_, err = db.Exec("ANALYZE access, refresh")
+	require.Nil(b, err)
+	return client
+}
@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// ErrUnavailable is returned without querying the database while the circuit breaker is open.
+var ErrUnavailable = errors.New("Storage unavailable")
+
+// WithCircuitBreaker opens the circuit after threshold consecutive operations failed because the database is
+// unreachable or timed out. While the circuit is open, operations fail immediately with ErrUnavailable instead
+// of waiting for timeouts and exhausting the connection pool. After cooldown, a single operation is let through
+// to probe the database; if it succeeds the circuit closes, otherwise it opens again for cooldown. A threshold
+// of zero or less disables the circuit breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(s *Storage) {
+		if threshold <= 0 {
+			s.breaker = nil
+			return
+		}
+		s.breaker = &breaker{threshold: threshold, cooldown: cooldown}
+	}
+}
+
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns false if the circuit is open. Once the cooldown elapsed, it returns true for a single probe.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with the outcome of an operation.
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil || !isUnavailable(err) {
+		b.failures = 0
+		return
+	}
+	if b.failures++; b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// isUnavailable returns true if err indicates that the database is unreachable, shutting down or too slow.
+func isUnavailable(err error) bool {
+	switch sqlState(err) {
+	case "57014", "53300":
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || isConnectionError(err)
+}
@@ -0,0 +1,190 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// ErrSlowDown is returned by PollBackchannelRequest if the client polls more often than the polling interval of
+// the request allows. The token endpoint should answer with the slow_down error.
+var ErrSlowDown = errors.New("Slow down")
+
+// BackchannelStatus is the status of a backchannel authentication request.
+type BackchannelStatus string
+
+// The statuses of a backchannel authentication request. A request is pending until the user approves or denies
+// it on the authentication device.
+const (
+	BackchannelPending  BackchannelStatus = "pending"
+	BackchannelApproved BackchannelStatus = "approved"
+	BackchannelDenied   BackchannelStatus = "denied"
+)
+
+// BackchannelAuthRequest is a backchannel authentication request of the Client Initiated Backchannel
+// Authentication (CIBA) flow of OpenID Connect.
+type BackchannelAuthRequest struct {
+	// AuthReqID is the auth_req_id handed out to the client.
+	AuthReqID string
+
+	// ClientID is the id of the client which started the request.
+	ClientID string
+
+	// Scope is the requested scope.
+	Scope string
+
+	// LoginHint identifies the user to authenticate, e.g. login_hint, id_token_hint or login_hint_token.
+	LoginHint string
+
+	// BindingMessage is the binding_message shown on both the consumption and the authentication device.
+	BindingMessage string
+
+	// Status is the status of the request. SaveBackchannelRequest ignores it and saves the request as pending.
+	Status BackchannelStatus
+
+	// UserData is the data of the user, which is set when the user approves the request.
+	UserData interface{}
+
+	// ExpiresIn is the lifetime of the auth_req_id in seconds.
+	ExpiresIn int32
+
+	// Interval is the minimum number of seconds the client must wait between polls. 0 does not limit polling.
+	Interval int32
+
+	// CreatedAt is the date of creation.
+	CreatedAt time.Time
+}
+
+// ExpireAt returns the expiration date.
+func (r *BackchannelAuthRequest) ExpireAt() time.Time {
+	return r.CreatedAt.Add(time.Duration(r.ExpiresIn) * time.Second)
+}
+
+// IsExpired returns true if the auth_req_id expired.
+func (r *BackchannelAuthRequest) IsExpired() bool {
+	return r.expiredAt(time.Now())
+}
+
+func (r *BackchannelAuthRequest) expiredAt(now time.Time) bool {
+	return r.ExpireAt().Before(now)
+}
+
+const backchannelColumns = "auth_req_id, client, scope, login_hint, binding_message, status, extra, expires_in, poll_interval, created_at"
+
+// SaveBackchannelRequest saves a pending backchannel authentication request.
+func (s *Storage) SaveBackchannelRequest(r *BackchannelAuthRequest) error {
+	if err := s.write("SaveBackchannelRequest", func(conn dbtx) error {
+		_, err := conn.Exec(
+			"INSERT INTO backchannel_request ("+backchannelColumns+") VALUES ($1, $2, $3, $4, $5, $6, '', $7, $8, $9)",
+			r.AuthReqID,
+			r.ClientID,
+			r.Scope,
+			r.LoginHint,
+			r.BindingMessage,
+			BackchannelPending,
+			r.ExpiresIn,
+			r.Interval,
+			r.CreatedAt,
+		)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// PollBackchannelRequest looks up the backchannel authentication request with auth_req_id of the client for the
+// token endpoint and records the poll. Returns ErrSlowDown if the previous poll is less than the interval of the
+// request ago, and an error if the request expired. The request is returned in any status; consume approved
+// requests with ConsumeBackchannelRequest.
+func (s *Storage) PollBackchannelRequest(authReqID, clientID string) (*BackchannelAuthRequest, error) {
+	var r *BackchannelAuthRequest
+	err := s.inTx("PollBackchannelRequest", func(tx dbtx) (err error) {
+		var polledAt sql.NullTime
+		row := tx.QueryRow("SELECT "+backchannelColumns+", last_polled_at FROM backchannel_request WHERE auth_req_id=$1 AND client=$2 FOR UPDATE", authReqID, clientID)
+		if r, err = s.scanBackchannelRequest(row, &polledAt); err != nil {
+			return err
+		}
+		now := s.now()
+		if polledAt.Valid && now.Before(polledAt.Time.Add(time.Duration(r.Interval)*time.Second)) {
+			return ErrSlowDown
+		}
+		if _, err := tx.Exec("UPDATE backchannel_request SET last_polled_at=$2 WHERE auth_req_id=$1", authReqID, now); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ApproveBackchannelRequest approves the pending backchannel authentication request with auth_req_id for the
+// user with userData. Returns ErrNotFound if there is no pending request which has not expired.
+func (s *Storage) ApproveBackchannelRequest(authReqID string, userData interface{}) error {
+	extra, err := assertToString(userData)
+	if err != nil {
+		return err
+	}
+	return s.resolveBackchannelRequest("ApproveBackchannelRequest", authReqID, BackchannelApproved, extra)
+}
+
+// DenyBackchannelRequest denies the pending backchannel authentication request with auth_req_id. Returns
+// ErrNotFound if there is no pending request which has not expired.
+func (s *Storage) DenyBackchannelRequest(authReqID string) error {
+	return s.resolveBackchannelRequest("DenyBackchannelRequest", authReqID, BackchannelDenied, "")
+}
+
+func (s *Storage) resolveBackchannelRequest(op, authReqID string, status BackchannelStatus, extra string) error {
+	n, err := s.writeCount(op,
+		"UPDATE backchannel_request SET status=$2, extra=$3 WHERE auth_req_id=$1 AND status=$4 AND created_at + expires_in * interval '1 second' >= $5",
+		authReqID, status, extra, BackchannelPending, s.now())
+	if err != nil {
+		return errors.New(err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ConsumeBackchannelRequest looks up the approved backchannel authentication request with auth_req_id of the
+// client and removes it in the same statement, so that tokens are issued only once per request. Returns
+// ErrNotFound if there is no approved request, and an error if the request expired.
+func (s *Storage) ConsumeBackchannelRequest(authReqID, clientID string) (*BackchannelAuthRequest, error) {
+	var r *BackchannelAuthRequest
+	err := s.write("ConsumeBackchannelRequest", func(conn dbtx) (err error) {
+		row := conn.QueryRow("DELETE FROM backchannel_request WHERE auth_req_id=$1 AND client=$2 AND status=$3 RETURNING "+backchannelColumns+", last_polled_at",
+			authReqID, clientID, BackchannelApproved)
+		r, err = s.scanBackchannelRequest(row, new(sql.NullTime))
+		return err
+	})
+	return r, err
+}
+
+// PurgeExpiredBackchannelRequests removes all expired backchannel authentication requests and returns the number
+// of removed rows.
+func (s *Storage) PurgeExpiredBackchannelRequests() (int64, error) {
+	query, args := s.expiredBackchannelPurge().query(s, 0)
+	return s.writeCount("PurgeExpiredBackchannelRequests", query, args...)
+}
+
+func (s *Storage) scanBackchannelRequest(row *sql.Row, polledAt *sql.NullTime) (*BackchannelAuthRequest, error) {
+	var r BackchannelAuthRequest
+	var extra string
+	if err := row.Scan(&r.AuthReqID, &r.ClientID, &r.Scope, &r.LoginHint, &r.BindingMessage, &r.Status, &extra, &r.ExpiresIn, &r.Interval, &r.CreatedAt, polledAt); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	if r.Status == BackchannelApproved {
+		r.UserData = extra
+	}
+
+	if r.expiredAt(s.now()) {
+		return nil, errors.Errorf("Auth request id expired at %s.", r.ExpireAt().String())
+	}
+	return &r, nil
+}
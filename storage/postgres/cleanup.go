@@ -0,0 +1,232 @@
+package postgres
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// cleanupLockID is the key of the advisory lock held by the instance running Cleanup.
+const cleanupLockID int64 = 0x6f73696e5f7063 // "osin_pc"
+
+// CleanupConfig configures the purges run by Cleanup.
+type CleanupConfig struct {
+	// ArchiveRetention is passed to PurgeArchive. Zero keeps archived rows.
+	ArchiveRetention time.Duration
+
+	// RevocationRetention is passed to PurgeRevocations. Zero keeps the revocation list.
+	RevocationRetention time.Duration
+
+	// BatchSize limits the number of rows removed per statement, so purging millions of rows neither locks
+	// tables for long nor causes a spike of WAL. Zero removes all rows of a purge in one statement.
+	BatchSize int
+
+	// Pause is the time to sleep between two batches.
+	Pause time.Duration
+
+	// Deadline limits the duration of a Cleanup. Rows not removed when it expires are removed by the next
+	// Cleanup. Zero does not limit the duration.
+	Deadline time.Duration
+
+	// LiveIndexes refreshes the partial indexes on live codes and tokens with RefreshLiveIndexes before the purges.
+	LiveIndexes bool
+}
+
+// purge removes the rows of table matching where, which compares with args.
+type purge struct {
+	table string
+
+	// key identifies the rows of a batch. It is ctid for tables without primary key.
+	key string
+
+	where string
+	args  []interface{}
+}
+
+// query returns the statement removing the rows of the purge, at most limit rows if limit is greater than zero,
+// together with its arguments.
+func (p purge) query(s *Storage, limit int) (string, []interface{}) {
+	where, args := p.where, append([]interface{}{}, p.args...)
+	if limit > 0 {
+		args = append(args, limit)
+		where = p.key + " IN (SELECT " + p.key + " FROM " + p.table + " WHERE " + where + " LIMIT $" + strconv.Itoa(len(args)) + ")"
+	}
+	return s.deleteQuery(p.table, where, "", args...)
+}
+
+// expiredTokenPurges are the purges of PurgeExpiredTokens. Refresh tokens are purged first, as access tokens are
+// only purged if they have no refresh token left.
+func (s *Storage) expiredTokenPurges() []purge {
+	return []purge{
+		{"refresh", "token", "rotated_at <= $1 OR absolute_expiry <= $2 OR last_used_at <= $3", []interface{}{s.graceStart(), s.now(), s.slidingStart()}},
+		{"authorize", "code", "expires_at < $1", []interface{}{s.now()}},
+		{"access", "access_token", "expires_at < $1 AND NOT EXISTS (SELECT 1 FROM refresh WHERE refresh.access=access.access_token)", []interface{}{s.now()}},
+	}
+}
+
+func (s *Storage) expiredPARPurge() purge {
+	return purge{"par_request", "request_uri", "created_at + expires_in * interval '1 second' < $1", []interface{}{s.now()}}
+}
+
+func (s *Storage) expiredNoncePurge() purge {
+	return purge{"nonce", "nonce", "expires_at <= $1", []interface{}{s.now()}}
+}
+
+func (s *Storage) expiredDenylistPurge() purge {
+	return purge{"jti_denylist", "jti", "expires_at <= $1", []interface{}{s.now()}}
+}
+
+func (s *Storage) expiredBackchannelPurge() purge {
+	return purge{"backchannel_request", "auth_req_id", "created_at + expires_in * interval '1 second' < $1", []interface{}{s.now()}}
+}
+
+func (s *Storage) archivePurges(olderThan time.Duration) []purge {
+	before := s.now().Add(-olderThan)
+	return []purge{
+		{"authorize_archive", "ctid", "archived_at < $1", []interface{}{before}},
+		{"access_archive", "ctid", "archived_at < $1", []interface{}{before}},
+	}
+}
+
+func (s *Storage) revocationPurge(olderThan time.Duration) purge {
+	return purge{"revocation", "id", "revoked_at < $1", []interface{}{s.now().Add(-olderThan)}}
+}
+
+// Cleanup runs PurgeExpiredTokens, PurgeExpiredPAR, PurgeExpiredNonces, PurgeExpiredDenylist,
+// PurgeExpiredBackchannelRequests and, if configured, PurgeArchive and PurgeRevocations, while holding an advisory
+// lock. If another instance holds the lock, the purges are skipped and false is returned, so with several
+// instances running RunCleanup only one of them purges at a time. The lock is released when Cleanup returns or
+// the connection holding it is lost.
+//
+// With config.BatchSize, rows are removed in batches of that size, pausing config.Pause between batches. Then the
+// purges of PurgeExpiredTokens do not run in a single transaction. The number of removed rows is logged and
+// reported to Metrics.Counter as CounterPurgedRows followed by the table, e.g. "purged_rows_access". Cleanup stops
+// without error when config.Deadline expires.
+func (s *Storage) Cleanup(ctx context.Context, config CleanupConfig) (bool, error) {
+	if err := s.unsupported("Cleanup"); err != nil {
+		return false, err
+	}
+	if s.readOnly {
+		return false, ErrReadOnly
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return false, errors.New(err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", cleanupLockID).Scan(&locked); err != nil {
+		return false, errors.New(err)
+	}
+	if !locked {
+		return false, nil
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", cleanupLockID)
+
+	var deadline time.Time
+	if config.Deadline > 0 {
+		deadline = time.Now().Add(config.Deadline)
+	}
+
+	if config.LiveIndexes {
+		if err := s.RefreshLiveIndexes(ctx); err != nil {
+			return true, err
+		}
+	}
+
+	var purges []purge
+	if config.BatchSize <= 0 {
+		// Without batches the expired tokens are purged in one transaction, like PurgeExpiredTokens does.
+		counts, err := s.PurgeExpiredTokens()
+		if err != nil {
+			return true, err
+		}
+		s.countPurged("refresh", counts.Refresh)
+		s.countPurged("authorize", counts.Authorize)
+		s.countPurged("access", counts.Access)
+	} else {
+		purges = s.expiredTokenPurges()
+	}
+	purges = append(purges, s.expiredPARPurge(), s.expiredNoncePurge(), s.expiredDenylistPurge(), s.expiredBackchannelPurge())
+	if config.ArchiveRetention > 0 {
+		purges = append(purges, s.archivePurges(config.ArchiveRetention)...)
+	}
+	if config.RevocationRetention > 0 {
+		purges = append(purges, s.revocationPurge(config.RevocationRetention))
+	}
+
+	for _, p := range purges {
+		if done, err := s.runPurge(ctx, p, config, deadline); err != nil {
+			return true, err
+		} else if done {
+			return true, nil
+		}
+	}
+	return true, nil
+}
+
+// runPurge removes the rows of p in batches of config.BatchSize. It returns true if deadline expired.
+func (s *Storage) runPurge(ctx context.Context, p purge, config CleanupConfig, deadline time.Time) (bool, error) {
+	var total int64
+	defer func() {
+		if total > 0 && config.BatchSize > 0 {
+			log.Printf("Purged %d rows from %s", total, p.table)
+		}
+		s.countPurged(p.table, total)
+	}()
+
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Printf("Cleanup deadline expired while purging %s", p.table)
+			return true, nil
+		}
+
+		query, args := p.query(s, config.BatchSize)
+		var n int64
+		if err := s.writeContext(ctx, "Cleanup", func(conn dbtx) (err error) {
+			n, err = execCount(conn, query, args...)
+			return err
+		}); err != nil {
+			return false, err
+		}
+		total += n
+		if config.BatchSize <= 0 || n < int64(config.BatchSize) {
+			return false, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, errors.New(ctx.Err())
+		case <-time.After(config.Pause):
+		}
+	}
+}
+
+// countPurged reports n rows removed from table to Metrics.Counter.
+func (s *Storage) countPurged(table string, n int64) {
+	if n > 0 && s.metrics.Counter != nil {
+		s.metrics.Counter(CounterPurgedRows+"_"+table, float64(n))
+	}
+}
+
+// RunCleanup calls Cleanup every interval until ctx is done. It is safe to run on every instance. Errors are
+// passed to onError, if not nil.
+func (s *Storage) RunCleanup(ctx context.Context, interval time.Duration, config CleanupConfig, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Cleanup(ctx, config); err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
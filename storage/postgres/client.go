@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/optimisticninja/osin"
+)
+
+// Client is the client returned by GetClient and attached to loaded codes and tokens. It extends the osin client
+// with the data the storage keeps about it.
+type Client struct {
+	osin.DefaultClient
+
+	// Trusted marks first-party clients, for which the authorization endpoint may skip the consent screen.
+	Trusted bool
+
+	// Metadata is shown to users on consent screens.
+	Metadata ClientMetadata
+
+	// Disabled and DeletedAt are set for clients disabled with DisableClient or soft-deleted with SoftDeleteClient.
+	// GetClient never returns such clients, see LookupClient. CreateClient and UpdateClient ignore them.
+	Disabled  bool
+	DeletedAt time.Time
+
+	// Version is incremented by every update of the client with UpdateClient or ImportClients and by every change
+	// of its state with DisableClient, EnableClient, SoftDeleteClient and RestoreClient. Pass it to
+	// UpdateClientIfVersion to detect concurrent updates. CreateClient and UpdateClient ignore it.
+	Version int64
+}
+
+// ClientMetadata is the branding of a client shown to users on consent screens. The names follow the client
+// metadata of RFC 7591.
+type ClientMetadata struct {
+	DisplayName string `json:"client_name,omitempty" yaml:"client_name,omitempty"`
+	LogoURI     string `json:"logo_uri,omitempty" yaml:"logo_uri,omitempty"`
+	PolicyURI   string `json:"policy_uri,omitempty" yaml:"policy_uri,omitempty"`
+	TOSURI      string `json:"tos_uri,omitempty" yaml:"tos_uri,omitempty"`
+}
+
+// GetMetadata returns the branding of the client.
+func (c *Client) GetMetadata() ClientMetadata {
+	return c.Metadata
+}
+
+// MetadataClient is implemented by clients which carry branding, like Client. CreateClient and UpdateClient store
+// the metadata of such clients. UpdateClient keeps the metadata of other clients unchanged.
+type MetadataClient interface {
+	osin.Client
+	GetMetadata() ClientMetadata
+}
+
+// IsTrusted returns true if the client is a trusted first-party client.
+func (c *Client) IsTrusted() bool {
+	return c.Trusted
+}
+
+// TrustedClient is implemented by clients which know whether they are trusted, like Client. CreateClient and
+// UpdateClient store the trust of such clients. UpdateClient keeps the trust of other clients unchanged.
+type TrustedClient interface {
+	osin.Client
+	IsTrusted() bool
+}
+
+// IsTrustedClient returns true if c is a trusted first-party client, e.g. the client of an osin.AuthorizeRequest
+// loaded from this storage.
+func IsTrustedClient(c osin.Client) bool {
+	t, ok := c.(TrustedClient)
+	return ok && t.IsTrusted()
+}
+
+// SecretKeepingClient is implemented by clients whose secret is not known to the caller, like the clients of
+// admin API updates without secret. UpdateClient keeps the stored secret of such clients if KeepsSecret returns
+// true.
+type SecretKeepingClient interface {
+	osin.Client
+	KeepsSecret() bool
+}
+
+// KeepsSecret returns true if UpdateClient keeps the stored secret of c, see SecretKeepingClient.
+func KeepsSecret(c osin.Client) bool {
+	k, ok := c.(SecretKeepingClient)
+	return ok && k.KeepsSecret()
+}
+
+// clientSecret returns the secret of c as query parameter, which is nil if c keeps its secret.
+func clientSecret(c osin.Client) interface{} {
+	if KeepsSecret(c) {
+		return nil
+	}
+	return c.GetSecret()
+}
+
+// clientTrust returns the trust of c as query parameter, which is nil if c does not implement TrustedClient.
+func clientTrust(c osin.Client) interface{} {
+	if t, ok := c.(TrustedClient); ok {
+		return t.IsTrusted()
+	}
+	return nil
+}
+
+// clientMetadata returns the metadata of c as query parameters, which are nil if c does not implement
+// MetadataClient.
+func clientMetadata(c osin.Client) []interface{} {
+	m, ok := c.(MetadataClient)
+	if !ok {
+		return []interface{}{nil, nil, nil, nil}
+	}
+	metadata := m.GetMetadata()
+	return []interface{}{metadata.DisplayName, metadata.LogoURI, metadata.PolicyURI, metadata.TOSURI}
+}
+
+// DisableClient suspends the client: GetClient fails with ErrClientDisabled and its codes and tokens cannot be
+// loaded until it is enabled again with EnableClient. Its configuration and tokens are kept. Returns
+// ErrClientNotFound if the client does not exist.
+func (s *Storage) DisableClient(id string) error {
+	return s.setClientState("DisableClient", id, "enabled=false")
+}
+
+// EnableClient re-enables a client disabled with DisableClient. Returns ErrClientNotFound if the client does not
+// exist.
+func (s *Storage) EnableClient(id string) error {
+	return s.setClientState("EnableClient", id, "enabled=true")
+}
+
+// SoftDeleteClient marks the client as deleted: GetClient fails with ErrClientDeleted and its codes and tokens
+// cannot be loaded, but its configuration and history are kept until it is restored with RestoreClient or removed
+// with RemoveClient. Returns ErrClientNotFound if the client does not exist.
+func (s *Storage) SoftDeleteClient(id string) error {
+	return s.setClientState("SoftDeleteClient", id, "deleted_at=COALESCE(deleted_at, $2)", s.now())
+}
+
+// RestoreClient undoes SoftDeleteClient. Returns ErrClientNotFound if the client does not exist.
+func (s *Storage) RestoreClient(id string) error {
+	return s.setClientState("RestoreClient", id, "deleted_at=NULL")
+}
+
+// setClientState runs the operation op, which applies set to the client and increments its version.
+func (s *Storage) setClientState(op, id, set string, args ...interface{}) error {
+	if err := s.mutate(op, AuditClientUpdated, id, id, func(conn dbtx) error {
+		if n, err := execCount(conn, "UPDATE client SET "+set+", version=version+1 WHERE id=$1", append([]interface{}{id}, args...)...); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrClientNotFound
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.afterCommit(func() {
+		s.evictClient(id)
+		s.hooks.clientChanged(id)
+	})
+	return nil
+}
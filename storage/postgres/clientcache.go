@@ -0,0 +1,141 @@
+package postgres
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/optimisticninja/osin"
+)
+
+// WithClientCache enables an in-memory LRU cache for clients loaded by GetClient, holding at most size clients
+// for at most ttl each. Cached clients are evicted when they are updated or removed through this storage. Changes
+// made by other instances are visible after ttl at the latest, or within milliseconds with RunClientInvalidation.
+// A size of zero or less disables the cache.
+func WithClientCache(size int, ttl time.Duration) Option {
+	return func(s *Storage) {
+		if size <= 0 {
+			s.clients = nil
+			return
+		}
+		s.clients = newClientCache(size, ttl)
+	}
+}
+
+// RunClientInvalidation evicts clients from the cache when sub receives an event of a client created, updated or
+// removed by any instance configured with WithNotify on the channel of sub, until ctx is done or sub is closed.
+// The cache is cleared when sub reconnected, as events may have been lost. Use a subscriber of its own, as the
+// events of sub are consumed, e.g.
+//
+//	sub, err := postgres.NewSubscriber(dsn, "osin")
+//	...
+//	go store.RunClientInvalidation(ctx, sub)
+func (s *Storage) RunClientInvalidation(ctx context.Context, sub *Subscriber) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			switch e.Type {
+			case AuditClientCreated, AuditClientUpdated, AuditClientDeleted:
+				s.evictClient(e.ClientID)
+			case EventReconnected:
+				s.clearClients()
+			}
+		}
+	}
+}
+
+// evictClient removes the client from the cache, if caching is enabled.
+func (s *Storage) evictClient(id string) {
+	if s.clients != nil {
+		s.clients.remove(id)
+	}
+}
+
+// clearClients empties the cache, if caching is enabled.
+func (s *Storage) clearClients() {
+	if s.clients != nil {
+		s.clients.clear()
+	}
+}
+
+type clientCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type clientCacheEntry struct {
+	client    Client
+	expiresAt time.Time
+}
+
+func newClientCache(size int, ttl time.Duration) *clientCache {
+	return &clientCache{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns a copy of the cached client or nil if it is not cached or expired.
+func (c *clientCache) get(id string) osin.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+
+	entry := e.Value.(*clientCacheEntry)
+	if entry.expiresAt.Before(time.Now()) {
+		c.order.Remove(e)
+		delete(c.entries, id)
+		return nil
+	}
+
+	c.order.MoveToFront(e)
+	client := entry.client
+	return &client
+}
+
+func (c *clientCache) put(client *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &clientCacheEntry{client: *client, expiresAt: time.Now().Add(c.ttl)}
+	if e, ok := c.entries[client.Id]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[client.Id] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*clientCacheEntry).client.Id)
+	}
+}
+
+func (c *clientCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		c.order.Remove(e)
+		delete(c.entries, id)
+	}
+}
+
+func (c *clientCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
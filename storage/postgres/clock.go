@@ -0,0 +1,33 @@
+package postgres
+
+import "time"
+
+// Clock returns the current time. The storage uses it for all timestamps it generates and for all expiry checks,
+// both in Go and in SQL, so that tests can control expiry. Durations like timeouts, backoffs and cache TTLs are
+// measured with the wall clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc is a function used as Clock.
+type ClockFunc func() time.Time
+
+// Now returns f().
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// WithClock replaces the wall clock of the storage with clock.
+func WithClock(clock Clock) Option {
+	return func(s *Storage) {
+		s.clock = clock
+	}
+}
+
+// now returns the current time of the clock of the storage.
+func (s *Storage) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
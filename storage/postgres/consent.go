@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Consent records that a user approved a set of scopes for a client.
+type Consent struct {
+	// UserRef identifies the user, e.g. the user's id.
+	UserRef string
+
+	// ClientID is the id of the client the scopes were approved for.
+	ClientID string
+
+	// Scope is the space separated list of approved scopes.
+	Scope string
+
+	// GrantedAt is the date the consent was given.
+	GrantedAt time.Time
+
+	// ExpiresAt is the date the consent expires. The zero time means the consent does not expire.
+	ExpiresAt time.Time
+}
+
+// IsExpired returns true if the consent expired.
+func (c *Consent) IsExpired() bool {
+	return c.expiredAt(time.Now())
+}
+
+func (c *Consent) expiredAt(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && c.ExpiresAt.Before(now)
+}
+
+// GrantConsent stores the consent. An existing consent of the same user for the same client is replaced.
+func (s *Storage) GrantConsent(c *Consent) error {
+	if err := s.write("GrantConsent", func(conn dbtx) error {
+		_, err := conn.Exec(
+			"INSERT INTO consent (user_ref, client, scope, granted_at, expires_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT "+s.conflictTarget("user_ref, client")+" DO UPDATE SET scope=EXCLUDED.scope, granted_at=EXCLUDED.granted_at, expires_at=EXCLUDED.expires_at",
+			c.UserRef,
+			c.ClientID,
+			c.Scope,
+			c.GrantedAt,
+			nullTime(c.ExpiresAt),
+		)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// GetConsent loads the consent of a user for a client. Returns ErrNotFound if there is none or it expired.
+func (s *Storage) GetConsent(userRef, clientID string) (*Consent, error) {
+	var c Consent
+	var expiresAt sql.NullTime
+	if err := s.read("GetConsent", func(conn dbtx) error {
+		return conn.QueryRow("SELECT user_ref, client, scope, granted_at, expires_at FROM consent WHERE user_ref=$1 AND client=$2", userRef, clientID).Scan(&c.UserRef, &c.ClientID, &c.Scope, &c.GrantedAt, &expiresAt)
+	}); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+
+	c.ExpiresAt = expiresAt.Time
+	if c.expiredAt(s.now()) {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+// HasConsent returns true if the user approved all scopes of the space separated list scope for the client
+// and the consent did not expire yet.
+func (s *Storage) HasConsent(userRef, clientID, scope string) (bool, error) {
+	c, err := s.GetConsent(userRef, clientID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	granted := map[string]bool{}
+	for _, g := range strings.Fields(c.Scope) {
+		granted[g] = true
+	}
+	for _, requested := range strings.Fields(scope) {
+		if !granted[requested] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RevokeConsent removes the consent of a user for a client.
+func (s *Storage) RevokeConsent(userRef, clientID string) error {
+	if err := s.write("RevokeConsent", func(conn dbtx) error {
+		_, err := conn.Exec("DELETE FROM consent WHERE user_ref=$1 AND client=$2", userRef, clientID)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// cronJobPrefix prefixes the names of the pg_cron jobs scheduled by ScheduleCronPurges.
+const cronJobPrefix = "osin_purge_"
+
+// cronTables are the tables ScheduleCronPurges can purge.
+var cronTables = []string{"refresh", "authorize", "access", "par_request", "nonce", "jti_denylist", "backchannel_request", "authorize_archive", "access_archive", "revocation"}
+
+// CronJob schedules the purge of a table with pg_cron, see ScheduleCronPurges.
+type CronJob struct {
+	// Table is the table to purge: "refresh", "authorize", "access", "par_request", "nonce", "jti_denylist" or
+	// "backchannel_request" for expired rows, "authorize_archive", "access_archive" or "revocation" for rows older
+	// than Retention.
+	Table string
+
+	// Schedule is the schedule in cron syntax, e.g. "*/10 * * * *".
+	Schedule string
+
+	// Retention is the time archived rows and revocation list entries are kept, see PurgeArchive and
+	// PurgeRevocations.
+	Retention time.Duration
+}
+
+// ScheduleCronPurges installs the pg_cron extension, if it is not installed yet, and schedules a job for each of
+// jobs, which purges the table like the purge methods of the storage, e.g. PurgeExpiredTokens, so that no
+// instance has to run RunCleanup. The commands follow the configuration of the storage, e.g. WithArchive,
+// WithRefreshGracePeriod and WithRefreshExpiry, as of scheduling, so schedule the jobs again after changing it.
+// Existing jobs of the same table are replaced. The jobs run in the database pg_cron is configured for, see
+// cron.database_name, with the privileges of the role scheduling them.
+func (s *Storage) ScheduleCronPurges(jobs []CronJob) error {
+	if err := s.unsupported("ScheduleCronPurges"); err != nil {
+		return err
+	}
+	commands := make([]string, len(jobs))
+	for i, job := range jobs {
+		var err error
+		if commands[i], err = s.cronCommand(job); err != nil {
+			return err
+		}
+	}
+
+	return s.inTx("ScheduleCronPurges", func(tx dbtx) error {
+		conn := tx.(ctxConn).unprepared()
+		if _, err := conn.Exec("CREATE EXTENSION IF NOT EXISTS pg_cron"); err != nil {
+			return errors.New(err)
+		}
+		for i, job := range jobs {
+			if _, err := conn.Exec("SELECT cron.schedule($1, $2, $3)", s.cronJobName(job.Table), job.Schedule, commands[i]); err != nil {
+				return errors.New(err)
+			}
+		}
+		return nil
+	})
+}
+
+// UnscheduleCronPurges removes the jobs scheduled by ScheduleCronPurges for the storage.
+func (s *Storage) UnscheduleCronPurges() error {
+	if err := s.unsupported("ScheduleCronPurges"); err != nil {
+		return err
+	}
+	return s.inTx("UnscheduleCronPurges", func(tx dbtx) error {
+		var names []string
+		for _, table := range cronTables {
+			names = append(names, s.cronJobName(table))
+		}
+		_, err := tx.(ctxConn).unprepared().Exec("SELECT cron.unschedule(jobid) FROM cron.job WHERE jobname=ANY($1)", pq.Array(names))
+		return err
+	})
+}
+
+// cronJobName returns the name of the job purging table. Jobs of tenant schemas are named after the schema, see
+// ForTenantSchema.
+func (s *Storage) cronJobName(table string) string {
+	if s.schema != "" {
+		return cronJobPrefix + s.schema + "_" + table
+	}
+	return cronJobPrefix + table
+}
+
+// cronCommand returns the statement of job. Unlike the purges of Cleanup, it compares with now() at the time the
+// job runs.
+func (s *Storage) cronCommand(job CronJob) (string, error) {
+	if strings.TrimSpace(job.Schedule) == "" {
+		return "", errors.Errorf("No schedule for table %s", job.Table)
+	}
+
+	retention := func() (string, error) {
+		if job.Retention <= 0 {
+			return "", errors.Errorf("Table %s requires a retention", job.Table)
+		}
+		return fmt.Sprintf("now() - interval '%d seconds'", int64(job.Retention/time.Second)), nil
+	}
+	var where string
+	switch job.Table {
+	case "refresh":
+		where = fmt.Sprintf("rotated_at <= now() - interval '%d seconds' OR absolute_expiry <= now()", int64(s.grace/time.Second))
+		if s.refreshTTL.sliding > 0 {
+			where += fmt.Sprintf(" OR last_used_at <= now() - interval '%d seconds'", int64(s.refreshTTL.sliding/time.Second))
+		}
+	case "authorize":
+		where = "expires_at < now()"
+	case "access":
+		where = "expires_at < now() AND NOT EXISTS (SELECT 1 FROM refresh WHERE refresh.access=access.access_token)"
+	case "par_request", "backchannel_request":
+		where = "created_at + expires_in * interval '1 second' < now()"
+	case "nonce", "jti_denylist":
+		where = "expires_at <= now()"
+	case "authorize_archive", "access_archive":
+		before, err := retention()
+		if err != nil {
+			return "", err
+		}
+		where = "archived_at < " + before
+	case "revocation":
+		before, err := retention()
+		if err != nil {
+			return "", err
+		}
+		where = "revoked_at < " + before
+	default:
+		return "", errors.Errorf("Table %s cannot be purged", job.Table)
+	}
+
+	query, args := s.deleteQuery(job.Table, where, "")
+	if len(args) > 0 {
+		// The time of archival passed by deleteQuery.
+		query = strings.Replace(query, "$1::timestamptz", "now()", 1)
+	}
+	if s.schema != "" {
+		query = "SET search_path TO " + pq.QuoteIdentifier(s.schema) + "; " + query
+	}
+	return query, nil
+}
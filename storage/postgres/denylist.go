@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// denylistPruneBatch is the maximum number of expired entries Deny removes from the denylist.
+const denylistPruneBatch = 100
+
+// Deny adds the jti of a self-contained JWT access token to the denylist until exp, the expiry of the token.
+// Afterwards the token is rejected anyway, so denying it again extends the entry to the latest expiry only. Deny
+// removes a batch of expired entries in the same transaction, which keeps the denylist as small as the number of
+// denied tokens which have not expired yet.
+func (s *Storage) Deny(jti string, exp time.Time) error {
+	return s.inTx("Deny", func(tx dbtx) error {
+		if _, err := tx.Exec(
+			"INSERT INTO jti_denylist (jti, expires_at) VALUES ($1, $2) ON CONFLICT "+s.conflictTarget("jti")+" DO UPDATE SET expires_at=GREATEST(jti_denylist.expires_at, EXCLUDED.expires_at)",
+			jti,
+			exp,
+		); err != nil {
+			return errors.New(err)
+		}
+		if _, err := tx.Exec(
+			"DELETE FROM jti_denylist WHERE jti IN (SELECT jti FROM jti_denylist WHERE expires_at <= $1 LIMIT $2)",
+			s.now(),
+			denylistPruneBatch,
+		); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+}
+
+// IsDenied returns true if jti is on the denylist and its entry has not expired yet. A jti which is not found on a
+// replica is looked up on the primary, so that a token is rejected right after Deny.
+func (s *Storage) IsDenied(jti string) (bool, error) {
+	var denied bool
+	err := s.read("IsDenied", func(conn dbtx) error {
+		var one int
+		err := conn.QueryRow("SELECT 1 FROM jti_denylist WHERE jti=$1 AND expires_at > $2", jti, s.now()).Scan(&one)
+		denied = err == nil
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, errors.New(err)
+	}
+	return denied, nil
+}
+
+// PurgeExpiredDenylist removes all expired entries from the denylist and returns the number of removed rows.
+func (s *Storage) PurgeExpiredDenylist() (int64, error) {
+	query, args := s.expiredDenylistPurge().query(s, 0)
+	return s.writeCount("PurgeExpiredDenylist", query, args...)
+}
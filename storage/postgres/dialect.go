@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Dialect is the flavour of the database server the storage talks to.
+type Dialect int
+
+// Dialects supported by the storage.
+const (
+	// DialectPostgres is PostgreSQL. It is the default.
+	DialectPostgres Dialect = iota
+
+	// DialectCockroachDB is CockroachDB. Schema statements run one by one instead of in a single transaction,
+	// and operations failing with a retryable error (SQLSTATE 40001) are retried by default. LISTEN/NOTIFY
+	// (WithNotify), table partitioning (CreatePartitionedSchemas), CopyAccess, which needs a temporary table, and
+	// Cleanup, which needs advisory locks, are not available.
+	DialectCockroachDB
+
+	// DialectYugabyteDB is the PostgreSQL compatible YSQL API of YugabyteDB. Like with DialectCockroachDB, schema
+	// statements run one by one and retryable errors are retried by default. LISTEN/NOTIFY (WithNotify) is not
+	// available. Primary keys are hash sharded, which is YugabyteDB's default for the first key column.
+	DialectYugabyteDB
+)
+
+// distributedRetryPolicy is the retry policy used with distributed dialects if WithRetry is not given. They run
+// transactions with optimistic concurrency control and expect clients to retry transactions which they aborted.
+var distributedRetryPolicy = RetryPolicy{MaxAttempts: 5, Backoff: 20 * time.Millisecond, MaxBackoff: time.Second}
+
+// unsupportedFeatures lists the features which are not available per dialect.
+var unsupportedFeatures = map[Dialect][]string{
+	DialectCockroachDB: {"WithNotify", "CreatePartitionedSchemas", "MaintainPartitions", "CopyAccess", "Cleanup", "EnableMultiTenancy", "ScheduleCronPurges", "WithUnloggedTables"},
+	DialectYugabyteDB:  {"WithNotify", "EnableMultiTenancy", "WithUnloggedTables"},
+}
+
+// String returns the name of the dialect.
+func (d Dialect) String() string {
+	switch d {
+	case DialectPostgres:
+		return "PostgreSQL"
+	case DialectCockroachDB:
+		return "CockroachDB"
+	case DialectYugabyteDB:
+		return "YugabyteDB"
+	}
+	return "unknown dialect"
+}
+
+// distributed returns true for distributed databases, which do not support transactional schema changes, the
+// xmax system column and restarting sequences.
+func (d Dialect) distributed() bool {
+	return d != DialectPostgres
+}
+
+// WithDialect adjusts the storage to the database server. Use it for servers which speak the PostgreSQL wire
+// protocol but differ in DDL or transaction semantics.
+func WithDialect(d Dialect) Option {
+	return func(s *Storage) {
+		s.dialect = d
+		if d.distributed() && s.retryPolicy.MaxAttempts == 0 {
+			s.retryPolicy = distributedRetryPolicy
+		}
+	}
+}
+
+// unsupported returns an error if feature is not available with the dialect of the storage.
+func (s *Storage) unsupported(feature string) error {
+	for _, f := range unsupportedFeatures[s.dialect] {
+		if f == feature {
+			return errors.Errorf("%s is not supported by %s", feature, s.dialect)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/lib/pq"
+)
+
+// EraseUser removes all data of the user in one transaction, to honour the right to be forgotten: the
+// authorize codes, access and refresh tokens whose UserData equals userRef, the access tokens of the user (see
+// ListAccessByUser), the token exchanges of the removed tokens, the consents, the sessions and the backchannel
+// authentication requests of the user. Codes and tokens are deleted even with WithArchive, and archived codes
+// and tokens of the user are deleted as well. It returns the number of removed rows per table.
+//
+// Clients and audit events are not removed, because they do not contain the user reference.
+func (s *Storage) EraseUser(ctx context.Context, userRef string) (map[string]int64, error) {
+	// Archiving would keep the erased tokens.
+	erasing := *s
+	erasing.archive = false
+
+	var revoked *revokedTokens
+	counts := map[string]int64{}
+	if err := s.inTxContext(ctx, "EraseUser", func(tx dbtx) (err error) {
+		if revoked, err = erasing.revokeUserTx(tx, userRef); err != nil {
+			return err
+		}
+		c := revoked.counts()
+		counts["refresh"], counts["access"], counts["authorize"] = c.Refresh, c.Access, c.Authorize
+
+		hashes := make([]string, len(revoked.access))
+		for i, token := range revoked.access {
+			hashes[i] = HashToken(token)
+		}
+		if counts["token_exchange"], err = execCount(tx, "DELETE FROM token_exchange WHERE access_token = ANY($1) OR subject_token_hash = ANY($2)", pq.Array(revoked.access), pq.Array(hashes)); err != nil {
+			return err
+		}
+		if counts["access_archive"], err = execCount(tx, "DELETE FROM access_archive WHERE extra=$1 OR user_ref=$1", userRef); err != nil {
+			return err
+		}
+		if counts["authorize_archive"], err = execCount(tx, "DELETE FROM authorize_archive WHERE extra=$1", userRef); err != nil {
+			return err
+		}
+		if counts["consent"], err = execCount(tx, "DELETE FROM consent WHERE user_ref=$1", userRef); err != nil {
+			return err
+		}
+		if counts["backchannel_request"], err = execCount(tx, "DELETE FROM backchannel_request WHERE extra=$1 OR login_hint=$1", userRef); err != nil {
+			return err
+		}
+		counts["session"], err = execCount(tx, "DELETE FROM session WHERE user_ref=$1", userRef)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	s.afterCommit(revoked.runHooks)
+	return counts, nil
+}
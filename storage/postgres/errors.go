@@ -0,0 +1,105 @@
+package postgres
+
+import "github.com/go-errors/errors"
+
+// The errors returned by Storage. Use errors.Is to check for them, as they are usually wrapped.
+var (
+	// ErrNotFound is returned if the requested row does not exist. ErrClientNotFound and ErrTokenNotFound
+	// match it as well.
+	ErrNotFound = errors.New("Not found")
+
+	// ErrClientNotFound is returned by GetClient and UpdateClient if the client does not exist, and by the
+	// token loading methods if the client of the token does not exist anymore.
+	ErrClientNotFound error = notFoundError("Client not found")
+
+	// ErrClientDeleted is returned by GetClient and the token loading methods if the client was soft-deleted with
+	// SoftDeleteClient. It matches ErrNotFound as well.
+	ErrClientDeleted error = notFoundError("Client deleted")
+
+	// ErrClientDisabled is returned by GetClient and the token loading methods if the client was disabled with
+	// DisableClient.
+	ErrClientDisabled = errors.New("Client disabled")
+
+	// ErrTokenNotFound is returned by LoadAuthorize, LoadAccess, LoadRefresh and Introspect if the code or token
+	// does not exist or was removed.
+	ErrTokenNotFound error = notFoundError("Token not found")
+
+	// ErrDuplicateKey is returned if a row with the same key already exists, e.g. by CreateClient for an existing
+	// client id or by SaveAccess for an existing token.
+	ErrDuplicateKey = errors.New("Duplicate key")
+
+	// ErrForeignKeyViolation is returned if a row references a row which does not exist or a row which is
+	// still referenced is removed.
+	ErrForeignKeyViolation = errors.New("Foreign key violation")
+
+	// ErrConflict is returned if an operation failed because of a concurrent transaction, i.e. a serialization
+	// failure or a deadlock, and was not retried or all retries failed. See WithRetry. UpdateClientIfVersion returns
+	// it if the client was updated concurrently.
+	ErrConflict = errors.New("Conflict with concurrent transaction")
+
+	// ErrReadOnly is returned by all operations which write to the database if the storage was created with
+	// WithReadOnly.
+	ErrReadOnly = errors.New("Storage is read-only")
+
+	// ErrLifetimeExceeded is returned if a code or token is saved with a lifetime exceeding the maximum of
+	// WithMaxLifetime and RejectLifetime.
+	ErrLifetimeExceeded = errors.New("Lifetime exceeds the maximum")
+
+	// ErrSigningKeyNotValid is returned by ActivateSigningKey if the key is not valid at the moment, i.e. before its
+	// NotBefore or after its NotAfter.
+	ErrSigningKeyNotValid = errors.New("Signing key not valid")
+
+	// ErrClosed is returned by all operations started after the storage was closed with Close or Shutdown.
+	ErrClosed = errors.New("Storage is closed")
+)
+
+// notFoundError is a specific not found error which matches ErrNotFound.
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// dbError is a database error classified as one of the errors above. It matches both kind and the original error.
+type dbError struct {
+	kind error
+	err  error
+}
+
+func (e *dbError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *dbError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// sqlStateKinds maps SQLSTATE codes to the errors above.
+var sqlStateKinds = map[string]error{
+	"23505": ErrDuplicateKey,
+	"23503": ErrForeignKeyViolation,
+	"40001": ErrConflict,
+	"40P01": ErrConflict,
+}
+
+// classify wraps database errors which map to one of the errors above.
+func classify(err error) error {
+	if kind, ok := sqlStateKinds[sqlState(err)]; ok {
+		return &dbError{kind: kind, err: err}
+	}
+	return err
+}
+
+// sqlState returns the SQLSTATE code of err or "" if err is not a database error. It works with every driver
+// whose errors implement SQLState, which includes lib/pq and pgx.
+func sqlState(err error) string {
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	return ""
+}
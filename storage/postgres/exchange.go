@@ -0,0 +1,110 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+	"github.com/optimisticninja/osin"
+)
+
+// TokenExchange records that an access token was issued by a token exchange (RFC 8693).
+type TokenExchange struct {
+	// SubjectTokenHash is the hash of the subject token, see HashToken. Subject tokens are never stored in plain
+	// text.
+	SubjectTokenHash string
+
+	// SubjectTokenType is the type of the subject token, e.g. urn:ietf:params:oauth:token-type:access_token.
+	SubjectTokenType string
+
+	// Actors is the delegation chain: the current actor first, followed by the actors of the nested act claims.
+	// It is empty for impersonation.
+	Actors []string
+
+	// CreatedAt is the time of the exchange. It is set by SaveExchangedAccess.
+	CreatedAt time.Time
+}
+
+// SaveExchangedAccess is SaveAccessWithMetadata for access data issued by the token exchange, which is recorded in
+// the same transaction. See RevokeDerivedTokens.
+func (s *Storage) SaveExchangedAccess(data *osin.AccessData, meta IssueMetadata, exchange *TokenExchange) error {
+	if exchange == nil || exchange.SubjectTokenHash == "" {
+		return errors.New("exchange.SubjectTokenHash must not be empty")
+	}
+	return s.saveAccess(data, meta, exchange)
+}
+
+func (s *Storage) saveExchange(tx dbtx, accessToken string, exchange *TokenExchange) error {
+	exchange.CreatedAt = s.now()
+	if _, err := tx.Exec(
+		"INSERT INTO token_exchange (access_token, token_hash, subject_token_hash, subject_token_type, actors, created_at) VALUES ($1, $2, $3, $4, $5, $6)"+s.onConflict(),
+		accessToken,
+		HashToken(accessToken),
+		exchange.SubjectTokenHash,
+		exchange.SubjectTokenType,
+		pq.Array(nonNil(exchange.Actors)),
+		exchange.CreatedAt,
+	); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// GetTokenExchange loads the token exchange the access token was issued by. Returns ErrNotFound if the token was
+// not issued by a token exchange. The exchange is kept after the token was removed.
+func (s *Storage) GetTokenExchange(accessToken string) (*TokenExchange, error) {
+	var e TokenExchange
+	if err := s.read("GetTokenExchange", func(conn dbtx) error {
+		return conn.QueryRow("SELECT subject_token_hash, subject_token_type, actors, created_at FROM token_exchange WHERE access_token=$1", accessToken).
+			Scan(&e.SubjectTokenHash, &e.SubjectTokenType, pq.Array(&e.Actors), &e.CreatedAt)
+	}); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	return &e, nil
+}
+
+// RevokeDerivedTokens removes all access tokens issued by token exchanges of subjectToken, the tokens exchanged
+// from those in turn, and their refresh tokens in one transaction. The subject token itself is not removed.
+func (s *Storage) RevokeDerivedTokens(subjectToken string) (*RevokeCounts, error) {
+	var revoked *revokedTokens
+	if err := s.inTx("RevokeDerivedTokens", func(tx dbtx) (err error) {
+		derived, err := queryStrings(tx, `WITH RECURSIVE derived AS (
+	SELECT access_token, token_hash FROM token_exchange WHERE subject_token_hash=$1
+	UNION
+	SELECT e.access_token, e.token_hash FROM token_exchange e JOIN derived d ON e.subject_token_hash=d.token_hash
+)
+SELECT access_token FROM derived`, HashToken(subjectToken))
+		if err != nil {
+			return err
+		}
+
+		revoked = &revokedTokens{hooks: s.hooks}
+		if revoked.refresh, err = queryStrings(tx, "DELETE FROM refresh WHERE access=ANY($1) RETURNING token", pq.Array(derived)); err != nil {
+			return err
+		}
+		query, args := s.deleteQuery("access", "access_token=ANY($1)", "access_token", pq.Array(derived))
+		if revoked.access, err = queryStrings(tx, query, args...); err != nil {
+			return err
+		}
+
+		for _, token := range revoked.refresh {
+			if err := s.recordRemoval(tx, AuditRefreshRevoked, "", HashToken(token)); err != nil {
+				return err
+			}
+		}
+		for _, token := range revoked.access {
+			if err := s.recordRemoval(tx, AuditAccessRevoked, "", HashToken(token)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	s.afterCommit(revoked.runHooks)
+	return revoked.counts(), nil
+}
@@ -0,0 +1,165 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// UserExport is the data ExportUserData writes for a user. Codes and tokens are exported as HashToken, never in
+// plain text.
+type UserExport struct {
+	UserRef        string                `json:"user_ref"`
+	ExportedAt     time.Time             `json:"exported_at"`
+	Authorizations []ExportedAuthorize   `json:"authorizations"`
+	AccessTokens   []ExportedAccess      `json:"access_tokens"`
+	Consents       []ExportedConsent     `json:"consents"`
+	Sessions       []ExportedUserSession `json:"sessions"`
+}
+
+// ExportedAuthorize is an authorize code in a UserExport.
+type ExportedAuthorize struct {
+	ClientID    string    `json:"client_id"`
+	CodeHash    string    `json:"code_hash"`
+	Scope       string    `json:"scope"`
+	RedirectURI string    `json:"redirect_uri"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// ExportedAccess is an access token and its refresh token in a UserExport.
+type ExportedAccess struct {
+	ClientID         string    `json:"client_id"`
+	TokenHash        string    `json:"token_hash"`
+	RefreshTokenHash string    `json:"refresh_token_hash,omitempty"`
+	Scope            string    `json:"scope"`
+	RedirectURI      string    `json:"redirect_uri"`
+	CreatedAt        time.Time `json:"created_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+// ExportedConsent is a consent in a UserExport.
+type ExportedConsent struct {
+	ClientID  string     `json:"client_id"`
+	Scope     string     `json:"scope"`
+	GrantedAt time.Time  `json:"granted_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ExportedUserSession is a session in a UserExport.
+type ExportedUserSession struct {
+	SIDHash  string    `json:"sid_hash"`
+	Clients  []string  `json:"clients"`
+	AuthTime time.Time `json:"auth_time"`
+	AMR      []string  `json:"amr"`
+	ACR      string    `json:"acr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ExportUserData writes all authorize codes, access and refresh tokens, consents and sessions of the user as a
+// UserExport in JSON to w, to answer a subject access request. Codes are associated with the user by their
+// UserData, which must equal userRef, and tokens by their UserData or user reference, see ListAccessByUser.
+func (s *Storage) ExportUserData(ctx context.Context, userRef string, w io.Writer) error {
+	var export *UserExport
+	if err := s.readContext(ctx, "ExportUserData", func(conn dbtx) error {
+		export = &UserExport{
+			UserRef:        userRef,
+			ExportedAt:     s.now(),
+			Authorizations: []ExportedAuthorize{},
+			AccessTokens:   []ExportedAccess{},
+			Consents:       []ExportedConsent{},
+			Sessions:       []ExportedUserSession{},
+		}
+
+		if err := queryRows(conn, func(row scanner) error {
+			var a ExportedAuthorize
+			var code string
+			var expiresIn int32
+			if err := row.Scan(&a.ClientID, &code, &a.Scope, &a.RedirectURI, &a.CreatedAt, &expiresIn); err != nil {
+				return err
+			}
+			a.CodeHash = HashToken(code)
+			a.ExpiresAt = a.CreatedAt.Add(time.Duration(expiresIn) * time.Second)
+			export.Authorizations = append(export.Authorizations, a)
+			return nil
+		}, "SELECT client, code, COALESCE(scope, ''), COALESCE(redirect_uri, ''), created_at, expires_in FROM authorize WHERE extra=$1 ORDER BY created_at", userRef); err != nil {
+			return err
+		}
+
+		if err := queryRows(conn, func(row scanner) error {
+			var a ExportedAccess
+			var token, refresh string
+			var expiresIn int32
+			if err := row.Scan(&a.ClientID, &token, &refresh, &a.Scope, &a.RedirectURI, &a.CreatedAt, &expiresIn); err != nil {
+				return err
+			}
+			a.TokenHash = HashToken(token)
+			if refresh != "" {
+				a.RefreshTokenHash = HashToken(refresh)
+			}
+			a.ExpiresAt = a.CreatedAt.Add(time.Duration(expiresIn) * time.Second)
+			export.AccessTokens = append(export.AccessTokens, a)
+			return nil
+		}, "SELECT client, access_token, COALESCE(refresh_token, ''), COALESCE(scope, ''), COALESCE(redirect_uri, ''), created_at, expires_in FROM access WHERE extra=$1 OR user_ref=$1 ORDER BY created_at", userRef); err != nil {
+			return err
+		}
+
+		if err := queryRows(conn, func(row scanner) error {
+			var c ExportedConsent
+			if err := row.Scan(&c.ClientID, &c.Scope, &c.GrantedAt, &c.ExpiresAt); err != nil {
+				return err
+			}
+			export.Consents = append(export.Consents, c)
+			return nil
+		}, "SELECT client, scope, granted_at, expires_at FROM consent WHERE user_ref=$1 ORDER BY granted_at", userRef); err != nil {
+			return err
+		}
+
+		return queryRows(conn, func(row scanner) error {
+			session, err := scanSession(row)
+			if err != nil {
+				return err
+			}
+			export.Sessions = append(export.Sessions, ExportedUserSession{
+				SIDHash:  HashToken(session.SID),
+				Clients:  session.Clients,
+				AuthTime: session.AuthTime,
+				AMR:      session.AMR,
+				ACR:      session.ACR,
+				LastSeen: session.LastSeen,
+			})
+			return nil
+		}, "SELECT "+sessionColumns+" FROM session WHERE user_ref=$1 ORDER BY auth_time", userRef)
+	}); err != nil {
+		return errors.New(err)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// queryRows runs query and calls fn for every row.
+func queryRows(conn dbtx, fn func(row scanner) error, query string, args ...interface{}) error {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return errors.New(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return errors.New(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
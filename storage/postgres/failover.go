@@ -0,0 +1,221 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// DefaultProbeInterval is the interval in which the nodes of NewFromDSNs are probed.
+const DefaultProbeInterval = 5 * time.Second
+
+// WithProbeInterval sets the interval in which the nodes of NewFromDSNs are probed. It has no effect with New and
+// NewFromDSN.
+func WithProbeInterval(interval time.Duration) Option {
+	return func(s *Storage) {
+		s.probeInterval = interval
+	}
+}
+
+// NewFromDSNs is NewFromDSN for a primary and its standbys without a proxy in front of them. dsns lists the nodes
+// in order of preference. New connections are opened to the current node as long as it is a reachable primary.
+// Otherwise they fail over to the first reachable primary in dsns, e.g. a promoted standby, and connections to the
+// previous node are closed when they are returned to the pool. If no primary is reachable, connections are opened
+// to a standby, so reads keep working while writes fail. The nodes are probed in the background in the interval
+// of WithProbeInterval, so the storage fails over before operations fail, until the storage is closed.
+//
+// Operations running while the primary becomes unreachable fail, unless they are retried, see WithRetry.
+func NewFromDSNs(dsns []string, opts ...Option) (*Storage, error) {
+	if len(dsns) == 0 {
+		return nil, errors.New("no DSN given")
+	}
+	f := &failover{done: make(chan struct{})}
+	for _, dsn := range dsns {
+		connector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, errors.New(err)
+		}
+		f.nodes = append(f.nodes, connector)
+	}
+
+	s, err := open(sql.OpenDB(f), opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.failover = f
+	interval := s.probeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	go f.probe(interval)
+	return s, nil
+}
+
+// failover is a driver.Connector which connects to the current node and fails over to the next primary.
+type failover struct {
+	nodes []driver.Connector
+
+	// current is the index of the node connections are opened to. It is accessed atomically.
+	current int32
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Connect opens a connection to the current node or to the node elected if the current one is not a reachable
+// primary.
+func (f *failover) Connect(ctx context.Context) (driver.Conn, error) {
+	node, conn, err := f.elect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &failoverConn{conn, f, node}, nil
+}
+
+func (f *failover) Driver() driver.Driver {
+	return f.nodes[0].Driver()
+}
+
+// elect returns a connection to the current node, if it is a reachable primary, or to the first reachable primary
+// of the other nodes, which becomes the current node. If no primary is reachable, it returns a connection to a
+// standby without changing the current node.
+func (f *failover) elect(ctx context.Context) (int, driver.Conn, error) {
+	current := int(atomic.LoadInt32(&f.current))
+	order := make([]int, 1, len(f.nodes))
+	order[0] = current
+	for i := range f.nodes {
+		if i != current {
+			order = append(order, i)
+		}
+	}
+
+	standby, standbyConn := -1, driver.Conn(nil)
+	var lastErr error
+	for _, i := range order {
+		conn, primary, err := f.dial(ctx, i)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !primary {
+			if standbyConn == nil {
+				standby, standbyConn = i, conn
+			} else {
+				conn.Close()
+			}
+			continue
+		}
+		if standbyConn != nil {
+			standbyConn.Close()
+		}
+		if i != current && atomic.CompareAndSwapInt32(&f.current, int32(current), int32(i)) {
+			log.Printf("Failing over from node %d to node %d", current, i)
+		}
+		return i, conn, nil
+	}
+	if standbyConn != nil {
+		return standby, standbyConn, nil
+	}
+	return -1, nil, lastErr
+}
+
+// dial connects to node i and returns whether it is a primary.
+func (f *failover) dial(ctx context.Context, i int) (driver.Conn, bool, error) {
+	conn, err := f.nodes[i].Connect(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	rows, err := conn.(driver.QueryerContext).QueryContext(ctx, "SELECT pg_is_in_recovery()", nil)
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	defer rows.Close()
+	values := make([]driver.Value, 1)
+	if err := rows.Next(values); err != nil && err != io.EOF {
+		conn.Close()
+		return nil, false, err
+	}
+	recovery, _ := values[0].(bool)
+	return conn, !recovery, nil
+}
+
+// probe elects the current node every interval until stop is called.
+func (f *failover) probe(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if _, conn, err := f.elect(ctx); err != nil {
+			log.Printf("No database node is reachable: %s", err)
+		} else {
+			conn.Close()
+		}
+		cancel()
+	}
+}
+
+func (f *failover) stop() {
+	f.stopOnce.Do(func() { close(f.done) })
+}
+
+// failoverConn is a connection to the node with the index node. It is discarded by the pool once the storage
+// failed over to another node.
+type failoverConn struct {
+	driver.Conn
+	f    *failover
+	node int
+}
+
+func (c *failoverConn) IsValid() bool {
+	if int(atomic.LoadInt32(&c.f.current)) != c.node {
+		return false
+	}
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *failoverConn) ResetSession(ctx context.Context) error {
+	if !c.IsValid() {
+		return driver.ErrBadConn
+	}
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *failoverConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *failoverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *failoverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *failoverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *failoverConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"github.com/optimisticninja/osin"
+)
+
+// Hooks are callbacks invoked after changes were committed successfully, e.g. to invalidate caches or to send
+// notifications. Hooks run synchronously in the goroutine of the storage call, so they should return quickly.
+// Nil hooks are skipped.
+type Hooks struct {
+	// OnClientChanged is called after a client was created, updated or removed.
+	OnClientChanged func(id string)
+
+	// OnClientCreated is called after a client was created, in addition to OnClientChanged.
+	OnClientCreated func(client osin.Client)
+
+	// OnAuthorizeSaved is called after authorize data was saved.
+	OnAuthorizeSaved func(data *osin.AuthorizeData)
+
+	// OnAuthorizeRemoved is called after an authorize code was removed.
+	OnAuthorizeRemoved func(code string)
+
+	// OnAccessSaved is called after access data (and its refresh token, if any) was saved.
+	OnAccessSaved func(data *osin.AccessData)
+
+	// OnAccessRemoved is called after an access token was removed.
+	OnAccessRemoved func(token string)
+
+	// OnRefreshRemoved is called after a refresh token was removed.
+	OnRefreshRemoved func(token string)
+}
+
+// WithHooks registers hooks which are invoked after successful commits. The option may be passed multiple
+// times, the hooks are then invoked in the order they were registered.
+func WithHooks(hooks Hooks) Option {
+	return func(s *Storage) {
+		s.hooks = append(s.hooks, hooks)
+	}
+}
+
+// hookList are the hooks registered with WithHooks.
+type hookList []Hooks
+
+// afterCommit runs fn immediately, or once the transaction the storage is bound to is committed. If the
+// transaction is not committed by this package (e.g. in SelfTest), fn is discarded.
+func (s *Storage) afterCommit(fn func()) {
+	if s.tx == nil {
+		fn()
+	} else if s.pending != nil {
+		*s.pending = append(*s.pending, fn)
+	}
+}
+
+func (l hookList) clientChanged(id string) {
+	for _, h := range l {
+		if h.OnClientChanged != nil {
+			h.OnClientChanged(id)
+		}
+	}
+}
+
+func (l hookList) clientCreated(client osin.Client) {
+	for _, h := range l {
+		if h.OnClientCreated != nil {
+			h.OnClientCreated(client)
+		}
+	}
+}
+
+func (l hookList) authorizeSaved(data *osin.AuthorizeData) {
+	for _, h := range l {
+		if h.OnAuthorizeSaved != nil {
+			h.OnAuthorizeSaved(data)
+		}
+	}
+}
+
+func (l hookList) authorizeRemoved(code string) {
+	for _, h := range l {
+		if h.OnAuthorizeRemoved != nil {
+			h.OnAuthorizeRemoved(code)
+		}
+	}
+}
+
+func (l hookList) accessSaved(data *osin.AccessData) {
+	for _, h := range l {
+		if h.OnAccessSaved != nil {
+			h.OnAccessSaved(data)
+		}
+	}
+}
+
+func (l hookList) accessRemoved(token string) {
+	for _, h := range l {
+		if h.OnAccessRemoved != nil {
+			h.OnAccessRemoved(token)
+		}
+	}
+}
+
+func (l hookList) refreshRemoved(token string) {
+	for _, h := range l {
+		if h.OnRefreshRemoved != nil {
+			h.OnRefreshRemoved(token)
+		}
+	}
+}
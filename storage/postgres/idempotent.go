@@ -0,0 +1,66 @@
+package postgres
+
+import "github.com/go-errors/errors"
+
+// errAlreadySaved is returned within the transaction of an idempotent save if the code or token exists already.
+// It rolls back the transaction, or the savepoint of idempotentSave within a transaction of WithTx, and is never
+// returned to the caller.
+var errAlreadySaved = errors.New("Already saved")
+
+// WithIdempotentSaves makes saving an authorization code with SaveAuthorize or an access token with SaveAccess,
+// which exists already, a no-op instead of an ErrDuplicateKey error, e.g. for retries of requests whose response
+// was lost. The existing code or token is kept as is, and neither an audit event is recorded nor are hooks run. On
+// partitioned tables codes and tokens are only unique within their partition, see CreatePartitionedSchemas.
+func WithIdempotentSaves() Option {
+	return func(s *Storage) {
+		s.idempotent = true
+	}
+}
+
+// onConflict returns the conflict clause appended to the inserts of codes and tokens.
+func (s *Storage) onConflict() string {
+	if s.idempotent {
+		return " ON CONFLICT DO NOTHING"
+	}
+	return ""
+}
+
+// idempotentSave runs fn, which saves a code or token, on conn. Within a transaction of WithTx, fn runs within a
+// savepoint if saves are idempotent, which is rolled back if fn returns errAlreadySaved. Thus the statements of
+// fn before the insert, e.g. the rotation of the previous token, are undone as if the transaction of the save was
+// rolled back.
+func (s *Storage) idempotentSave(conn dbtx, fn func(conn dbtx) error) error {
+	if !s.idempotent || s.tx == nil {
+		return fn(conn)
+	}
+
+	savepoint := conn.(ctxConn).unprepared()
+	if _, err := savepoint.Exec("SAVEPOINT idempotent_save"); err != nil {
+		return errors.New(err)
+	}
+	if err := fn(conn); err == errAlreadySaved {
+		if _, err := savepoint.Exec("ROLLBACK TO SAVEPOINT idempotent_save"); err != nil {
+			return errors.New(err)
+		}
+		return errAlreadySaved
+	} else if err != nil {
+		return err
+	}
+	if _, err := savepoint.Exec("RELEASE SAVEPOINT idempotent_save"); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// insertToken runs the insert of a code or token and returns errAlreadySaved if nothing was inserted because of
+// WithIdempotentSaves.
+func (s *Storage) insertToken(conn dbtx, query string, args ...interface{}) error {
+	n, err := execCount(conn, query+s.onConflict(), args...)
+	if err != nil {
+		return errors.New(err)
+	}
+	if n == 0 {
+		return errAlreadySaved
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package postgres
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"gopkg.in/yaml.v3"
+)
+
+// ImportFormat is the encoding of the input of ImportClients.
+type ImportFormat int
+
+// Formats supported by ImportClients.
+const (
+	ImportJSON ImportFormat = iota
+	ImportYAML
+)
+
+// ImportedClient is a client in the input of ImportClients. The input is a list of clients, e.g. in YAML:
+//
+//   - id: billing-service
+//     secret: s3cr3t
+//     redirect_uri: https://billing.example.com/callback
+//     user_data: '{"team": "billing"}'
+//     trusted: true
+//     client_name: Billing
+type ImportedClient struct {
+	ID     string `json:"id" yaml:"id"`
+	Secret string `json:"secret" yaml:"secret"`
+
+	// RedirectURI may contain several redirect URIs separated by the RedirectUriSeparator configured for osin.
+	RedirectURI string `json:"redirect_uri" yaml:"redirect_uri"`
+
+	// UserData is stored as the UserData of the client.
+	UserData string `json:"user_data" yaml:"user_data"`
+
+	// Trusted marks the client as trusted first-party client, see Client.
+	Trusted bool `json:"trusted" yaml:"trusted"`
+
+	// ClientMetadata is the branding of the client.
+	ClientMetadata `yaml:",inline"`
+}
+
+// ImportCounts reports how many clients were created and updated by ImportClients.
+type ImportCounts struct {
+	Created int64
+	Updated int64
+}
+
+// DecodeClients reads a list of clients in format from r and checks that every client has an id.
+func DecodeClients(r io.Reader, format ImportFormat) ([]ImportedClient, error) {
+	var clients []ImportedClient
+	switch format {
+	case ImportJSON:
+		if err := json.NewDecoder(r).Decode(&clients); err != nil {
+			return nil, errors.New(err)
+		}
+	case ImportYAML:
+		if err := yaml.NewDecoder(r).Decode(&clients); err != nil && err != io.EOF {
+			return nil, errors.New(err)
+		}
+	default:
+		return nil, errors.Errorf("Unknown import format %d", format)
+	}
+
+	for i, c := range clients {
+		if c.ID == "" {
+			return nil, errors.Errorf("Client %d has no id", i)
+		}
+	}
+	return clients, nil
+}
+
+// ImportClients reads a list of clients from r and creates or updates them in one transaction. Either all
+// clients are imported or none. Existing clients which are not part of the input are left untouched.
+func (s *Storage) ImportClients(r io.Reader, format ImportFormat) (*ImportCounts, error) {
+	clients, err := DecodeClients(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	created := make([]bool, len(clients))
+	err = s.inTx("ImportClients", func(tx dbtx) error {
+		for i, c := range clients {
+			if err := s.importClientTx(tx, c, &created[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := &ImportCounts{}
+	for _, ok := range created {
+		if ok {
+			counts.Created++
+		} else {
+			counts.Updated++
+		}
+	}
+
+	s.afterCommit(func() {
+		for i, c := range clients {
+			s.clientImported(c, created[i])
+		}
+	})
+	return counts, nil
+}
+
+// UpsertClient creates the client or replaces the client with the same id, so that provisioning can be re-run
+// without failing with ErrDuplicateKey. Like ImportClients, it replaces the trust and metadata of an existing
+// client as well: clients which do not implement TrustedClient or MetadataClient are stored as untrusted and
+// without metadata. Returns true if the client was created.
+func (s *Storage) UpsertClient(c osin.Client) (bool, error) {
+	data, err := assertToString(c.GetUserData())
+	if err != nil {
+		return false, err
+	}
+	imported := ImportedClient{ID: c.GetId(), Secret: c.GetSecret(), RedirectURI: c.GetRedirectUri(), UserData: data, Trusted: IsTrustedClient(c)}
+	if m, ok := c.(MetadataClient); ok {
+		imported.ClientMetadata = m.GetMetadata()
+	}
+
+	var created bool
+	if err := s.inTx("UpsertClient", func(tx dbtx) error {
+		return s.importClientTx(tx, imported, &created)
+	}); err != nil {
+		return false, err
+	}
+
+	s.afterCommit(func() { s.clientImported(imported, created) })
+	return created, nil
+}
+
+// importClientTx creates or updates c within tx and records the change.
+func (s *Storage) importClientTx(tx dbtx, c ImportedClient, created *bool) error {
+	if err := s.upsertClient(tx, c, created); err != nil {
+		return err
+	}
+
+	typ := AuditClientUpdated
+	if *created {
+		typ = AuditClientCreated
+	}
+	if err := s.recordAudit(tx, typ, c.ID, c.ID); err != nil {
+		return err
+	}
+	return s.notify(tx, typ, c.ID, c.ID)
+}
+
+// clientImported evicts the imported client c from the cache and runs the hooks. It must run after the
+// transaction was committed.
+func (s *Storage) clientImported(c ImportedClient, created bool) {
+	s.evictClient(c.ID)
+	s.hooks.clientChanged(c.ID)
+	if created {
+		s.hooks.clientCreated(&Client{DefaultClient: osin.DefaultClient{Id: c.ID, Secret: c.Secret, RedirectUri: c.RedirectURI, UserData: c.UserData}, Trusted: c.Trusted, Metadata: c.ClientMetadata})
+	}
+}
+
+// upsertClient creates or updates c, sets created to true if the client did not exist before and records the
+// rotation of the secret of an existing client.
+func (s *Storage) upsertClient(tx dbtx, c ImportedClient, created *bool) error {
+	// The previous secret is read from the locked row, so concurrent rotations are recorded one after another.
+	previous, err := queryStrings(tx, "SELECT secret FROM client WHERE id=$1 FOR UPDATE", c.ID)
+	if err != nil {
+		return err
+	}
+
+	upsert := "INSERT INTO client (id, secret, redirect_uri, extra, is_trusted, display_name, logo_uri, policy_uri, tos_uri) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) " +
+		"ON CONFLICT " + s.conflictTarget("id") + " DO UPDATE SET secret=EXCLUDED.secret, redirect_uri=EXCLUDED.redirect_uri, extra=EXCLUDED.extra, is_trusted=EXCLUDED.is_trusted, version=client.version+1, " +
+		"display_name=EXCLUDED.display_name, logo_uri=EXCLUDED.logo_uri, policy_uri=EXCLUDED.policy_uri, tos_uri=EXCLUDED.tos_uri"
+	if s.dialect.distributed() {
+		// CockroachDB and YugabyteDB have no usable xmax system column.
+		if _, err := tx.Exec(upsert, c.ID, c.Secret, c.RedirectURI, c.UserData, c.Trusted, c.DisplayName, c.LogoURI, c.PolicyURI, c.TOSURI); err != nil {
+			return errors.New(err)
+		}
+		*created = len(previous) == 0
+	} else if err := tx.QueryRow(upsert+" RETURNING xmax = 0", c.ID, c.Secret, c.RedirectURI, c.UserData, c.Trusted, c.DisplayName, c.LogoURI, c.PolicyURI, c.TOSURI).Scan(created); err != nil {
+		return errors.New(err)
+	}
+
+	if len(previous) == 0 || previous[0] == c.Secret {
+		return nil
+	}
+	return s.recordSecretRotation(tx, c.ID, previous[0])
+}
@@ -0,0 +1,89 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// Token type hints as defined in RFC 7009 and used by RFC 7662.
+const (
+	TokenTypeAccess  = "access_token"
+	TokenTypeRefresh = "refresh_token"
+)
+
+// Introspection is the result of Introspect and contains the information required for a RFC 7662 response.
+type Introspection struct {
+	// Active is false if the token expired or its client is disabled or soft-deleted.
+	Active bool
+
+	// TokenType is either TokenTypeAccess or TokenTypeRefresh.
+	TokenType string
+
+	// ClientID is the id of the client the token was issued to.
+	ClientID string
+
+	// Scope is the scope of the token.
+	Scope string
+
+	// IssuedAt is the date the token was issued.
+	IssuedAt time.Time
+
+	// ExpiresAt is the expiration date of the token. For refresh tokens it is the earlier of their absolute and
+	// sliding expiry, see WithRefreshExpiry, and the zero time if they do not expire.
+	ExpiresAt time.Time
+
+	// DPoPThumbprint is the JWK thumbprint of the DPoP key the token is bound to, if any. It is returned as the
+	// jkt member of the cnf claim of RFC 7662 responses.
+	DPoPThumbprint string
+
+	// CertificateThumbprint is the thumbprint of the client certificate the token is bound to, if any. It is
+	// returned as the x5t#S256 member of the cnf claim of RFC 7662 responses.
+	CertificateThumbprint string
+
+	// Audience are the resources the token is restricted to, if any. Resource servers must reject tokens which
+	// do not contain them.
+	Audience []string
+
+	// AuthorizationDetails are the authorization details of the token, if any.
+	AuthorizationDetails json.RawMessage
+}
+
+// Introspect resolves an access or refresh token with a single query. Unlike LoadAccess, neither the client nor
+// the authorize data or previous access data are loaded. Tokens of disabled or soft-deleted clients and refresh
+// tokens expired by WithRefreshExpiry are inactive.
+// Returns ErrTokenNotFound if the token is unknown or revoked.
+// Introspections of access tokens are counted if usage tracking is enabled, see WithUsageTracking.
+func (s *Storage) Introspect(token string) (*Introspection, error) {
+	var i Introspection
+	var expiresIn int32
+	var details []byte
+	var suspended, refreshExpired bool
+	var lastUsedAt, absoluteExpiry sql.NullTime
+	if err := s.read("Introspect", func(conn dbtx) error {
+		return conn.QueryRow(`SELECT 'access_token', client, COALESCE(scope, ''), created_at, expires_in, COALESCE(dpop_jkt, ''), COALESCE(x5t_s256, ''), resources, authorization_details, EXISTS (SELECT 1 FROM client c WHERE c.id=access.client AND (NOT c.enabled OR c.deleted_at IS NOT NULL)), false, NULL::timestamptz, NULL::timestamptz FROM access WHERE access_token=$1
+UNION ALL
+SELECT 'refresh_token', a.client, COALESCE(a.scope, ''), a.created_at, a.expires_in, COALESCE(a.dpop_jkt, ''), COALESCE(a.x5t_s256, ''), a.resources, a.authorization_details, EXISTS (SELECT 1 FROM client c WHERE c.id=a.client AND (NOT c.enabled OR c.deleted_at IS NOT NULL)), NOT (`+refreshUnexpired("$3", "$4")+`), r.last_used_at, r.absolute_expiry FROM refresh r JOIN access a ON a.access_token=r.access WHERE r.token=$1 AND (r.rotated_at IS NULL OR r.rotated_at > $2)
+LIMIT 1`, token, s.graceStart(), s.now(), s.slidingStart()).Scan(&i.TokenType, &i.ClientID, &i.Scope, &i.IssuedAt, &expiresIn, &i.DPoPThumbprint, &i.CertificateThumbprint, pq.Array(&i.Audience), &details, &suspended, &refreshExpired, &lastUsedAt, &absoluteExpiry)
+	}); err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+
+	if details != nil {
+		i.AuthorizationDetails = details
+	}
+	i.Active = !suspended && !refreshExpired
+	if i.TokenType == TokenTypeAccess {
+		i.ExpiresAt = i.IssuedAt.Add(time.Duration(expiresIn) * time.Second)
+		i.Active = i.Active && i.ExpiresAt.After(s.now())
+		s.countUsage(token, i.ClientID)
+	} else {
+		i.ExpiresAt = s.refreshExpiresAt(lastUsedAt, absoluteExpiry)
+	}
+	return &i, nil
+}
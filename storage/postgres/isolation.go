@@ -0,0 +1,36 @@
+package postgres
+
+import "database/sql"
+
+// WithIsolation runs the transactions of the storage, including those of WithTx, at level instead of the default
+// isolation level of the database, e.g. sql.LevelRepeatableRead or sql.LevelSerializable. Transactions failing
+// with a serialization failure are retried according to WithRetry.
+func WithIsolation(level sql.IsolationLevel) Option {
+	return func(s *Storage) {
+		s.isolation = level
+	}
+}
+
+// WithOperationIsolation runs the transactions of the operation op, which is the name of a method of Storage,
+// e.g. "SaveAccess", at level. It takes precedence over WithIsolation, so only the rotation sensitive operations
+// can run at a stricter level. Operations which do not run in a transaction are not affected.
+func WithOperationIsolation(op string, level sql.IsolationLevel) Option {
+	return func(s *Storage) {
+		if s.isolations == nil {
+			s.isolations = map[string]sql.IsolationLevel{}
+		}
+		s.isolations[op] = level
+	}
+}
+
+// txOptions returns the options of the transactions of the operation op.
+func (s *Storage) txOptions(op string) *sql.TxOptions {
+	level, ok := s.isolations[op]
+	if !ok {
+		level = s.isolation
+	}
+	if level == sql.LevelDefault {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: level}
+}
@@ -0,0 +1,151 @@
+package postgres
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// IssueMetadata describes where a code or token was issued. It is recorded by SaveAuthorizeWithMetadata and
+// SaveAccessWithMetadata in the issued_ip and user_agent columns for security reviews.
+type IssueMetadata struct {
+	// IP is the IP address of the client which requested the code or token.
+	IP string
+
+	// UserAgent is the user agent of the client which requested the code or token.
+	UserAgent string
+
+	// DPoPThumbprint is the JWK SHA-256 thumbprint (jkt) of the DPoP key the access token and its refresh token are
+	// bound to (RFC 9449). It is returned by LoadDPoPThumbprint and Introspect. It is ignored for authorize codes.
+	DPoPThumbprint string
+
+	// CertificateThumbprint is the base64url encoded SHA-256 thumbprint (x5t#S256) of the client certificate the
+	// access token is bound to (RFC 8705). It is returned by LoadCertificateThumbprint and Introspect. It is ignored
+	// for authorize codes.
+	CertificateThumbprint string
+
+	// Resources are the resource indicators (RFC 8707) the code or token is restricted to. Access tokens issued for
+	// an authorize code without resources inherit the resources of the code. They are returned by LoadResources,
+	// LoadAuthorizeResources and Introspect.
+	Resources []string
+
+	// AuthorizationDetails is the authorization_details JSON array of a rich authorization request (RFC 9396).
+	// Access tokens issued for an authorize code without authorization details inherit the authorization details
+	// of the code. They are returned by LoadAuthorizationDetails, LoadAuthorizeAuthorizationDetails and Introspect.
+	AuthorizationDetails json.RawMessage
+
+	// UserRef identifies the user the access token was issued to, for ListAccessByUser. If empty, it is extracted
+	// from the UserData of the token with the function configured with WithUserRef. It is ignored for authorize
+	// codes.
+	UserRef string
+}
+
+// IssueMetadataFromRequest returns the remote address and the user agent of r and, for mutual TLS connections, the
+// thumbprint of the client certificate. Proxy headers like X-Forwarded-For are not evaluated, set IP yourself when
+// running behind a trusted proxy.
+func IssueMetadataFromRequest(r *http.Request) IssueMetadata {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	meta := IssueMetadata{IP: ip, UserAgent: r.UserAgent()}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		meta.CertificateThumbprint = CertificateThumbprint(r.TLS.PeerCertificates[0])
+	}
+	return meta
+}
+
+// LoadDPoPThumbprint returns the JWK thumbprint of the DPoP key the access token is bound to, or an empty string
+// if it is not bound. Resource servers must reject DPoP proofs of other keys. Returns ErrTokenNotFound if the token
+// does not exist.
+func (s *Storage) LoadDPoPThumbprint(accessToken string) (string, error) {
+	var jkt string
+	if err := s.read("LoadDPoPThumbprint", func(conn dbtx) error {
+		return conn.QueryRow("SELECT COALESCE(dpop_jkt, '') FROM access WHERE access_token=$1", accessToken).Scan(&jkt)
+	}); err == sql.ErrNoRows {
+		return "", ErrTokenNotFound
+	} else if err != nil {
+		return "", errors.New(err)
+	}
+	return jkt, nil
+}
+
+// LoadCertificateThumbprint returns the thumbprint of the client certificate the access token is bound to, or an
+// empty string if it is not bound. Resource servers must reject requests over connections with other client
+// certificates. Returns ErrTokenNotFound if the token does not exist.
+func (s *Storage) LoadCertificateThumbprint(accessToken string) (string, error) {
+	var x5t string
+	if err := s.read("LoadCertificateThumbprint", func(conn dbtx) error {
+		return conn.QueryRow("SELECT COALESCE(x5t_s256, '') FROM access WHERE access_token=$1", accessToken).Scan(&x5t)
+	}); err == sql.ErrNoRows {
+		return "", ErrTokenNotFound
+	} else if err != nil {
+		return "", errors.New(err)
+	}
+	return x5t, nil
+}
+
+// CertificateThumbprint returns the x5t#S256 thumbprint of cert as defined by RFC 8705, e.g. of
+// r.TLS.PeerCertificates[0].
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// LoadResources returns the resources the access token is restricted to. Returns ErrTokenNotFound if the token does
+// not exist.
+func (s *Storage) LoadResources(accessToken string) ([]string, error) {
+	return s.loadResources("LoadResources", "SELECT resources FROM access WHERE access_token=$1", accessToken)
+}
+
+// LoadAuthorizeResources returns the resources requested with the authorize code, to check the resources of the
+// token request against them. Returns ErrTokenNotFound if the code does not exist.
+func (s *Storage) LoadAuthorizeResources(code string) ([]string, error) {
+	return s.loadResources("LoadAuthorizeResources", "SELECT resources FROM authorize WHERE code=$1", code)
+}
+
+func (s *Storage) loadResources(op, query, key string) ([]string, error) {
+	var resources []string
+	if err := s.read(op, func(conn dbtx) error {
+		return conn.QueryRow(query, key).Scan(pq.Array(&resources))
+	}); err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	return resources, nil
+}
+
+// LoadAuthorizationDetails returns the authorization details of the access token, or nil if it has none. Returns
+// ErrTokenNotFound if the token does not exist.
+func (s *Storage) LoadAuthorizationDetails(accessToken string) (json.RawMessage, error) {
+	return s.loadAuthorizationDetails("LoadAuthorizationDetails", "SELECT authorization_details FROM access WHERE access_token=$1", accessToken)
+}
+
+// LoadAuthorizeAuthorizationDetails returns the authorization details requested with the authorize code, or nil if
+// it has none. Returns ErrTokenNotFound if the code does not exist.
+func (s *Storage) LoadAuthorizeAuthorizationDetails(code string) (json.RawMessage, error) {
+	return s.loadAuthorizationDetails("LoadAuthorizeAuthorizationDetails", "SELECT authorization_details FROM authorize WHERE code=$1", code)
+}
+
+func (s *Storage) loadAuthorizationDetails(op, query, key string) (json.RawMessage, error) {
+	var details []byte
+	if err := s.read(op, func(conn dbtx) error {
+		return conn.QueryRow(query, key).Scan(&details)
+	}); err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	if details == nil {
+		return nil, nil
+	}
+	return details, nil
+}
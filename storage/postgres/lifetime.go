@@ -0,0 +1,65 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// LifetimePolicy decides how WithMaxLifetime treats codes and tokens saved with a longer lifetime.
+type LifetimePolicy int
+
+const (
+	// ClampLifetime reduces the lifetime to the maximum. As osin returns the expires_in of the saved access
+	// data, clients learn the reduced lifetime.
+	ClampLifetime LifetimePolicy = iota
+
+	// RejectLifetime fails saving with ErrLifetimeExceeded.
+	RejectLifetime
+)
+
+// WithMaxLifetime caps the lifetime of authorize codes and access tokens at max, independent of the configuration
+// of osin. SaveAuthorize, SaveAccess, SaveAccessBatch and CopyAccess clamp or reject longer lifetimes according to
+// policy. LoadAuthorize and LoadAccess return an error for codes and tokens created more than max ago and reduce
+// the ExpiresIn of the loaded data to max, e.g. for rows saved before the cap was configured. Refresh tokens are not
+// affected, see WithRefreshExpiry.
+func WithMaxLifetime(max time.Duration, policy LifetimePolicy) Option {
+	return func(s *Storage) {
+		s.maxLifetime = max
+		s.lifetime = policy
+	}
+}
+
+// maxExpiresIn returns the maximum lifetime in seconds, or zero if it is not capped.
+func (s *Storage) maxExpiresIn() int32 {
+	return int32(s.maxLifetime / time.Second)
+}
+
+// limitLifetime applies the lifetime policy to the lifetime of a code or token to be saved.
+func (s *Storage) limitLifetime(expiresIn *int32) error {
+	max := s.maxExpiresIn()
+	if max <= 0 || *expiresIn <= max {
+		return nil
+	}
+	if s.lifetime == RejectLifetime {
+		return errors.New(ErrLifetimeExceeded)
+	}
+	*expiresIn = max
+	return nil
+}
+
+// capLifetime reduces the lifetime of a loaded code or token to the maximum and returns an error if it was created
+// more than the maximum lifetime ago.
+func (s *Storage) capLifetime(createdAt time.Time, expiresIn *int32) error {
+	max := s.maxExpiresIn()
+	if max <= 0 {
+		return nil
+	}
+	if *expiresIn > max {
+		*expiresIn = max
+	}
+	if expiry := createdAt.Add(time.Duration(max) * time.Second); expiry.Before(s.now()) {
+		return errors.Errorf("Token expired at %s.", expiry.String())
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// liveIndexTables are the tables with a partial index on the live rows of a client, see RefreshLiveIndexes.
+var liveIndexTables = []string{"authorize", "access"}
+
+// RefreshLiveIndexes maintains partial indexes on the client and expiry of the codes and tokens which did not
+// expire yet, e.g. for ListAccessByClient and CountActiveAccess. They stay small on large tables with months of
+// expired rows, which full indexes would cover as well. As index predicates cannot depend on the current time,
+// the indexes cover the rows expiring after the start of the current day in UTC: RefreshLiveIndexes replaces
+// them with an index for the current day, if it does not exist yet. Run it daily, e.g. with CleanupConfig.LiveIndexes. The
+// indexes are created and dropped concurrently, so neither reads nor writes are blocked. Queries use them with
+// custom plans only, in which the current time is known.
+func (s *Storage) RefreshLiveIndexes(ctx context.Context) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.leave()
+
+	cutoff := s.now().UTC().Truncate(24 * time.Hour)
+	for _, table := range liveIndexTables {
+		if err := s.refreshLiveIndex(ctx, table, cutoff); err != nil {
+			return classify(err)
+		}
+	}
+	return nil
+}
+
+// refreshLiveIndex creates the live index of table for cutoff and drops the indexes of earlier cutoffs. The
+// statements cannot run in a transaction.
+func (s *Storage) refreshLiveIndex(ctx context.Context, table string, cutoff time.Time) error {
+	schema, qualified := "current_schema()", table
+	var args []interface{}
+	if s.schema != "" {
+		schema, qualified = "$2", pq.QuoteIdentifier(s.schema)+"."+table
+		args = append(args, s.schema)
+	}
+	name := table + "_live_" + cutoff.Format("20060102") + "_idx"
+
+	// Indexes whose concurrent creation failed are left invalid and must be dropped.
+	valid := map[string]bool{}
+	if err := queryRows(ctxConn{ctx, s.db, nil}, func(row scanner) error {
+		var index string
+		var ok bool
+		if err := row.Scan(&index, &ok); err != nil {
+			return err
+		}
+		valid[index] = ok
+		return nil
+	}, `SELECT c.relname, i.indisvalid FROM pg_index i
+JOIN pg_class c ON c.oid=i.indexrelid JOIN pg_class t ON t.oid=i.indrelid JOIN pg_namespace n ON n.oid=t.relnamespace
+WHERE t.relname=$1 AND n.nspname=`+schema+` AND c.relname LIKE $1 || '\_live\_%\_idx'`, append([]interface{}{table}, args...)...); err != nil {
+		return err
+	}
+
+	drop := func(index string) error {
+		if s.schema != "" {
+			index = pq.QuoteIdentifier(s.schema) + "." + index
+		}
+		if _, err := s.db.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+index); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	}
+	if ok, exists := valid[name]; !ok {
+		if exists {
+			if err := drop(name); err != nil {
+				return err
+			}
+		}
+		if _, err := s.db.ExecContext(ctx, "CREATE INDEX CONCURRENTLY "+name+" ON "+qualified+" (client, expires_at) WHERE expires_at > '"+cutoff.Format(time.RFC3339)+"'"); err != nil {
+			return errors.New(err)
+		}
+	}
+	for index := range valid {
+		if index != name {
+			if err := drop(index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
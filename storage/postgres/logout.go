@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"database/sql"
+	"net/url"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// SetClientPostLogoutRedirectURIs stores the post_logout_redirect_uris of the client, to which OpenID Connect
+// RP-initiated logout may redirect, for checks with ClientAllowsPostLogoutRedirectURI. Returns an error if a URI is
+// not absolute or has a fragment and ErrClientNotFound if the client does not exist.
+func (s *Storage) SetClientPostLogoutRedirectURIs(clientID string, uris []string) error {
+	for _, uri := range uris {
+		if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+			return errors.Errorf("Invalid post logout redirect URI %q", uri)
+		}
+	}
+
+	if err := s.mutate("SetClientPostLogoutRedirectURIs", AuditClientUpdated, clientID, clientID, func(conn dbtx) error {
+		if n, err := execCount(conn, "UPDATE client SET post_logout_redirect_uris=$2 WHERE id=$1", clientID, nullArray(uris)); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrClientNotFound
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.afterCommit(func() {
+		s.evictClient(clientID)
+		s.hooks.clientChanged(clientID)
+	})
+	return nil
+}
+
+// GetClientPostLogoutRedirectURIs loads the post_logout_redirect_uris of the client. Returns ErrClientNotFound if
+// the client does not exist.
+func (s *Storage) GetClientPostLogoutRedirectURIs(clientID string) ([]string, error) {
+	var uris pq.StringArray
+	if err := s.read("GetClientPostLogoutRedirectURIs", func(conn dbtx) error {
+		return conn.QueryRow("SELECT post_logout_redirect_uris FROM client WHERE id=$1", clientID).Scan(&uris)
+	}); err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	return uris, nil
+}
+
+// ClientAllowsPostLogoutRedirectURI returns true if uri, the post_logout_redirect_uri of a logout request, exactly
+// matches one of the post_logout_redirect_uris of the client, as OpenID Connect RP-Initiated Logout requires.
+// Returns ErrClientNotFound if the client does not exist.
+func (s *Storage) ClientAllowsPostLogoutRedirectURI(clientID, uri string) (bool, error) {
+	var allowed bool
+	if err := s.read("ClientAllowsPostLogoutRedirectURI", func(conn dbtx) error {
+		return conn.QueryRow("SELECT COALESCE($2 = ANY(post_logout_redirect_uris), false) FROM client WHERE id=$1", clientID, uri).Scan(&allowed)
+	}); err == sql.ErrNoRows {
+		return false, ErrClientNotFound
+	} else if err != nil {
+		return false, errors.New(err)
+	}
+	return allowed, nil
+}
@@ -0,0 +1,163 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Gauges reported by ReportGauges.
+const (
+	// GaugeExpiredAccessTokens is the number of expired access tokens PurgeExpiredTokens would remove.
+	GaugeExpiredAccessTokens = "expired_access_tokens"
+
+	// GaugeOrphanedRefreshTokens is the number of refresh tokens whose access token does not exist anymore.
+	GaugeOrphanedRefreshTokens = "orphaned_refresh_tokens"
+
+	// GaugeExpiredAuthorizeCodes is the number of expired authorize codes PurgeExpiredTokens would remove.
+	GaugeExpiredAuthorizeCodes = "expired_authorize_codes"
+)
+
+// CounterPurgedRows is the counter of the rows removed by Cleanup. It is reported per table with the name of the
+// table appended, e.g. "purged_rows_access".
+const CounterPurgedRows = "purged_rows"
+
+// Metrics receive the metrics of the storage, e.g. to export them to Prometheus. Nil callbacks are skipped.
+type Metrics struct {
+	// Gauge is called with the current value of a gauge, e.g. GaugeExpiredAccessTokens.
+	Gauge func(name string, value float64)
+
+	// Counter is called with the increment of a counter, e.g. CounterPurgedRows.
+	Counter func(name string, delta float64)
+
+	// Operation is called after every operation, e.g. to break down latency and error rates per operation, table
+	// and client.
+	Operation func(op Operation)
+}
+
+// Operation describes an operation of the storage reported to Metrics.Operation.
+type Operation struct {
+	// Name is the name of the operation, which is the name of a method of Storage, e.g. "SaveAccess".
+	Name string
+
+	// Table is the table of the first statement of the operation, e.g. "access".
+	Table string
+
+	// ClientHash identifies the client the operation works on, or is empty if the operation is not specific to a
+	// client. It is the first 16 characters of the HashToken of the client id, so the id is not disclosed.
+	ClientHash string
+
+	Duration time.Duration
+
+	// Err is the error the operation failed with, or nil.
+	Err error
+}
+
+// operationKey is the context key of the *Operation being run.
+type operationKey struct{}
+
+// startOperation returns ctx with the operation op, if operations are reported to Metrics.Operation.
+func (s *Storage) startOperation(ctx context.Context, op string) context.Context {
+	if s.metrics.Operation == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, operationKey{}, &Operation{Name: op})
+}
+
+// observe reports the operation in ctx, which started at start and failed with err, to Metrics.Operation.
+func (s *Storage) observe(ctx context.Context, start time.Time, err error) {
+	if o, ok := ctx.Value(operationKey{}).(*Operation); ok {
+		o.Duration, o.Err = time.Since(start), err
+		s.metrics.Operation(*o)
+	}
+}
+
+// tableRegexp matches the table of a statement.
+var tableRegexp = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE)\s+(\w+)`)
+
+// noteTable records the table of query for the operation in ctx, if it is the first statement of the operation.
+func noteTable(ctx context.Context, query string) {
+	if o, ok := ctx.Value(operationKey{}).(*Operation); ok && o.Table == "" {
+		if m := tableRegexp.FindStringSubmatch(query); m != nil {
+			o.Table = m[1]
+		}
+	}
+}
+
+// noteClient records the client the operation running on conn works on.
+func noteClient(conn dbtx, clientID string) {
+	c, ok := conn.(ctxConn)
+	if !ok || clientID == "" {
+		return
+	}
+	if o, ok := c.ctx.Value(operationKey{}).(*Operation); ok {
+		o.ClientHash = HashToken(clientID)[:16]
+	}
+}
+
+// WithMetrics reports the metrics of the storage to metrics. Gauges are reported by ReportGauges, which should
+// be called periodically, e.g. with RunGauges.
+func WithMetrics(metrics Metrics) Option {
+	return func(s *Storage) {
+		s.metrics = metrics
+	}
+}
+
+// gaugeQueries are the queries of the gauges reported by ReportGauges. The current time is passed to queries
+// comparing with it as $1.
+var gaugeQueries = []struct {
+	name  string
+	query string
+}{
+	{GaugeExpiredAccessTokens, "SELECT count(*) FROM access WHERE expires_at < $1 AND NOT EXISTS (SELECT 1 FROM refresh WHERE refresh.access=access.access_token)"},
+	{GaugeOrphanedRefreshTokens, "SELECT count(*) FROM refresh WHERE NOT EXISTS (SELECT 1 FROM access WHERE access.access_token=refresh.access)"},
+	{GaugeExpiredAuthorizeCodes, "SELECT count(*) FROM authorize WHERE expires_at < $1"},
+}
+
+// ReportGauges queries the gauges and reports them to Metrics.Gauge, so alerts can fire when the cleanup falls
+// behind. It does nothing if no gauge callback was configured with WithMetrics.
+func (s *Storage) ReportGauges(ctx context.Context) error {
+	if s.metrics.Gauge == nil {
+		return nil
+	}
+
+	values := make([]float64, len(gaugeQueries))
+	if err := s.readContext(ctx, "ReportGauges", func(conn dbtx) error {
+		for i, g := range gaugeQueries {
+			var args []interface{}
+			if strings.Contains(g.query, "$1") {
+				args = append(args, s.now())
+			}
+			if err := conn.QueryRow(g.query, args...).Scan(&values[i]); err != nil {
+				return errors.New(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for i, g := range gaugeQueries {
+		s.metrics.Gauge(g.name, values[i])
+	}
+	return nil
+}
+
+// RunGauges calls ReportGauges every interval until ctx is done. Errors are passed to onError, if not nil.
+func (s *Storage) RunGauges(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.ReportGauges(ctx); err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
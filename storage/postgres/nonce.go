@@ -0,0 +1,28 @@
+package postgres
+
+import (
+	"time"
+)
+
+// ClaimNonce atomically records the first use of nonce (e.g. an OpenID Connect nonce or a JWT jti) for the
+// duration of ttl. Returns true if the nonce was claimed and false if it was already used and has not expired
+// yet, in which case the request must be rejected as a replay.
+func (s *Storage) ClaimNonce(nonce string, ttl time.Duration) (bool, error) {
+	now := s.now()
+	n, err := s.writeCount("ClaimNonce",
+		"INSERT INTO nonce (nonce, expires_at) VALUES ($1, $2) ON CONFLICT "+s.conflictTarget("nonce")+" DO UPDATE SET expires_at=EXCLUDED.expires_at WHERE nonce.expires_at <= $3",
+		nonce,
+		now.Add(ttl),
+		now,
+	)
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// PurgeExpiredNonces removes all expired nonces and returns the number of removed rows.
+func (s *Storage) PurgeExpiredNonces() (int64, error) {
+	query, args := s.expiredNoncePurge().query(s, 0)
+	return s.writeCount("PurgeExpiredNonces", query, args...)
+}
@@ -0,0 +1,129 @@
+package postgres
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// EventReconnected is delivered by a Subscriber after the connection to the database was lost and
+// re-established. Notifications sent in the meantime are lost, so subscribers should flush their caches.
+const EventReconnected = "reconnected"
+
+// Event is a change notification sent through postgres' NOTIFY if enabled with WithNotify.
+// Events are sent when clients are created, updated or removed and when codes or tokens are revoked.
+type Event struct {
+	// Type is one of AuditClientCreated, AuditClientUpdated, AuditClientDeleted, AuditAuthorizeConsumed,
+	// AuditAccessRevoked, AuditRefreshRevoked or EventReconnected.
+	Type string `json:"type"`
+
+	// ClientID is the id of the affected client, if known.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Subject is the client id for client events and the HashToken of the code or token otherwise.
+	Subject string `json:"subject,omitempty"`
+}
+
+// WithNotify enables change notifications on the given channel. Notifications are sent within the transaction
+// of the change and are thus only delivered if the change is committed. Use a Subscriber to receive them.
+func WithNotify(channel string) Option {
+	return func(s *Storage) {
+		s.channel = channel
+	}
+}
+
+// notifies returns true if an event of type typ is sent.
+func (s *Storage) notifies(typ string) bool {
+	if s.channel == "" {
+		return false
+	}
+	switch typ {
+	case AuditClientCreated, AuditClientUpdated, AuditClientDeleted, AuditAuthorizeConsumed, AuditAccessRevoked, AuditRefreshRevoked:
+		return true
+	}
+	return false
+}
+
+// notify sends an event if events of type typ are sent.
+func (s *Storage) notify(conn dbtx, typ, clientID, subject string) error {
+	if !s.notifies(typ) {
+		return nil
+	}
+
+	if err := s.unsupported("WithNotify"); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(&Event{Type: typ, ClientID: clientID, Subject: subject})
+	if err != nil {
+		return errors.New(err)
+	}
+	if _, err := conn.Exec("SELECT pg_notify($1, $2)", s.channel, string(payload)); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// Subscriber listens for events sent by storages configured with WithNotify.
+type Subscriber struct {
+	listener *pq.Listener
+	events   chan Event
+	done     chan struct{}
+}
+
+// NewSubscriber connects to the database at dsn and listens on channel. The connection is re-established
+// automatically if it is lost, in which case an event of type EventReconnected is delivered.
+func NewSubscriber(dsn, channel string) (*Subscriber, error) {
+	listener := pq.NewListener(dsn, 100*time.Millisecond, 10*time.Second, nil)
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, errors.New(err)
+	}
+
+	sub := &Subscriber{listener: listener, events: make(chan Event, 64), done: make(chan struct{})}
+	go sub.run()
+	return sub, nil
+}
+
+// Events returns the channel events are delivered on. It is closed when the subscriber is closed.
+func (s *Subscriber) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops listening and closes the events channel.
+func (s *Subscriber) Close() error {
+	close(s.done)
+	if err := s.listener.Close(); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+func (s *Subscriber) run() {
+	defer close(s.events)
+	for {
+		select {
+		case <-s.done:
+			return
+		case n, ok := <-s.listener.Notify:
+			if !ok {
+				return
+			}
+
+			var e Event
+			if n == nil {
+				e.Type = EventReconnected
+			} else if err := json.Unmarshal([]byte(n.Extra), &e); err != nil {
+				continue
+			}
+
+			select {
+			case s.events <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
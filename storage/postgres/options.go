@@ -0,0 +1,20 @@
+package postgres
+
+// Option configures a Storage. Options are passed to New.
+type Option func(*Storage)
+
+// WithReadOnly makes all operations which write to the database fail with ErrReadOnly, e.g. for resource servers
+// which only call GetClient and LoadAccess against a replica and must never write to the database. LoadRefresh does
+// not record the use of refresh tokens then.
+func WithReadOnly() Option {
+	return func(s *Storage) {
+		s.readOnly = true
+	}
+}
+
+// WithAudit enables recording of security relevant events in the audit table. See AuditEvent.
+func WithAudit() Option {
+	return func(s *Storage) {
+		s.audit = true
+	}
+}
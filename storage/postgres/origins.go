@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// SetClientOrigins stores the origins browser-based apps of the client are served from, e.g.
+// "https://app.example.com", for checks with ClientAllowsOrigin. Origins are normalized, see NormalizeOrigin.
+// Returns an error if an origin is invalid and ErrClientNotFound if the client does not exist.
+func (s *Storage) SetClientOrigins(clientID string, origins []string) error {
+	normalized := make([]string, len(origins))
+	for i, origin := range origins {
+		var err error
+		if normalized[i], err = NormalizeOrigin(origin); err != nil {
+			return err
+		}
+	}
+
+	if err := s.mutate("SetClientOrigins", AuditClientUpdated, clientID, clientID, func(conn dbtx) error {
+		if n, err := execCount(conn, "UPDATE client SET allowed_origins=$2 WHERE id=$1", clientID, nullArray(normalized)); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrClientNotFound
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.afterCommit(func() {
+		s.evictClient(clientID)
+		s.hooks.clientChanged(clientID)
+	})
+	return nil
+}
+
+// GetClientOrigins loads the allowed origins of the client. Returns ErrClientNotFound if the client does not exist.
+func (s *Storage) GetClientOrigins(clientID string) ([]string, error) {
+	var origins pq.StringArray
+	if err := s.read("GetClientOrigins", func(conn dbtx) error {
+		return conn.QueryRow("SELECT allowed_origins FROM client WHERE id=$1", clientID).Scan(&origins)
+	}); err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	return origins, nil
+}
+
+// ClientAllowsOrigin returns true if origin, usually the Origin header of a request to the token endpoint, is an
+// allowed origin of the client. Invalid origins are never allowed. Returns ErrClientNotFound if the client does
+// not exist.
+func (s *Storage) ClientAllowsOrigin(clientID, origin string) (bool, error) {
+	normalized, err := NormalizeOrigin(origin)
+	if err != nil {
+		normalized = ""
+	}
+
+	var allowed bool
+	if err := s.read("ClientAllowsOrigin", func(conn dbtx) error {
+		return conn.QueryRow("SELECT COALESCE($2 = ANY(allowed_origins), false) FROM client WHERE id=$1", clientID, normalized).Scan(&allowed)
+	}); err == sql.ErrNoRows {
+		return false, ErrClientNotFound
+	} else if err != nil {
+		return false, errors.New(err)
+	}
+	return allowed, nil
+}
+
+// NormalizeOrigin returns the serialization of origin as used in the Origin header: the lowercase scheme and host
+// and the port, if any. Returns an error if origin is not an absolute http or https URL without path, query or
+// fragment.
+func NormalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", errors.New(err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if (scheme != "http" && scheme != "https") || u.Host == "" || u.User != nil || strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.Errorf("Invalid origin %q", origin)
+	}
+	return scheme + "://" + strings.ToLower(u.Host), nil
+}
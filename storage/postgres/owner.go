@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/go-errors/errors"
+)
+
+// SetClientOwner stores the owner of the client, e.g. the id of the user or team which registered it in a
+// developer portal, for ListClientsByOwner. The empty owner removes the owner. Returns ErrClientNotFound if the
+// client does not exist.
+func (s *Storage) SetClientOwner(clientID, owner string) error {
+	if err := s.mutate("SetClientOwner", AuditClientUpdated, clientID, clientID, func(conn dbtx) error {
+		if n, err := execCount(conn, "UPDATE client SET owner=$2 WHERE id=$1", clientID, nullString(owner)); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrClientNotFound
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.afterCommit(func() {
+		s.evictClient(clientID)
+		s.hooks.clientChanged(clientID)
+	})
+	return nil
+}
+
+// GetClientOwner loads the owner of the client, which is empty if the client has no owner. Returns
+// ErrClientNotFound if the client does not exist.
+func (s *Storage) GetClientOwner(clientID string) (string, error) {
+	var owner string
+	if err := s.read("GetClientOwner", func(conn dbtx) error {
+		return conn.QueryRow("SELECT COALESCE(owner, '') FROM client WHERE id=$1", clientID).Scan(&owner)
+	}); err == sql.ErrNoRows {
+		return "", ErrClientNotFound
+	} else if err != nil {
+		return "", errors.New(err)
+	}
+	return owner, nil
+}
+
+// ListClientsByOwner returns the clients of owner ordered by id, so a self-service portal can show each team only
+// the clients it owns. Disabled clients are returned as well, soft-deleted clients are not.
+func (s *Storage) ListClientsByOwner(owner string) ([]*Client, error) {
+	var clients []*Client
+	if err := s.read("ListClientsByOwner", func(conn dbtx) error {
+		clients = nil
+		return queryRows(conn, func(row scanner) error {
+			var c Client
+			var extra string
+			var deletedAt sql.NullTime
+			if err := row.Scan(clientDest(&c, &extra, &deletedAt)...); err != nil {
+				return err
+			}
+			c.UserData = extra
+			clients = append(clients, &c)
+			return nil
+		}, "SELECT "+clientColumns("")+" FROM client WHERE owner=$1 AND deleted_at IS NULL ORDER BY id", owner)
+	}); err != nil {
+		return nil, errors.New(err)
+	}
+	return clients, nil
+}
@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"database/sql"
+	"net/url"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// PushedAuthorizeRequest is an authorization request pushed to the server as described in RFC 9126.
+type PushedAuthorizeRequest struct {
+	// RequestURI is the request_uri handed out to the client, e.g. "urn:ietf:params:oauth:request_uri:<random>".
+	RequestURI string
+
+	// ClientID is the id of the client which pushed the request.
+	ClientID string
+
+	// Parameters are the authorization request parameters as they were pushed by the client.
+	Parameters url.Values
+
+	// ExpiresIn is the lifetime of the request_uri in seconds. RFC 9126 recommends a short lifetime.
+	ExpiresIn int32
+
+	// CreatedAt is the date of creation.
+	CreatedAt time.Time
+}
+
+// ExpireAt returns the expiration date.
+func (r *PushedAuthorizeRequest) ExpireAt() time.Time {
+	return r.CreatedAt.Add(time.Duration(r.ExpiresIn) * time.Second)
+}
+
+// IsExpired returns true if the request_uri expired.
+func (r *PushedAuthorizeRequest) IsExpired() bool {
+	return r.expiredAt(time.Now())
+}
+
+func (r *PushedAuthorizeRequest) expiredAt(now time.Time) bool {
+	return r.ExpireAt().Before(now)
+}
+
+// SavePAR saves a pushed authorization request.
+func (s *Storage) SavePAR(r *PushedAuthorizeRequest) error {
+	if err := s.write("SavePAR", func(conn dbtx) error {
+		_, err := conn.Exec(
+			"INSERT INTO par_request (request_uri, client, parameters, expires_in, created_at) VALUES ($1, $2, $3, $4, $5)",
+			r.RequestURI,
+			r.ClientID,
+			r.Parameters.Encode(),
+			r.ExpiresIn,
+			r.CreatedAt,
+		)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// LoadPAR looks up a pushed authorization request by its request_uri without consuming it.
+// Returns an error if the request expired.
+func (s *Storage) LoadPAR(requestURI string) (*PushedAuthorizeRequest, error) {
+	var r *PushedAuthorizeRequest
+	err := s.read("LoadPAR", func(conn dbtx) (err error) {
+		r, err = s.scanPAR(conn.QueryRow("SELECT request_uri, client, parameters, expires_in, created_at FROM par_request WHERE request_uri=$1 LIMIT 1", requestURI))
+		return err
+	})
+	return r, err
+}
+
+// ConsumePAR looks up a pushed authorization request by its request_uri and removes it in the same statement,
+// so that a request_uri can be used only once. Returns an error if the request expired.
+func (s *Storage) ConsumePAR(requestURI string) (*PushedAuthorizeRequest, error) {
+	var r *PushedAuthorizeRequest
+	err := s.write("ConsumePAR", func(conn dbtx) (err error) {
+		r, err = s.scanPAR(conn.QueryRow("DELETE FROM par_request WHERE request_uri=$1 RETURNING request_uri, client, parameters, expires_in, created_at", requestURI))
+		return err
+	})
+	return r, err
+}
+
+// PurgeExpiredPAR removes all expired pushed authorization requests and returns the number of removed rows.
+func (s *Storage) PurgeExpiredPAR() (int64, error) {
+	query, args := s.expiredPARPurge().query(s, 0)
+	return s.writeCount("PurgeExpiredPAR", query, args...)
+}
+
+func (s *Storage) scanPAR(row *sql.Row) (*PushedAuthorizeRequest, error) {
+	var r PushedAuthorizeRequest
+	var params string
+	if err := row.Scan(&r.RequestURI, &r.ClientID, &params, &r.ExpiresIn, &r.CreatedAt); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	r.Parameters = values
+
+	if r.expiredAt(s.now()) {
+		return nil, errors.Errorf("Request URI expired at %s.", r.ExpireAt().String())
+	}
+	return &r, nil
+}
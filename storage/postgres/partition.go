@@ -0,0 +1,212 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// PartitionInterval is the time range covered by one partition.
+type PartitionInterval int
+
+// Partition intervals supported by CreatePartitionedSchemas.
+const (
+	PartitionMonthly PartitionInterval = iota
+	PartitionDaily
+)
+
+// PartitionConfig configures the partitions of the access and authorize tables.
+type PartitionConfig struct {
+	// Interval is the time range covered by one partition.
+	Interval PartitionInterval
+
+	// Ahead is the number of future partitions MaintainPartitions keeps in stock. Defaults to 3.
+	Ahead int
+
+	// Retention is the time partitions are kept after their range ended. MaintainPartitions drops older
+	// partitions. Zero keeps all partitions.
+	Retention time.Duration
+}
+
+// partitionedTables are the tables CreatePartitionedSchemas partitions by created_at.
+var partitionedTables = []string{"authorize", "access"}
+
+// partitionedSchemas replace the definitions of the partitioned tables in schemas. The primary key must include
+// the partition key, so codes and tokens are unique only within a partition.
+var partitionedSchemas = []string{`CREATE TABLE IF NOT EXISTS authorize (
+	client       text NOT NULL,
+	code         text NOT NULL,
+	expires_in   int NOT NULL,
+	scope        text,
+	redirect_uri text,
+	state        text,
+	extra 		 text NOT NULL,
+	created_at   timestamp with time zone NOT NULL,
+	code_challenge        text,
+	code_challenge_method text,
+	issued_ip             text,
+	user_agent            text,
+	resources             text[],
+	authorization_details jsonb,
+	PRIMARY KEY (code, created_at)
+) PARTITION BY RANGE (created_at)`, `CREATE TABLE IF NOT EXISTS access (
+	client        text NOT NULL,
+	authorize     text,
+	previous      text,
+	access_token  text NOT NULL,
+	refresh_token text,
+	expires_in    int NOT NULL,
+	scope         text,
+	redirect_uri  text,
+	extra 		  text NOT NULL,
+	created_at    timestamp with time zone NOT NULL,
+	issued_ip     text,
+	user_agent    text,
+	dpop_jkt      text,
+	x5t_s256      text,
+	resources     text[],
+	authorization_details jsonb,
+	PRIMARY KEY (access_token, created_at)
+) PARTITION BY RANGE (created_at)`,
+	`CREATE TABLE IF NOT EXISTS authorize_default PARTITION OF authorize DEFAULT`,
+	`CREATE TABLE IF NOT EXISTS access_default PARTITION OF access DEFAULT`}
+
+// CreatePartitionedSchemas is CreateSchemas with the access and authorize tables partitioned by created_at,
+// so expired tokens can be purged by dropping whole partitions instead of deleting rows. It creates the
+// partitions for config right away. Call MaintainPartitions periodically, e.g. daily, to create upcoming and drop
+// expired partitions. Rows outside of all partitions are stored in a default partition.
+//
+// Tables which already exist are not converted. Run it on an empty database.
+func (s *Storage) CreatePartitionedSchemas(config PartitionConfig) error {
+	if err := s.unsupported("CreatePartitionedSchemas"); err != nil {
+		return err
+	}
+	if err := s.inTx("CreatePartitionedSchemas", func(tx dbtx) error {
+		if err := lockSchema(tx); err != nil {
+			return err
+		}
+		if err := execSchemas(tx, partitionedSchemas); err != nil {
+			return err
+		}
+		return execSchemas(tx, schemas)
+	}); err != nil {
+		return err
+	}
+
+	_, _, err := s.MaintainPartitions(config)
+	return err
+}
+
+// MaintainPartitions creates the partitions from the current up to config.Ahead future intervals and drops the
+// partitions whose range ended more than config.Retention ago. Refresh tokens of access tokens in dropped
+// partitions are removed as well. Like CreateSchemas, it holds the advisory lock for schema changes. If archiving is enabled, the rows of dropped partitions are archived first. It returns the names of the created and dropped partitions.
+func (s *Storage) MaintainPartitions(config PartitionConfig) (created, dropped []string, err error) {
+	if err := s.unsupported("MaintainPartitions"); err != nil {
+		return nil, nil, err
+	}
+	if config.Ahead <= 0 {
+		config.Ahead = 3
+	}
+
+	err = s.inTx("MaintainPartitions", func(tx dbtx) error {
+		created, dropped = nil, nil
+		if err := lockSchema(tx); err != nil {
+			return err
+		}
+		conn := tx.(ctxConn).unprepared()
+		now := s.now().UTC()
+		for _, table := range partitionedTables {
+			existing, err := queryStrings(conn, "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid=i.inhrelid WHERE i.inhparent=$1::regclass", table)
+			if err != nil {
+				return err
+			}
+			exists := map[string]bool{}
+			for _, name := range existing {
+				exists[name] = true
+			}
+
+			start := config.Interval.start(now)
+			for i := 0; i <= config.Ahead; i++ {
+				name := config.Interval.name(table, start)
+				end := config.Interval.next(start)
+				if !exists[name] {
+					if _, err := conn.Exec(fmt.Sprintf(
+						"CREATE TABLE %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+						name, table, start.Format(time.RFC3339), end.Format(time.RFC3339),
+					)); err != nil {
+						return errors.New(err)
+					}
+					created = append(created, name)
+				}
+				start = end
+			}
+
+			if config.Retention <= 0 {
+				continue
+			}
+			for _, name := range existing {
+				start, ok := config.Interval.parse(table, name)
+				if !ok || !config.Interval.next(start).Before(now.Add(-config.Retention)) {
+					continue
+				}
+				if table == "access" {
+					if _, err := conn.Exec("DELETE FROM refresh WHERE access IN (SELECT access_token FROM " + name + ")"); err != nil {
+						return errors.New(err)
+					}
+				}
+				if columns, _ := s.archivedColumns(table); s.archive {
+					if _, err := conn.Exec("INSERT INTO "+table+"_archive ("+columns+", archived_at) SELECT "+columns+", $1::timestamptz FROM "+name, now); err != nil {
+						return errors.New(err)
+					}
+				}
+				if _, err := conn.Exec("DROP TABLE " + name); err != nil {
+					return errors.New(err)
+				}
+				dropped = append(dropped, name)
+			}
+		}
+		return nil
+	})
+	return created, dropped, err
+}
+
+// start returns the start of the interval t is in.
+func (p PartitionInterval) start(t time.Time) time.Time {
+	if p == PartitionDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// next returns the start of the interval following the one starting at start.
+func (p PartitionInterval) next(start time.Time) time.Time {
+	if p == PartitionDaily {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+func (p PartitionInterval) layout() string {
+	if p == PartitionDaily {
+		return "20060102"
+	}
+	return "200601"
+}
+
+// name returns the name of the partition of table starting at start, e.g. access_p202401.
+func (p PartitionInterval) name(table string, start time.Time) string {
+	return table + "_p" + start.Format(p.layout())
+}
+
+// parse returns the start of the partition of table with the name. It returns false for partitions not created
+// with this interval, e.g. the default partition.
+func (p PartitionInterval) parse(table, name string) (time.Time, bool) {
+	suffix := strings.TrimPrefix(name, table+"_p")
+	if suffix == name || len(suffix) != len(p.layout()) {
+		return time.Time{}, false
+	}
+	start, err := time.Parse(p.layout(), suffix)
+	return start, err == nil
+}
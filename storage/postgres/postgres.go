@@ -2,63 +2,623 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/lib/pq"
 	"github.com/optimisticninja/osin"
 )
 
-var (
-	ErrNotFound = errors.New("Not found")
-)
-
 var schemas = []string{`CREATE TABLE IF NOT EXISTS client (
 	id           text NOT NULL PRIMARY KEY,
 	secret 		 text NOT NULL,
 	extra 		 text NOT NULL,
-	redirect_uri text NOT NULL
+	redirect_uri text NOT NULL,
+	access_ttl   int,
+	refresh_ttl  int,
+	is_trusted   boolean NOT NULL DEFAULT false,
+	display_name text NOT NULL DEFAULT '',
+	logo_uri     text NOT NULL DEFAULT '',
+	policy_uri   text NOT NULL DEFAULT '',
+	tos_uri      text NOT NULL DEFAULT '',
+	allowed_origins                     text[],
+	post_logout_redirect_uris           text[],
+	backchannel_logout_uri              text,
+	backchannel_logout_session_required boolean NOT NULL DEFAULT false,
+	enabled                             boolean NOT NULL DEFAULT true,
+	deleted_at                          timestamp with time zone,
+	version                             bigint NOT NULL DEFAULT 1
 )`, `CREATE TABLE IF NOT EXISTS authorize (
 	client       text NOT NULL,
 	code         text NOT NULL PRIMARY KEY,
 	expires_in   int NOT NULL,
-	scope        text NOT NULL,
-	redirect_uri text NOT NULL,
-	state        text NOT NULL,
+	scope        text,
+	redirect_uri text,
+	state        text,
 	extra 		 text NOT NULL,
-	created_at   timestamp with time zone NOT NULL
+	created_at   timestamp with time zone NOT NULL,
+	code_challenge        text,
+	code_challenge_method text,
+	issued_ip             text,
+	user_agent            text,
+	resources             text[],
+	authorization_details jsonb
 )`, `CREATE TABLE IF NOT EXISTS access (
 	client        text NOT NULL,
-	authorize     text NOT NULL,
-	previous      text NOT NULL,
+	authorize     text,
+	previous      text,
 	access_token  text NOT NULL PRIMARY KEY,
-	refresh_token text NOT NULL,
+	refresh_token text,
 	expires_in    int NOT NULL,
-	scope         text NOT NULL,
-	redirect_uri  text NOT NULL,
+	scope         text,
+	redirect_uri  text,
 	extra 		  text NOT NULL,
-	created_at    timestamp with time zone NOT NULL
+	created_at    timestamp with time zone NOT NULL,
+	issued_ip     text,
+	user_agent    text,
+	dpop_jkt      text,
+	x5t_s256      text,
+	resources     text[],
+	authorization_details jsonb
 )`, `CREATE TABLE IF NOT EXISTS refresh (
 	token         text NOT NULL PRIMARY KEY,
-	access        text NOT NULL
-)`}
+	access          text NOT NULL,
+	rotated_at      timestamp with time zone,
+	last_used_at    timestamp with time zone,
+	absolute_expiry timestamp with time zone,
+	use_count       int NOT NULL DEFAULT 0
+)`, `CREATE TABLE IF NOT EXISTS token_usage (
+	token_hash    text NOT NULL PRIMARY KEY,
+	client        text NOT NULL,
+	uses          bigint NOT NULL,
+	first_used_at timestamp with time zone NOT NULL,
+	last_used_at  timestamp with time zone NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS token_usage_client_idx ON token_usage (client, last_used_at ASC)`,
+	`CREATE TABLE IF NOT EXISTS token_exchange (
+	access_token       text NOT NULL PRIMARY KEY,
+	token_hash         text NOT NULL,
+	subject_token_hash text NOT NULL,
+	subject_token_type text NOT NULL,
+	actors             text[] NOT NULL,
+	created_at         timestamp with time zone NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS token_exchange_subject_idx ON token_exchange (subject_token_hash)`, `CREATE TABLE IF NOT EXISTS backchannel_request (
+	auth_req_id     text NOT NULL PRIMARY KEY,
+	client          text NOT NULL,
+	scope           text NOT NULL,
+	login_hint      text NOT NULL,
+	binding_message text NOT NULL,
+	status          text NOT NULL,
+	extra           text NOT NULL,
+	expires_in      int NOT NULL,
+	poll_interval   int NOT NULL,
+	created_at      timestamp with time zone NOT NULL,
+	last_polled_at  timestamp with time zone
+)`, `CREATE TABLE IF NOT EXISTS par_request (
+	request_uri text NOT NULL PRIMARY KEY,
+	client      text NOT NULL,
+	parameters  text NOT NULL,
+	expires_in  int NOT NULL,
+	created_at  timestamp with time zone NOT NULL
+)`, `CREATE TABLE IF NOT EXISTS consent (
+	user_ref   text NOT NULL,
+	client     text NOT NULL,
+	scope      text NOT NULL,
+	granted_at timestamp with time zone NOT NULL,
+	expires_at timestamp with time zone,
+	PRIMARY KEY (user_ref, client)
+)`, `CREATE TABLE IF NOT EXISTS session (
+	sid       text NOT NULL PRIMARY KEY,
+	user_ref  text NOT NULL,
+	clients   text[] NOT NULL,
+	auth_time timestamp with time zone NOT NULL,
+	amr       text[] NOT NULL,
+	acr       text NOT NULL,
+	last_seen timestamp with time zone NOT NULL
+)`, `CREATE TABLE IF NOT EXISTS signing_key (
+	kid                   text NOT NULL PRIMARY KEY,
+	alg                   text NOT NULL,
+	public_key            text NOT NULL,
+	encrypted_private_key bytea NOT NULL,
+	active                boolean NOT NULL,
+	not_before            timestamp with time zone NOT NULL,
+	not_after             timestamp with time zone
+)`, `CREATE TABLE IF NOT EXISTS nonce (
+	nonce      text NOT NULL PRIMARY KEY,
+	expires_at timestamp with time zone NOT NULL
+)`, `CREATE TABLE IF NOT EXISTS scope (
+	name        text NOT NULL PRIMARY KEY,
+	description text NOT NULL,
+	is_default  boolean NOT NULL,
+	restricted  boolean NOT NULL
+)`, `CREATE TABLE IF NOT EXISTS client_scope (
+	client text NOT NULL,
+	scope  text NOT NULL,
+	PRIMARY KEY (client, scope)
+)`, `CREATE TABLE IF NOT EXISTS revocation (
+	id         bigserial NOT NULL PRIMARY KEY,
+	token_type text NOT NULL,
+	token_hash text NOT NULL,
+	client     text NOT NULL,
+	revoked_at timestamp with time zone NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS revocation_revoked_at_idx ON revocation (revoked_at)`, `CREATE TABLE IF NOT EXISTS jti_denylist (
+	jti        text NOT NULL PRIMARY KEY,
+	expires_at timestamp with time zone NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS jti_denylist_expires_at_idx ON jti_denylist (expires_at)`, `CREATE TABLE IF NOT EXISTS audit (
+	id         bigserial NOT NULL PRIMARY KEY,
+	type       text NOT NULL,
+	actor      text NOT NULL,
+	client     text NOT NULL,
+	subject    text NOT NULL,
+	metadata   jsonb NOT NULL,
+	created_at timestamp with time zone NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS audit_client_idx ON audit (client, created_at ASC)`,
+	`CREATE TABLE IF NOT EXISTS authorize_archive (
+	client       text NOT NULL,
+	code         text NOT NULL,
+	expires_in   int NOT NULL,
+	scope        text,
+	redirect_uri text,
+	state        text,
+	extra        text NOT NULL,
+	created_at   timestamp with time zone NOT NULL,
+	code_challenge        text,
+	code_challenge_method text,
+	issued_ip             text,
+	user_agent            text,
+	resources             text[],
+	authorization_details jsonb,
+	archived_at  timestamp with time zone NOT NULL
+)`, `CREATE TABLE IF NOT EXISTS access_archive (
+	client        text NOT NULL,
+	authorize     text,
+	previous      text,
+	access_token  text NOT NULL,
+	refresh_token text,
+	expires_in    int NOT NULL,
+	scope         text,
+	redirect_uri  text,
+	extra         text NOT NULL,
+	created_at    timestamp with time zone NOT NULL,
+	issued_ip     text,
+	user_agent    text,
+	dpop_jkt      text,
+	x5t_s256      text,
+	resources     text[],
+	authorization_details jsonb,
+	archived_at   timestamp with time zone NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS access_archive_archived_at_idx ON access_archive (archived_at ASC)`,
+	`CREATE INDEX IF NOT EXISTS authorize_archive_archived_at_idx ON authorize_archive (archived_at ASC)`,
+	// Optional fields are stored as NULL instead of empty strings. Relax tables created by earlier versions.
+	`ALTER TABLE authorize ALTER COLUMN scope DROP NOT NULL, ALTER COLUMN redirect_uri DROP NOT NULL, ALTER COLUMN state DROP NOT NULL`,
+	`ALTER TABLE access ALTER COLUMN authorize DROP NOT NULL, ALTER COLUMN previous DROP NOT NULL, ALTER COLUMN refresh_token DROP NOT NULL, ALTER COLUMN scope DROP NOT NULL, ALTER COLUMN redirect_uri DROP NOT NULL`,
+	// PKCE code challenges (RFC 7636) were not stored by earlier versions.
+	`ALTER TABLE authorize ADD COLUMN IF NOT EXISTS code_challenge text, ADD COLUMN IF NOT EXISTS code_challenge_method text`,
+	`ALTER TABLE authorize_archive ADD COLUMN IF NOT EXISTS code_challenge text, ADD COLUMN IF NOT EXISTS code_challenge_method text`,
+	// Refresh tokens in their grace period (WithRefreshGracePeriod) were not supported by earlier versions.
+	`ALTER TABLE refresh ADD COLUMN IF NOT EXISTS rotated_at timestamp with time zone`,
+	// Refresh token expiry (WithRefreshExpiry) was not tracked by earlier versions.
+	`ALTER TABLE refresh ADD COLUMN IF NOT EXISTS last_used_at timestamp with time zone, ADD COLUMN IF NOT EXISTS absolute_expiry timestamp with time zone`,
+	// Per-client token lifetimes (SetClientTokenTTL) were not supported by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS access_ttl int, ADD COLUMN IF NOT EXISTS refresh_ttl int`,
+	// Refresh token usage (ListUnusedRefreshTokens) was not tracked by earlier versions.
+	`ALTER TABLE refresh ADD COLUMN IF NOT EXISTS use_count int NOT NULL DEFAULT 0`,
+	// The origin of issued tokens (SaveAccessWithMetadata) was not recorded by earlier versions.
+	`ALTER TABLE authorize ADD COLUMN IF NOT EXISTS issued_ip text, ADD COLUMN IF NOT EXISTS user_agent text`,
+	`ALTER TABLE authorize_archive ADD COLUMN IF NOT EXISTS issued_ip text, ADD COLUMN IF NOT EXISTS user_agent text`,
+	`ALTER TABLE access ADD COLUMN IF NOT EXISTS issued_ip text, ADD COLUMN IF NOT EXISTS user_agent text`,
+	`ALTER TABLE access_archive ADD COLUMN IF NOT EXISTS issued_ip text, ADD COLUMN IF NOT EXISTS user_agent text`,
+	// DPoP bound tokens (RFC 9449) were not supported by earlier versions.
+	`ALTER TABLE access ADD COLUMN IF NOT EXISTS dpop_jkt text`,
+	`ALTER TABLE access_archive ADD COLUMN IF NOT EXISTS dpop_jkt text`,
+	// Certificate bound tokens (RFC 8705) were not supported by earlier versions.
+	`ALTER TABLE access ADD COLUMN IF NOT EXISTS x5t_s256 text`,
+	`ALTER TABLE access_archive ADD COLUMN IF NOT EXISTS x5t_s256 text`,
+	// Resource indicators (RFC 8707) were not stored by earlier versions.
+	`ALTER TABLE authorize ADD COLUMN IF NOT EXISTS resources text[]`,
+	`ALTER TABLE authorize_archive ADD COLUMN IF NOT EXISTS resources text[]`,
+	`ALTER TABLE access ADD COLUMN IF NOT EXISTS resources text[]`,
+	`ALTER TABLE access_archive ADD COLUMN IF NOT EXISTS resources text[]`,
+	// Rich authorization requests (RFC 9396) were not stored by earlier versions.
+	`ALTER TABLE authorize ADD COLUMN IF NOT EXISTS authorization_details jsonb`,
+	`ALTER TABLE authorize_archive ADD COLUMN IF NOT EXISTS authorization_details jsonb`,
+	`ALTER TABLE access ADD COLUMN IF NOT EXISTS authorization_details jsonb`,
+	`ALTER TABLE access_archive ADD COLUMN IF NOT EXISTS authorization_details jsonb`,
+	// Trusted first-party clients were not marked by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS is_trusted boolean NOT NULL DEFAULT false`,
+	// Client branding was not stored by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS display_name text NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS logo_uri text NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS policy_uri text NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS tos_uri text NOT NULL DEFAULT ''`,
+	// Allowed CORS origins of clients were not stored by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS allowed_origins text[]`,
+	// Post logout redirect URIs of clients were not stored by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS post_logout_redirect_uris text[]`,
+	// Back-channel logout registrations of clients were not stored by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS backchannel_logout_uri text, ADD COLUMN IF NOT EXISTS backchannel_logout_session_required boolean NOT NULL DEFAULT false`,
+	// Clients could not be disabled or soft-deleted in earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS enabled boolean NOT NULL DEFAULT true, ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone`,
+	// Client versions for optimistic concurrency control were not stored by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1`,
+	// Expiry checks computed created_at + expires_in in earlier versions. The expression is computed in UTC, as
+	// generated columns require an immutable expression. Adding the columns rewrites the tables.
+	`ALTER TABLE authorize ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone GENERATED ALWAYS AS (((created_at AT TIME ZONE 'UTC') + expires_in * interval '1 second') AT TIME ZONE 'UTC') STORED`,
+	`CREATE INDEX IF NOT EXISTS authorize_expires_at_idx ON authorize (expires_at ASC)`,
+	`ALTER TABLE access ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone GENERATED ALWAYS AS (((created_at AT TIME ZONE 'UTC') + expires_in * interval '1 second') AT TIME ZONE 'UTC') STORED`,
+	`CREATE INDEX IF NOT EXISTS access_expires_at_idx ON access (expires_at ASC)`,
+	// Secret rotations were not recorded by earlier versions.
+	`CREATE TABLE IF NOT EXISTS client_secret_history (
+	id          bigserial NOT NULL PRIMARY KEY,
+	client      text NOT NULL,
+	secret_hash text NOT NULL,
+	actor       text NOT NULL,
+	rotated_at  timestamp with time zone NOT NULL
+)`, `CREATE INDEX IF NOT EXISTS client_secret_history_client_idx ON client_secret_history (client, rotated_at ASC)`,
+	// Client owners were not stored by earlier versions.
+	`ALTER TABLE client ADD COLUMN IF NOT EXISTS owner text`,
+	`CREATE INDEX IF NOT EXISTS client_owner_idx ON client (owner)`,
+	// The user of access tokens was not stored by earlier versions. The index on the whole UserData failed for large
+	// UserData and is replaced.
+	`ALTER TABLE access ADD COLUMN IF NOT EXISTS user_ref text`,
+	`DROP INDEX IF EXISTS access_extra_idx`,
+	`CREATE INDEX IF NOT EXISTS access_user_ref_idx ON access (user_ref, expires_at)`,
+	// Keeps the newest active key per algorithm, so that the unique index can be created. Once it exists, the keys
+	// are left alone, as EnableMultiTenancy scopes the index per tenant.
+	`UPDATE signing_key SET active=false WHERE to_regclass('signing_key_active_idx') IS NULL AND active AND kid NOT IN (SELECT DISTINCT ON (alg) kid FROM signing_key WHERE active ORDER BY alg, not_before DESC, kid)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS signing_key_active_idx ON signing_key (alg) WHERE active`,
+	`ALTER TABLE access_archive ADD COLUMN IF NOT EXISTS user_ref text`}
 
 // Storage implements interface "github.com/openshift/osin".Storage and interface "github.com/anaxilaus/osin-postgres".Storage
 type Storage struct {
 	db *sql.DB
+
+	// tx is set if the storage is bound to a transaction. All queries are then executed within tx and
+	// it is up to the owner of tx to commit or roll back.
+	tx *sql.Tx
+
+	// pending collects the functions to run after tx was committed. See afterCommit.
+	pending *[]func()
+
+	audit         bool
+	actor         string
+	auditMetadata map[string]string
+	hooks         hookList
+	channel       string
+	clients       *clientCache
+
+	replicas  *replicaSet
+	lastWrite *int64
+
+	retryPolicy RetryPolicy
+	breaker     *breaker
+	timeouts    map[string]time.Duration
+	timeout     time.Duration
+	maxLifetime time.Duration
+	lifetime    LifetimePolicy
+	unlogged    []string
+	slowQuery   time.Duration
+	isolation   sql.IsolationLevel
+	isolations  map[string]sql.IsolationLevel
+	debug       *int32
+	archive     bool
+	metrics     Metrics
+	dialect     Dialect
+	clock       Clock
+	rotate      bool
+	grace       time.Duration
+	refreshTTL  refreshExpiry
+	usage       *usageCounter
+	revocations bool
+	idempotent  bool
+	userRef     func(userData interface{}) string
+
+	// stmts caches the prepared statements. It is shared with all storages derived from this one by Clone
+	// or AuditAs, which are marked as borrowed and do not close it.
+	stmts    *stmtCache
+	borrowed bool
+
+	readOnly bool
+
+	// tenant restricts the storage to the rows of a tenant, see ForTenant.
+	tenant         string
+	multiTenant    bool
+	tenantVariable string
+
+	// schema restricts the storage to the tables of a tenant schema, see ForTenantSchema.
+	schema string
+
+	// ownsDB is set if the storage opened db itself with NewFromDSN and closes it on Close.
+	ownsDB bool
+	pool   PoolConfig
+
+	// failover selects the node connections are opened to, see NewFromDSNs.
+	failover      *failover
+	probeInterval time.Duration
+
+	// drain tracks the operations in flight for Shutdown. It is shared with all copies of the storage.
+	drain           *drain
+	shutdownTimeout time.Duration
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// dbtx is the connection operations run their queries on. See ctxConn.
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlConn is implemented by *sql.DB and *sql.Tx.
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// ctxConn implements dbtx by running all queries on conn with the context of the operation. Queries run as
+// prepared statements from stmts, if set.
+type ctxConn struct {
+	ctx   context.Context
+	conn  sqlConn
+	stmts *stmtCache
+}
+
+func (c ctxConn) Exec(query string, args ...interface{}) (res sql.Result, err error) {
+	noteTable(c.ctx, query)
+	defer func(start time.Time) {
+		rows := int64(-1)
+		if err == nil {
+			if n, err := res.RowsAffected(); err == nil {
+				rows = n
+			}
+		}
+		logQuery(c.ctx, start, query, args, rows)
+	}(time.Now())
+	if stmt := c.stmt(query); stmt != nil {
+		return stmt.ExecContext(c.ctx, args...)
+	}
+	return c.conn.ExecContext(c.ctx, query, args...)
+}
+
+func (c ctxConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	noteTable(c.ctx, query)
+	defer logQuery(c.ctx, time.Now(), query, args, -1)
+	if stmt := c.stmt(query); stmt != nil {
+		return stmt.QueryContext(c.ctx, args...)
+	}
+	return c.conn.QueryContext(c.ctx, query, args...)
+}
+
+func (c ctxConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	noteTable(c.ctx, query)
+	defer logQuery(c.ctx, time.Now(), query, args, -1)
+	if stmt := c.stmt(query); stmt != nil {
+		return stmt.QueryRowContext(c.ctx, args...)
+	}
+	return c.conn.QueryRowContext(c.ctx, query, args...)
 }
 
 // New returns a new postgres storage instance.
-func New(db *sql.DB) *Storage {
-	return &Storage{db}
+func New(db *sql.DB, opts ...Option) *Storage {
+	s := &Storage{db: db, stmts: newStmtCache(db), debug: new(int32), drain: newDrain()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// conn returns the connection for writes, which is the transaction the storage is bound to or the primary
+// database otherwise.
+func (s *Storage) conn() sqlConn {
+	s.markWrite()
+	return s.primary()
+}
+
+// primary returns the transaction the storage is bound to or the primary database otherwise.
+func (s *Storage) primary() sqlConn {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// read runs the read-only operation op. fn runs against a replica, if one is configured and reads do not stick
+// to the primary. If fn does not find a row on the replica, it is run again against the primary.
+func (s *Storage) read(op string, fn func(conn dbtx) error) error {
+	return s.readContext(context.Background(), op, fn)
+}
+
+// readContext is read with a context, which limits the operation in addition to its timeout.
+func (s *Storage) readContext(ctx context.Context, op string, fn func(conn dbtx) error) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.leave()
+	ctx, cancel := s.context(ctx, op)
+	defer cancel()
+	defer func(start time.Time) { s.observe(ctx, start, err) }(time.Now())
+	return classify(s.retry(ctx, func() error {
+		replica := s.replica()
+		if replica == nil {
+			return s.scoped(ctx, s.primary(), fn)
+		}
+		if err := s.scoped(ctx, replica, fn); err != sql.ErrNoRows && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return s.scoped(ctx, s.primary(), fn)
+	}))
+}
+
+// write runs the operation op against the primary database.
+func (s *Storage) write(op string, fn func(conn dbtx) error) error {
+	return s.writeContext(context.Background(), op, fn)
+}
+
+// writeContext is write with a context, which limits the operation in addition to its timeout.
+func (s *Storage) writeContext(ctx context.Context, op string, fn func(conn dbtx) error) (err error) {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.leave()
+	ctx, cancel := s.context(ctx, op)
+	defer cancel()
+	defer func(start time.Time) { s.observe(ctx, start, err) }(time.Now())
+	return classify(s.retry(ctx, func() error {
+		return s.scoped(ctx, s.conn(), fn)
+	}))
+}
+
+// writeCount runs the operation op, which executes query against the primary database, and returns the number
+// of affected rows.
+func (s *Storage) writeCount(op, query string, args ...interface{}) (n int64, err error) {
+	err = s.write(op, func(conn dbtx) (err error) {
+		n, err = execCount(conn, query, args...)
+		return err
+	})
+	return n, err
+}
+
+// inTx runs the operation op within a transaction. If the storage is already bound to a transaction, fn runs
+// within it, otherwise a new transaction is started and committed if fn returns nil or rolled back if not.
+func (s *Storage) inTx(op string, fn func(tx dbtx) error) error {
+	return s.inTxContext(context.Background(), op, fn)
+}
+
+// inTxContext is inTx with a context, which limits the operation in addition to its timeout.
+func (s *Storage) inTxContext(ctx context.Context, op string, fn func(tx dbtx) error) (err error) {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.leave()
+	ctx, cancel := s.context(ctx, op)
+	defer cancel()
+	defer func(start time.Time) { s.observe(ctx, start, err) }(time.Now())
+	if s.tx != nil {
+		return classify(fn(ctxConn{ctx, s.tx, s.stmts}))
+	}
+	return classify(s.retry(ctx, func() error {
+		return s.runTx(ctx, op, fn)
+	}))
+}
+
+// runTx runs fn within a new transaction of the operation op.
+func (s *Storage) runTx(ctx context.Context, op string, fn func(tx dbtx) error) error {
+	s.markWrite()
+	tx, err := s.db.BeginTx(ctx, s.txOptions(op))
+	if err != nil {
+		return errors.New(err)
+	}
+	if err := s.setTenant(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := fn(ctxConn{ctx, tx, s.stmts}); err != nil {
+		if rbe := tx.Rollback(); rbe != nil {
+			return errors.New(rbe)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// mutate runs the operation op. fn changes the entity identified by subject. If auditing, notifications or the
+// revocation list are enabled for the event type typ, fn and the recording of the event run in one transaction.
+func (s *Storage) mutate(op, typ, clientID, subject string, fn func(conn dbtx) error) error {
+	if !s.audit && !s.notifies(typ) && !s.recordsRevocation(typ) {
+		return s.write(op, func(conn dbtx) error {
+			noteClient(conn, clientID)
+			return fn(conn)
+		})
+	}
+	return s.mutateTx(op, typ, clientID, subject, fn)
+}
+
+// mutateTx is mutate running fn in a transaction even if no event is recorded, for operations of several
+// statements.
+func (s *Storage) mutateTx(op, typ, clientID, subject string, fn func(conn dbtx) error) error {
+	return s.inTx(op, func(tx dbtx) error {
+		noteClient(tx, clientID)
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := s.recordAudit(tx, typ, clientID, subject); err != nil {
+			return err
+		}
+		if err := s.recordRevocation(tx, typ, clientID, subject); err != nil {
+			return err
+		}
+		return s.notify(tx, typ, clientID, subject)
+	})
 }
 
 // CreateSchemas creates the schemata, if they do not exist yet in the database. Returns an error if something went wrong.
+// It can be run any number of times. All statements run in a single transaction, so either the whole schema is
+// created or nothing at all. The transaction holds an advisory lock, so instances starting simultaneously apply
+// the schema one after another instead of failing on each other's DDL. With DialectCockroachDB and
+// DialectYugabyteDB every statement runs in its own transaction without the lock, because they do not support
+// schema changes in transactions reliably.
 func (s *Storage) CreateSchemas() error {
-	for k, schema := range schemas {
-		if _, err := s.db.Exec(schema); err != nil {
+	unlogged, err := s.unloggedStatements()
+	if err != nil {
+		return err
+	}
+	if s.dialect.distributed() {
+		for _, schema := range schemas {
+			if err := s.inTx("CreateSchemas", func(tx dbtx) error {
+				return execSchemas(tx, []string{schema})
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return s.inTx("CreateSchemas", func(tx dbtx) error {
+		if err := lockSchema(tx); err != nil {
+			return err
+		}
+		if err := execSchemas(tx, schemas); err != nil {
+			return err
+		}
+		return execSchemas(tx, unlogged)
+	})
+}
+
+// schemaLockID is the key of the advisory lock held by transactions changing the schema.
+const schemaLockID int64 = 0x6f73696e5f7067 // "osin_pg"
+
+// lockSchema acquires the advisory lock for schema changes. It waits until concurrent schema changes of other
+// instances are committed and is released at the end of tx.
+func lockSchema(tx dbtx) error {
+	if _, err := tx.(ctxConn).unprepared().Exec("SELECT pg_advisory_xact_lock($1)", schemaLockID); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// execSchemas executes the schema statements within tx.
+func execSchemas(tx dbtx, statements []string) error {
+	conn := tx.(ctxConn).unprepared()
+	for k, schema := range statements {
+		if _, err := conn.Exec(schema); err != nil {
 			log.Printf("Error creating schema %d: %s", k, schema)
 			return err
 		}
@@ -66,110 +626,337 @@ func (s *Storage) CreateSchemas() error {
 	return nil
 }
 
+// DropSchemas drops all tables created by CreateSchemas including their data. It is the counterpart to
+// CreateSchemas for tearing down test and ephemeral environments. Tables which do not exist are skipped.
+func (s *Storage) DropSchemas() error {
+	if err := s.inTx("DropSchemas", func(tx dbtx) error {
+		_, err := tx.(ctxConn).unprepared().Exec("DROP TABLE IF EXISTS " + strings.Join(tables(), ", ") + " CASCADE")
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+
+	s.afterCommit(func() {
+		if s.stmts != nil {
+			s.stmts.close()
+		}
+		s.clearClients()
+	})
+	return nil
+}
+
+// Reset removes all data from the tables created by CreateSchemas but keeps the tables.
+func (s *Storage) Reset() error {
+	if err := s.inTx("Reset", func(tx dbtx) error {
+		query := "TRUNCATE " + strings.Join(tables(), ", ") + " RESTART IDENTITY CASCADE"
+		if s.dialect.distributed() {
+			// Serial columns of distributed databases cannot be restarted.
+			query = "TRUNCATE " + strings.Join(tables(), ", ") + " CASCADE"
+		}
+		_, err := tx.(ctxConn).unprepared().Exec(query)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+
+	s.afterCommit(s.clearClients)
+	return nil
+}
+
+// tables returns the names of the tables created by CreateSchemas.
+func tables() []string {
+	var names []string
+	for _, schema := range schemas {
+		if m := createTableRegexp.FindStringSubmatch(schema); m != nil {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+var createTableRegexp = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+)`)
+
 // Clone the storage if needed. For example, using mgo, you can clone the session with session.Clone
 // to avoid concurrent access problems.
 // This is to avoid cloning the connection at each method access.
-// Can return itself if not a problem.
+// Can return itself if not a problem. If replicas are configured, the clone tracks read stickiness on its own.
+// The clone shares the prepared statements of s, so closing it does not close them.
 func (s *Storage) Clone() osin.Storage {
-	return s
+	c := *s
+	c.borrowed = true
+	if s.replicas != nil {
+		c.lastWrite = new(int64)
+	}
+	return &c
 }
 
-// Close the resources the Storage potentially holds (using Clone for example)
+// Close the resources the Storage potentially holds (using Clone for example). Closing the storage returned by
+// New closes its prepared statements, which are prepared again on next use. If the storage owns the database,
+// because it was opened by NewFromDSN or passed with WithOwnedDB, Close shuts the storage down with Shutdown
+// instead, waiting for the operations in flight at most for the timeout of WithShutdownTimeout.
 func (s *Storage) Close() {
+	if s.borrowed {
+		return
+	}
+	if !s.ownsDB {
+		if s.stmts != nil {
+			s.stmts.close()
+		}
+		return
+	}
+
+	timeout := s.shutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Closing the storage with operations in flight: %s", err)
+	}
 }
 
-// GetClient loads the client by id
+// GetClient loads the client by id. The client is a *Client. Returns ErrClientNotFound if the client does not exist,
+// ErrClientDeleted if it was soft-deleted and ErrClientDisabled if it was disabled.
 func (s *Storage) GetClient(id string) (osin.Client, error) {
-	row := s.db.QueryRow("SELECT id, secret, redirect_uri, extra FROM client WHERE id=$1", id)
-	var c osin.DefaultClient
-	var extra string
+	cache := s.clients != nil && s.tx == nil
+	if cache {
+		if c := s.clients.get(id); c != nil {
+			return c, nil
+		}
+	}
+
+	c, err := s.lookupClient("GetClient", id)
+	if err != nil {
+		return nil, err
+	}
+	if !c.DeletedAt.IsZero() {
+		return nil, ErrClientDeleted
+	} else if c.Disabled {
+		return nil, ErrClientDisabled
+	}
+	if cache {
+		s.clients.put(c)
+	}
+	return c, nil
+}
+
+// LookupClient loads the client by id like GetClient, but returns disabled and soft-deleted clients as well, e.g.
+// for administration. Returns ErrClientNotFound if the client does not exist.
+func (s *Storage) LookupClient(id string) (*Client, error) {
+	return s.lookupClient("LookupClient", id)
+}
 
-	if err := row.Scan(&c.Id, &c.Secret, &c.RedirectUri, &extra); err == sql.ErrNoRows {
-		return nil, ErrNotFound
+func (s *Storage) lookupClient(op, id string) (*Client, error) {
+	var c Client
+	var extra string
+	var deletedAt sql.NullTime
+	if err := s.read(op, func(conn dbtx) error {
+		noteClient(conn, id)
+		return conn.QueryRow("SELECT "+clientColumns("")+" FROM client WHERE id=$1", id).Scan(clientDest(&c, &extra, &deletedAt)...)
+	}); err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
 	} else if err != nil {
 		return nil, errors.New(err)
 	}
 	c.UserData = extra
+	c.DeletedAt = deletedAt.Time
 	return &c, nil
 }
 
+// clientColumns returns the columns of the client table scanned by clientDest, qualified with alias unless it is
+// empty.
+func clientColumns(alias string) string {
+	if alias != "" {
+		alias += "."
+	}
+	return alias + "id, " + alias + "secret, " + alias + "redirect_uri, " + alias + "extra, " + alias + "is_trusted, " +
+		alias + "display_name, " + alias + "logo_uri, " + alias + "policy_uri, " + alias + "tos_uri, NOT " + alias + "enabled, " +
+		alias + "deleted_at, " + alias + "version"
+}
+
+// clientDest returns the destinations of the columns returned by clientColumns.
+func clientDest(c *Client, extra *string, deletedAt *sql.NullTime) []interface{} {
+	return []interface{}{&c.Id, &c.Secret, &c.RedirectUri, extra, &c.Trusted, &c.Metadata.DisplayName, &c.Metadata.LogoURI, &c.Metadata.PolicyURI, &c.Metadata.TOSURI, &c.Disabled, deletedAt, &c.Version}
+}
+
 // UpdateClient updates the client (identified by it's id) and replaces the values with the values of client.
+// The trust and metadata of the client are replaced only if client implements TrustedClient and MetadataClient,
+// and the secret is kept if client implements SecretKeepingClient. The version of the client is incremented, see UpdateClientIfVersion.
+// Returns ErrClientNotFound if the client does not exist.
 func (s *Storage) UpdateClient(c osin.Client) error {
+	return s.updateClient("UpdateClient", c, nil)
+}
+
+// UpdateClientIfVersion is UpdateClient, which updates the client only if its version still equals version, the
+// Version of the client when it was loaded with GetClient or LookupClient. Returns ErrConflict if the client was
+// updated in the meantime, so that concurrent edits do not overwrite each other.
+func (s *Storage) UpdateClientIfVersion(c osin.Client, version int64) error {
+	return s.updateClient("UpdateClientIfVersion", c, &version)
+}
+
+// updateClient runs the operation op, which updates the client if version is nil or equals its version.
+func (s *Storage) updateClient(op string, c osin.Client, version *int64) error {
 	data, err := assertToString(c.GetUserData())
 	if err != nil {
 		return err
 	}
 
-	if _, err := s.db.Exec("UPDATE client SET (secret, redirect_uri, extra) = ($2, $3, $4) WHERE id=$1", c.GetId(), c.GetSecret(), c.GetRedirectUri(), data); err != nil {
-		return errors.New(err)
+	if err := s.mutateTx(op, AuditClientUpdated, c.GetId(), c.GetId(), func(conn dbtx) error {
+		// The previous secret is returned from the row locked by the update, so concurrent rotations are recorded
+		// one after another.
+		previous, err := queryStrings(conn,
+			"UPDATE client SET (secret, redirect_uri, extra, is_trusted, display_name, logo_uri, policy_uri, tos_uri, version) = (COALESCE($2, client.secret), $3, $4, COALESCE($5, client.is_trusted), COALESCE($6, client.display_name), COALESCE($7, client.logo_uri), COALESCE($8, client.policy_uri), COALESCE($9, client.tos_uri), client.version + 1) FROM (SELECT id, secret FROM client WHERE id=$1 FOR UPDATE) old WHERE client.id=old.id AND ($10::bigint IS NULL OR client.version=$10) RETURNING old.secret",
+			append(append([]interface{}{c.GetId(), clientSecret(c), c.GetRedirectUri(), data, clientTrust(c)}, clientMetadata(c)...), version)...)
+		if err != nil {
+			return err
+		}
+		if len(previous) > 0 {
+			if KeepsSecret(c) || previous[0] == c.GetSecret() {
+				return nil
+			}
+			return s.recordSecretRotation(conn, c.GetId(), previous[0])
+		}
+
+		if version != nil {
+			var exists bool
+			if err := conn.QueryRow("SELECT EXISTS (SELECT 1 FROM client WHERE id=$1)", c.GetId()).Scan(&exists); err != nil {
+				return errors.New(err)
+			} else if exists {
+				return ErrConflict
+			}
+		}
+		return ErrClientNotFound
+	}); err != nil {
+		return err
 	}
+
+	s.afterCommit(func() {
+		s.evictClient(c.GetId())
+		s.hooks.clientChanged(c.GetId())
+	})
 	return nil
 }
 
 // CreateClient stores the client in the database and returns an error, if something went wrong.
+// The client is trusted only if it implements TrustedClient and is trusted, and has metadata only if it implements
+// MetadataClient.
+// Returns ErrDuplicateKey if a client with the same id exists.
 func (s *Storage) CreateClient(c osin.Client) error {
 	data, err := assertToString(c.GetUserData())
 	if err != nil {
 		return err
 	}
 
-	if _, err := s.db.Exec("INSERT INTO client (id, secret, redirect_uri, extra) VALUES ($1, $2, $3, $4)", c.GetId(), c.GetSecret(), c.GetRedirectUri(), data); err != nil {
-		return errors.New(err)
+	if err := s.mutate("CreateClient", AuditClientCreated, c.GetId(), c.GetId(), func(conn dbtx) error {
+		if _, err := conn.Exec(
+			"INSERT INTO client (id, secret, redirect_uri, extra, is_trusted, display_name, logo_uri, policy_uri, tos_uri) VALUES ($1, $2, $3, $4, $5, COALESCE($6, ''), COALESCE($7, ''), COALESCE($8, ''), COALESCE($9, ''))",
+			append([]interface{}{c.GetId(), c.GetSecret(), c.GetRedirectUri(), data, IsTrustedClient(c)}, clientMetadata(c)...)...); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+
+	s.afterCommit(func() {
+		s.hooks.clientChanged(c.GetId())
+		s.hooks.clientCreated(c)
+	})
 	return nil
 }
 
 // RemoveClient removes a client (identified by id) from the database. Returns an error if something went wrong.
+// Removing a client which does not exist is not an error.
 func (s *Storage) RemoveClient(id string) (err error) {
-	if _, err = s.db.Exec("DELETE FROM client WHERE id=$1", id); err != nil {
-		return errors.New(err)
+	if err := s.mutate("RemoveClient", AuditClientDeleted, id, id, func(conn dbtx) error {
+		if _, err := conn.Exec("DELETE FROM client WHERE id=$1", id); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+
+	s.afterCommit(func() {
+		s.evictClient(id)
+		s.hooks.clientChanged(id)
+	})
 	return nil
 }
 
 // SaveAuthorize saves authorize data.
 func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) (err error) {
+	return s.SaveAuthorizeWithMetadata(data, IssueMetadata{})
+}
+
+// SaveAuthorizeWithMetadata is SaveAuthorize, which records where the code was issued.
+func (s *Storage) SaveAuthorizeWithMetadata(data *osin.AuthorizeData, meta IssueMetadata) (err error) {
 	extra, err := assertToString(data.UserData)
 	if err != nil {
 		return err
 	}
+	if err := s.limitLifetime(&data.ExpiresIn); err != nil {
+		return err
+	}
 
-	if _, err = s.db.Exec(
-		"INSERT INTO authorize (client, code, expires_in, scope, redirect_uri, state, created_at, extra) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		data.Client.GetId(),
-		data.Code,
-		data.ExpiresIn,
-		data.Scope,
-		data.RedirectUri,
-		data.State,
-		data.CreatedAt,
-		extra,
-	); err != nil {
-		return errors.New(err)
+	if err := s.mutate("SaveAuthorize", AuditAuthorizeIssued, data.Client.GetId(), HashToken(data.Code), func(conn dbtx) error {
+		return s.idempotentSave(conn, func(conn dbtx) error {
+			return s.insertToken(conn,
+				"INSERT INTO authorize (client, code, expires_in, scope, redirect_uri, state, created_at, extra, code_challenge, code_challenge_method, issued_ip, user_agent, resources, authorization_details) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)",
+				data.Client.GetId(),
+				data.Code,
+				data.ExpiresIn,
+				nullString(data.Scope),
+				nullString(data.RedirectUri),
+				nullString(data.State),
+				data.CreatedAt,
+				extra,
+				nullString(data.CodeChallenge),
+				nullString(data.CodeChallengeMethod),
+				nullString(meta.IP),
+				nullString(meta.UserAgent),
+				nullArray(meta.Resources),
+				nullJSON(meta.AuthorizationDetails),
+			)
+		})
+	}); err == errAlreadySaved {
+		return nil
+	} else if err != nil {
+		return err
 	}
+
+	s.afterCommit(func() { s.hooks.authorizeSaved(data) })
 	return nil
 }
 
-// LoadAuthorize looks up AuthorizeData by a code.
+// LoadAuthorize looks up AuthorizeData by a code. Returns ErrTokenNotFound if the code does not exist.
 // Client information MUST be loaded together.
 // Optionally can return error if expired.
 func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
 	var data osin.AuthorizeData
 	var extra string
 	var cid string
-	if err := s.db.QueryRow("SELECT client, code, expires_in, scope, redirect_uri, state, created_at, extra FROM authorize WHERE code=$1 LIMIT 1", code).Scan(&cid, &data.Code, &data.ExpiresIn, &data.Scope, &data.RedirectUri, &data.State, &data.CreatedAt, &extra); err == sql.ErrNoRows {
-		return nil, ErrNotFound
+	if err := s.read("LoadAuthorize", func(conn dbtx) error {
+		err := conn.QueryRow("SELECT client, code, expires_in, COALESCE(scope, ''), COALESCE(redirect_uri, ''), COALESCE(state, ''), created_at, extra, COALESCE(code_challenge, ''), COALESCE(code_challenge_method, '') FROM authorize WHERE code=$1 LIMIT 1", code).Scan(&cid, &data.Code, &data.ExpiresIn, &data.Scope, &data.RedirectUri, &data.State, &data.CreatedAt, &extra, &data.CodeChallenge, &data.CodeChallengeMethod)
+		noteClient(conn, cid)
+		return err
+	}); err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
 	} else if err != nil {
 		return nil, errors.New(err)
 	}
 	data.UserData = extra
+	if err := s.capLifetime(data.CreatedAt, &data.ExpiresIn); err != nil {
+		return nil, err
+	}
 
 	c, err := s.GetClient(cid)
 	if err != nil {
 		return nil, err
 	}
 
-	if data.ExpireAt().Before(time.Now()) {
+	if data.ExpireAt().Before(s.now()) {
 		return nil, errors.Errorf("Token expired at %s.", data.ExpireAt().String())
 	}
 
@@ -179,15 +966,34 @@ func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
 
 // RemoveAuthorize revokes or deletes the authorization code.
 func (s *Storage) RemoveAuthorize(code string) (err error) {
-	if _, err = s.db.Exec("DELETE FROM authorize WHERE code=$1", code); err != nil {
-		return errors.New(err)
+	if err := s.mutate("RemoveAuthorize", AuditAuthorizeConsumed, "", HashToken(code), func(conn dbtx) error {
+		query, args := s.deleteQuery("authorize", "code=$1", "", code)
+		if _, err := conn.Exec(query, args...); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+
+	s.afterCommit(func() { s.hooks.authorizeRemoved(code) })
 	return nil
 }
 
 // SaveAccess writes AccessData.
 // If RefreshToken is not blank, it must save in a way that can be loaded using LoadRefresh.
+// See WithRotation to remove the access token it was refreshed from.
 func (s *Storage) SaveAccess(data *osin.AccessData) (err error) {
+	return s.SaveAccessWithMetadata(data, IssueMetadata{})
+}
+
+// SaveAccessWithMetadata is SaveAccess, which records where the token was issued.
+func (s *Storage) SaveAccessWithMetadata(data *osin.AccessData, meta IssueMetadata) (err error) {
+	return s.saveAccess(data, meta, nil)
+}
+
+// saveAccess saves data and, if not nil, the token exchange it was issued by.
+func (s *Storage) saveAccess(data *osin.AccessData, meta IssueMetadata, exchange *TokenExchange) (err error) {
 	prev := ""
 	authorizeData := &osin.AuthorizeData{}
 
@@ -204,114 +1010,245 @@ func (s *Storage) SaveAccess(data *osin.AccessData) (err error) {
 		return err
 	}
 
-	tx, err := s.db.Begin()
-	if err != nil {
-		return errors.New(err)
-	}
-
-	if data.RefreshToken != "" {
-		if err := s.saveRefresh(tx, data.RefreshToken, data.AccessToken); err != nil {
-			return err
-		}
-	}
-
 	if data.Client == nil {
 		return errors.New("data.Client must not be nil")
 	}
+	if err := s.limitLifetime(&data.ExpiresIn); err != nil {
+		return err
+	}
 
-	_, err = tx.Exec("INSERT INTO access (client, authorize, previous, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, extra) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", data.Client.GetId(), authorizeData.Code, prev, data.AccessToken, data.RefreshToken, data.ExpiresIn, data.Scope, data.RedirectUri, data.CreatedAt, extra)
-	if err != nil {
-		if rbe := tx.Rollback(); rbe != nil {
-			return errors.New(rbe)
-		}
-		return errors.New(err)
+	event := AuditAccessIssued
+	if prev != "" {
+		event = AuditAccessRefreshed
 	}
 
-	if err = tx.Commit(); err != nil {
-		return errors.New(err)
+	var rotated *revokedTokens
+	if err := s.inTx("SaveAccess", func(tx dbtx) error {
+		return s.idempotentSave(tx, func(tx dbtx) (err error) {
+			noteClient(tx, data.Client.GetId())
+			// The absolute expiry is inherited from the refresh tokens of prev, which are superseded below.
+			var absoluteExpiry sql.NullTime
+			if data.RefreshToken != "" {
+				if absoluteExpiry, err = s.absoluteExpiry(tx, prev); err != nil {
+					return err
+				}
+			}
+
+			if (s.rotate || s.grace > 0) && prev != "" {
+				if rotated, err = s.rotateTx(tx, data.Client.GetId(), prev, data.AccessToken); err != nil {
+					return err
+				}
+			}
+
+			if data.RefreshToken != "" {
+				if err := s.saveRefresh(tx, data.RefreshToken, data.AccessToken, data.Client.GetId(), absoluteExpiry); err != nil {
+					return err
+				}
+			}
+
+			if err := s.insertToken(tx, "INSERT INTO access (client, authorize, previous, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, extra, issued_ip, user_agent, dpop_jkt, x5t_s256, resources, authorization_details, user_ref) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, COALESCE($15, (SELECT resources FROM authorize WHERE code=$2 LIMIT 1)), COALESCE($16, (SELECT authorization_details FROM authorize WHERE code=$2 LIMIT 1)), $17)", data.Client.GetId(), nullString(authorizeData.Code), nullString(prev), data.AccessToken, nullString(data.RefreshToken), data.ExpiresIn, nullString(data.Scope), nullString(data.RedirectUri), data.CreatedAt, extra, nullString(meta.IP), nullString(meta.UserAgent), nullString(meta.DPoPThumbprint), nullString(meta.CertificateThumbprint), nullArray(meta.Resources), nullJSON(meta.AuthorizationDetails), nullString(s.userRefOf(meta.UserRef, data.UserData))); err != nil {
+				return err
+			}
+			if exchange != nil {
+				if err := s.saveExchange(tx, data.AccessToken, exchange); err != nil {
+					return err
+				}
+			}
+			return s.recordAudit(tx, event, data.Client.GetId(), HashToken(data.AccessToken))
+		})
+	}); err == errAlreadySaved {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
+	s.afterCommit(func() {
+		if rotated != nil {
+			rotated.runHooks()
+		}
+		s.hooks.accessSaved(data)
+	})
 	return nil
 }
 
-// LoadAccess retrieves access data by token. Client information MUST be loaded together.
+// LoadAccess retrieves access data by token. Returns ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
 // AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
 // Optionally can return error if expired.
+// Loads are counted if usage tracking is enabled, see WithUsageTracking.
 func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	return s.LoadAccessWith(code, LoadAccessOptions{})
+}
+
+// loadAccess is LoadAccess without counting the load. It loads the previous access data with loadAccess as well,
+// unless opts.SkipPrevious is set.
+func (s *Storage) loadAccess(code string, opts LoadAccessOptions) (*osin.AccessData, error) {
 	var extra, cid, prevAccessToken, authorizeCode string
 	var result osin.AccessData
 
-	if err := s.db.QueryRow(
-		"SELECT client, authorize, previous, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, extra FROM access WHERE access_token=$1 LIMIT 1",
-		code,
-	).Scan(
-		&cid,
-		&authorizeCode,
-		&prevAccessToken,
-		&result.AccessToken,
-		&result.RefreshToken,
-		&result.ExpiresIn,
-		&result.Scope,
-		&result.RedirectUri,
-		&result.CreatedAt,
-		&extra,
-	); err == sql.ErrNoRows {
-		return nil, ErrNotFound
+	if err := s.read("LoadAccess", func(conn dbtx) error {
+		err := conn.QueryRow(
+			"SELECT client, COALESCE(authorize, ''), COALESCE(previous, ''), access_token, COALESCE(refresh_token, ''), expires_in, COALESCE(scope, ''), COALESCE(redirect_uri, ''), created_at, extra FROM access WHERE access_token=$1 LIMIT 1",
+			code,
+		).Scan(
+			&cid,
+			&authorizeCode,
+			&prevAccessToken,
+			&result.AccessToken,
+			&result.RefreshToken,
+			&result.ExpiresIn,
+			&result.Scope,
+			&result.RedirectUri,
+			&result.CreatedAt,
+			&extra,
+		)
+		noteClient(conn, cid)
+		return err
+	}); err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
 	} else if err != nil {
 		return nil, errors.New(err)
 	}
 
 	result.UserData = extra
-	client, err := s.GetClient(cid)
-	if err != nil {
-		return nil, err
+	if opts.SkipClient {
+		result.Client = &osin.DefaultClient{Id: cid}
+	} else {
+		client, err := s.GetClient(cid)
+		if err != nil {
+			return nil, err
+		}
+		result.Client = client
 	}
 
-	result.Client = client
-	result.AuthorizeData, _ = s.LoadAuthorize(authorizeCode)
-	prevAccess, _ := s.LoadAccess(prevAccessToken)
-	result.AccessData = prevAccess
+	if authorizeCode != "" && !opts.SkipAuthorize {
+		result.AuthorizeData, _ = s.LoadAuthorize(authorizeCode)
+	}
+	if prevAccessToken != "" && !opts.SkipPrevious {
+		result.AccessData, _ = s.loadAccess(prevAccessToken, opts)
+	}
 	return &result, nil
 }
 
 // RemoveAccess revokes or deletes an AccessData.
 func (s *Storage) RemoveAccess(code string) (err error) {
-	_, err = s.db.Exec("DELETE FROM access WHERE access_token=$1", code)
-	if err != nil {
-		return errors.New(err)
+	if err := s.mutate("RemoveAccess", AuditAccessRevoked, "", HashToken(code), func(conn dbtx) error {
+		query, args := s.deleteQuery("access", "access_token=$1", "", code)
+		if _, err := conn.Exec(query, args...); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+
+	s.afterCommit(func() { s.hooks.accessRemoved(code) })
 	return nil
 }
 
-// LoadRefresh retrieves refresh AccessData. Client information MUST be loaded together.
+// LoadRefresh retrieves refresh AccessData. Returns ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
 // AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
 // Optionally can return error if expired.
+// The refresh token, its access data, client and authorize data are loaded in a single query, so the previous
+// access data is not loaded. Every resolution records the time and number of uses of the token, see
+// ListUnusedRefreshTokens.
 func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
-	row := s.db.QueryRow("SELECT access FROM refresh WHERE token=$1 LIMIT 1", code)
-	var access string
-	if err := row.Scan(&access); err == sql.ErrNoRows {
-		return nil, ErrNotFound
+	var lastUsedAt, absoluteExpiry sql.NullTime
+	var result osin.AccessData
+	var authorize osin.AuthorizeData
+	var authorizeCreatedAt, deletedAt sql.NullTime
+	var client Client
+	var clientExtra, extra, authorizeExtra string
+	if err := s.read("LoadRefresh", func(conn dbtx) error {
+		err := conn.QueryRow(
+			`SELECT r.last_used_at, r.absolute_expiry,
+a.access_token, COALESCE(a.refresh_token, ''), a.expires_in, COALESCE(a.scope, ''), COALESCE(a.redirect_uri, ''), a.created_at, a.extra,
+COALESCE(z.code, ''), COALESCE(z.expires_in, 0), COALESCE(z.scope, ''), COALESCE(z.redirect_uri, ''), COALESCE(z.state, ''), z.created_at, COALESCE(z.extra, ''), COALESCE(z.code_challenge, ''), COALESCE(z.code_challenge_method, ''),
+`+clientColumns("c")+`
+FROM refresh r JOIN access a ON a.access_token=r.access JOIN client c ON c.id=a.client LEFT JOIN authorize z ON z.code=a.authorize
+WHERE r.token=$1 AND (r.rotated_at IS NULL OR r.rotated_at > $2) LIMIT 1`,
+			code, s.graceStart(),
+		).Scan(append([]interface{}{
+			&lastUsedAt, &absoluteExpiry,
+			&result.AccessToken, &result.RefreshToken, &result.ExpiresIn, &result.Scope, &result.RedirectUri, &result.CreatedAt, &extra,
+			&authorize.Code, &authorize.ExpiresIn, &authorize.Scope, &authorize.RedirectUri, &authorize.State, &authorizeCreatedAt, &authorizeExtra, &authorize.CodeChallenge, &authorize.CodeChallengeMethod,
+		}, clientDest(&client, &clientExtra, &deletedAt)...)...)
+		noteClient(conn, client.Id)
+		return err
+	}); err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
 	} else if err != nil {
 		return nil, errors.New(err)
 	}
-	return s.LoadAccess(access)
+
+	if err := s.checkRefreshExpiry(lastUsedAt, absoluteExpiry); err != nil {
+		return nil, err
+	}
+	if !deletedAt.Time.IsZero() {
+		return nil, ErrClientDeleted
+	} else if client.Disabled {
+		return nil, ErrClientDisabled
+	}
+	client.UserData = clientExtra
+	result.Client = &client
+	result.UserData = extra
+
+	// Like loadAccess, an expired or missing authorize code is not loaded.
+	if authorize.Code != "" {
+		authorize.CreatedAt = authorizeCreatedAt.Time
+		authorize.UserData = authorizeExtra
+		authorize.Client = &client
+		if s.capLifetime(authorize.CreatedAt, &authorize.ExpiresIn) == nil && !authorize.ExpireAt().Before(s.now()) {
+			result.AuthorizeData = &authorize
+		}
+	}
+
+	if s.readOnly {
+		return &result, nil
+	}
+	if err := s.write("LoadRefresh", func(conn dbtx) error {
+		_, err := conn.Exec("UPDATE refresh SET last_used_at=$2, use_count=use_count+1 WHERE token=$1", code, s.now())
+		return err
+	}); err != nil {
+		return nil, errors.New(err)
+	}
+	return &result, nil
 }
 
-// RemoveRefresh revokes or deletes refresh AccessData.
+// RemoveRefresh revokes or deletes refresh AccessData. osin calls it after a refresh with the refresh token which
+// was used, so with WithRefreshGracePeriod refresh tokens rotated within the grace period are kept. Use
+// RevokeToken to revoke a refresh token unconditionally.
 func (s *Storage) RemoveRefresh(code string) error {
-	_, err := s.db.Exec("DELETE FROM refresh WHERE token=$1", code)
-	if err != nil {
-		return errors.New(err)
+	return s.removeRefresh("RemoveRefresh", code, "DELETE FROM refresh WHERE token=$1 AND (rotated_at IS NULL OR rotated_at <= $2)", s.graceStart())
+}
+
+// removeRefresh runs the operation op, which removes the refresh token code with query.
+func (s *Storage) removeRefresh(op, code, query string, args ...interface{}) error {
+	if err := s.mutate(op, AuditRefreshRevoked, "", HashToken(code), func(conn dbtx) error {
+		if _, err := conn.Exec(query, append([]interface{}{code}, args...)...); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+
+	s.afterCommit(func() { s.hooks.refreshRemoved(code) })
 	return nil
 }
 
-func (s *Storage) saveRefresh(tx *sql.Tx, refresh, access string) (err error) {
-	_, err = tx.Exec("INSERT INTO refresh (token, access) VALUES ($1, $2)", refresh, access)
-	if err != nil {
-		if rbe := tx.Rollback(); rbe != nil {
-			return errors.New(rbe)
-		}
+// saveRefresh saves the refresh token of access. The refresh token inherits absoluteExpiry, if valid, or expires
+// after the refresh token lifetime of the client or the absolute expiry of WithRefreshExpiry otherwise.
+func (s *Storage) saveRefresh(tx dbtx, refresh, access, clientID string, absoluteExpiry sql.NullTime) (err error) {
+	var defaultExpiry sql.NullTime
+	if s.refreshTTL.absolute > 0 {
+		defaultExpiry = sql.NullTime{Time: s.now().Add(s.refreshTTL.absolute), Valid: true}
+	}
+	if _, err = tx.Exec(
+		"INSERT INTO refresh (token, access, last_used_at, absolute_expiry) VALUES ($1, $2, $3, COALESCE($4, $3 + (SELECT refresh_ttl FROM client WHERE id=$5) * interval '1 second', $6))"+s.onConflict(),
+		refresh, access, s.now(), absoluteExpiry, clientID, defaultExpiry,
+	); err != nil {
 		return errors.New(err)
 	}
 	return nil
@@ -329,3 +1266,29 @@ func assertToString(in interface{}) (string, error) {
 	}
 	return "", errors.Errorf(`Could not assert "%v" to string`, in)
 }
+
+// nullString maps the empty string to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullArray maps empty arrays to NULL.
+func nullArray(a []string) interface{} {
+	if len(a) == 0 {
+		return nil
+	}
+	return pq.Array(a)
+}
+
+// nullJSON maps empty JSON to NULL.
+func nullJSON(j json.RawMessage) interface{} {
+	if len(j) == 0 {
+		return nil
+	}
+	return string(j)
+}
+
+// nullTime maps the zero time to NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -1,15 +1,30 @@
 package postgres
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/optimisticninja/osin-postgres/storage"
-	_ "github.com/lib/pq"
+	"github.com/optimisticninja/osin-postgres/storage/osintest"
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
 	"github.com/optimisticninja/osin"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -20,12 +35,31 @@ import (
 )
 
 var db *sql.DB
+var dsn string
 var store *Storage
+var dialect Dialect
 var userDataMock = "bar"
 
 func TestMain(m *testing.M) {
+	// OSIN_TEST_DSN runs the tests against an existing database instead of a container, e.g. a CockroachDB
+	// node in CI together with OSIN_TEST_DIALECT=cockroachdb.
+	if dsn = os.Getenv("OSIN_TEST_DSN"); dsn != "" {
+		var err error
+		if db, err = sql.Open("postgres", dsn); err != nil {
+			log.Fatalf("Could not connect to database: %s", err)
+		}
+		switch os.Getenv("OSIN_TEST_DIALECT") {
+		case "cockroachdb":
+			dialect = DialectCockroachDB
+		case "yugabytedb":
+			dialect = DialectYugabyteDB
+		}
+		os.Exit(run(m))
+	}
+
 	c, err := dockertest.ConnectToPostgreSQL(15, time.Second, func(url string) bool {
 		var err error
+		dsn = url
 		db, err = sql.Open("postgres", url)
 		if err != nil {
 			return false
@@ -37,12 +71,7 @@ func TestMain(m *testing.M) {
 		log.Fatalf("Could not connect to database: %s", err)
 	}
 
-	store = New(db)
-	if err = store.CreateSchemas(); err != nil {
-		log.Fatalf("Could not ping database: %v", err)
-	}
-
-	retCode := m.Run()
+	retCode := run(m)
 
 	// force teardown
 	tearDown(c)
@@ -50,10 +79,25 @@ func TestMain(m *testing.M) {
 	os.Exit(retCode)
 }
 
+func run(m *testing.M) int {
+	store = New(db, WithDialect(dialect))
+	if err := store.CreateSchemas(); err != nil {
+		log.Fatalf("Could not ping database: %v", err)
+	}
+	return m.Run()
+}
+
 func tearDown(c dockertest.ContainerID) {
 	c.KillRemove()
 }
 
+// postgresOnly skips tests of features which are only available with DialectPostgres.
+func postgresOnly(t *testing.T) {
+	if dialect != DialectPostgres {
+		t.Skipf("Not supported by %s", dialect)
+	}
+}
+
 func TestClientOperations(t *testing.T) {
 	create := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
 	createClient(t, store, create)
@@ -64,6 +108,112 @@ func TestClientOperations(t *testing.T) {
 	getClient(t, store, update)
 }
 
+func TestTrustedClient(t *testing.T) {
+	trusted := &Client{DefaultClient: osin.DefaultClient{Id: "trusted", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}, Trusted: true}
+	createClient(t, store, trusted)
+	defer store.RemoveClient(trusted.Id)
+	getClient(t, store, trusted)
+
+	// Updating with a client which does not know about trust keeps it.
+	updateClient(t, store, &osin.DefaultClient{Id: "trusted", Secret: "secret123", RedirectUri: "http://localhost/", UserData: ""})
+	client, err := store.GetClient(trusted.Id)
+	require.Nil(t, err)
+	assert.True(t, IsTrustedClient(client))
+	assert.Equal(t, "secret123", client.GetSecret())
+
+	trusted.Trusted = false
+	updateClient(t, store, trusted)
+	client, err = store.GetClient(trusted.Id)
+	require.Nil(t, err)
+	assert.False(t, IsTrustedClient(client))
+	assert.False(t, IsTrustedClient(&osin.DefaultClient{}))
+}
+
+func TestClientMetadata(t *testing.T) {
+	metadata := ClientMetadata{DisplayName: "Example", LogoURI: "https://example.com/logo.png", PolicyURI: "https://example.com/privacy", TOSURI: "https://example.com/tos"}
+	client := &Client{DefaultClient: osin.DefaultClient{Id: "branded", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}, Metadata: metadata}
+	createClient(t, store, client)
+	defer store.RemoveClient(client.Id)
+	getClient(t, store, client)
+
+	// Updating with a client without metadata keeps it.
+	updateClient(t, store, &osin.DefaultClient{Id: "branded", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""})
+	getClient(t, store, client)
+
+	client.Metadata = ClientMetadata{DisplayName: "Renamed"}
+	updateClient(t, store, client)
+	getClient(t, store, client)
+
+	plain := &osin.DefaultClient{Id: "unbranded", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, plain)
+	defer store.RemoveClient(plain.Id)
+	loaded, err := store.GetClient(plain.Id)
+	require.Nil(t, err)
+	assert.Equal(t, ClientMetadata{}, loaded.(*Client).Metadata)
+}
+
+func TestClientOrigins(t *testing.T) {
+	client := &osin.DefaultClient{Id: "cors", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RemoveClient(client.Id)
+
+	allowed, err := store.ClientAllowsOrigin(client.Id, "https://app.example.com")
+	require.Nil(t, err)
+	assert.False(t, allowed)
+
+	require.Nil(t, store.SetClientOrigins(client.Id, []string{"HTTPS://App.Example.com/", "http://localhost:3000"}))
+	origins, err := store.GetClientOrigins(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"https://app.example.com", "http://localhost:3000"}, origins)
+
+	for origin, expected := range map[string]bool{
+		"https://app.example.com":      true,
+		"https://APP.example.com":      true,
+		"http://localhost:3000":        true,
+		"http://app.example.com":       false,
+		"https://app.example.com:8443": false,
+		"null":                         false,
+	} {
+		allowed, err := store.ClientAllowsOrigin(client.Id, origin)
+		require.Nil(t, err)
+		assert.Equal(t, expected, allowed, origin)
+	}
+
+	assert.NotNil(t, store.SetClientOrigins(client.Id, []string{"https://app.example.com/path"}))
+	assert.Equal(t, ErrClientNotFound, store.SetClientOrigins("unknown", nil))
+	_, err = store.ClientAllowsOrigin("unknown", "https://app.example.com")
+	assert.Equal(t, ErrClientNotFound, err)
+}
+
+func TestClientPostLogoutRedirectURIs(t *testing.T) {
+	client := &osin.DefaultClient{Id: "logout", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RemoveClient(client.Id)
+
+	uris := []string{"https://app.example.com/logged-out", "com.example.app:/logout"}
+	require.Nil(t, store.SetClientPostLogoutRedirectURIs(client.Id, uris))
+	loaded, err := store.GetClientPostLogoutRedirectURIs(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, uris, loaded)
+
+	for uri, expected := range map[string]bool{
+		"https://app.example.com/logged-out":     true,
+		"com.example.app:/logout":                true,
+		"https://app.example.com/logged-out?x=1": false,
+		"https://app.example.com/logged-out/":    false,
+		"https://evil.example.com/logged-out":    false,
+	} {
+		allowed, err := store.ClientAllowsPostLogoutRedirectURI(client.Id, uri)
+		require.Nil(t, err)
+		assert.Equal(t, expected, allowed, uri)
+	}
+
+	assert.NotNil(t, store.SetClientPostLogoutRedirectURIs(client.Id, []string{"/relative"}))
+	assert.NotNil(t, store.SetClientPostLogoutRedirectURIs(client.Id, []string{"https://app.example.com/#fragment"}))
+	_, err = store.ClientAllowsPostLogoutRedirectURI("unknown", uris[0])
+	assert.Equal(t, ErrClientNotFound, err)
+}
+
 func TestAuthorizeOperations(t *testing.T) {
 	client := &osin.DefaultClient{Id: "2", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
 	createClient(t, store, client)
@@ -88,6 +238,7 @@ func TestAuthorizeOperations(t *testing.T) {
 		require.Nil(t, err)
 		require.Equal(t, authorize.CreatedAt.Unix(), authorize.CreatedAt.Unix())
 		authorize.CreatedAt = result.CreatedAt
+		authorize.Client = &Client{DefaultClient: *client}
 		require.True(t, reflect.DeepEqual(authorize, result), "Case: %d\n%v\n\n%v", k, authorize, result)
 
 		// Test remove
@@ -265,42 +416,2959 @@ func TestErrors(t *testing.T) {
 	assert.NotNil(t, store.SaveAuthorize(&osin.AuthorizeData{Code: "a", Client: &osin.DefaultClient{}}))
 	assert.NotNil(t, store.SaveAuthorize(&osin.AuthorizeData{Code: "b", Client: &osin.DefaultClient{}, UserData: struct{}{}}))
 	_, err := store.LoadAccess("")
-	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrTokenNotFound, err)
 	_, err = store.LoadAuthorize("")
-	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrTokenNotFound, err)
 	_, err = store.LoadRefresh("")
-	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrTokenNotFound, err)
 	_, err = store.GetClient("")
+	assert.Equal(t, ErrClientNotFound, err)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, ErrClientNotFound, store.UpdateClient(&osin.DefaultClient{Id: "missing"}))
+	assert.True(t, errors.Is(store.CreateClient(&osin.DefaultClient{Id: "dupe"}), ErrDuplicateKey))
+	assert.True(t, errors.Is(store.SaveAuthorize(&osin.AuthorizeData{Code: "a", Client: &osin.DefaultClient{}}), ErrDuplicateKey))
+}
+
+func TestPAROperations(t *testing.T) {
+	par := &PushedAuthorizeRequest{
+		RequestURI: "urn:ietf:params:oauth:request_uri:" + uuid.New(),
+		ClientID:   "par-client",
+		Parameters: url.Values{"response_type": {"code"}, "scope": {"a b"}},
+		ExpiresIn:  60,
+		CreatedAt:  time.Now().Round(time.Second),
+	}
+	require.Nil(t, store.SavePAR(par))
+
+	result, err := store.LoadPAR(par.RequestURI)
+	require.Nil(t, err)
+	require.Equal(t, par.CreatedAt.Unix(), result.CreatedAt.Unix())
+	require.Equal(t, par.Parameters, result.Parameters)
+
+	result, err = store.ConsumePAR(par.RequestURI)
+	require.Nil(t, err)
+	require.Equal(t, par.ClientID, result.ClientID)
+	_, err = store.ConsumePAR(par.RequestURI)
+	assert.Equal(t, ErrNotFound, err)
+
+	expired := &PushedAuthorizeRequest{
+		RequestURI: "urn:ietf:params:oauth:request_uri:" + uuid.New(),
+		ClientID:   "par-client",
+		Parameters: url.Values{},
+		ExpiresIn:  1,
+		CreatedAt:  time.Now().Add(-time.Minute),
+	}
+	require.Nil(t, store.SavePAR(expired))
+	_, err = store.LoadPAR(expired.RequestURI)
+	require.NotNil(t, err)
+
+	n, err := store.PurgeExpiredPAR()
+	require.Nil(t, err)
+	require.True(t, n >= 1)
+	_, err = store.LoadPAR(expired.RequestURI)
 	assert.Equal(t, ErrNotFound, err)
 }
 
-type ts struct{}
+func TestBackchannelRequests(t *testing.T) {
+	req := &BackchannelAuthRequest{
+		AuthReqID:      uuid.New(),
+		ClientID:       "ciba-client",
+		Scope:          "openid",
+		LoginHint:      "alice",
+		BindingMessage: "W4SCT",
+		ExpiresIn:      60,
+		Interval:       5,
+		CreatedAt:      time.Now().Round(time.Second),
+	}
+	require.Nil(t, store.SaveBackchannelRequest(req))
 
-func (s *ts) String() string {
-	return "foo"
+	result, err := store.PollBackchannelRequest(req.AuthReqID, req.ClientID)
+	require.Nil(t, err)
+	assert.Equal(t, BackchannelPending, result.Status)
+	assert.Equal(t, req.BindingMessage, result.BindingMessage)
+	_, err = store.PollBackchannelRequest(req.AuthReqID, req.ClientID)
+	assert.Equal(t, ErrSlowDown, err)
+	_, err = store.PollBackchannelRequest(req.AuthReqID, "other-client")
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = store.ConsumeBackchannelRequest(req.AuthReqID, req.ClientID)
+	assert.Equal(t, ErrNotFound, err, "pending requests cannot be consumed")
+	require.Nil(t, store.ApproveBackchannelRequest(req.AuthReqID, "user"))
+	assert.Equal(t, ErrNotFound, store.DenyBackchannelRequest(req.AuthReqID), "approved requests cannot be denied")
+
+	result, err = store.ConsumeBackchannelRequest(req.AuthReqID, req.ClientID)
+	require.Nil(t, err)
+	assert.Equal(t, BackchannelApproved, result.Status)
+	assert.Equal(t, "user", result.UserData)
+	_, err = store.ConsumeBackchannelRequest(req.AuthReqID, req.ClientID)
+	assert.Equal(t, ErrNotFound, err)
+
+	denied := &BackchannelAuthRequest{AuthReqID: uuid.New(), ClientID: "ciba-client", ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, store.SaveBackchannelRequest(denied))
+	require.Nil(t, store.DenyBackchannelRequest(denied.AuthReqID))
+	result, err = store.PollBackchannelRequest(denied.AuthReqID, denied.ClientID)
+	require.Nil(t, err)
+	assert.Equal(t, BackchannelDenied, result.Status)
+	assert.Nil(t, result.UserData)
+
+	expired := &BackchannelAuthRequest{AuthReqID: uuid.New(), ClientID: "ciba-client", ExpiresIn: 1, CreatedAt: time.Now().Add(-time.Minute)}
+	require.Nil(t, store.SaveBackchannelRequest(expired))
+	_, err = store.PollBackchannelRequest(expired.AuthReqID, expired.ClientID)
+	require.NotNil(t, err)
+	assert.Equal(t, ErrNotFound, store.ApproveBackchannelRequest(expired.AuthReqID, "user"))
+
+	n, err := store.PurgeExpiredBackchannelRequests()
+	require.Nil(t, err)
+	require.True(t, n >= 1)
+	_, err = store.PollBackchannelRequest(expired.AuthReqID, expired.ClientID)
+	assert.Equal(t, ErrNotFound, err)
 }
 
-func TestAssertToString(t *testing.T) {
-	res, err := assertToString(struct{}{})
+func TestSelfTest(t *testing.T) {
+	report, err := SelfTest(db)
+	require.Nil(t, err)
+	require.False(t, report.Failed(), "%s", report)
+	require.Len(t, report.Steps, 7)
+}
+
+func TestIntrospect(t *testing.T) {
+	client := &osin.DefaultClient{Id: "introspect", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	access := &osin.AccessData{
+		Client:       client,
+		AccessToken:  uuid.New(),
+		RefreshToken: uuid.New(),
+		ExpiresIn:    int32(60),
+		Scope:        "scope",
+		RedirectUri:  "https://localhost/",
+		CreatedAt:    time.Now().Round(time.Second),
+		UserData:     userDataMock,
+	}
+	createClient(t, store, client)
+	require.Nil(t, store.SaveAccess(access))
+
+	result, err := store.Introspect(access.AccessToken)
+	require.Nil(t, err)
+	assert.True(t, result.Active)
+	assert.Equal(t, TokenTypeAccess, result.TokenType)
+	assert.Equal(t, client.Id, result.ClientID)
+	assert.Equal(t, "scope", result.Scope)
+	assert.Equal(t, access.ExpireAt().Unix(), result.ExpiresAt.Unix())
+
+	result, err = store.Introspect(access.RefreshToken)
+	require.Nil(t, err)
+	assert.True(t, result.Active)
+	assert.Equal(t, TokenTypeRefresh, result.TokenType)
+	assert.True(t, result.ExpiresAt.IsZero(), "refresh tokens do not expire without WithRefreshExpiry")
+
+	require.Nil(t, store.RemoveAccess(access.AccessToken))
+	_, err = store.Introspect(access.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	require.Nil(t, store.RemoveRefresh(access.RefreshToken))
+	removeClient(t, store, client)
+}
+
+func TestRevokeAll(t *testing.T) {
+	client := &osin.DefaultClient{Id: "revoke", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	for _, user := range []string{"alice", "bob"} {
+		require.Nil(t, store.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: user}))
+		require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: user}))
+	}
+
+	counts, err := store.RevokeAllByUser("alice")
+	require.Nil(t, err)
+	assert.Equal(t, &RevokeCounts{Access: 1, Refresh: 1, Authorize: 1}, counts)
+
+	counts, err = store.RevokeAllByClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, &RevokeCounts{Access: 1, Refresh: 1, Authorize: 1}, counts)
+	removeClient(t, store, client)
+}
+
+func TestRemoveByClient(t *testing.T) {
+	client := &osin.DefaultClient{Id: "remove-by-client", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer removeClient(t, store, client)
+	code := uuid.New()
+	require.Nil(t, store.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: code, ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}))
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+
+	counts, err := store.RemoveAccessByClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, &RevokeCounts{Access: 1, Refresh: 1}, counts)
+	_, err = store.LoadAccess(access.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	_, err = store.LoadAuthorize(code)
+	require.Nil(t, err)
+
+	counts, err = store.RemoveAuthorizeByClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, &RevokeCounts{Authorize: 1}, counts)
+	_, err = store.LoadAuthorize(code)
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestListAccessByClient(t *testing.T) {
+	client := &osin.DefaultClient{Id: "list-access", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
+	older := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, Scope: "read write", CreatedAt: time.Now().Add(-time.Second), UserData: userDataMock}
+	newer := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: userDataMock}
+	expired := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 1, Scope: "write", CreatedAt: time.Now().Add(-time.Hour), UserData: userDataMock}
+	for _, data := range []*osin.AccessData{older, newer, expired} {
+		require.Nil(t, store.SaveAccess(data))
+	}
+
+	summaries, err := store.ListAccessByClient(client.Id, AccessListOptions{})
+	require.Nil(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, HashToken(newer.AccessToken), summaries[0].TokenHash)
+	assert.Equal(t, MaskToken(newer.AccessToken), summaries[0].MaskedToken)
+	assert.NotContains(t, summaries[0].MaskedToken, newer.AccessToken[4:len(newer.AccessToken)-4])
+	assert.False(t, summaries[0].HasRefresh)
+	assert.True(t, summaries[1].HasRefresh)
+	assert.Equal(t, older.ExpireAt().Unix(), summaries[1].ExpiresAt.Unix())
+
+	summaries, err = store.ListAccessByClient(client.Id, AccessListOptions{Scope: "write", IncludeExpired: true})
+	require.Nil(t, err)
+	require.Len(t, summaries, 2)
+	assert.Equal(t, HashToken(older.AccessToken), summaries[0].TokenHash)
+	assert.Equal(t, HashToken(expired.AccessToken), summaries[1].TokenHash)
+
+	summaries, err = store.ListAccessByClient(client.Id, AccessListOptions{Offset: 1, Limit: 1})
+	require.Nil(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, HashToken(older.AccessToken), summaries[0].TokenHash)
+}
+
+func TestListAccessByUser(t *testing.T) {
+	web := &osin.DefaultClient{Id: "user-web", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	mobile := &osin.DefaultClient{Id: "user-mobile", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	for _, c := range []*osin.DefaultClient{web, mobile} {
+		createClient(t, store, c)
+		defer store.RevokeAllByClient(c.Id)
+		defer removeClient(t, store, c)
+	}
+
+	// The user is extracted from UserData of the form "<user>|<session>" or passed explicitly.
+	user := "user-" + uuid.New()
+	extracting := New(db, WithDialect(dialect), WithUserRef(func(userData interface{}) string {
+		return strings.SplitN(userData.(string), "|", 2)[0]
+	}))
+	older := &osin.AccessData{Client: web, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Second), UserData: user + "|web"}
+	newer := &osin.AccessData{Client: mobile, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	expired := &osin.AccessData{Client: web, AccessToken: uuid.New(), ExpiresIn: 1, CreatedAt: time.Now().Add(-time.Hour), UserData: user + "|old"}
+	require.Nil(t, extracting.SaveAccess(older))
+	require.Nil(t, extracting.SaveAccessWithMetadata(newer, IssueMetadata{UserRef: user}))
+	require.Nil(t, extracting.SaveAccess(expired))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: web, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: user}))
+
+	// UserData larger than a btree index entry can be saved.
+	large := &osin.AccessData{Client: web, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: user + "|" + strings.Repeat(uuid.New(), 1000)}
+	require.Nil(t, extracting.SaveAccess(large))
+
+	summaries, err := store.ListAccessByUser(user, AccessListOptions{})
+	require.Nil(t, err)
+	require.Len(t, summaries, 3)
+	assert.Equal(t, HashToken(large.AccessToken), summaries[0].TokenHash)
+	assert.Equal(t, HashToken(newer.AccessToken), summaries[1].TokenHash)
+	assert.Equal(t, mobile.Id, summaries[1].ClientID)
+	assert.Equal(t, web.Id, summaries[2].ClientID)
+
+	summaries, err = store.ListAccessByUser(user, AccessListOptions{IncludeExpired: true})
+	require.Nil(t, err)
+	assert.Len(t, summaries, 4)
+}
+
+func TestCountActive(t *testing.T) {
+	client := &osin.DefaultClient{Id: "count-active", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 1, CreatedAt: time.Now().Add(-time.Hour), UserData: userDataMock}))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}))
+
+	n, err := store.CountActiveAccess(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = store.CountActiveRefresh(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	expiring := New(db, WithDialect(dialect), WithRefreshExpiry(0, time.Nanosecond))
+	require.Nil(t, expiring.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}))
+	n, err = store.CountActiveRefresh(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestNewFromDSN(t *testing.T) {
+	s, err := NewFromDSN(dsn, WithDialect(dialect), WithPool(PoolConfig{MaxOpenConns: 3}))
+	require.Nil(t, err)
+	assert.Equal(t, 3, s.db.Stats().MaxOpenConnections)
+	_, err = s.GetClient("missing")
+	assert.Equal(t, ErrClientNotFound, err)
+	s.Close()
+	assert.NotNil(t, s.db.Ping())
+
+	_, err = NewFromDSN("postgres://localhost:1/osin?sslmode=disable&connect_timeout=1")
 	assert.NotNil(t, err)
+}
 
-	res, err = assertToString("foo")
-	assert.Nil(t, err)
-	assert.Equal(t, "foo", res)
+func TestWithTx(t *testing.T) {
+	var saved []string
+	hooked := New(db, WithDialect(dialect), WithHooks(Hooks{OnAccessSaved: func(data *osin.AccessData) { saved = append(saved, data.AccessToken) }}))
+	assert.Equal(t, db, hooked.DB())
+	assert.Nil(t, hooked.Tx())
+	client := &osin.DefaultClient{Id: "with-tx", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
 
-	res, err = assertToString(nil)
-	assert.Nil(t, err)
-	assert.Equal(t, "", res)
+	committed := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, hooked.WithTx(context.Background(), func(tx osin.Storage) error {
+		require.Nil(t, tx.SaveAccess(committed))
+		assert.Empty(t, saved)
+		_, err := tx.(*Storage).Tx().Exec("INSERT INTO nonce (nonce, expires_at) VALUES ($1, $2)", committed.AccessToken, time.Now())
+		return err
+	}))
+	assert.Equal(t, []string{committed.AccessToken}, saved)
+	_, err := store.LoadAccess(committed.AccessToken)
+	require.Nil(t, err)
 
-	res, err = assertToString(new(ts))
-	assert.Nil(t, err)
-	assert.Equal(t, "foo", res)
+	failed := errors.New("failed")
+	rolledBack := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	assert.Equal(t, failed, hooked.WithTx(context.Background(), func(tx osin.Storage) error {
+		require.Nil(t, tx.SaveAccess(rolledBack))
+		return failed
+	}))
+	assert.Len(t, saved, 1)
+	_, err = store.LoadAccess(rolledBack.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
 }
 
-func getClient(t *testing.T, store storage.Storage, set osin.Client) {
-	client, err := store.GetClient(set.GetId())
+func TestReadOnly(t *testing.T) {
+	client := &osin.DefaultClient{Id: "read-only", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+
+	readOnly := New(db, WithDialect(dialect), WithReadOnly())
+	_, err := readOnly.GetClient(client.Id)
+	require.Nil(t, err)
+	_, err = readOnly.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	_, err = readOnly.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+
+	assert.True(t, errors.Is(readOnly.CreateClient(&osin.DefaultClient{Id: "read-only-2"}), ErrReadOnly))
+	assert.True(t, errors.Is(readOnly.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}), ErrReadOnly))
+	assert.True(t, errors.Is(readOnly.RemoveAccess(access.AccessToken), ErrReadOnly))
+	assert.True(t, errors.Is(readOnly.CreateSchemas(), ErrReadOnly))
+	_, err = readOnly.PurgeExpiredNonces()
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	_, err = readOnly.Cleanup(context.Background(), CleanupConfig{})
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	_, err = store.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+}
+
+// tenancyStorage returns a storage created with WithMultiTenancy and opts, which connects as a role which is no
+// superuser, as row level security does not apply to superusers. Its tables live in their own schema.
+func tenancyStorage(t *testing.T, opts ...Option) (*Storage, *sql.DB) {
+	postgresOnly(t)
+
+	tenantDB, err := sql.Open("postgres", dsn)
+	require.Nil(t, err)
+	t.Cleanup(func() { tenantDB.Close() })
+	tenantDB.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"DROP SCHEMA IF EXISTS tenancy CASCADE",
+		"CREATE SCHEMA tenancy",
+		"SET search_path TO tenancy",
+		"DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'osin_tenant') THEN CREATE ROLE osin_tenant; END IF; END $$",
+		"GRANT USAGE ON SCHEMA tenancy TO osin_tenant",
+	} {
+		_, err := tenantDB.Exec(stmt)
+		require.Nil(t, err)
+	}
+	t.Cleanup(func() { db.Exec("DROP SCHEMA IF EXISTS tenancy CASCADE") })
+
+	opts = append([]Option{WithMultiTenancy()}, opts...)
+	admin := New(tenantDB, opts...)
+	require.Nil(t, admin.CreateSchemas())
+	require.Nil(t, admin.EnableMultiTenancy())
+	require.Nil(t, admin.EnableMultiTenancy())
+	for _, stmt := range []string{
+		"GRANT ALL ON ALL TABLES IN SCHEMA tenancy TO osin_tenant",
+		"GRANT ALL ON ALL SEQUENCES IN SCHEMA tenancy TO osin_tenant",
+		"SET ROLE osin_tenant",
+	} {
+		_, err := tenantDB.Exec(stmt)
+		require.Nil(t, err)
+	}
+	t.Cleanup(func() { tenantDB.Exec("RESET ROLE") })
+	return New(tenantDB, opts...), tenantDB
+}
+
+func TestMultiTenancy(t *testing.T) {
+	store, _ := tenancyStorage(t)
+	acme, globex := store.ForTenant("acme"), store.ForTenant("globex")
+	assert.Equal(t, "acme", acme.Tenant())
+
+	// The same client id is used by both tenants.
+	for _, tenant := range []*Storage{acme, globex} {
+		require.Nil(t, tenant.CreateClient(&osin.DefaultClient{Id: "app", Secret: tenant.Tenant(), RedirectUri: "http://localhost/", UserData: ""}))
+	}
+	client, err := acme.GetClient("app")
+	require.Nil(t, err)
+	assert.Equal(t, "acme", client.GetSecret())
+	client, err = globex.GetClient("app")
+	require.Nil(t, err)
+	assert.Equal(t, "globex", client.GetSecret())
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, globex.SaveAccess(access))
+	_, err = globex.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	_, err = globex.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+	_, err = acme.LoadAccess(access.AccessToken)
+	assert.True(t, errors.Is(err, ErrTokenNotFound))
+	_, err = acme.LoadRefresh(access.RefreshToken)
+	assert.True(t, errors.Is(err, ErrTokenNotFound))
+	assert.True(t, errors.Is(acme.RemoveClient("unknown"), ErrClientNotFound))
+
+	// Writes within a transaction are scoped as well.
+	require.Nil(t, acme.WithTx(context.Background(), func(tx osin.Storage) error {
+		return tx.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock})
+	}))
+	n, err := acme.CountActiveAccess("app")
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, n)
+	n, err = globex.CountActiveAccess("app")
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, n)
+
+	// A storage without tenant or with the empty tenant sees no rows and cannot write any.
+	for _, untenanted := range []*Storage{store, store.ForTenant("")} {
+		n, err = untenanted.CountActiveAccess("app")
+		require.Nil(t, err)
+		assert.EqualValues(t, 0, n)
+		_, err = untenanted.GetClient("app")
+		assert.True(t, errors.Is(err, ErrClientNotFound))
+		assert.NotNil(t, untenanted.CreateClient(&osin.DefaultClient{Id: "untenanted", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}))
+	}
+
+	// A role bypassing row level security sees the rows of all tenants.
+	adminDB, err := sql.Open("postgres", dsn)
+	require.Nil(t, err)
+	defer adminDB.Close()
+	adminDB.SetMaxOpenConns(1)
+	_, err = adminDB.Exec("SET search_path TO tenancy")
+	require.Nil(t, err)
+	n, err = New(adminDB, WithMultiTenancy()).CountActiveAccess("app")
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, n)
+
+	require.Nil(t, acme.RemoveClient("app"))
+	_, err = acme.GetClient("app")
+	assert.True(t, errors.Is(err, ErrClientNotFound))
+	_, err = globex.GetClient("app")
+	require.Nil(t, err)
+}
+
+func TestTenantSigningKeys(t *testing.T) {
+	store, _ := tenancyStorage(t)
+	for _, tenant := range []*Storage{store.ForTenant("acme"), store.ForTenant("globex")} {
+		old := &SigningKey{KID: "old", Alg: "RS256", PublicKey: "{}", EncryptedPrivateKey: []byte(tenant.Tenant()), NotBefore: time.Now().Add(-time.Hour)}
+		current := &SigningKey{KID: "current", Alg: "RS256", PublicKey: "{}", EncryptedPrivateKey: []byte(tenant.Tenant()), NotBefore: time.Now().Add(-time.Minute)}
+		require.Nil(t, tenant.SaveSigningKey(old))
+		require.Nil(t, tenant.SaveSigningKey(current))
+		require.Nil(t, tenant.ActivateSigningKey(old.KID))
+		require.Nil(t, tenant.ActivateSigningKey(current.KID))
+	}
+
+	// Every tenant has an active key per algorithm.
+	for _, name := range []string{"acme", "globex"} {
+		active, err := store.ForTenant(name).ActiveSigningKey("RS256")
+		require.Nil(t, err)
+		assert.Equal(t, "current", active.KID)
+		assert.Equal(t, []byte(name), active.EncryptedPrivateKey)
+	}
+}
+
+func TestTenantVariable(t *testing.T) {
+	store, tenantDB := tenancyStorage(t, WithTenantVariable("app.tenant_id"))
+	acme := store.ForTenant("acme")
+	client := &osin.DefaultClient{Id: "app", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, acme.CreateClient(client))
+
+	// The application shares the variable with the storage within a transaction.
+	require.Nil(t, acme.WithTx(context.Background(), func(tx osin.Storage) error {
+		var tenant string
+		if err := tx.(*Storage).Tx().QueryRow("SELECT current_setting('app.tenant_id')").Scan(&tenant); err != nil {
+			return err
+		}
+		assert.Equal(t, "acme", tenant)
+		return nil
+	}))
+
+	// Rows are isolated by the database for queries of the application as well.
+	count := func(tenant string) (n int) {
+		tx, err := tenantDB.Begin()
+		require.Nil(t, err)
+		defer tx.Rollback()
+		_, err = tx.Exec("SELECT set_config('app.tenant_id', $1, true)", tenant)
+		require.Nil(t, err)
+		require.Nil(t, tx.QueryRow("SELECT count(*) FROM client WHERE id = 'app'").Scan(&n))
+		return n
+	}
+	assert.Equal(t, 1, count("acme"))
+	assert.Equal(t, 0, count("globex"))
+	_, err := store.ForTenant("globex").GetClient("app")
+	assert.True(t, errors.Is(err, ErrClientNotFound))
+}
+
+func TestTenantSchemas(t *testing.T) {
+	defer db.Exec(`DROP SCHEMA IF EXISTS tenant_a, "tenant-b" CASCADE`)
+	require.Nil(t, store.CreateTenantSchema("tenant_a"))
+	require.Nil(t, store.CreateTenantSchema("tenant-b"))
+	require.Nil(t, store.CreateTenantSchema("tenant-b"))
+	assert.NotNil(t, store.CreateTenantSchema(""))
+
+	a, b := store.ForTenantSchema("tenant_a"), store.ForTenantSchema("tenant-b")
+	assert.Equal(t, "tenant_a", a.TenantSchema())
+	for _, tenant := range []*Storage{a, b} {
+		require.Nil(t, tenant.CreateClient(&osin.DefaultClient{Id: "schema-app", Secret: tenant.TenantSchema(), RedirectUri: "http://localhost/", UserData: ""}))
+	}
+	client, err := b.GetClient("schema-app")
+	require.Nil(t, err)
+	assert.Equal(t, "tenant-b", client.GetSecret())
+	_, err = store.GetClient("schema-app")
+	assert.True(t, errors.Is(err, ErrClientNotFound))
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, b.SaveAccess(access))
+	_, err = b.LoadAccess(access.AccessToken)
 	require.Nil(t, err)
-	require.EqualValues(t, set, client)
+	_, err = a.LoadAccess(access.AccessToken)
+	assert.True(t, errors.Is(err, ErrTokenNotFound))
+	_, err = store.LoadRefresh(access.RefreshToken)
+	assert.True(t, errors.Is(err, ErrTokenNotFound))
+
+	require.Nil(t, a.RemoveClient("schema-app"))
+	_, err = b.GetClient("schema-app")
+	require.Nil(t, err)
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	client := &osin.DefaultClient{Id: "slow-query", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer removeClient(t, store, client)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+	defer store.RemoveAccess(access.AccessToken)
+
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	_, err := New(db, WithDialect(dialect), WithSlowQueryLog(time.Hour)).LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Empty(t, out.String())
+
+	_, err = New(db, WithDialect(dialect), WithSlowQueryLog(time.Nanosecond)).LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Contains(t, out.String(), "Slow query in LoadAccess")
+	assert.Contains(t, out.String(), "string(36)")
+	assert.NotContains(t, out.String(), access.AccessToken)
+}
+
+func TestDebugLog(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	debug := New(db, WithDialect(dialect))
+	assert.False(t, debug.Debug())
+	_, err := debug.PurgeExpiredNonces()
+	require.Nil(t, err)
+	assert.Empty(t, out.String())
+
+	debug.SetDebug(true)
+	assert.True(t, debug.Debug())
+	assert.True(t, debug.Clone().(*Storage).Debug())
+	_, err = debug.PurgeExpiredNonces()
+	require.Nil(t, err)
+	assert.Contains(t, out.String(), "Query in PurgeExpiredNonces")
+	assert.Regexp(t, `\[time\.Time\], \d+ rows`, out.String())
+
+	debug.SetDebug(false)
+	out.Reset()
+	_, err = debug.PurgeExpiredNonces()
+	require.Nil(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestOperationMetrics(t *testing.T) {
+	var ops []Operation
+	observed := New(db, WithDialect(dialect), WithMetrics(Metrics{Operation: func(op Operation) { ops = append(ops, op) }}))
+	find := func(name string) Operation {
+		for _, op := range ops {
+			if op.Name == name {
+				return op
+			}
+		}
+		t.Fatalf("Operation %s was not reported", name)
+		return Operation{}
+	}
+
+	client := &osin.DefaultClient{Id: "operation-metrics", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, observed, client)
+	defer removeClient(t, store, client)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, observed.SaveAccess(access))
+	defer store.RemoveAccess(access.AccessToken)
+	_, err := observed.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+
+	hash := HashToken(client.Id)[:16]
+	for _, name := range []string{"CreateClient", "SaveAccess", "LoadAccess", "GetClient"} {
+		op := find(name)
+		assert.Equal(t, hash, op.ClientHash, name)
+		assert.Nil(t, op.Err, name)
+		assert.True(t, op.Duration > 0, name)
+	}
+	assert.Equal(t, "access", find("LoadAccess").Table)
+	assert.Equal(t, "client", find("GetClient").Table)
+
+	ops = nil
+	_, err = observed.LoadAccess("unknown")
+	require.NotNil(t, err)
+	op := find("LoadAccess")
+	assert.NotNil(t, op.Err)
+	assert.Empty(t, op.ClientHash)
+}
+
+func TestIsolation(t *testing.T) {
+	isolated := New(db, WithDialect(dialect), WithIsolation(sql.LevelRepeatableRead), WithOperationIsolation("SaveAccess", sql.LevelSerializable))
+	assert.Equal(t, &sql.TxOptions{Isolation: sql.LevelSerializable}, isolated.txOptions("SaveAccess"))
+	assert.Equal(t, &sql.TxOptions{Isolation: sql.LevelRepeatableRead}, isolated.txOptions("RemoveAccess"))
+	assert.Nil(t, store.txOptions("SaveAccess"))
+
+	require.Nil(t, isolated.WithTx(context.Background(), func(tx osin.Storage) error {
+		var level string
+		if err := tx.(*Storage).Tx().QueryRow("SHOW transaction_isolation").Scan(&level); err != nil {
+			return err
+		}
+		assert.Equal(t, "repeatable read", level)
+		return nil
+	}))
+
+	client := &osin.DefaultClient{Id: "isolation", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer removeClient(t, store, client)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, isolated.SaveAccess(access))
+	defer store.RemoveAccess(access.AccessToken)
+	_, err := isolated.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+}
+
+func TestNewFromDSNs(t *testing.T) {
+	_, err := NewFromDSNs(nil)
+	assert.NotNil(t, err)
+
+	// The first node is unreachable, so the storage fails over to the second one.
+	failover, err := NewFromDSNs([]string{"postgres://localhost:1/osin?sslmode=disable&connect_timeout=1", dsn}, WithDialect(dialect), WithProbeInterval(10*time.Millisecond))
+	require.Nil(t, err)
+	defer failover.Close()
+	assert.EqualValues(t, 1, failover.failover.current)
+
+	client := &osin.DefaultClient{Id: "failover", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, failover, client)
+	defer removeClient(t, store, client)
+	time.Sleep(50 * time.Millisecond)
+	_, err = failover.GetClient(client.Id)
+	require.Nil(t, err)
+
+	_, err = NewFromDSNs([]string{"postgres://localhost:1/osin?sslmode=disable&connect_timeout=1"})
+	assert.NotNil(t, err)
+}
+
+func TestShutdown(t *testing.T) {
+	owned, err := sql.Open("postgres", dsn)
+	require.Nil(t, err)
+	s := New(owned, WithDialect(dialect), WithOwnedDB())
+
+	client := &osin.DefaultClient{Id: "shutdown", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	started, release, done := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		done <- s.WithTx(context.Background(), func(tx osin.Storage) error {
+			close(started)
+			<-release
+			// Operations of transactions in flight still run while the storage drains.
+			return tx.(*Storage).CreateClient(client)
+		})
+	}()
+	<-started
+	defer removeClient(t, store, client)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		_, err := s.GetClient("shutdown")
+		return errors.Is(err, ErrClosed)
+	}, time.Second, 10*time.Millisecond)
+
+	close(release)
+	require.Nil(t, <-done)
+	require.Nil(t, <-shutdown)
+	assert.NotNil(t, owned.Ping())
+	_, err = store.GetClient(client.Id)
+	require.Nil(t, err)
+
+	// Shutdown gives up waiting when its context is done.
+	d := newDrain()
+	waiting := &Storage{drain: d}
+	require.Nil(t, waiting.enter())
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.True(t, errors.Is(d.wait(expired), context.Canceled))
+	waiting.leave()
+	require.Nil(t, d.wait(context.Background()))
+}
+
+func TestMaxLifetime(t *testing.T) {
+	client := &osin.DefaultClient{Id: "max-lifetime", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
+
+	clamping := New(db, WithDialect(dialect), WithMaxLifetime(time.Hour, ClampLifetime))
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 7200, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, clamping.SaveAccess(access))
+	assert.EqualValues(t, 3600, access.ExpiresIn)
+	loaded, err := store.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.EqualValues(t, 3600, loaded.ExpiresIn)
+
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 7200, CreatedAt: time.Now(), UserData: userDataMock}
+	rejecting := New(db, WithDialect(dialect), WithMaxLifetime(time.Hour, RejectLifetime))
+	assert.True(t, errors.Is(rejecting.SaveAuthorize(authorize), ErrLifetimeExceeded))
+	assert.True(t, errors.Is(rejecting.SaveAccess(&osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 7200, CreatedAt: time.Now(), UserData: userDataMock}), ErrLifetimeExceeded))
+
+	// Rows saved before the cap are capped on load.
+	old := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 86400, CreatedAt: time.Now().Add(-2 * time.Hour), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(old))
+	_, err = store.LoadAccess(old.AccessToken)
+	require.Nil(t, err)
+	_, err = clamping.LoadAccess(old.AccessToken)
+	assert.NotNil(t, err)
+	require.Nil(t, store.SaveAuthorize(authorize))
+	loadedAuthorize, err := clamping.LoadAuthorize(authorize.Code)
+	require.Nil(t, err)
+	assert.EqualValues(t, 3600, loadedAuthorize.ExpiresIn)
+}
+
+func TestExpiresAtColumn(t *testing.T) {
+	client := &osin.DefaultClient{Id: "expires-at", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
+
+	createdAt := time.Now().Truncate(time.Second)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 90, CreatedAt: createdAt, UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 30, CreatedAt: createdAt, UserData: userDataMock}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	defer store.RemoveAuthorize(authorize.Code)
+
+	var expiresAt time.Time
+	require.Nil(t, db.QueryRow("SELECT expires_at FROM access WHERE access_token=$1", access.AccessToken).Scan(&expiresAt))
+	assert.True(t, access.ExpireAt().Equal(expiresAt), "%s != %s", access.ExpireAt(), expiresAt)
+	require.Nil(t, db.QueryRow("SELECT expires_at FROM authorize WHERE code=$1", authorize.Code).Scan(&expiresAt))
+	assert.True(t, authorize.ExpireAt().Equal(expiresAt), "%s != %s", authorize.ExpireAt(), expiresAt)
+
+	n, err := store.CountActiveAccess(client.Id)
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, n)
+}
+
+func TestCronCommands(t *testing.T) {
+	command, err := store.cronCommand(CronJob{Table: "access", Schedule: "*/10 * * * *"})
+	require.Nil(t, err)
+	assert.Equal(t, "DELETE FROM access WHERE expires_at < now() AND NOT EXISTS (SELECT 1 FROM refresh WHERE refresh.access=access.access_token)", command)
+
+	archiving := New(db, WithArchive(), WithRefreshGracePeriod(time.Minute))
+	command, err = archiving.cronCommand(CronJob{Table: "authorize", Schedule: "@hourly"})
+	require.Nil(t, err)
+	assert.Contains(t, command, "INSERT INTO authorize_archive")
+	assert.NotContains(t, command, "$")
+	command, err = archiving.cronCommand(CronJob{Table: "refresh", Schedule: "@hourly"})
+	require.Nil(t, err)
+	assert.Contains(t, command, "rotated_at <= now() - interval '60 seconds'")
+	command, err = archiving.ForTenantSchema("acme").cronCommand(CronJob{Table: "nonce", Schedule: "@daily"})
+	require.Nil(t, err)
+	assert.Equal(t, `SET search_path TO "acme"; DELETE FROM nonce WHERE expires_at <= now()`, command)
+	assert.Equal(t, "osin_purge_acme_nonce", archiving.ForTenantSchema("acme").cronJobName("nonce"))
+
+	_, err = store.cronCommand(CronJob{Table: "revocation", Schedule: "@daily"})
+	assert.NotNil(t, err)
+	_, err = store.cronCommand(CronJob{Table: "client", Schedule: "@daily"})
+	assert.NotNil(t, err)
+	_, err = store.cronCommand(CronJob{Table: "access"})
+	assert.NotNil(t, err)
+
+	// pg_cron must be preloaded by the server, which the test database is not configured for.
+	if err := store.ScheduleCronPurges([]CronJob{{Table: "nonce", Schedule: "@daily"}}); err != nil {
+		t.Skipf("pg_cron is not available: %s", err)
+	}
+	require.Nil(t, store.UnscheduleCronPurges())
+}
+
+func TestUnloggedTables(t *testing.T) {
+	postgresOnly(t)
+
+	assert.NotNil(t, New(db, WithUnloggedTables("unknown")).CreateSchemas())
+
+	// The tables are created in a schema of their own, so the tables of the other tests stay logged.
+	defer db.Exec("DROP SCHEMA IF EXISTS unlogged CASCADE")
+	require.Nil(t, New(db, WithUnloggedTables("authorize")).CreateTenantSchema("unlogged"))
+	persistence := func(table string) (p string) {
+		require.Nil(t, db.QueryRow("SELECT relpersistence FROM pg_class WHERE oid = to_regclass($1)", "unlogged."+table).Scan(&p))
+		return p
+	}
+	assert.Equal(t, "u", persistence("authorize"))
+	assert.Equal(t, "p", persistence("access"))
+}
+
+func TestLiveIndexes(t *testing.T) {
+	postgresOnly(t)
+
+	_, err := db.Exec("CREATE INDEX access_live_20000101_idx ON access (client, expires_at) WHERE expires_at > '2000-01-01T00:00:00Z'")
+	require.Nil(t, err)
+	require.Nil(t, store.RefreshLiveIndexes(context.Background()))
+	require.Nil(t, store.RefreshLiveIndexes(context.Background()))
+
+	indexes := func(table string) (names []string) {
+		rows, err := db.Query("SELECT indexname FROM pg_indexes WHERE tablename=$1 AND indexname LIKE '%\\_live\\_%' ORDER BY indexname", table)
+		require.Nil(t, err)
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			require.Nil(t, rows.Scan(&name))
+			names = append(names, name)
+		}
+		return names
+	}
+	today := time.Now().UTC().Format("20060102")
+	assert.Equal(t, []string{"access_live_" + today + "_idx"}, indexes("access"))
+	assert.Equal(t, []string{"authorize_live_" + today + "_idx"}, indexes("authorize"))
+
+	_, err = store.Cleanup(context.Background(), CleanupConfig{LiveIndexes: true})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"access_live_" + today + "_idx"}, indexes("access"))
+}
+
+func TestLoadAccessWith(t *testing.T) {
+	client := &osin.DefaultClient{Id: "load-access-with", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
+
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	prev := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(prev))
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessData: prev, AccessToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+
+	full, err := store.LoadAccessWith(access.AccessToken, LoadAccessOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, client.Secret, full.Client.GetSecret())
+	assert.NotNil(t, full.AuthorizeData)
+	assert.NotNil(t, full.AccessData)
+
+	lean, err := store.LoadAccessWith(access.AccessToken, LoadAccessOptions{SkipClient: true, SkipAuthorize: true, SkipPrevious: true})
+	require.Nil(t, err)
+	assert.Equal(t, client.Id, lean.Client.GetId())
+	assert.Empty(t, lean.Client.GetSecret())
+	assert.Nil(t, lean.AuthorizeData)
+	assert.Nil(t, lean.AccessData)
+	assert.Equal(t, "read", lean.Scope)
+	assert.EqualValues(t, 60, lean.ExpiresIn)
+
+	_, err = store.LoadAccessWith(uuid.New(), LoadAccessOptions{SkipClient: true})
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestLoadRefreshSingleQuery(t *testing.T) {
+	client := &osin.DefaultClient{Id: "load-refresh-join", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer removeClient(t, store, client)
+
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAuthorize(authorize))
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	debug := New(db, WithDialect(dialect))
+	debug.SetDebug(true)
+
+	loaded, err := debug.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, access.AccessToken, loaded.AccessToken)
+	assert.Equal(t, client.Secret, loaded.Client.GetSecret())
+	require.NotNil(t, loaded.AuthorizeData)
+	assert.Equal(t, authorize.Code, loaded.AuthorizeData.Code)
+	assert.Len(t, regexp.MustCompile(`Query in LoadRefresh took \S+: SELECT`).FindAllString(out.String(), -1), 1)
+
+	require.Nil(t, store.DisableClient(client.Id))
+	_, err = store.LoadRefresh(access.RefreshToken)
+	assert.Equal(t, ErrClientDisabled, err)
+}
+
+func TestConsentOperations(t *testing.T) {
+	consent := &Consent{UserRef: "alice", ClientID: "consent", Scope: "read write", GrantedAt: time.Now()}
+	require.Nil(t, store.GrantConsent(consent))
+
+	ok, err := store.HasConsent("alice", "consent", "read")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = store.HasConsent("alice", "consent", "read admin")
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	consent.Scope = "read write admin"
+	consent.ExpiresAt = time.Now().Add(-time.Minute)
+	require.Nil(t, store.GrantConsent(consent))
+	ok, err = store.HasConsent("alice", "consent", "read")
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	require.Nil(t, store.RevokeConsent("alice", "consent"))
+	_, err = store.GetConsent("alice", "consent")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSessionOperations(t *testing.T) {
+	session := &Session{
+		SID:      uuid.New(),
+		UserRef:  "alice",
+		Clients:  []string{"a"},
+		AuthTime: time.Now().Round(time.Second),
+		AMR:      []string{"pwd", "otp"},
+		ACR:      "1",
+		LastSeen: time.Now().Round(time.Second),
+	}
+	require.Nil(t, store.CreateSession(session))
+	require.Nil(t, store.TouchSession(session.SID, "b"))
+	require.Nil(t, store.TouchSession(session.SID, "a"))
+
+	result, err := store.GetSession(session.SID)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, result.Clients)
+	assert.Equal(t, session.AMR, result.AMR)
+	assert.True(t, !result.LastSeen.Before(session.LastSeen))
+
+	result, err = store.TerminateSession(session.SID)
+	require.Nil(t, err)
+	assert.Equal(t, "alice", result.UserRef)
+	_, err = store.GetSession(session.SID)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, store.TouchSession(session.SID, ""))
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	for _, id := range []string{"bcl-a", "bcl-b", "bcl-c"} {
+		createClient(t, store, &osin.DefaultClient{Id: id, Secret: "secret", RedirectUri: "http://localhost/", UserData: ""})
+		defer store.RemoveClient(id)
+	}
+	logout := BackchannelLogout{URI: "https://a.example.com/logout", SessionRequired: true}
+	require.Nil(t, store.SetClientBackchannelLogout("bcl-a", logout))
+	require.Nil(t, store.SetClientBackchannelLogout("bcl-b", BackchannelLogout{URI: "https://b.example.com/logout"}))
+	loaded, err := store.GetClientBackchannelLogout("bcl-a")
+	require.Nil(t, err)
+	assert.Equal(t, &logout, loaded)
+	assert.NotNil(t, store.SetClientBackchannelLogout("bcl-c", BackchannelLogout{URI: "/logout"}))
+	assert.Equal(t, ErrClientNotFound, store.SetClientBackchannelLogout("unknown", logout))
+
+	session := &Session{SID: uuid.New(), UserRef: "alice", Clients: []string{"bcl-b", "bcl-c"}, AuthTime: time.Now(), LastSeen: time.Now()}
+	require.Nil(t, store.CreateSession(session))
+	require.Nil(t, store.TouchSession(session.SID, "bcl-a"))
+
+	terminated, targets, err := store.TerminateSessionWithLogout(session.SID)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"bcl-b", "bcl-c", "bcl-a"}, terminated.Clients)
+	assert.Equal(t, []*LogoutTarget{
+		{ClientID: "bcl-a", BackchannelLogout: logout, SID: session.SID, UserRef: "alice"},
+		{ClientID: "bcl-b", BackchannelLogout: BackchannelLogout{URI: "https://b.example.com/logout"}, SID: session.SID, UserRef: "alice"},
+	}, targets)
+
+	targets, err = store.LogoutTargets(terminated)
+	require.Nil(t, err)
+	assert.Len(t, targets, 2)
+	_, _, err = store.TerminateSessionWithLogout(session.SID)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSigningKeyOperations(t *testing.T) {
+	old := &SigningKey{KID: uuid.New(), Alg: "RS256", PublicKey: "{}", EncryptedPrivateKey: []byte("old"), NotBefore: time.Now().Add(-time.Hour)}
+	current := &SigningKey{KID: uuid.New(), Alg: "RS256", PublicKey: "{}", EncryptedPrivateKey: []byte("new"), NotBefore: time.Now().Add(-time.Minute)}
+	require.Nil(t, store.SaveSigningKey(old))
+	require.Nil(t, store.SaveSigningKey(current))
+
+	require.Nil(t, store.ActivateSigningKey(old.KID))
+	require.Nil(t, store.ActivateSigningKey(current.KID))
+	active, err := store.ActiveSigningKey("RS256")
+	require.Nil(t, err)
+	assert.Equal(t, current.KID, active.KID)
+	assert.Equal(t, []byte("new"), active.EncryptedPrivateKey)
+
+	keys, err := store.ListVerificationKeys()
+	require.Nil(t, err)
+	assert.Len(t, keys, 2)
+
+	require.Nil(t, store.RetireSigningKey(old.KID, time.Now().Add(-time.Second)))
+	keys, err = store.ListVerificationKeys()
+	require.Nil(t, err)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, ErrNotFound, store.ActivateSigningKey("unknown"))
+	assert.Equal(t, ErrSigningKeyNotValid, store.ActivateSigningKey(old.KID))
+	future := &SigningKey{KID: uuid.New(), Alg: "RS256", PublicKey: "{}", EncryptedPrivateKey: []byte("future"), NotBefore: time.Now().Add(time.Hour)}
+	require.Nil(t, store.SaveSigningKey(future))
+	assert.Equal(t, ErrSigningKeyNotValid, store.ActivateSigningKey(future.KID))
+	active, err = store.ActiveSigningKey("RS256")
+	require.Nil(t, err)
+	assert.Equal(t, current.KID, active.KID)
+
+	// There is at most one active key per algorithm.
+	_, err = db.Exec("UPDATE signing_key SET active=true WHERE kid=$1", future.KID)
+	assert.NotNil(t, err)
+
+	require.Nil(t, store.RemoveSigningKey(old.KID))
+	require.Nil(t, store.RemoveSigningKey(current.KID))
+	require.Nil(t, store.RemoveSigningKey(future.KID))
+}
+
+func TestClaimNonce(t *testing.T) {
+	nonce := uuid.New()
+	ok, err := store.ClaimNonce(nonce, time.Minute)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = store.ClaimNonce(nonce, time.Minute)
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	expired := uuid.New()
+	ok, err = store.ClaimNonce(expired, -time.Second)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = store.ClaimNonce(expired, time.Minute)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = store.ClaimNonce(uuid.New(), -time.Second)
+	require.Nil(t, err)
+	n, err := store.PurgeExpiredNonces()
+	require.Nil(t, err)
+	assert.True(t, n >= 1)
+}
+
+func TestDenylist(t *testing.T) {
+	jti := uuid.New()
+	denied, err := store.IsDenied(jti)
+	require.Nil(t, err)
+	assert.False(t, denied)
+
+	require.Nil(t, store.Deny(jti, time.Now().Add(time.Minute)))
+	require.Nil(t, store.Deny(jti, time.Now().Add(-time.Minute)), "denying again keeps the later expiry")
+	denied, err = store.IsDenied(jti)
+	require.Nil(t, err)
+	assert.True(t, denied)
+
+	expired := uuid.New()
+	require.Nil(t, store.Deny(expired, time.Now().Add(-time.Second)))
+	denied, err = store.IsDenied(expired)
+	require.Nil(t, err)
+	assert.False(t, denied)
+
+	require.Nil(t, store.Deny(uuid.New(), time.Now().Add(time.Minute)))
+	var count int
+	require.Nil(t, db.QueryRow("SELECT count(*) FROM jti_denylist WHERE jti=$1", expired).Scan(&count))
+	assert.Equal(t, 0, count, "Deny prunes expired entries")
+
+	_, err = db.Exec("INSERT INTO jti_denylist (jti, expires_at) VALUES ($1, $2)", expired, time.Now().Add(-time.Second))
+	require.Nil(t, err)
+	n, err := store.PurgeExpiredDenylist()
+	require.Nil(t, err)
+	assert.True(t, n >= 1)
+}
+
+func TestScopes(t *testing.T) {
+	prefix := uuid.New() + ":"
+	openid := &Scope{Name: prefix + "openid", Description: "Sign in", Default: true}
+	email := &Scope{Name: prefix + "email", Description: "Email address"}
+	admin := &Scope{Name: prefix + "admin", Description: "Administration", Default: true, Restricted: true}
+	for _, scope := range []*Scope{openid, email, admin} {
+		require.Nil(t, store.CreateScope(scope))
+		defer store.RemoveScope(scope.Name)
+	}
+	assert.True(t, errors.Is(store.CreateScope(openid), ErrDuplicateKey))
+
+	email.Description = "Email address and verification status"
+	require.Nil(t, store.UpdateScope(email))
+	loaded, err := store.GetScope(email.Name)
+	require.Nil(t, err)
+	assert.Equal(t, email, loaded)
+	assert.Equal(t, ErrNotFound, store.UpdateScope(&Scope{Name: prefix + "unknown"}))
+	_, err = store.GetScope(prefix + "unknown")
+	assert.Equal(t, ErrNotFound, err)
+
+	client := &osin.DefaultClient{Id: prefix + "client"}
+	granted, err := store.ValidateScopes(client, email.Name+" "+openid.Name+" "+email.Name)
+	require.Nil(t, err)
+	assert.Equal(t, email.Name+" "+openid.Name, granted)
+	granted, err = store.ValidateScopes(client, "")
+	require.Nil(t, err)
+	assert.Contains(t, granted, openid.Name)
+	assert.NotContains(t, granted, admin.Name, "restricted default scopes are granted to granted clients only")
+	_, err = store.ValidateScopes(client, openid.Name+" "+admin.Name)
+	assert.True(t, errors.Is(err, ErrInvalidScope))
+	_, err = store.ValidateScopes(client, prefix+"unknown")
+	assert.True(t, errors.Is(err, ErrInvalidScope))
+
+	require.Nil(t, store.GrantClientScope(client.Id, admin.Name))
+	require.Nil(t, store.GrantClientScope(client.Id, admin.Name))
+	scopes, err := store.ListClientScopes(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, []string{admin.Name}, scopes)
+	granted, err = store.ValidateScopes(client, openid.Name+" "+admin.Name)
+	require.Nil(t, err)
+	assert.Equal(t, openid.Name+" "+admin.Name, granted)
+
+	require.Nil(t, store.RemoveClientScope(client.Id, admin.Name))
+	_, err = store.ValidateScopes(client, admin.Name)
+	assert.True(t, errors.Is(err, ErrInvalidScope))
+
+	require.Nil(t, store.RemoveScope(email.Name))
+	_, err = store.GetScope(email.Name)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestAudit(t *testing.T) {
+	audited := New(db, WithAudit()).AuditAs("admin", map[string]string{"ip": "127.0.0.1"})
+	client := &osin.DefaultClient{Id: "audit-" + uuid.New(), Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, audited.CreateClient(client))
+	require.Nil(t, audited.SaveAccess(access))
+	require.Nil(t, audited.RemoveAccess(access.AccessToken))
+	require.Nil(t, audited.RemoveClient(client.Id))
+
+	events, err := audited.ListAuditEvents(AuditFilter{ClientID: client.Id})
+	require.Nil(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, AuditClientCreated, events[0].Type)
+	assert.Equal(t, AuditAccessIssued, events[1].Type)
+	assert.Equal(t, HashToken(access.AccessToken), events[1].Subject)
+	assert.Equal(t, AuditClientDeleted, events[2].Type)
+	assert.Equal(t, "admin", events[2].Actor)
+	assert.Equal(t, map[string]string{"ip": "127.0.0.1"}, events[2].Metadata)
+
+	events, err = audited.ListAuditEvents(AuditFilter{Subject: HashToken(access.AccessToken), Type: AuditAccessRevoked})
+	require.Nil(t, err)
+	require.Len(t, events, 1)
+}
+
+func TestAuditBulkRevocation(t *testing.T) {
+	audited := New(db, WithAudit()).AuditAs("admin", nil)
+	client := &osin.DefaultClient{Id: "audit-bulk-" + uuid.New(), Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, audited.CreateClient(client))
+	defer removeClient(t, audited, client)
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, RedirectUri: "http://localhost/", CreatedAt: time.Now(), UserData: "audit-user"}
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: "audit-user"}
+	require.Nil(t, audited.SaveAuthorize(authorize))
+	require.Nil(t, audited.SaveAccess(access))
+
+	_, err := audited.RevokeAllByUser("audit-user")
+	require.Nil(t, err)
+
+	for typ, subject := range map[string]string{
+		AuditAccessRevoked:     HashToken(access.AccessToken),
+		AuditRefreshRevoked:    HashToken(access.RefreshToken),
+		AuditAuthorizeConsumed: HashToken(authorize.Code),
+	} {
+		events, err := audited.ListAuditEvents(AuditFilter{Type: typ, Subject: subject})
+		require.Nil(t, err)
+		require.Len(t, events, 1, typ)
+		assert.Equal(t, "admin", events[0].Actor)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var changed, removed []string
+	var saved *osin.AccessData
+	hooked := New(db, WithHooks(Hooks{
+		OnClientChanged: func(id string) { changed = append(changed, id) },
+		OnAccessSaved:   func(data *osin.AccessData) { saved = data },
+		OnAccessRemoved: func(token string) { removed = append(removed, token) },
+	}))
+
+	client := &osin.DefaultClient{Id: "hooks", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, hooked.CreateClient(client))
+	require.Nil(t, hooked.SaveAccess(access))
+	assert.Equal(t, access, saved)
+	assert.NotNil(t, hooked.CreateClient(client))
+	assert.Equal(t, []string{"hooks"}, changed)
+
+	_, err := hooked.RevokeAllByClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, []string{access.AccessToken}, removed)
+	require.Nil(t, hooked.RemoveClient(client.Id))
+	assert.Equal(t, []string{"hooks", "hooks"}, changed)
+}
+
+func TestNotify(t *testing.T) {
+	postgresOnly(t)
+
+	sub, err := NewSubscriber(dsn, "osin_test")
+	require.Nil(t, err)
+	defer sub.Close()
+
+	notifying := New(db, WithNotify("osin_test"))
+	client := &osin.DefaultClient{Id: "notify", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, notifying.CreateClient(client))
+	require.Nil(t, notifying.RemoveAccess("token"))
+
+	for _, expected := range []Event{
+		{Type: AuditClientCreated, ClientID: "notify", Subject: "notify"},
+		{Type: AuditAccessRevoked, Subject: HashToken("token")},
+	} {
+		select {
+		case e := <-sub.Events():
+			assert.Equal(t, expected, e)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for event")
+		}
+	}
+	require.Nil(t, notifying.RemoveClient(client.Id))
+}
+
+func TestClientInvalidation(t *testing.T) {
+	postgresOnly(t)
+
+	sub, err := NewSubscriber(dsn, "osin_invalidation")
+	require.Nil(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cached := New(db, WithClientCache(10, time.Hour))
+	go cached.RunClientInvalidation(ctx, sub)
+
+	other := New(db, WithNotify("osin_invalidation"))
+	client := &osin.DefaultClient{Id: "invalidation", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, other.CreateClient(client))
+	defer other.RemoveClient(client.Id)
+
+	loaded, err := cached.GetClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, "secret", loaded.GetSecret())
+
+	client.Secret = "rotated"
+	require.Nil(t, other.UpdateClient(client))
+	assert.Eventually(t, func() bool {
+		loaded, err := cached.GetClient(client.Id)
+		return err == nil && loaded.GetSecret() == "rotated"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	secret := []byte("secret")
+	received := make(chan *WebhookPayload, 1)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, SignWebhook(secret, r.Header.Get(WebhookTimestampHeader), body), r.Header.Get(WebhookSignatureHeader))
+		var payload WebhookPayload
+		require.Nil(t, json.Unmarshal(body, &payload))
+		received <- &payload
+	}))
+	defer server.Close()
+
+	publisher := NewWebhookPublisher(WebhookConfig{URLs: []string{server.URL}, Secret: secret, Backoff: time.Millisecond})
+	hooked := New(db, WithHooks(publisher.Hooks()))
+	client := &osin.DefaultClient{Id: "webhook", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, hooked.CreateClient(client))
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, AuditClientCreated, payload.Type)
+		assert.Equal(t, "webhook", payload.ClientID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+	publisher.Close()
+	require.Nil(t, hooked.RemoveClient(client.Id))
+}
+
+func TestWebhookPublisherRetries(t *testing.T) {
+	var mu sync.Mutex
+	var failed bool
+	received := make(chan *WebhookPayload, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := !failed
+		failed = true
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var payload WebhookPayload
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- &payload
+	}))
+	defer server.Close()
+
+	publisher := NewWebhookPublisher(WebhookConfig{URLs: []string{server.URL}, Backoff: 500 * time.Millisecond, MaxAttempts: 2})
+	hooks := publisher.Hooks()
+	hooks.OnAccessRemoved("first")
+	hooks.OnAccessRemoved("second")
+
+	// The retry of the first event does not delay the second event.
+	select {
+	case payload := <-received:
+		assert.Equal(t, HashToken("second"), payload.Subject)
+	case <-time.After(400 * time.Millisecond):
+		t.Fatal("Timed out waiting for webhook")
+	}
+	publisher.Close()
+	require.Len(t, received, 1)
+	assert.Equal(t, HashToken("first"), (<-received).Subject)
+
+	// Events published after Close are dropped.
+	hooks.OnAccessRemoved("third")
+	publisher.Close()
+}
+
+func TestClientCache(t *testing.T) {
+	cached := New(db, WithClientCache(1, time.Minute))
+	client := &osin.DefaultClient{Id: "cached", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, cached.CreateClient(client))
+	getClient(t, cached, client)
+
+	// Changes made through another storage are not visible until the entry expires or is evicted.
+	update := &osin.DefaultClient{Id: "cached", Secret: "secret123", RedirectUri: "http://localhost/", UserData: ""}
+	updateClient(t, store, update)
+	getClient(t, cached, client)
+
+	other := &osin.DefaultClient{Id: "cached-other", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, cached.CreateClient(other))
+	getClient(t, cached, other)
+	getClient(t, cached, update)
+
+	update.Secret = "secret456"
+	updateClient(t, cached, update)
+	getClient(t, cached, update)
+
+	removeClient(t, cached, update)
+	_, err := cached.GetClient(update.Id)
+	assert.Equal(t, ErrClientNotFound, err)
+	removeClient(t, cached, other)
+}
+
+func TestClientCacheDisabled(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		uncached := New(db, WithClientCache(size, time.Minute))
+		assert.Nil(t, uncached.clients)
+
+		client := &osin.DefaultClient{Id: "uncached", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+		require.Nil(t, uncached.CreateClient(client))
+		getClient(t, uncached, client)
+
+		// Changes made through another storage are visible at once.
+		update := &osin.DefaultClient{Id: "uncached", Secret: "secret123", RedirectUri: "http://localhost/", UserData: ""}
+		updateClient(t, store, update)
+		getClient(t, uncached, update)
+		removeClient(t, uncached, update)
+	}
+}
+
+func TestReplicaRouting(t *testing.T) {
+	replica, err := sql.Open("postgres", dsn)
+	require.Nil(t, err)
+	defer replica.Close()
+
+	routed := New(db, WithReplicas(time.Second, replica)).Clone().(*Storage)
+	assert.NotNil(t, routed.replica())
+
+	client := &osin.DefaultClient{Id: "replica", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, routed, client)
+	assert.Nil(t, routed.replica())
+	getClient(t, routed, client)
+
+	// A fresh clone does not stick to the primary.
+	clone := routed.Clone().(*Storage)
+	assert.NotNil(t, clone.replica())
+	getClient(t, clone, client)
+	removeClient(t, routed, client)
+}
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, IsTransient(errors.New(&pq.Error{Code: "40001"})))
+	assert.True(t, IsTransient(&pq.Error{Code: "40P01"}))
+	assert.True(t, IsTransient(&pq.Error{Code: "08006"}))
+	assert.True(t, IsTransient(errors.New(driver.ErrBadConn)))
+	assert.False(t, IsTransient(&pq.Error{Code: "23505"}))
+	assert.False(t, IsTransient(sql.ErrNoRows))
+	assert.False(t, IsTransient(ErrNotFound))
+}
+
+func TestRetry(t *testing.T) {
+	retrying := New(db, WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	attempts := 0
+	err := retrying.write("Test", func(conn dbtx) error {
+		attempts++
+		return &pq.Error{Code: "40001"}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = retrying.inTx("Test", func(tx dbtx) error {
+		if attempts++; attempts == 1 {
+			return &pq.Error{Code: "40P01"}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	err = retrying.write("Test", func(conn dbtx) error {
+		attempts++
+		return &pq.Error{Code: "23505"}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	guarded := New(db, WithCircuitBreaker(2, 50*time.Millisecond))
+	down := func(conn dbtx) error { return errors.New(driver.ErrBadConn) }
+	up := func(conn dbtx) error { return nil }
+
+	assert.NotEqual(t, ErrUnavailable, guarded.write("Test", down))
+	assert.NotEqual(t, ErrUnavailable, guarded.write("Test", down))
+	assert.Equal(t, ErrUnavailable, guarded.write("Test", up))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NotEqual(t, ErrUnavailable, guarded.write("Test", down))
+	assert.Equal(t, ErrUnavailable, guarded.write("Test", up))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(t, guarded.write("Test", up))
+	assert.Nil(t, guarded.write("Test", up))
+
+	// Errors which do not indicate an outage do not open the circuit.
+	for i := 0; i < 3; i++ {
+		assert.NotEqual(t, ErrUnavailable, guarded.write("Test", func(conn dbtx) error { return &pq.Error{Code: "23505"} }))
+	}
+
+	// A threshold of zero disables the circuit breaker.
+	unguarded := New(db, WithCircuitBreaker(0, time.Minute))
+	for i := 0; i < 3; i++ {
+		assert.NotEqual(t, ErrUnavailable, unguarded.write("Test", down))
+	}
+	assert.Nil(t, unguarded.write("Test", up))
+}
+
+func TestOperationTimeout(t *testing.T) {
+	postgresOnly(t)
+
+	limited := New(db, WithOperationTimeout("Test", 50*time.Millisecond))
+	start := time.Now()
+	err := limited.write("Test", func(conn dbtx) error {
+		_, err := conn.Exec("SELECT pg_sleep(5)")
+		return err
+	})
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	assert.Nil(t, limited.write("Other", func(conn dbtx) error {
+		_, err := conn.Exec("SELECT pg_sleep(0.1)")
+		return err
+	}))
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	postgresOnly(t)
+
+	limited := New(db, WithDefaultTimeout(50*time.Millisecond), WithOperationTimeout("Slow", time.Second), WithOperationTimeout("Unlimited", 0))
+	sleep := func(op string, seconds float64) error {
+		return limited.write(op, func(conn dbtx) error {
+			_, err := conn.Exec("SELECT pg_sleep($1)", seconds)
+			return err
+		})
+	}
+	start := time.Now()
+	assert.NotNil(t, sleep("Test", 5))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Nil(t, sleep("Slow", 0.1))
+	assert.Nil(t, sleep("Unlimited", 0.1))
+	assert.Nil(t, sleep("CreateSchemas", 0.1))
+}
+
+func TestPreparedStatements(t *testing.T) {
+	prepared := New(db)
+	client := &osin.DefaultClient{Id: "prepared", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, prepared, client)
+	getClient(t, prepared, client)
+	assert.NotEmpty(t, prepared.stmts.stmts)
+
+	clone := prepared.Clone()
+	clone.Close()
+	assert.NotEmpty(t, prepared.stmts.stmts)
+
+	prepared.Close()
+	assert.Empty(t, prepared.stmts.stmts)
+	getClient(t, prepared, client)
+	require.Nil(t, prepared.RemoveClient(client.Id))
+}
+
+func TestPreparedStatementsBounded(t *testing.T) {
+	prepared := New(db)
+	defer prepared.Close()
+
+	// Queries with dynamic conditions are not prepared.
+	_, err := prepared.ListAuditEvents(AuditFilter{Type: AuditClientCreated, Actor: "admin"})
+	require.Nil(t, err)
+	_, err = prepared.ListAccessByClient("prepared", AccessListOptions{Scope: "read"})
+	require.Nil(t, err)
+	assert.Empty(t, prepared.stmts.stmts)
+
+	for i := 0; i < maxCachedStmts+10; i++ {
+		require.Nil(t, prepared.read("Test", func(conn dbtx) error {
+			var n int
+			return conn.QueryRow(fmt.Sprintf("SELECT %d", i)).Scan(&n)
+		}))
+	}
+	assert.Len(t, prepared.stmts.stmts, maxCachedStmts)
+}
+
+// pgxError mimics pgconn.PgError of pgx.
+type pgxError struct{ code string }
+
+func (e *pgxError) Error() string    { return "pgx: " + e.code }
+func (e *pgxError) SQLState() string { return e.code }
+
+func TestClassify(t *testing.T) {
+	for _, driverErr := range []func(code string) error{
+		func(code string) error { return &pq.Error{Code: pq.ErrorCode(code)} },
+		func(code string) error { return &pgxError{code: code} },
+	} {
+		assert.True(t, errors.Is(classify(errors.New(driverErr("23505"))), ErrDuplicateKey))
+		assert.True(t, errors.Is(classify(driverErr("23503")), ErrForeignKeyViolation))
+		assert.True(t, errors.Is(classify(driverErr("40001")), ErrConflict))
+		assert.True(t, IsTransient(classify(driverErr("40P01"))))
+		assert.True(t, IsTransient(driverErr("08006")))
+		assert.False(t, errors.Is(classify(driverErr("08006")), ErrConflict))
+	}
+
+	var pqErr *pq.Error
+	assert.True(t, errors.As(classify(&pq.Error{Code: "23505", Constraint: "client_pkey"}), &pqErr))
+	assert.Equal(t, "client_pkey", pqErr.Constraint)
+	assert.Equal(t, sql.ErrNoRows, classify(sql.ErrNoRows))
+}
+
+func TestOptionalFieldsAreNull(t *testing.T) {
+	client := &osin.DefaultClient{Id: "nullable", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	access := &osin.AccessData{
+		Client:      client,
+		AccessToken: uuid.New(),
+		ExpiresIn:   60,
+		CreatedAt:   time.Now(),
+	}
+	require.Nil(t, store.SaveAccess(access))
+
+	var nulls int
+	require.Nil(t, db.QueryRow("SELECT num_nulls(authorize, previous, refresh_token, scope, redirect_uri) FROM access WHERE access_token=$1", access.AccessToken).Scan(&nulls))
+	assert.Equal(t, 5, nulls)
+
+	result, err := store.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, "", result.RefreshToken)
+	assert.Equal(t, "", result.RedirectUri)
+	assert.Nil(t, result.AuthorizeData)
+	assert.Nil(t, result.AccessData)
+
+	require.Nil(t, store.RemoveAccess(access.AccessToken))
+	removeClient(t, store, client)
+}
+
+func TestCreateSchemas(t *testing.T) {
+	postgresOnly(t)
+
+	require.Nil(t, store.CreateSchemas())
+
+	original := schemas
+	defer func() { schemas = original }()
+	schemas = append(append([]string{}, original...), "CREATE TABLE schema_probe (id int)", "NOT SQL")
+	require.NotNil(t, store.CreateSchemas())
+
+	var exists bool
+	require.Nil(t, db.QueryRow("SELECT to_regclass('schema_probe') IS NOT NULL").Scan(&exists))
+	assert.False(t, exists)
+}
+
+func TestResetAndDropSchemas(t *testing.T) {
+	client := &osin.DefaultClient{Id: "reset", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	require.Nil(t, store.Reset())
+	_, err := store.GetClient(client.Id)
+	assert.Equal(t, ErrClientNotFound, err)
+
+	require.Nil(t, store.DropSchemas())
+	require.Nil(t, store.DropSchemas())
+	var exists bool
+	require.Nil(t, db.QueryRow("SELECT to_regclass('client') IS NOT NULL").Scan(&exists))
+	assert.False(t, exists)
+
+	require.Nil(t, store.CreateSchemas())
+	createClient(t, store, client)
+	removeClient(t, store, client)
+}
+
+func TestClientLifecycle(t *testing.T) {
+	cached := New(db, WithDialect(dialect), WithClientCache(10, time.Minute))
+	client := &osin.DefaultClient{Id: "lifecycle", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, cached, client)
+	defer cached.RemoveClient(client.Id)
+	getClient(t, cached, client)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, cached.SaveAccess(access))
+
+	require.Nil(t, cached.DisableClient(client.Id))
+	_, err := cached.GetClient(client.Id)
+	assert.Equal(t, ErrClientDisabled, err)
+	_, err = cached.LoadAccess(access.AccessToken)
+	assert.Equal(t, ErrClientDisabled, err)
+	i, err := cached.Introspect(access.AccessToken)
+	require.Nil(t, err)
+	assert.False(t, i.Active)
+	loaded, err := cached.LookupClient(client.Id)
+	require.Nil(t, err)
+	assert.True(t, loaded.Disabled)
+
+	require.Nil(t, cached.EnableClient(client.Id))
+	getClient(t, cached, client)
+	_, err = cached.LoadAccess(access.AccessToken)
+	assert.Nil(t, err)
+
+	require.Nil(t, cached.SoftDeleteClient(client.Id))
+	_, err = cached.GetClient(client.Id)
+	assert.Equal(t, ErrClientDeleted, err)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	loaded, err = cached.LookupClient(client.Id)
+	require.Nil(t, err)
+	assert.False(t, loaded.DeletedAt.IsZero())
+	assert.True(t, errors.Is(cached.CreateClient(client), ErrDuplicateKey))
+
+	require.Nil(t, cached.RestoreClient(client.Id))
+	getClient(t, cached, client)
+	assert.Equal(t, ErrClientNotFound, cached.DisableClient("unknown"))
+}
+
+func TestClientVersion(t *testing.T) {
+	client := &osin.DefaultClient{Id: "versioned", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RemoveClient(client.Id)
+	loaded, err := store.LookupClient(client.Id)
+	require.Nil(t, err)
+	version := loaded.Version
+
+	first := &osin.DefaultClient{Id: "versioned", Secret: "first", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, store.UpdateClientIfVersion(first, version))
+	second := &osin.DefaultClient{Id: "versioned", Secret: "second", RedirectUri: "http://localhost/", UserData: ""}
+	assert.Equal(t, ErrConflict, store.UpdateClientIfVersion(second, version))
+	getClient(t, store, first)
+
+	require.Nil(t, store.UpdateClient(second))
+	loaded, err = store.LookupClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, version+2, loaded.Version)
+	assert.Equal(t, ErrClientNotFound, store.UpdateClientIfVersion(&osin.DefaultClient{Id: "unknown"}, 1))
+
+	// Changes of the state of the client are updates, too.
+	version = loaded.Version
+	require.Nil(t, store.DisableClient(client.Id))
+	assert.Equal(t, ErrConflict, store.UpdateClientIfVersion(first, version))
+	require.Nil(t, store.EnableClient(client.Id))
+	require.Nil(t, store.SoftDeleteClient(client.Id))
+	require.Nil(t, store.RestoreClient(client.Id))
+	loaded, err = store.LookupClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, version+4, loaded.Version)
+	require.Nil(t, store.UpdateClientIfVersion(first, loaded.Version))
+}
+
+func TestAdminHandler(t *testing.T) {
+	server := httptest.NewServer(NewAdminHandler(store))
+	defer server.Close()
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/clients", `{"id": "admin", "secret": "secret", "redirect_uri": "http://localhost/"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = do(http.MethodPost, "/clients", `{"id": "admin", "secret": "secret", "redirect_uri": "http://localhost/"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = do(http.MethodPut, "/clients/admin", `{"secret": "other", "redirect_uri": "http://example.com/"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(http.MethodGet, "/clients/admin", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var client AdminClient
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&client))
+	assert.Equal(t, AdminClient{ID: "admin", RedirectURI: "http://example.com/"}, client)
+
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/clients/admin", strings.NewReader(`{"secret": "other", "redirect_uri": "http://example.com/"}`))
+	require.Nil(t, err)
+	req.Header.Set("If-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	req, err = http.NewRequest(http.MethodPut, server.URL+"/clients/admin", strings.NewReader(`{"secret": "stale", "redirect_uri": "http://example.com/"}`))
+	require.Nil(t, err)
+	req.Header.Set("If-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = do(http.MethodPost, "/clients/admin/disable", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(http.MethodGet, "/clients/admin", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&client))
+	assert.True(t, client.Disabled)
+	resp = do(http.MethodPost, "/clients/admin/enable", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(http.MethodDelete, "/clients/admin?soft=true", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, err = store.GetClient("admin")
+	assert.Equal(t, ErrClientDeleted, err)
+	resp = do(http.MethodPost, "/clients/admin/restore", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	c, err := store.GetClient("admin")
+	require.Nil(t, err)
+	access := &osin.AccessData{Client: c, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, store.SaveAccess(access))
+
+	resp = do(http.MethodPost, "/tokens/introspect", `{"token": "`+access.AccessToken+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var token AdminToken
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&token))
+	assert.True(t, token.Active)
+	assert.Equal(t, "admin", token.ClientID)
+
+	resp = do(http.MethodPost, "/tokens/revoke", `{"token": "`+access.AccessToken+`"}`)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(http.MethodPost, "/tokens/introspect", `{"token": "`+access.AccessToken+`"}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(http.MethodDelete, "/clients/admin/tokens", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var counts AdminRevokeCounts
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&counts))
+	assert.Equal(t, int64(1), counts.Refresh)
+
+	resp = do(http.MethodDelete, "/clients/admin", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(http.MethodGet, "/clients/admin", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminHandlerTokens(t *testing.T) {
+	server := httptest.NewServer(NewAdminHandler(store))
+	defer server.Close()
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/clients", `{"id": "admin-tokens", "secret": "secret", "redirect_uri": "http://localhost/"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	defer removeClient(t, store, &osin.DefaultClient{Id: "admin-tokens"})
+
+	resp = do(http.MethodPut, "/clients/admin-tokens", `{"redirect_uri": "http://example.com/"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	client, err := store.GetClient("admin-tokens")
+	require.Nil(t, err)
+	assert.Equal(t, "secret", client.GetSecret())
+	assert.Equal(t, "http://example.com/", client.GetRedirectUri())
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: "admin-user"}
+	require.Nil(t, store.SaveAccess(access))
+	other := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, Scope: "write", CreatedAt: time.Now(), UserData: "other-user"}
+	require.Nil(t, store.SaveAccess(other))
+
+	var summaries []AdminAccessSummary
+	resp = do(http.MethodGet, "/clients/admin-tokens/tokens", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&summaries))
+	assert.Len(t, summaries, 2)
+
+	resp = do(http.MethodGet, "/clients/admin-tokens/tokens?scope=read&limit=10", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&summaries))
+	require.Len(t, summaries, 1)
+	assert.Equal(t, HashToken(access.AccessToken), summaries[0].TokenHash)
+	assert.True(t, summaries[0].HasRefresh)
+
+	resp = do(http.MethodGet, "/users/admin-user/tokens", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&summaries))
+	require.Len(t, summaries, 1)
+	assert.Equal(t, "admin-tokens", summaries[0].ClientID)
+	assert.Equal(t, HashToken(access.AccessToken), summaries[0].TokenHash)
+
+	resp = do(http.MethodGet, "/users/admin-user/tokens?limit=many", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Tokens listed for a user are revoked for the user, also if they reference the user explicitly.
+	referenced := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: `{"sub": "admin-user"}`}
+	require.Nil(t, store.SaveAccessWithMetadata(referenced, IssueMetadata{UserRef: "admin-user"}))
+	resp = do(http.MethodGet, "/users/admin-user/tokens", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&summaries))
+	assert.Len(t, summaries, 2)
+
+	resp = do(http.MethodDelete, "/users/admin-user/tokens", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var counts AdminRevokeCounts
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&counts))
+	assert.Equal(t, AdminRevokeCounts{Access: 2, Refresh: 2}, counts)
+	resp = do(http.MethodGet, "/users/admin-user/tokens", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&summaries))
+	assert.Empty(t, summaries)
+	_, err = store.LoadAccess(referenced.AccessToken)
+	assert.True(t, errors.Is(err, ErrTokenNotFound))
+}
+
+func TestImportClients(t *testing.T) {
+	counts, err := store.ImportClients(strings.NewReader(`
+- id: import-1
+  secret: secret
+  redirect_uri: http://localhost/
+- id: import-2
+  secret: secret
+  redirect_uri: http://localhost/
+  user_data: '{"team": "billing"}'
+  trusted: true
+  client_name: Billing
+  logo_uri: https://billing.example.com/logo.png
+`), ImportYAML)
+	require.Nil(t, err)
+	assert.Equal(t, &ImportCounts{Created: 2}, counts)
+	getClient(t, store, &Client{
+		DefaultClient: osin.DefaultClient{Id: "import-2", Secret: "secret", RedirectUri: "http://localhost/", UserData: `{"team": "billing"}`},
+		Trusted:       true,
+		Metadata:      ClientMetadata{DisplayName: "Billing", LogoURI: "https://billing.example.com/logo.png"},
+	})
+
+	counts, err = store.ImportClients(strings.NewReader(`[{"id": "import-2", "secret": "rotated", "redirect_uri": "http://localhost/"}, {"id": "import-3"}]`), ImportJSON)
+	require.Nil(t, err)
+	assert.Equal(t, &ImportCounts{Created: 1, Updated: 1}, counts)
+	getClient(t, store, &osin.DefaultClient{Id: "import-2", Secret: "rotated", RedirectUri: "http://localhost/", UserData: ""})
+
+	_, err = store.ImportClients(strings.NewReader(`[{"id": "import-4"}, {"secret": "no id"}]`), ImportJSON)
+	assert.NotNil(t, err)
+	_, err = store.GetClient("import-4")
+	assert.Equal(t, ErrClientNotFound, err)
+
+	for _, id := range []string{"import-1", "import-2", "import-3"} {
+		require.Nil(t, store.RemoveClient(id))
+	}
+}
+
+func TestUpsertClient(t *testing.T) {
+	client := &Client{DefaultClient: osin.DefaultClient{Id: "upsert", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}, Trusted: true}
+	created, err := store.UpsertClient(client)
+	require.Nil(t, err)
+	assert.True(t, created)
+	defer store.RemoveClient(client.Id)
+	getClient(t, store, client)
+
+	created, err = store.UpsertClient(client)
+	require.Nil(t, err)
+	assert.False(t, created)
+
+	update := &osin.DefaultClient{Id: "upsert", Secret: "rotated", RedirectUri: "http://example.com/", UserData: "{}"}
+	created, err = store.UpsertClient(update)
+	require.Nil(t, err)
+	assert.False(t, created)
+	getClient(t, store, update)
+}
+
+func TestExportUserData(t *testing.T) {
+	client := &osin.DefaultClient{Id: "export", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: "export-user"}
+	require.Nil(t, store.SaveAccess(access))
+	referenced := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, Scope: "write", CreatedAt: time.Now().Add(time.Second), UserData: `{"sub": "export-user"}`}
+	require.Nil(t, store.SaveAccessWithMetadata(referenced, IssueMetadata{UserRef: "export-user"}))
+	require.Nil(t, store.GrantConsent(&Consent{UserRef: "export-user", ClientID: client.Id, Scope: "read", GrantedAt: time.Now()}))
+
+	var buf strings.Builder
+	require.Nil(t, store.ExportUserData(context.Background(), "export-user", &buf))
+	var export UserExport
+	require.Nil(t, json.Unmarshal([]byte(buf.String()), &export))
+	assert.Equal(t, "export-user", export.UserRef)
+	require.Len(t, export.AccessTokens, 2)
+	assert.Equal(t, HashToken(access.AccessToken), export.AccessTokens[0].TokenHash)
+	assert.Equal(t, HashToken(access.RefreshToken), export.AccessTokens[0].RefreshTokenHash)
+	assert.Equal(t, HashToken(referenced.AccessToken), export.AccessTokens[1].TokenHash)
+	assert.NotContains(t, buf.String(), access.AccessToken)
+	require.Len(t, export.Consents, 1)
+	assert.Empty(t, export.Authorizations)
+	assert.Empty(t, export.Sessions)
+
+	_, err := store.RevokeAllByUser("export-user")
+	require.Nil(t, err)
+	require.Nil(t, store.RevokeConsent("export-user", client.Id))
+	removeClient(t, store, client)
+}
+
+func TestEraseUser(t *testing.T) {
+	client := &osin.DefaultClient{Id: "erase", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: "erase-user"}
+	require.Nil(t, store.SaveAccess(access))
+	require.Nil(t, store.GrantConsent(&Consent{UserRef: "erase-user", ClientID: client.Id, Scope: "read", GrantedAt: time.Now()}))
+	require.Nil(t, store.CreateSession(&Session{SID: uuid.New(), UserRef: "erase-user", AuthTime: time.Now(), LastSeen: time.Now()}))
+
+	counts, err := store.EraseUser(context.Background(), "erase-user")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int64{"access": 1, "refresh": 1, "authorize": 0, "token_exchange": 0, "access_archive": 0, "authorize_archive": 0, "consent": 1, "backchannel_request": 0, "session": 1}, counts)
+
+	_, err = store.LoadAccess(access.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	ok, err := store.HasConsent("erase-user", client.Id, "read")
+	require.Nil(t, err)
+	assert.False(t, ok)
+	removeClient(t, store, client)
+}
+
+func TestEraseUserWithArchive(t *testing.T) {
+	archiving := New(db, WithDialect(dialect), WithArchive())
+	client := &osin.DefaultClient{Id: "erase-archive", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, archiving, client)
+	defer removeClient(t, archiving, client)
+
+	user := "erase-" + uuid.New()
+	removed := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: user}
+	require.Nil(t, archiving.SaveAccess(removed))
+	require.Nil(t, archiving.RemoveAccess(removed.AccessToken))
+	referenced := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: "referenced"}
+	require.Nil(t, archiving.SaveAccessWithMetadata(referenced, IssueMetadata{UserRef: user}))
+	require.Nil(t, archiving.RemoveAccess(referenced.AccessToken))
+	var ref string
+	require.Nil(t, db.QueryRow("SELECT user_ref FROM access_archive WHERE access_token=$1", referenced.AccessToken).Scan(&ref))
+	assert.Equal(t, user, ref)
+	subject := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: user}
+	require.Nil(t, archiving.SaveAccess(subject))
+	exchanged := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: "service"}
+	require.Nil(t, archiving.SaveExchangedAccess(exchanged, IssueMetadata{UserRef: user}, &TokenExchange{
+		SubjectTokenHash: HashToken(subject.AccessToken),
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:access_token",
+		Actors:           []string{"service"},
+	}))
+	ciba := &BackchannelAuthRequest{AuthReqID: uuid.New(), ClientID: client.Id, Scope: "openid", LoginHint: "hint", ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, archiving.SaveBackchannelRequest(ciba))
+	require.Nil(t, archiving.ApproveBackchannelRequest(ciba.AuthReqID, user))
+
+	counts, err := archiving.EraseUser(context.Background(), user)
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, counts["access"])
+	assert.EqualValues(t, 1, counts["token_exchange"])
+	assert.EqualValues(t, 2, counts["access_archive"])
+	assert.EqualValues(t, 1, counts["backchannel_request"])
+
+	var archived int
+	require.Nil(t, db.QueryRow("SELECT count(*) FROM access_archive WHERE extra=$1 OR user_ref=$1", user).Scan(&archived))
+	assert.Equal(t, 0, archived)
+	_, err = archiving.GetTokenExchange(exchanged.AccessToken)
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestPartitionedSchemas(t *testing.T) {
+	postgresOnly(t)
+
+	require.Nil(t, store.DropSchemas())
+	defer func() {
+		require.Nil(t, store.DropSchemas())
+		require.Nil(t, store.CreateSchemas())
+	}()
+
+	config := PartitionConfig{Interval: PartitionDaily, Ahead: 1, Retention: 24 * time.Hour}
+	require.Nil(t, store.CreatePartitionedSchemas(config))
+	today := time.Now().UTC()
+	created, dropped, err := store.MaintainPartitions(config)
+	require.Nil(t, err)
+	assert.Empty(t, created)
+	assert.Empty(t, dropped)
+
+	old := today.AddDate(0, 0, -5)
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE %s PARTITION OF access FOR VALUES FROM ('%s') TO ('%s')",
+		PartitionDaily.name("access", PartitionDaily.start(old)),
+		PartitionDaily.start(old).Format(time.RFC3339),
+		PartitionDaily.next(PartitionDaily.start(old)).Format(time.RFC3339)))
+	require.Nil(t, err)
+
+	client := &osin.DefaultClient{Id: "partitioned", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	expired := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: old}
+	current := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: today}
+	require.Nil(t, store.SaveAccess(expired))
+	require.Nil(t, store.SaveAccess(current))
+
+	_, dropped, err = store.MaintainPartitions(config)
+	require.Nil(t, err)
+	assert.Equal(t, []string{PartitionDaily.name("access", PartitionDaily.start(old))}, dropped)
+	_, err = store.LoadRefresh(expired.RefreshToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	_, err = store.LoadAccess(current.AccessToken)
+	assert.Nil(t, err)
+}
+
+func TestPartitionInterval(t *testing.T) {
+	start := PartitionMonthly.start(time.Date(2024, 2, 17, 13, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), PartitionMonthly.next(start))
+	assert.Equal(t, "access_p202402", PartitionMonthly.name("access", start))
+	parsed, ok := PartitionMonthly.parse("access", "access_p202402")
+	assert.True(t, ok)
+	assert.Equal(t, start, parsed)
+	_, ok = PartitionMonthly.parse("access", "access_default")
+	assert.False(t, ok)
+	_, ok = PartitionDaily.parse("access", "access_p202402")
+	assert.False(t, ok)
+}
+
+func TestArchive(t *testing.T) {
+	archiving := New(db, WithArchive())
+	client := &osin.DefaultClient{Id: "archive", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, archiving, client)
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now()}
+	require.Nil(t, archiving.SaveAccess(access))
+	require.Nil(t, archiving.RemoveAccess(access.AccessToken))
+	_, err := archiving.LoadAccess(access.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	var archived int
+	require.Nil(t, db.QueryRow("SELECT count(*) FROM access_archive WHERE access_token=$1", access.AccessToken).Scan(&archived))
+	assert.Equal(t, 1, archived)
+
+	expired := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 1, CreatedAt: time.Now().Add(-time.Hour)}
+	require.Nil(t, archiving.SaveAuthorize(expired))
+	counts, err := archiving.PurgeExpiredTokens()
+	require.Nil(t, err)
+	assert.True(t, counts.Authorize >= 1)
+	require.Nil(t, db.QueryRow("SELECT count(*) FROM authorize_archive WHERE code=$1", expired.Code).Scan(&archived))
+	assert.Equal(t, 1, archived)
+
+	counts, err = archiving.PurgeArchive(0)
+	require.Nil(t, err)
+	assert.True(t, counts.Access >= 1)
+	assert.True(t, counts.Authorize >= 1)
+	removeClient(t, archiving, client)
+}
+
+func TestStats(t *testing.T) {
+	client := &osin.DefaultClient{Id: "stats", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	expired := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 1, CreatedAt: time.Now().Add(-time.Hour)}
+	require.Nil(t, store.SaveAccess(expired))
+
+	stats, err := store.Stats(context.Background())
+	require.Nil(t, err)
+	for _, table := range tables() {
+		assert.Contains(t, stats, table)
+	}
+	assert.True(t, stats["client"].Rows >= 1)
+	assert.True(t, stats["access"].Expired >= 1)
+	assert.False(t, stats["access"].Oldest.After(expired.CreatedAt))
+	assert.True(t, stats["client"].Oldest.IsZero())
+
+	require.Nil(t, store.RemoveAccess(expired.AccessToken))
+	removeClient(t, store, client)
+}
+
+func TestReportGauges(t *testing.T) {
+	gauges := map[string]float64{}
+	measured := New(db, WithMetrics(Metrics{Gauge: func(name string, value float64) { gauges[name] = value }}))
+	client := &osin.DefaultClient{Id: "gauges", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, measured, client)
+	expired := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 1, CreatedAt: time.Now().Add(-time.Hour)}
+	require.Nil(t, measured.SaveAccess(expired))
+
+	require.Nil(t, measured.ReportGauges(context.Background()))
+	assert.True(t, gauges[GaugeExpiredAccessTokens] >= 1)
+	assert.Contains(t, gauges, GaugeOrphanedRefreshTokens)
+	assert.Contains(t, gauges, GaugeExpiredAuthorizeCodes)
+
+	require.Nil(t, measured.RemoveAccess(expired.AccessToken))
+	removeClient(t, measured, client)
+}
+
+func TestDialect(t *testing.T) {
+	crdb := New(db, WithDialect(DialectCockroachDB))
+	assert.Equal(t, distributedRetryPolicy, crdb.retryPolicy)
+	assert.NotNil(t, crdb.unsupported("WithNotify"))
+	_, _, err := crdb.MaintainPartitions(PartitionConfig{})
+	assert.NotNil(t, err)
+
+	policy := RetryPolicy{MaxAttempts: 2}
+	assert.Equal(t, policy, New(db, WithRetry(policy), WithDialect(DialectCockroachDB)).retryPolicy)
+	assert.Nil(t, New(db).unsupported("WithNotify"))
+
+	yugabyte := New(db, WithDialect(DialectYugabyteDB))
+	assert.Equal(t, distributedRetryPolicy, yugabyte.retryPolicy)
+	assert.NotNil(t, yugabyte.unsupported("WithNotify"))
+	assert.Nil(t, yugabyte.unsupported("MaintainPartitions"))
+}
+
+func TestOsinFlows(t *testing.T) {
+	osintest.Run(t, store)
+}
+
+func TestClock(t *testing.T) {
+	now := time.Now()
+	clocked := New(db, WithDialect(dialect), WithClock(ClockFunc(func() time.Time { return now })))
+	client := &osin.DefaultClient{Id: "clock", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, clocked, client)
+	defer clocked.RemoveClient(client.Id)
+
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, RedirectUri: "http://localhost/", CreatedAt: now, UserData: userDataMock}
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	require.Nil(t, clocked.SaveAuthorize(authorize))
+	require.Nil(t, clocked.SaveAccess(access))
+	claimed, err := clocked.ClaimNonce("clock", time.Minute)
+	require.Nil(t, err)
+	require.True(t, claimed)
+
+	now = now.Add(2 * time.Minute)
+	_, err = clocked.LoadAuthorize(authorize.Code)
+	assert.NotNil(t, err, "authorize code must be expired")
+	result, err := clocked.Introspect(access.AccessToken)
+	require.Nil(t, err)
+	assert.False(t, result.Active)
+	claimed, err = clocked.ClaimNonce("clock", time.Minute)
+	require.Nil(t, err)
+	assert.True(t, claimed, "nonce must be expired")
+
+	counts, err := clocked.PurgeExpiredTokens()
+	require.Nil(t, err)
+	assert.True(t, counts.Authorize >= 1)
+	assert.True(t, counts.Access >= 1)
+	_, err = store.LoadAccess(access.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestRotation(t *testing.T) {
+	rotating := New(db, WithDialect(dialect), WithRotation())
+	client := &osin.DefaultClient{Id: "rotation", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, rotating, client)
+	defer rotating.RemoveClient(client.Id)
+
+	first := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, rotating.SaveAccess(first))
+	second := &osin.AccessData{Client: client, AccessData: first, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, rotating.SaveAccess(second))
+
+	_, err := rotating.LoadAccess(first.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	_, err = rotating.LoadRefresh(first.RefreshToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	loaded, err := rotating.LoadRefresh(second.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, second.AccessToken, loaded.AccessToken)
+
+	// Without rotation, the previous tokens are kept.
+	third := &osin.AccessData{Client: client, AccessData: second, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(third))
+	_, err = store.LoadRefresh(second.RefreshToken)
+	assert.Nil(t, err)
+}
+
+func TestRevocationList(t *testing.T) {
+	since := time.Now()
+	revoking := New(db, WithDialect(dialect), WithRevocationList())
+	client := &osin.DefaultClient{Id: "revocations", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, revoking, client)
+	defer revoking.RemoveClient(client.Id)
+
+	first := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, revoking.SaveAccess(first))
+	second := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, revoking.SaveAccess(second))
+
+	require.Nil(t, revoking.RemoveAccess(first.AccessToken))
+	_, err := revoking.RevokeAllByClient(client.Id)
+	require.Nil(t, err)
+
+	revocations, err := revoking.ListRevocations(since, 0, 100)
+	require.Nil(t, err)
+	var hashes []string
+	for _, r := range revocations {
+		hashes = append(hashes, r.TokenType+":"+r.TokenHash)
+	}
+	assert.Equal(t, []string{
+		TokenTypeAccess + ":" + HashToken(first.AccessToken),
+		TokenTypeRefresh + ":" + HashToken(second.RefreshToken),
+		TokenTypeAccess + ":" + HashToken(second.AccessToken),
+	}, hashes)
+
+	page, err := revoking.ListRevocations(since, revocations[0].ID, 1)
+	require.Nil(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, revocations[1].ID, page[0].ID)
+
+	var streamed []int64
+	require.Nil(t, revoking.StreamRevocations(context.Background(), since, func(r *Revocation) error {
+		streamed = append(streamed, r.ID)
+		return nil
+	}))
+	assert.Len(t, streamed, len(revocations))
+
+	n, err := revoking.PurgeRevocations(-time.Minute)
+	require.Nil(t, err)
+	assert.True(t, n >= int64(len(revocations)))
+}
+
+func TestRefreshGracePeriod(t *testing.T) {
+	now := time.Now()
+	grace := New(db, WithDialect(dialect), WithRotation(), WithRefreshGracePeriod(time.Minute), WithClock(ClockFunc(func() time.Time { return now })))
+	client := &osin.DefaultClient{Id: "grace", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, grace, client)
+	defer grace.RemoveClient(client.Id)
+
+	first := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	require.Nil(t, grace.SaveAccess(first))
+	second := &osin.AccessData{Client: client, AccessData: first, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	require.Nil(t, grace.SaveAccess(second))
+	require.Nil(t, grace.RemoveRefresh(first.RefreshToken))
+
+	loaded, err := grace.LoadRefresh(first.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, second.AccessToken, loaded.AccessToken)
+	_, err = grace.LoadAccess(first.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	now = now.Add(2 * time.Minute)
+	_, err = grace.LoadRefresh(first.RefreshToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	counts, err := grace.PurgeExpiredTokens()
+	require.Nil(t, err)
+	assert.True(t, counts.Refresh >= 1)
+	loaded, err = grace.LoadRefresh(second.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, second.AccessToken, loaded.AccessToken)
+}
+
+func TestRevokeDuringGracePeriod(t *testing.T) {
+	grace := New(db, WithDialect(dialect), WithRotation(), WithRefreshGracePeriod(time.Minute))
+	client := &osin.DefaultClient{Id: "grace-revoke", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, grace, client)
+	defer grace.RevokeAllByClient(client.Id)
+	defer grace.RemoveClient(client.Id)
+
+	first := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, grace.SaveAccess(first))
+	second := &osin.AccessData{Client: client, AccessData: first, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, grace.SaveAccess(second))
+	_, err := grace.LoadRefresh(first.RefreshToken)
+	require.Nil(t, err)
+
+	// A leaked rotated refresh token is revoked although it is within the grace period.
+	require.Nil(t, grace.RevokeToken(first.RefreshToken))
+	_, err = grace.LoadRefresh(first.RefreshToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+	_, err = grace.LoadRefresh(second.RefreshToken)
+	assert.Nil(t, err)
+}
+
+func TestIntrospectExpiredRefresh(t *testing.T) {
+	now := time.Now()
+	expiring := New(db, WithDialect(dialect), WithRefreshExpiry(time.Hour, 3*time.Hour), WithClock(ClockFunc(func() time.Time { return now })))
+	client := &osin.DefaultClient{Id: "introspect-refresh-expiry", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, expiring, client)
+	defer expiring.RevokeAllByClient(client.Id)
+	defer expiring.RemoveClient(client.Id)
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	require.Nil(t, expiring.SaveAccess(access))
+	i, err := expiring.Introspect(access.RefreshToken)
+	require.Nil(t, err)
+	assert.True(t, i.Active)
+	assert.Equal(t, now.Add(time.Hour).Unix(), i.ExpiresAt.Unix(), "sliding expiry precedes the absolute expiry")
+
+	// Used until shortly before the absolute expiry, which then precedes the sliding expiry.
+	for j := 0; j < 3; j++ {
+		now = now.Add(50 * time.Minute)
+		_, err = expiring.LoadRefresh(access.RefreshToken)
+		require.Nil(t, err)
+	}
+	i, err = expiring.Introspect(access.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, access.CreatedAt.Add(3*time.Hour).Unix(), i.ExpiresAt.Unix())
+
+	// Unused for longer than the sliding expiry.
+	now = now.Add(2 * time.Hour)
+	_, err = expiring.LoadRefresh(access.RefreshToken)
+	assert.NotNil(t, err)
+	i, err = expiring.Introspect(access.RefreshToken)
+	require.Nil(t, err)
+	assert.False(t, i.Active)
+}
+
+func TestRefreshExpiry(t *testing.T) {
+	now := time.Now()
+	expiring := New(db, WithDialect(dialect), WithRefreshExpiry(time.Hour, 3*time.Hour), WithClock(ClockFunc(func() time.Time { return now })))
+	client := &osin.DefaultClient{Id: "refresh-expiry", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, expiring, client)
+	defer expiring.RemoveClient(client.Id)
+
+	abandoned := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	require.Nil(t, expiring.SaveAccess(abandoned))
+	prev := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	require.Nil(t, expiring.SaveAccess(prev))
+
+	// Using the refresh token within the sliding window keeps it alive, until the absolute expiry of the chain.
+	for i := 0; i < 2; i++ {
+		now = now.Add(50 * time.Minute)
+		_, err := expiring.LoadRefresh(prev.RefreshToken)
+		require.Nil(t, err)
+		next := &osin.AccessData{Client: client, AccessData: prev, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+		require.Nil(t, expiring.SaveAccess(next))
+		prev = next
+	}
+	_, err := expiring.LoadRefresh(abandoned.RefreshToken)
+	assert.NotNil(t, err, "unused refresh token must expire")
+
+	now = now.Add(50 * time.Minute)
+	_, err = expiring.LoadRefresh(prev.RefreshToken)
+	require.Nil(t, err)
+	now = now.Add(50 * time.Minute)
+	_, err = expiring.LoadRefresh(prev.RefreshToken)
+	assert.NotNil(t, err, "refresh token must expire after the absolute expiry of the chain")
+
+	counts, err := expiring.PurgeExpiredTokens()
+	require.Nil(t, err)
+	assert.True(t, counts.Refresh >= 2)
+}
+
+func TestClientTokenTTL(t *testing.T) {
+	client := &osin.DefaultClient{Id: "ttl", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RemoveClient(client.Id)
+
+	ttl, err := store.GetClientTokenTTL(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, &ClientTokenTTL{}, ttl)
+
+	require.Nil(t, store.SetClientTokenTTL(client.Id, ClientTokenTTL{Access: time.Minute, Refresh: time.Hour}))
+	ttl, err = store.GetClientTokenTTL(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, &ClientTokenTTL{Access: time.Minute, Refresh: time.Hour}, ttl)
+	assert.Equal(t, ErrClientNotFound, store.SetClientTokenTTL("unknown", ClientTokenTTL{}))
+
+	ar := &osin.AccessRequest{Client: client, Expiration: 3600}
+	require.Nil(t, store.ApplyClientTokenTTL(ar))
+	assert.Equal(t, int32(60), ar.Expiration)
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+	var absoluteExpiry time.Time
+	require.Nil(t, db.QueryRow("SELECT absolute_expiry FROM refresh WHERE token=$1", access.RefreshToken).Scan(&absoluteExpiry))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), absoluteExpiry, time.Minute)
+}
+
+func TestListUnusedRefreshTokens(t *testing.T) {
+	now := time.Now()
+	clocked := New(db, WithDialect(dialect), WithClock(ClockFunc(func() time.Time { return now })))
+	client := &osin.DefaultClient{Id: "unused", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, clocked, client)
+	defer clocked.RevokeAllByClient(client.Id)
+	defer clocked.RemoveClient(client.Id)
+
+	unused := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	used := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: now, UserData: userDataMock}
+	require.Nil(t, clocked.SaveAccess(unused))
+	require.Nil(t, clocked.SaveAccess(used))
+
+	now = now.Add(48 * time.Hour)
+	for i := 0; i < 2; i++ {
+		_, err := clocked.LoadRefresh(used.RefreshToken)
+		require.Nil(t, err)
+	}
+
+	now = now.Add(time.Hour)
+	tokens, err := clocked.ListUnusedRefreshTokens(24*time.Hour, 100000)
+	require.Nil(t, err)
+	var found []string
+	for _, u := range tokens {
+		if u.ClientID == client.Id {
+			found = append(found, u.Token)
+			assert.Equal(t, unused.AccessToken, u.AccessToken)
+			assert.Equal(t, int64(0), u.UseCount)
+		}
+	}
+	assert.Equal(t, []string{unused.RefreshToken}, found)
+
+	var useCount int64
+	require.Nil(t, db.QueryRow("SELECT use_count FROM refresh WHERE token=$1", used.RefreshToken).Scan(&useCount))
+	assert.Equal(t, int64(2), useCount)
+}
+
+func TestUsageTracking(t *testing.T) {
+	tracking := New(db, WithDialect(dialect), WithUsageTracking())
+	client := &osin.DefaultClient{Id: "usage", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, tracking, client)
+	defer tracking.RevokeAllByClient(client.Id)
+	defer tracking.RemoveClient(client.Id)
+
+	since := time.Now().Add(-time.Second)
+	first := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	second := &osin.AccessData{Client: client, AccessData: first, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, tracking.SaveAccess(first))
+	require.Nil(t, tracking.SaveAccess(second))
+
+	for i := 0; i < 3; i++ {
+		_, err := tracking.LoadAccess(second.AccessToken)
+		require.Nil(t, err)
+	}
+	require.Nil(t, tracking.FlushUsage(context.Background()))
+	_, err := tracking.Introspect(second.AccessToken)
+	require.Nil(t, err)
+	require.Nil(t, tracking.FlushUsage(context.Background()))
+
+	usage, err := tracking.ListClientUsage(since)
+	require.Nil(t, err)
+	var found *ClientUsage
+	for _, u := range usage {
+		if u.ClientID == client.Id {
+			found = u
+		}
+	}
+	require.NotNil(t, found)
+	// Loading the previous access data together with second is not counted as a use of first.
+	assert.Equal(t, int64(1), found.Tokens)
+	assert.Equal(t, int64(4), found.Uses)
+	assert.Equal(t, int64(4), found.MaxUses)
+}
+
+func TestSaveWithMetadata(t *testing.T) {
+	client := &osin.DefaultClient{Id: "metadata", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer store.RemoveClient(client.Id)
+
+	r := httptest.NewRequest(http.MethodPost, "/token", nil)
+	r.RemoteAddr = "192.0.2.1:4711"
+	r.Header.Set("User-Agent", "test/1.0")
+	meta := IssueMetadataFromRequest(r)
+	assert.Equal(t, IssueMetadata{IP: "192.0.2.1", UserAgent: "test/1.0"}, meta)
+
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAuthorizeWithMetadata(authorize, meta))
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccessWithMetadata(access, meta))
+
+	var ip, userAgent string
+	require.Nil(t, db.QueryRow("SELECT issued_ip, user_agent FROM authorize WHERE code=$1", authorize.Code).Scan(&ip, &userAgent))
+	assert.Equal(t, meta, IssueMetadata{IP: ip, UserAgent: userAgent})
+	require.Nil(t, db.QueryRow("SELECT issued_ip, user_agent FROM access WHERE access_token=$1", access.AccessToken).Scan(&ip, &userAgent))
+	assert.Equal(t, meta, IssueMetadata{IP: ip, UserAgent: userAgent})
+}
+
+func TestDPoPThumbprint(t *testing.T) {
+	client := &osin.DefaultClient{Id: "dpop", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer store.RemoveClient(client.Id)
+
+	bound := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccessWithMetadata(bound, IssueMetadata{DPoPThumbprint: "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"}))
+	unbound := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(unbound))
+
+	jkt, err := store.LoadDPoPThumbprint(bound.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I", jkt)
+	jkt, err = store.LoadDPoPThumbprint(unbound.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, "", jkt)
+	_, err = store.LoadDPoPThumbprint("unknown")
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	i, err := store.Introspect(bound.RefreshToken)
+	require.Nil(t, err)
+	assert.Equal(t, "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I", i.DPoPThumbprint)
+}
+
+func TestCertificateThumbprint(t *testing.T) {
+	client := &osin.DefaultClient{Id: "mtls", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer store.RemoveClient(client.Id)
+
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	r := httptest.NewRequest(http.MethodPost, "/token", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	meta := IssueMetadataFromRequest(r)
+	assert.Equal(t, CertificateThumbprint(cert), meta.CertificateThumbprint)
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccessWithMetadata(access, meta))
+	x5t, err := store.LoadCertificateThumbprint(access.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, meta.CertificateThumbprint, x5t)
+
+	i, err := store.Introspect(access.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, meta.CertificateThumbprint, i.CertificateThumbprint)
+}
+
+func TestSecretHistory(t *testing.T) {
+	client := &osin.DefaultClient{Id: "secret-history", Secret: "first", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RemoveClient(client.Id)
+
+	admin := store.AuditAs("admin", nil)
+	client.Secret = "second"
+	require.Nil(t, admin.UpdateClient(client))
+	client.RedirectUri = "http://localhost/callback"
+	require.Nil(t, store.UpdateClient(client))
+	client.Secret = "third"
+	require.Nil(t, store.UpdateClient(client))
+
+	rotations, err := store.ListSecretRotations(client.Id)
+	require.Nil(t, err)
+	require.Len(t, rotations, 2)
+	assert.Equal(t, HashToken("second"), rotations[0].SecretHash)
+	assert.Equal(t, "", rotations[0].Actor)
+	assert.Equal(t, HashToken("first"), rotations[1].SecretHash)
+	assert.Equal(t, "admin", rotations[1].Actor)
+
+	client.Secret = "fourth"
+	created, err := store.UpsertClient(client)
+	require.Nil(t, err)
+	assert.False(t, created)
+	_, err = store.ImportClients(strings.NewReader(`[{"id": "secret-history", "secret": "fifth", "redirect_uri": "http://localhost/"}]`), ImportJSON)
+	require.Nil(t, err)
+	_, err = store.ImportClients(strings.NewReader(`[{"id": "secret-history", "secret": "fifth", "redirect_uri": "http://localhost/"}]`), ImportJSON)
+	require.Nil(t, err)
+	rotations, err = store.ListSecretRotations(client.Id)
+	require.Nil(t, err)
+	require.Len(t, rotations, 4)
+	assert.Equal(t, HashToken("fourth"), rotations[0].SecretHash)
+	assert.Equal(t, HashToken("third"), rotations[1].SecretHash)
+
+	server := httptest.NewServer(NewAdminHandler(store))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/clients/secret-history/secrets")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	var history []AdminSecretRotation
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&history))
+	require.Len(t, history, 4)
+	assert.Equal(t, "admin", history[3].Actor)
+}
+
+func TestClientOwner(t *testing.T) {
+	first := &osin.DefaultClient{Id: "owned-1", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	second := &osin.DefaultClient{Id: "owned-2", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	other := &osin.DefaultClient{Id: "owned-3", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	for _, c := range []*osin.DefaultClient{second, first, other} {
+		createClient(t, store, c)
+		defer store.RemoveClient(c.Id)
+	}
+
+	require.Nil(t, store.SetClientOwner(first.Id, "team-a"))
+	require.Nil(t, store.SetClientOwner(second.Id, "team-a"))
+	require.Nil(t, store.SetClientOwner(other.Id, "team-b"))
+	assert.Equal(t, ErrClientNotFound, store.SetClientOwner("unknown", "team-a"))
+	owner, err := store.GetClientOwner(first.Id)
+	require.Nil(t, err)
+	assert.Equal(t, "team-a", owner)
+
+	clients, err := store.ListClientsByOwner("team-a")
+	require.Nil(t, err)
+	require.Len(t, clients, 2)
+	assert.Equal(t, first.Id, clients[0].Id)
+	assert.Equal(t, second.Id, clients[1].Id)
+
+	require.Nil(t, store.SoftDeleteClient(second.Id))
+	require.Nil(t, store.SetClientOwner(other.Id, ""))
+	clients, err = store.ListClientsByOwner("team-a")
+	require.Nil(t, err)
+	assert.Len(t, clients, 1)
+	clients, err = store.ListClientsByOwner("team-b")
+	require.Nil(t, err)
+	assert.Empty(t, clients)
+}
+
+func TestTokenExchange(t *testing.T) {
+	client := &osin.DefaultClient{Id: "exchange", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer store.RemoveClient(client.Id)
+
+	subject := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(subject))
+	exchanged := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveExchangedAccess(exchanged, IssueMetadata{}, &TokenExchange{
+		SubjectTokenHash: HashToken(subject.AccessToken),
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:access_token",
+		Actors:           []string{"service-a"},
+	}))
+	delegated := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveExchangedAccess(delegated, IssueMetadata{}, &TokenExchange{
+		SubjectTokenHash: HashToken(exchanged.AccessToken),
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:access_token",
+		Actors:           []string{"service-b", "service-a"},
+	}))
+
+	e, err := store.GetTokenExchange(delegated.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, HashToken(exchanged.AccessToken), e.SubjectTokenHash)
+	assert.Equal(t, []string{"service-b", "service-a"}, e.Actors)
+	_, err = store.GetTokenExchange(subject.AccessToken)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	counts, err := store.RevokeDerivedTokens(subject.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, &RevokeCounts{Access: 2, Refresh: 1}, counts)
+	_, err = store.LoadAccess(subject.AccessToken)
+	assert.Nil(t, err)
+	_, err = store.LoadAccess(delegated.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestResources(t *testing.T) {
+	client := &osin.DefaultClient{Id: "resources", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer store.RemoveClient(client.Id)
+
+	resources := []string{"https://api.example.com/", "https://files.example.com/"}
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAuthorizeWithMetadata(authorize, IssueMetadata{Resources: resources}))
+	loaded, err := store.LoadAuthorizeResources(authorize.Code)
+	require.Nil(t, err)
+	assert.Equal(t, resources, loaded)
+
+	inherited := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(inherited))
+	loaded, err = store.LoadResources(inherited.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, resources, loaded)
+
+	narrowed := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccessWithMetadata(narrowed, IssueMetadata{Resources: resources[:1]}))
+	i, err := store.Introspect(narrowed.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, resources[:1], i.Audience)
+
+	unrestricted := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(unrestricted))
+	loaded, err = store.LoadResources(unrestricted.AccessToken)
+	require.Nil(t, err)
+	assert.Empty(t, loaded)
+}
+
+func TestAuthorizationDetails(t *testing.T) {
+	client := &osin.DefaultClient{Id: "rar", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RevokeAllByClient(client.Id)
+	defer store.RemoveClient(client.Id)
+
+	details := json.RawMessage(`[{"type":"payment_initiation","instructedAmount":{"currency":"EUR","amount":"123.50"}}]`)
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAuthorizeWithMetadata(authorize, IssueMetadata{AuthorizationDetails: details}))
+	loaded, err := store.LoadAuthorizeAuthorizationDetails(authorize.Code)
+	require.Nil(t, err)
+	assert.JSONEq(t, string(details), string(loaded))
+
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(access))
+	loaded, err = store.LoadAuthorizationDetails(access.AccessToken)
+	require.Nil(t, err)
+	assert.JSONEq(t, string(details), string(loaded))
+	i, err := store.Introspect(access.AccessToken)
+	require.Nil(t, err)
+	assert.JSONEq(t, string(details), string(i.AuthorizationDetails))
+
+	plain := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, store.SaveAccess(plain))
+	loaded, err = store.LoadAuthorizationDetails(plain.AccessToken)
+	require.Nil(t, err)
+	assert.Nil(t, loaded)
+}
+
+type ts struct{}
+
+func (s *ts) String() string {
+	return "foo"
+}
+
+func TestIdempotentSaves(t *testing.T) {
+	idempotent := New(db, WithDialect(dialect), WithIdempotentSaves())
+	client := &osin.DefaultClient{Id: "idempotent", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, idempotent, client)
+	defer idempotent.RemoveClient(client.Id)
+
+	authorize := &osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, Scope: "read", RedirectUri: "http://localhost/", CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, idempotent.SaveAuthorize(authorize))
+	require.Nil(t, idempotent.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: authorize.Code, ExpiresIn: 60, Scope: "write", CreatedAt: time.Now(), UserData: userDataMock}))
+	assert.True(t, errors.Is(store.SaveAuthorize(authorize), ErrDuplicateKey))
+	loaded, err := idempotent.LoadAuthorize(authorize.Code)
+	require.Nil(t, err)
+	assert.Equal(t, "read", loaded.Scope)
+
+	access := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, idempotent.SaveAccess(access))
+	require.Nil(t, idempotent.SaveAccess(&osin.AccessData{Client: client, AccessToken: access.AccessToken, RefreshToken: access.RefreshToken, ExpiresIn: 60, Scope: "write", CreatedAt: time.Now(), UserData: userDataMock}))
+	assert.True(t, errors.Is(store.SaveAccess(access), ErrDuplicateKey))
+	loadedAccess, err := idempotent.LoadAccess(access.AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, "read", loadedAccess.Scope)
+	_, err = idempotent.LoadRefresh(access.RefreshToken)
+	require.Nil(t, err)
+}
+
+func TestIdempotentSavesWithTx(t *testing.T) {
+	idempotent := New(db, WithDialect(dialect), WithIdempotentSaves(), WithRotation())
+	client := &osin.DefaultClient{Id: "idempotent-tx", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, idempotent, client)
+	defer idempotent.RemoveClient(client.Id)
+
+	prev := &osin.AccessData{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, idempotent.SaveAccess(prev))
+	saved := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	require.Nil(t, idempotent.SaveAccess(saved))
+
+	// A replayed save refreshed from prev does not rotate prev within the transaction.
+	require.Nil(t, idempotent.WithTx(context.Background(), func(tx osin.Storage) error {
+		if err := tx.SaveAccess(&osin.AccessData{Client: client, AccessData: prev, AccessToken: saved.AccessToken, ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}); err != nil {
+			return err
+		}
+		return tx.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: uuid.New(), ExpiresIn: 60, RedirectUri: "http://localhost/", CreatedAt: time.Now(), UserData: userDataMock})
+	}))
+	_, err := idempotent.LoadAccess(prev.AccessToken)
+	require.Nil(t, err)
+	_, err = idempotent.LoadRefresh(prev.RefreshToken)
+	require.Nil(t, err)
+}
+
+func TestSaveAccessBatch(t *testing.T) {
+	client := &osin.DefaultClient{Id: "batch", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	createClient(t, store, client)
+	defer store.RemoveClient(client.Id)
+
+	batch := make([]*osin.AccessData, batchSize+10)
+	for i := range batch {
+		batch[i] = &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: userDataMock}
+		if i%2 == 0 {
+			batch[i].RefreshToken = uuid.New()
+		}
+	}
+	require.Nil(t, store.SaveAccessBatch(batch))
+	require.Nil(t, store.SaveAccessBatch(nil))
+
+	for _, data := range []*osin.AccessData{batch[0], batch[len(batch)-1]} {
+		loaded, err := store.LoadAccess(data.AccessToken)
+		require.Nil(t, err)
+		assert.Equal(t, data.Scope, loaded.Scope)
+	}
+	_, err := store.LoadRefresh(batch[0].RefreshToken)
+	require.Nil(t, err)
+
+	// The batch is saved in one transaction, so a duplicate saves none of the tokens.
+	duplicate := &osin.AccessData{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock}
+	assert.True(t, errors.Is(store.SaveAccessBatch([]*osin.AccessData{duplicate, batch[1]}), ErrDuplicateKey))
+	_, err = store.LoadAccess(duplicate.AccessToken)
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	idempotent := New(db, WithDialect(dialect), WithIdempotentSaves())
+	require.Nil(t, idempotent.SaveAccessBatch([]*osin.AccessData{duplicate, batch[1]}))
+	_, err = store.LoadAccess(duplicate.AccessToken)
+	require.Nil(t, err)
+}
+
+func TestCopyImport(t *testing.T) {
+	clients := []*ImportedClient{
+		{ID: "copy-1", Secret: "secret", RedirectURI: "http://localhost/", Trusted: true},
+		{ID: "copy-2", Secret: "secret", RedirectURI: "http://localhost/", ClientMetadata: ClientMetadata{DisplayName: "Copy"}},
+	}
+	n, err := store.CopyClients(context.Background(), func() (*ImportedClient, error) {
+		if len(clients) == 0 {
+			return nil, io.EOF
+		}
+		c := clients[0]
+		clients = clients[1:]
+		return c, nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	defer store.RemoveClient("copy-1")
+	defer store.RemoveClient("copy-2")
+
+	client, err := store.GetClient("copy-2")
+	require.Nil(t, err)
+	assert.Equal(t, "Copy", client.(*Client).Metadata.DisplayName)
+
+	tokens := []*osin.AccessData{
+		{Client: client, AccessToken: uuid.New(), RefreshToken: uuid.New(), ExpiresIn: 60, Scope: "read", CreatedAt: time.Now(), UserData: userDataMock},
+		{Client: client, AccessToken: uuid.New(), ExpiresIn: 60, CreatedAt: time.Now(), UserData: userDataMock},
+	}
+	remaining := tokens
+	n, err = store.CopyAccess(context.Background(), func() (*osin.AccessData, error) {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		data := remaining[0]
+		remaining = remaining[1:]
+		return data, nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	loaded, err := store.LoadAccess(tokens[0].AccessToken)
+	require.Nil(t, err)
+	assert.Equal(t, "read", loaded.Scope)
+	_, err = store.LoadRefresh(tokens[0].RefreshToken)
+	require.Nil(t, err)
+	_, err = store.LoadAccess(tokens[1].AccessToken)
+	require.Nil(t, err)
+}
+
+func TestCreateSchemasConcurrently(t *testing.T) {
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- New(db, WithDialect(dialect)).CreateSchemas() }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		assert.Nil(t, <-errs)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	conn, err := db.Conn(context.Background())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(context.Background(), "SELECT pg_advisory_lock($1)", cleanupLockID)
+	require.Nil(t, err)
+
+	ran, err := store.Cleanup(context.Background(), CleanupConfig{})
+	require.Nil(t, err)
+	assert.False(t, ran)
+
+	_, err = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", cleanupLockID)
+	require.Nil(t, err)
+	ran, err = store.Cleanup(context.Background(), CleanupConfig{ArchiveRetention: time.Hour, RevocationRetention: time.Hour})
+	require.Nil(t, err)
+	assert.True(t, ran)
+}
+
+func TestCleanupBatches(t *testing.T) {
+	purged := map[string]float64{}
+	cleanup := New(db, WithDialect(dialect), WithMetrics(Metrics{Counter: func(name string, delta float64) { purged[name] += delta }}))
+	for i := 0; i < 5; i++ {
+		_, err := db.Exec("INSERT INTO nonce (nonce, expires_at) VALUES ($1, $2)", uuid.New(), time.Now().Add(-time.Minute))
+		require.Nil(t, err)
+	}
+
+	ran, err := cleanup.Cleanup(context.Background(), CleanupConfig{BatchSize: 2})
+	require.Nil(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, float64(5), purged[CounterPurgedRows+"_nonce"])
+
+	_, err = db.Exec("INSERT INTO nonce (nonce, expires_at) VALUES ($1, $2)", uuid.New(), time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	ran, err = cleanup.Cleanup(context.Background(), CleanupConfig{BatchSize: 2, Deadline: time.Nanosecond})
+	require.Nil(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, float64(5), purged[CounterPurgedRows+"_nonce"])
+	n, err := cleanup.PurgeExpiredNonces()
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestAssertToString(t *testing.T) {
+	res, err := assertToString(struct{}{})
+	assert.NotNil(t, err)
+
+	res, err = assertToString("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", res)
+
+	res, err = assertToString(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", res)
+
+	res, err = assertToString(new(ts))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", res)
+}
+
+func getClient(t *testing.T, store storage.Storage, set osin.Client) {
+	client, err := store.GetClient(set.GetId())
+	require.Nil(t, err)
+	expected := set
+	if c, ok := set.(*osin.DefaultClient); ok {
+		expected = &Client{DefaultClient: *c}
+	}
+	if c, ok := client.(*Client); ok {
+		// Versions are checked by TestClientVersion.
+		loaded := *c
+		loaded.Version = 0
+		client = &loaded
+	}
+	require.EqualValues(t, expected, client)
 }
 
 func createClient(t *testing.T, store storage.Storage, set osin.Client) {
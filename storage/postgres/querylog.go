@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WithSlowQueryLog logs every query of the storage which takes longer than threshold, e.g. to spot missing indexes
+// in production. The log line contains the operation, the duration, the query and the shapes of its arguments,
+// like "string(36)" or "time.Time", but never their values, as they include secrets such as tokens.
+func WithSlowQueryLog(threshold time.Duration) Option {
+	return func(s *Storage) {
+		s.slowQuery = threshold
+	}
+}
+
+// SetDebug enables or disables logging every statement of the storage, for debugging integration issues in
+// staging. Like WithSlowQueryLog, the statements are logged with their placeholders and the shapes of their
+// arguments, and statements modifying rows with the number of affected rows. It can be toggled at runtime and
+// applies to the storage and all copies, e.g. from Clone or ForTenant, from their next operation on.
+func (s *Storage) SetDebug(enabled bool) {
+	if s.debug == nil {
+		return
+	}
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(s.debug, v)
+}
+
+// Debug returns true if statement logging is enabled with SetDebug.
+func (s *Storage) Debug() bool {
+	return s.debug != nil && atomic.LoadInt32(s.debug) == 1
+}
+
+// queryLogKey is the context key of the queryLog of an operation.
+type queryLogKey struct{}
+
+// queryLog is passed to the queries of the operation op in its context if they are logged.
+type queryLog struct {
+	op string
+
+	// slow is the threshold of WithSlowQueryLog, or zero.
+	slow time.Duration
+
+	debug bool
+}
+
+// withQueryLog returns ctx with the queryLog of the operation op, if its queries are logged.
+func (s *Storage) withQueryLog(ctx context.Context, op string) context.Context {
+	if s.slowQuery <= 0 && !s.Debug() {
+		return ctx
+	}
+	return context.WithValue(ctx, queryLogKey{}, queryLog{op, s.slowQuery, s.Debug()})
+}
+
+// logQuery logs the query started at start according to the queryLog in ctx. rows is the number of affected rows,
+// or -1 if it is not known.
+func logQuery(ctx context.Context, start time.Time, query string, args []interface{}, rows int64) {
+	l, ok := ctx.Value(queryLogKey{}).(queryLog)
+	if !ok {
+		return
+	}
+	took := time.Since(start)
+	if l.slow > 0 && took >= l.slow {
+		log.Printf("Slow query in %s took %s: %s %s", l.op, took, strings.Join(strings.Fields(query), " "), argShapes(args))
+	} else if l.debug {
+		line := fmt.Sprintf("Query in %s took %s: %s %s", l.op, took, strings.Join(strings.Fields(query), " "), argShapes(args))
+		if rows >= 0 {
+			line += fmt.Sprintf(", %d rows", rows)
+		}
+		log.Print(line)
+	}
+}
+
+// argShapes describes the types and lengths of args without their values.
+func argShapes(args []interface{}) string {
+	shapes := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			shapes[i] = "NULL"
+		case string:
+			shapes[i] = fmt.Sprintf("string(%d)", len(v))
+		case []byte:
+			shapes[i] = fmt.Sprintf("bytes(%d)", len(v))
+		case *pq.StringArray:
+			shapes[i] = fmt.Sprintf("[]string(%d)", len(*v))
+		case []string:
+			shapes[i] = fmt.Sprintf("[]string(%d)", len(v))
+		default:
+			shapes[i] = fmt.Sprintf("%T", v)
+		}
+	}
+	return "[" + strings.Join(shapes, " ") + "]"
+}
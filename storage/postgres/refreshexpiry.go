@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// refreshExpiry configures the expiry of refresh tokens. See WithRefreshExpiry.
+type refreshExpiry struct {
+	sliding  time.Duration
+	absolute time.Duration
+}
+
+// WithRefreshExpiry expires refresh tokens, which osin does not do by itself. A refresh token expires if it was not
+// used for sliding or if absolute passed since the first refresh token of its chain was issued, i.e. refreshed
+// tokens inherit the absolute expiry of the token they were refreshed from. Zero disables either expiry.
+// LoadRefresh returns an error for expired refresh tokens and PurgeExpiredTokens removes them, so long-lived
+// sessions stay alive as long as they are used, while abandoned ones lapse.
+func WithRefreshExpiry(sliding, absolute time.Duration) Option {
+	return func(s *Storage) {
+		s.refreshTTL = refreshExpiry{sliding: sliding, absolute: absolute}
+	}
+}
+
+// absoluteExpiry returns the absolute expiry a new refresh token of access data refreshed from prev inherits. It
+// is NULL if prev is empty or its refresh tokens do not expire. See saveRefresh.
+func (s *Storage) absoluteExpiry(tx dbtx, prev string) (expiry sql.NullTime, err error) {
+	if prev == "" {
+		return expiry, nil
+	}
+	if err := tx.QueryRow("SELECT min(absolute_expiry) FROM refresh WHERE access=$1", prev).Scan(&expiry); err != nil {
+		return expiry, errors.New(err)
+	}
+	return expiry, nil
+}
+
+// slidingStart returns the time before which unused refresh tokens are expired. It is the zero time if sliding
+// expiry is disabled.
+func (s *Storage) slidingStart() time.Time {
+	if s.refreshTTL.sliding <= 0 {
+		return time.Time{}
+	}
+	return s.now().Add(-s.refreshTTL.sliding)
+}
+
+// refreshUnexpired returns the condition matching the refresh tokens r which did not expire, the SQL equivalent of
+// checkRefreshExpiry. now and slidingStart are the placeholders of the current time and of slidingStart.
+func refreshUnexpired(now, slidingStart string) string {
+	return "(r.absolute_expiry IS NULL OR r.absolute_expiry > " + now + ") AND (r.last_used_at IS NULL OR r.last_used_at > " + slidingStart + ")"
+}
+
+// refreshExpiresAt returns the earlier of the absolute and the sliding expiry of a refresh token, or the zero time
+// if it does not expire.
+func (s *Storage) refreshExpiresAt(lastUsedAt, absoluteExpiry sql.NullTime) time.Time {
+	var expiresAt time.Time
+	if absoluteExpiry.Valid {
+		expiresAt = absoluteExpiry.Time
+	}
+	if s.refreshTTL.sliding > 0 && lastUsedAt.Valid {
+		if sliding := lastUsedAt.Time.Add(s.refreshTTL.sliding); expiresAt.IsZero() || sliding.Before(expiresAt) {
+			expiresAt = sliding
+		}
+	}
+	return expiresAt
+}
+
+// checkRefreshExpiry returns an error if the refresh token expired.
+func (s *Storage) checkRefreshExpiry(lastUsedAt, absoluteExpiry sql.NullTime) error {
+	now := s.now()
+	if absoluteExpiry.Valid && !absoluteExpiry.Time.After(now) {
+		return errors.Errorf("Refresh token expired at %s.", absoluteExpiry.Time.String())
+	}
+	if s.refreshTTL.sliding > 0 && lastUsedAt.Valid && !lastUsedAt.Time.After(s.slidingStart()) {
+		return errors.Errorf("Refresh token expired at %s.", lastUsedAt.Time.Add(s.refreshTTL.sliding).String())
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// RefreshTokenUsage is the usage of a refresh token returned by ListUnusedRefreshTokens.
+type RefreshTokenUsage struct {
+	Token       string
+	AccessToken string
+	ClientID    string
+
+	// LastUsedAt is the time LoadRefresh resolved the token the last time, or the time it was issued if it was not
+	// used yet.
+	LastUsedAt time.Time
+
+	// UseCount is the number of times LoadRefresh resolved the token.
+	UseCount int64
+}
+
+// ListUnusedRefreshTokens returns up to limit refresh tokens which were not used for unusedFor, least recently used
+// first, to revoke them by inactivity policies. limit defaults to 100. Rotated tokens in their grace period are not
+// returned.
+func (s *Storage) ListUnusedRefreshTokens(unusedFor time.Duration, limit int) ([]*RefreshTokenUsage, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	var tokens []*RefreshTokenUsage
+	err := s.read("ListUnusedRefreshTokens", func(conn dbtx) error {
+		rows, err := conn.Query(`SELECT r.token, r.access, a.client, COALESCE(r.last_used_at, a.created_at) AS last_used_at, r.use_count
+FROM refresh r JOIN access a ON a.access_token=r.access
+WHERE r.rotated_at IS NULL AND COALESCE(r.last_used_at, a.created_at) < $1
+ORDER BY last_used_at LIMIT $2`, s.now().Add(-unusedFor), limit)
+		if err != nil {
+			return errors.New(err)
+		}
+		defer rows.Close()
+
+		tokens = nil
+		for rows.Next() {
+			var u RefreshTokenUsage
+			if err := rows.Scan(&u.Token, &u.AccessToken, &u.ClientID, &u.LastUsedAt, &u.UseCount); err != nil {
+				return errors.New(err)
+			}
+			tokens = append(tokens, &u)
+		}
+		if err := rows.Err(); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+	return tokens, err
+}
@@ -0,0 +1,48 @@
+package postgres
+
+import (
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// WithReplicas routes read-only operations (GetClient, LoadAuthorize, LoadAccess, LoadRefresh, LoadPAR and
+// Introspect) to the replicas in round robin order, while writes go to the primary database passed to New.
+//
+// After a write, reads stick to the primary for the stickiness duration to avoid stale reads within the same
+// flow. Stickiness is tracked per storage returned by Clone, which osin calls once per request. Reads which do
+// not find a row on a replica are retried on the primary, as the row may not have been replicated yet.
+func WithReplicas(stickiness time.Duration, replicas ...*sql.DB) Option {
+	return func(s *Storage) {
+		if len(replicas) == 0 {
+			return
+		}
+		s.replicas = &replicaSet{dbs: replicas, stickiness: stickiness}
+		s.lastWrite = new(int64)
+	}
+}
+
+type replicaSet struct {
+	dbs        []*sql.DB
+	next       uint32
+	stickiness time.Duration
+}
+
+// replica returns the replica to read from or nil if reads must go to the primary.
+func (s *Storage) replica() sqlConn {
+	if s.replicas == nil || s.tx != nil {
+		return nil
+	}
+	if time.Since(time.Unix(0, atomic.LoadInt64(s.lastWrite))) < s.replicas.stickiness {
+		return nil
+	}
+	n := atomic.AddUint32(&s.replicas.next, 1)
+	return s.replicas.dbs[int(n)%len(s.replicas.dbs)]
+}
+
+// markWrite records a write for read stickiness.
+func (s *Storage) markWrite() {
+	if s.lastWrite != nil {
+		atomic.StoreInt64(s.lastWrite, time.Now().UnixNano())
+	}
+}
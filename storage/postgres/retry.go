@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// RetryPolicy configures the retries of operations which failed with a transient error. See IsTransient.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one. Values below two disable retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It is doubled for every further retry.
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts. Zero means no cap.
+	MaxBackoff time.Duration
+}
+
+// WithRetry retries operations which failed with a transient error according to policy. Operations run in a
+// transaction are retried as a whole. Operations of a storage bound to a transaction are not retried, because
+// the transaction is aborted after an error.
+func WithRetry(policy RetryPolicy) Option {
+	return func(s *Storage) {
+		s.retryPolicy = policy
+	}
+}
+
+// IsTransient returns true if err is likely to go away when the operation is retried: serialization failures,
+// deadlocks, connection errors and server shutdowns.
+func IsTransient(err error) bool {
+	switch sqlState(err) {
+	case "40001", "40P01":
+		return true
+	}
+	return isConnectionError(err)
+}
+
+// isConnectionError returns true if err indicates that the connection to the database failed or the server
+// is shutting down.
+func isConnectionError(err error) bool {
+	if code := sqlState(err); code != "" {
+		switch code {
+		case "57P01", "57P02", "57P03":
+			return true
+		}
+		return strings.HasPrefix(code, "08")
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr)
+}
+
+// retry runs fn until it succeeds, fails with an error which is not transient, the retry policy is exhausted or
+// ctx is done. Every attempt passes the circuit breaker, if one is configured.
+func (s *Storage) retry(ctx context.Context, op func() error) error {
+	fn := func() error {
+		if !s.breaker.allow() {
+			return ErrUnavailable
+		}
+		err := op()
+		s.breaker.record(err)
+		return err
+	}
+
+	err := fn()
+	if s.tx != nil {
+		return err
+	}
+
+	backoff := s.retryPolicy.Backoff
+	for attempt := 2; attempt <= s.retryPolicy.MaxAttempts && err != nil && IsTransient(err); attempt++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; s.retryPolicy.MaxBackoff > 0 && backoff > s.retryPolicy.MaxBackoff {
+			backoff = s.retryPolicy.MaxBackoff
+		}
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// revocationPageSize is the number of revocations StreamRevocations reads per query.
+const revocationPageSize = 1000
+
+// Revocation is an entry of the revocation list recorded with WithRevocationList.
+type Revocation struct {
+	// ID is assigned by the database and increases monotonically. Pass the ID of the last revocation as afterID
+	// to ListRevocations to continue a sync.
+	ID int64
+
+	// TokenType is either TokenTypeAccess or TokenTypeRefresh.
+	TokenType string
+
+	// TokenHash is the SHA-256 hash of the revoked token, see HashToken.
+	TokenHash string
+
+	// ClientID is the id of the client of the token. It is empty for revocations of tokens by value.
+	ClientID string
+
+	// RevokedAt is the time of revocation.
+	RevokedAt time.Time
+}
+
+// WithRevocationList records every revoked access and refresh token in a revocation list, from which resource
+// servers and API gateways can sync a local revocation cache incrementally with ListRevocations or
+// StreamRevocations. Tokens are recorded by their hash in the same transaction as their removal. Expired tokens
+// removed by PurgeExpiredTokens are not recorded. Use PurgeRevocations to remove entries older than the longest
+// token lifetime.
+func WithRevocationList() Option {
+	return func(s *Storage) {
+		s.revocations = true
+	}
+}
+
+// revocationTokenTypes maps the event types of token removals to the token types of the revocation list.
+var revocationTokenTypes = map[string]string{
+	AuditAccessRevoked:  TokenTypeAccess,
+	AuditRefreshRevoked: TokenTypeRefresh,
+}
+
+// recordsRevocation returns true if the event type typ is recorded in the revocation list.
+func (s *Storage) recordsRevocation(typ string) bool {
+	_, ok := revocationTokenTypes[typ]
+	return s.revocations && ok
+}
+
+// recordRevocation inserts the revocation of the token with hash subject into the revocation list, if the
+// revocation list is enabled and typ is a token revocation.
+func (s *Storage) recordRevocation(conn dbtx, typ, clientID, subject string) error {
+	if !s.recordsRevocation(typ) {
+		return nil
+	}
+	if _, err := conn.Exec(
+		"INSERT INTO revocation (token_type, token_hash, client, revoked_at) VALUES ($1, $2, $3, $4)",
+		revocationTokenTypes[typ],
+		subject,
+		clientID,
+		s.now(),
+	); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// ListRevocations returns at most limit tokens revoked since since with an id greater than afterID, ordered by
+// id. Start a sync with afterID 0 and continue it with the ID of the last returned revocation until fewer than
+// limit revocations are returned. Revocations of transactions committed concurrently with the previous call may
+// have an id lower than its last ID, so keep since a few seconds before the time of the previous call.
+func (s *Storage) ListRevocations(since time.Time, afterID int64, limit int) ([]*Revocation, error) {
+	return s.listRevocations(context.Background(), since, afterID, limit)
+}
+
+// StreamRevocations calls fn for every token revoked since since, ordered by id. The revocations are read in pages,
+// so the revocation list can be streamed without loading it into memory. Stops at the first error returned by fn.
+func (s *Storage) StreamRevocations(ctx context.Context, since time.Time, fn func(*Revocation) error) error {
+	var afterID int64
+	for {
+		page, err := s.listRevocations(ctx, since, afterID, revocationPageSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range page {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(page) < revocationPageSize {
+			return nil
+		}
+		afterID = page[len(page)-1].ID
+	}
+}
+
+func (s *Storage) listRevocations(ctx context.Context, since time.Time, afterID int64, limit int) ([]*Revocation, error) {
+	var revocations []*Revocation
+	err := s.readContext(ctx, "ListRevocations", func(conn dbtx) error {
+		revocations = nil
+		return queryRows(conn, func(row scanner) error {
+			var r Revocation
+			if err := row.Scan(&r.ID, &r.TokenType, &r.TokenHash, &r.ClientID, &r.RevokedAt); err != nil {
+				return err
+			}
+			revocations = append(revocations, &r)
+			return nil
+		}, "SELECT id, token_type, token_hash, client, revoked_at FROM revocation WHERE revoked_at >= $1 AND id > $2 ORDER BY id LIMIT $3", since, afterID, limit)
+	})
+	return revocations, err
+}
+
+// PurgeRevocations removes the entries recorded more than olderThan ago from the revocation list and returns the
+// number of removed rows.
+func (s *Storage) PurgeRevocations(olderThan time.Duration) (int64, error) {
+	query, args := s.revocationPurge(olderThan).query(s, 0)
+	return s.writeCount("PurgeRevocations", query, args...)
+}
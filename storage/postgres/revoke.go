@@ -0,0 +1,225 @@
+package postgres
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// RevokeCounts reports how many rows were removed by a bulk revocation or purge.
+type RevokeCounts struct {
+	Access    int64
+	Refresh   int64
+	Authorize int64
+}
+
+// RevokeAllByClient removes all access tokens, refresh tokens and authorize codes issued to the client in one
+// transaction. The client itself is not removed.
+func (s *Storage) RevokeAllByClient(clientID string) (*RevokeCounts, error) {
+	return s.revokeAll("RevokeAllByClient", "client", clientID)
+}
+
+// RevokeAllByUser removes all authorize codes whose UserData equals userRef and all access and refresh tokens of
+// the user, i.e. whose UserData or user reference equals userRef (see ListAccessByUser), in one transaction.
+func (s *Storage) RevokeAllByUser(userRef string) (*RevokeCounts, error) {
+	var revoked *revokedTokens
+	if err := s.inTx("RevokeAllByUser", func(tx dbtx) (err error) {
+		revoked, err = s.revokeUserTx(tx, userRef)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	s.afterCommit(revoked.runHooks)
+	return revoked.counts(), nil
+}
+
+// RemoveAccessByClient removes all access tokens and refresh tokens issued to the client in one transaction, e.g.
+// after its secret was rotated because of a suspected compromise. Authorize codes are kept, see
+// RemoveAuthorizeByClient.
+func (s *Storage) RemoveAccessByClient(clientID string) (*RevokeCounts, error) {
+	return s.revokeByClient("RemoveAccessByClient", clientID, s.revokeAccessTx)
+}
+
+// RemoveAuthorizeByClient removes all pending authorize codes of the client in one transaction, so they cannot be
+// exchanged for tokens anymore. Access and refresh tokens are kept, see RemoveAccessByClient.
+func (s *Storage) RemoveAuthorizeByClient(clientID string) (*RevokeCounts, error) {
+	return s.revokeByClient("RemoveAuthorizeByClient", clientID, s.revokeAuthorizeTx)
+}
+
+// RevokeToken removes the access or refresh token as described in RFC 7009. Revoking a refresh token does not
+// revoke the access token it was issued with. Unlike RemoveRefresh, refresh tokens within the grace period of
+// WithRefreshGracePeriod are revoked as well. Returns ErrTokenNotFound if the token does not exist.
+func (s *Storage) RevokeToken(token string) error {
+	i, err := s.Introspect(token)
+	if err != nil {
+		return err
+	}
+	if i.TokenType == TokenTypeRefresh {
+		return s.removeRefresh("RevokeToken", token, "DELETE FROM refresh WHERE token=$1")
+	}
+	return s.RemoveAccess(token)
+}
+
+// revokeAll runs the operation op, which removes all rows where column equals value. column must be a column of
+// both access and authorize.
+func (s *Storage) revokeAll(op, column, value string) (*RevokeCounts, error) {
+	var revoked *revokedTokens
+	if err := s.inTx(op, func(tx dbtx) (err error) {
+		revoked, err = s.revokeAllTx(tx, column, value)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	s.afterCommit(revoked.runHooks)
+	return revoked.counts(), nil
+}
+
+// revokeByClient runs the operation op, which removes the rows of the client with revoke.
+func (s *Storage) revokeByClient(op, clientID string, revoke func(tx dbtx, r *revokedTokens, column, value string) error) (*RevokeCounts, error) {
+	var revoked *revokedTokens
+	if err := s.inTx(op, func(tx dbtx) error {
+		revoked = &revokedTokens{hooks: s.hooks}
+		return revoke(tx, revoked, "client", clientID)
+	}); err != nil {
+		return nil, err
+	}
+
+	s.afterCommit(revoked.runHooks)
+	return revoked.counts(), nil
+}
+
+// revokedTokens are the refresh tokens, access tokens and authorize codes removed by revokeAllTx.
+type revokedTokens struct {
+	hooks                      hookList
+	refresh, access, authorize []string
+}
+
+// revokeAllTx removes all rows where column equals value within tx and audits and notifies about every removed
+// token.
+func (s *Storage) revokeAllTx(tx dbtx, column, value string) (*revokedTokens, error) {
+	r := &revokedTokens{hooks: s.hooks}
+	if err := s.revokeAccessTx(tx, r, column, value); err != nil {
+		return nil, err
+	}
+	if err := s.revokeAuthorizeTx(tx, r, column, value); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// revokeUserTx removes the codes and tokens of the user within tx, see RevokeAllByUser.
+func (s *Storage) revokeUserTx(tx dbtx, userRef string) (*revokedTokens, error) {
+	revoked, err := s.revokeAllTx(tx, "extra", userRef)
+	if err != nil {
+		return nil, err
+	}
+	referenced := &revokedTokens{hooks: s.hooks}
+	if err := s.revokeAccessTx(tx, referenced, "user_ref", userRef); err != nil {
+		return nil, err
+	}
+	revoked.refresh = append(revoked.refresh, referenced.refresh...)
+	revoked.access = append(revoked.access, referenced.access...)
+	return revoked, nil
+}
+
+// revokeAccessTx removes all access tokens where column equals value and their refresh tokens within tx, adds
+// them to r and audits, notifies and records the revocation of every removed token.
+func (s *Storage) revokeAccessTx(tx dbtx, r *revokedTokens, column, value string) (err error) {
+	clientID := revokedClient(column, value)
+	if r.refresh, err = queryStrings(tx, "DELETE FROM refresh USING access WHERE refresh.access=access.access_token AND access."+column+"=$1 RETURNING refresh.token", value); err != nil {
+		return err
+	}
+	query, args := s.deleteQuery("access", column+"=$1", "access_token", value)
+	if r.access, err = queryStrings(tx, query, args...); err != nil {
+		return err
+	}
+
+	for _, token := range r.refresh {
+		if err := s.recordRemoval(tx, AuditRefreshRevoked, clientID, HashToken(token)); err != nil {
+			return err
+		}
+	}
+	for _, token := range r.access {
+		if err := s.recordRemoval(tx, AuditAccessRevoked, clientID, HashToken(token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeAuthorizeTx removes all authorize codes where column equals value within tx, adds them to r and audits
+// and notifies about every removed code.
+func (s *Storage) revokeAuthorizeTx(tx dbtx, r *revokedTokens, column, value string) (err error) {
+	clientID := revokedClient(column, value)
+	query, args := s.deleteQuery("authorize", column+"=$1", "code", value)
+	if r.authorize, err = queryStrings(tx, query, args...); err != nil {
+		return err
+	}
+
+	for _, code := range r.authorize {
+		if err := s.recordRemoval(tx, AuditAuthorizeConsumed, clientID, HashToken(code)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokedClient returns the client id of revocations where column equals value, if column is the client.
+func revokedClient(column, value string) string {
+	if column == "client" {
+		return value
+	}
+	return ""
+}
+
+// runHooks runs the hooks for all removed tokens. It must run after the transaction was committed.
+func (r *revokedTokens) runHooks() {
+	for _, token := range r.refresh {
+		r.hooks.refreshRemoved(token)
+	}
+	for _, token := range r.access {
+		r.hooks.accessRemoved(token)
+	}
+	for _, code := range r.authorize {
+		r.hooks.authorizeRemoved(code)
+	}
+}
+
+func (r *revokedTokens) counts() *RevokeCounts {
+	return &RevokeCounts{Access: int64(len(r.access)), Refresh: int64(len(r.refresh)), Authorize: int64(len(r.authorize))}
+}
+
+// execCount executes query and returns the number of affected rows.
+func execCount(conn dbtx, query string, args ...interface{}) (int64, error) {
+	res, err := conn.Exec(query, args...)
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	return n, nil
+}
+
+// queryStrings executes query and returns the values of the single text column of the result.
+func queryStrings(conn dbtx, query string, args ...interface{}) ([]string, error) {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, errors.New(err)
+		}
+		result = append(result, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err)
+	}
+	return result, nil
+}
@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// WithRotation removes the previous access token and its refresh tokens in SaveAccess, when the saved access data
+// was refreshed from it (AccessData is set). The removal runs in the same transaction as the insert, so a
+// refreshed token pair never coexists with the pair it superseded. Removed tokens are audited, notified and
+// reported to the hooks like removals with RemoveAccess and RemoveRefresh.
+func WithRotation() Option {
+	return func(s *Storage) {
+		s.rotate = true
+	}
+}
+
+// WithRefreshGracePeriod keeps the refresh tokens of the previous access token valid for grace after SaveAccess
+// saved access data refreshed from it, so that a client retrying a refresh whose response was lost does not
+// fail. During the grace period, LoadRefresh resolves the old refresh token to the new access data and
+// RemoveRefresh ignores it, because osin removes the old refresh token right after the refresh. Afterwards the
+// token is invalid and removed by PurgeExpiredTokens. Use it together with WithRotation.
+func WithRefreshGracePeriod(grace time.Duration) Option {
+	return func(s *Storage) {
+		s.grace = grace
+	}
+}
+
+// graceStart returns the time before which rotated refresh tokens are invalid.
+func (s *Storage) graceStart() time.Time {
+	return s.now().Add(-s.grace)
+}
+
+// rotateTx supersedes the access token prev by next within tx. With a grace period, the refresh tokens of prev
+// are moved to next, otherwise they are removed. With rotation, prev is removed.
+func (s *Storage) rotateTx(tx dbtx, clientID, prev, next string) (*revokedTokens, error) {
+	var err error
+	r := &revokedTokens{hooks: s.hooks}
+	if s.grace > 0 {
+		if _, err := tx.Exec("UPDATE refresh SET access=$2, rotated_at=COALESCE(rotated_at, $3) WHERE access=$1", prev, next, s.now()); err != nil {
+			return nil, errors.New(err)
+		}
+	} else if r.refresh, err = queryStrings(tx, "DELETE FROM refresh WHERE access=$1 RETURNING token", prev); err != nil {
+		return nil, err
+	}
+	if s.rotate {
+		query, args := s.deleteQuery("access", "access_token=$1", "access_token", prev)
+		if r.access, err = queryStrings(tx, query, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, token := range r.refresh {
+		if err := s.recordRemoval(tx, AuditRefreshRevoked, clientID, HashToken(token)); err != nil {
+			return nil, err
+		}
+	}
+	for _, token := range r.access {
+		if err := s.recordRemoval(tx, AuditAccessRevoked, clientID, HashToken(token)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// recordRemoval audits, notifies and records the revocation of a removed token.
+func (s *Storage) recordRemoval(tx dbtx, typ, clientID, subject string) error {
+	if err := s.recordAudit(tx, typ, clientID, subject); err != nil {
+		return err
+	}
+	if err := s.recordRevocation(tx, typ, clientID, subject); err != nil {
+		return err
+	}
+	return s.notify(tx, typ, clientID, subject)
+}
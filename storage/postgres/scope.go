@@ -0,0 +1,187 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+	"github.com/optimisticninja/osin"
+)
+
+// ErrInvalidScope is returned by ValidateScopes if a requested scope is unknown or restricted and not granted to
+// the client. The authorization and token endpoints should answer with the invalid_scope error.
+var ErrInvalidScope = errors.New("Invalid scope")
+
+// Scope is an entry of the scope registry.
+type Scope struct {
+	// Name is the scope value as requested by clients.
+	Name string
+
+	// Description describes the scope, e.g. for consent screens.
+	Description string
+
+	// Default scopes are granted if a client does not request a scope.
+	Default bool
+
+	// Restricted scopes can only be requested by clients they were granted to with GrantClientScope.
+	Restricted bool
+}
+
+// CreateScope adds a scope to the registry. Returns ErrDuplicateKey if the scope exists.
+func (s *Storage) CreateScope(scope *Scope) error {
+	if err := s.write("CreateScope", func(conn dbtx) error {
+		_, err := conn.Exec(
+			"INSERT INTO scope (name, description, is_default, restricted) VALUES ($1, $2, $3, $4)",
+			scope.Name,
+			scope.Description,
+			scope.Default,
+			scope.Restricted,
+		)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// UpdateScope updates the description and flags of a scope. Returns ErrNotFound if the scope does not exist.
+func (s *Storage) UpdateScope(scope *Scope) error {
+	n, err := s.writeCount("UpdateScope",
+		"UPDATE scope SET description=$2, is_default=$3, restricted=$4 WHERE name=$1",
+		scope.Name,
+		scope.Description,
+		scope.Default,
+		scope.Restricted,
+	)
+	if err != nil {
+		return errors.New(err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetScope looks up a scope by its name. Returns ErrNotFound if the scope does not exist.
+func (s *Storage) GetScope(name string) (*Scope, error) {
+	var scope Scope
+	err := s.read("GetScope", func(conn dbtx) error {
+		return conn.QueryRow("SELECT name, description, is_default, restricted FROM scope WHERE name=$1", name).
+			Scan(&scope.Name, &scope.Description, &scope.Default, &scope.Restricted)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	return &scope, nil
+}
+
+// ListScopes returns all scopes of the registry ordered by name.
+func (s *Storage) ListScopes() ([]*Scope, error) {
+	var scopes []*Scope
+	err := s.read("ListScopes", func(conn dbtx) error {
+		scopes = nil
+		return queryRows(conn, func(row scanner) error {
+			var scope Scope
+			if err := row.Scan(&scope.Name, &scope.Description, &scope.Default, &scope.Restricted); err != nil {
+				return err
+			}
+			scopes = append(scopes, &scope)
+			return nil
+		}, "SELECT name, description, is_default, restricted FROM scope ORDER BY name")
+	})
+	return scopes, err
+}
+
+// RemoveScope removes a scope and its grants to clients from the registry.
+func (s *Storage) RemoveScope(name string) error {
+	return s.inTx("RemoveScope", func(tx dbtx) error {
+		if _, err := tx.Exec("DELETE FROM client_scope WHERE scope=$1", name); err != nil {
+			return errors.New(err)
+		}
+		if _, err := tx.Exec("DELETE FROM scope WHERE name=$1", name); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+}
+
+// GrantClientScope allows the client to request the restricted scope. Granting a scope twice has no effect.
+func (s *Storage) GrantClientScope(clientID, scope string) error {
+	if err := s.write("GrantClientScope", func(conn dbtx) error {
+		_, err := conn.Exec("INSERT INTO client_scope (client, scope) VALUES ($1, $2) ON CONFLICT DO NOTHING", clientID, scope)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// RemoveClientScope withdraws the grant of the restricted scope from the client.
+func (s *Storage) RemoveClientScope(clientID, scope string) error {
+	if err := s.write("RemoveClientScope", func(conn dbtx) error {
+		_, err := conn.Exec("DELETE FROM client_scope WHERE client=$1 AND scope=$2", clientID, scope)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// ListClientScopes returns the names of the restricted scopes granted to the client ordered by name.
+func (s *Storage) ListClientScopes(clientID string) ([]string, error) {
+	var scopes []string
+	err := s.read("ListClientScopes", func(conn dbtx) (err error) {
+		scopes, err = queryStrings(conn, "SELECT scope FROM client_scope WHERE client=$1 ORDER BY scope", clientID)
+		return err
+	})
+	return scopes, err
+}
+
+// ValidateScopes checks the space-delimited scopes requested by the client against the scope registry and returns
+// the scopes to grant. If no scope is requested, the default scopes the client may request are granted. Returns
+// ErrInvalidScope if a requested scope is unknown or restricted and not granted to the client.
+func (s *Storage) ValidateScopes(client osin.Client, requested string) (string, error) {
+	names := strings.Fields(requested)
+	type entry struct{ isDefault, allowed bool }
+	known := map[string]entry{}
+	var defaults []string
+	err := s.read("ValidateScopes", func(conn dbtx) error {
+		known, defaults = map[string]entry{}, nil
+		return queryRows(conn, func(row scanner) error {
+			var name string
+			var e entry
+			if err := row.Scan(&name, &e.isDefault, &e.allowed); err != nil {
+				return err
+			}
+			known[name] = e
+			if e.isDefault && e.allowed {
+				defaults = append(defaults, name)
+			}
+			return nil
+		}, `SELECT name, is_default, NOT restricted OR EXISTS (SELECT 1 FROM client_scope WHERE client=$1 AND client_scope.scope=scope.name)
+			FROM scope WHERE name=ANY($2) OR is_default ORDER BY name`, client.GetId(), pq.Array(names))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) == 0 {
+		return strings.Join(defaults, " "), nil
+	}
+	granted := make([]string, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		if e, ok := known[name]; !ok || !e.allowed {
+			return "", errors.New(fmt.Errorf("%w: %q", ErrInvalidScope, name))
+		}
+		if !seen[name] {
+			seen[name] = true
+			granted = append(granted, name)
+		}
+	}
+	return strings.Join(granted, " "), nil
+}
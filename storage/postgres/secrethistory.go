@@ -0,0 +1,54 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// SecretRotation is an entry of the secret history of a client, recorded whenever UpdateClient,
+// UpdateClientIfVersion, UpsertClient or ImportClients replaces the secret of the client.
+type SecretRotation struct {
+	// ClientID is the id of the client.
+	ClientID string
+
+	// SecretHash is the SHA-256 hash of the replaced secret, see HashToken. Secrets are never recorded in plain text.
+	SecretHash string
+
+	// Actor is the actor set with AuditAs, e.g. the id of the administrator who rotated the secret.
+	Actor string
+
+	// RotatedAt is the time the secret was replaced.
+	RotatedAt time.Time
+}
+
+// recordSecretRotation records that the secret of the client replaced previous.
+func (s *Storage) recordSecretRotation(conn dbtx, clientID, previous string) error {
+	if _, err := conn.Exec(
+		"INSERT INTO client_secret_history (client, secret_hash, actor, rotated_at) VALUES ($1, $2, $3, $4)",
+		clientID, HashToken(previous), s.actor, s.now(),
+	); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// ListSecretRotations returns the secret history of the client, newest first, so security can audit when, how
+// often and by whom its secret was rotated. The history is kept when the client is removed.
+func (s *Storage) ListSecretRotations(clientID string) ([]*SecretRotation, error) {
+	var rotations []*SecretRotation
+	if err := s.read("ListSecretRotations", func(conn dbtx) error {
+		rotations = nil
+		return queryRows(conn, func(row scanner) error {
+			r := SecretRotation{ClientID: clientID}
+			if err := row.Scan(&r.SecretHash, &r.Actor, &r.RotatedAt); err != nil {
+				return err
+			}
+			rotations = append(rotations, &r)
+			return nil
+		}, "SELECT secret_hash, actor, rotated_at FROM client_secret_history WHERE client=$1 ORDER BY rotated_at DESC, id DESC", clientID)
+	}); err != nil {
+		return nil, errors.New(err)
+	}
+	return rotations, nil
+}
@@ -0,0 +1,184 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/pborman/uuid"
+)
+
+// selfTestTables are the tables which must exist for the storage to work.
+var selfTestTables = []string{"client", "authorize", "access", "refresh"}
+
+// SelfTestStep is the outcome of a single step of a self test.
+type SelfTestStep struct {
+	// Name describes the step, e.g. "save authorize".
+	Name string
+
+	// Duration is the time the step took.
+	Duration time.Duration
+
+	// Err is nil if the step succeeded.
+	Err error
+}
+
+// SelfTestReport is the outcome of SelfTest.
+type SelfTestReport struct {
+	// Steps are the executed steps in order. Execution stops after the first failing step.
+	Steps []SelfTestStep
+
+	// Duration is the total time the self test took.
+	Duration time.Duration
+}
+
+// Failed returns true if any step failed.
+func (r *SelfTestReport) Failed() bool {
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// SelfTest exercises a full synthetic flow against db: it verifies the schema, creates a client, saves and loads
+// an authorize code, exchanges it for an access token, refreshes the token, revokes it and cleans up. All steps
+// run inside a single transaction which is rolled back at the end, so no data is left behind. A failing step
+// (e.g. because of missing permissions) is recorded in the report and stops the test. An error is returned only
+// if the transaction could not be started or rolled back.
+func SelfTest(db *sql.DB) (*SelfTestReport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	s := &Storage{db: db, tx: tx}
+	id := "selftest-" + uuid.New()
+	client := &osin.DefaultClient{Id: id, Secret: uuid.New(), RedirectUri: "http://localhost/"}
+	authorize := &osin.AuthorizeData{
+		Client:      client,
+		Code:        uuid.New(),
+		ExpiresIn:   60,
+		RedirectUri: client.RedirectUri,
+		CreatedAt:   time.Now(),
+	}
+	access := &osin.AccessData{
+		Client:        client,
+		AuthorizeData: authorize,
+		AccessToken:   uuid.New(),
+		RefreshToken:  uuid.New(),
+		ExpiresIn:     60,
+		RedirectUri:   client.RedirectUri,
+		CreatedAt:     time.Now(),
+	}
+	refreshed := &osin.AccessData{
+		Client:       client,
+		AccessData:   access,
+		AccessToken:  uuid.New(),
+		RefreshToken: uuid.New(),
+		ExpiresIn:    60,
+		RedirectUri:  client.RedirectUri,
+		CreatedAt:    time.Now(),
+	}
+
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"verify schema", func() error {
+			for _, table := range selfTestTables {
+				var exists bool
+				if err := tx.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+					return errors.New(err)
+				} else if !exists {
+					return errors.Errorf("Table %s does not exist", table)
+				}
+			}
+			return nil
+		}},
+		{"create client", func() error {
+			if err := s.CreateClient(client); err != nil {
+				return err
+			}
+			_, err := s.GetClient(id)
+			return err
+		}},
+		{"save authorize", func() error {
+			if err := s.SaveAuthorize(authorize); err != nil {
+				return err
+			}
+			_, err := s.LoadAuthorize(authorize.Code)
+			return err
+		}},
+		{"exchange code", func() error {
+			if err := s.SaveAccess(access); err != nil {
+				return err
+			}
+			if err := s.RemoveAuthorize(authorize.Code); err != nil {
+				return err
+			}
+			_, err := s.LoadAccess(access.AccessToken)
+			return err
+		}},
+		{"refresh token", func() error {
+			if _, err := s.LoadRefresh(access.RefreshToken); err != nil {
+				return err
+			}
+			if err := s.SaveAccess(refreshed); err != nil {
+				return err
+			}
+			return s.RemoveRefresh(access.RefreshToken)
+		}},
+		{"revoke token", func() error {
+			if err := s.RemoveAccess(refreshed.AccessToken); err != nil {
+				return err
+			}
+			if err := s.RemoveRefresh(refreshed.RefreshToken); err != nil {
+				return err
+			}
+			if _, err := s.LoadAccess(refreshed.AccessToken); !errors.Is(err, ErrNotFound) {
+				return errors.Errorf("Expected revoked token to be not found, got: %v", err)
+			}
+			return nil
+		}},
+		{"cleanup", func() error {
+			if err := s.RemoveAccess(access.AccessToken); err != nil {
+				return err
+			}
+			return s.RemoveClient(id)
+		}},
+	}
+
+	report := &SelfTestReport{}
+	start := time.Now()
+	for _, step := range steps {
+		stepStart := time.Now()
+		err := step.fn()
+		report.Steps = append(report.Steps, SelfTestStep{Name: step.name, Duration: time.Since(stepStart), Err: err})
+		if err != nil {
+			break
+		}
+	}
+
+	report.Duration = time.Since(start)
+	if err := tx.Rollback(); err != nil {
+		return report, errors.New(err)
+	}
+	return report, nil
+}
+
+// String returns a human readable summary of the report.
+func (r *SelfTestReport) String() string {
+	var out string
+	for _, step := range r.Steps {
+		status := "ok"
+		if step.Err != nil {
+			status = "FAIL: " + step.Err.Error()
+		}
+		out += fmt.Sprintf("%-16s %10s  %s\n", step.Name, step.Duration.Round(time.Microsecond), status)
+	}
+	return out + fmt.Sprintf("%-16s %10s\n", "total", r.Duration.Round(time.Microsecond))
+}
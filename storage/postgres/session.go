@@ -0,0 +1,119 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// Session is an OpenID Connect session of a user at the authorization server.
+type Session struct {
+	// SID is the session id as used in the sid claim.
+	SID string
+
+	// UserRef identifies the user, e.g. the user's id.
+	UserRef string
+
+	// Clients are the ids of the clients which participate in the session.
+	Clients []string
+
+	// AuthTime is the time the user authenticated.
+	AuthTime time.Time
+
+	// AMR are the authentication methods references.
+	AMR []string
+
+	// ACR is the authentication context class reference.
+	ACR string
+
+	// LastSeen is the last time the session was used.
+	LastSeen time.Time
+}
+
+const sessionColumns = "sid, user_ref, clients, auth_time, amr, acr, last_seen"
+
+// CreateSession stores a new session.
+func (s *Storage) CreateSession(session *Session) error {
+	if err := s.write("CreateSession", func(conn dbtx) error {
+		_, err := conn.Exec(
+			"INSERT INTO session ("+sessionColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			session.SID,
+			session.UserRef,
+			pq.Array(nonNil(session.Clients)),
+			session.AuthTime,
+			pq.Array(nonNil(session.AMR)),
+			session.ACR,
+			session.LastSeen,
+		)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// GetSession loads a session by its sid.
+func (s *Storage) GetSession(sid string) (*Session, error) {
+	var session *Session
+	err := s.read("GetSession", func(conn dbtx) (err error) {
+		session, err = scanSession(conn.QueryRow("SELECT "+sessionColumns+" FROM session WHERE sid=$1", sid))
+		return err
+	})
+	return session, err
+}
+
+// TouchSession sets the session's last seen time to now and adds clientID to the session's clients,
+// if it is not empty and not yet part of the session. Returns ErrNotFound if the session does not exist.
+func (s *Storage) TouchSession(sid, clientID string) error {
+	n, err := s.writeCount("TouchSession",
+		"UPDATE session SET last_seen=$2, clients=CASE WHEN $3='' OR $3=ANY(clients) THEN clients ELSE array_append(clients, $3) END WHERE sid=$1",
+		sid,
+		s.now(),
+		clientID,
+	)
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TerminateSession removes a session and returns it, so that the participating clients can be notified
+// through front- or back-channel logout. Returns ErrNotFound if the session does not exist.
+func (s *Storage) TerminateSession(sid string) (*Session, error) {
+	var session *Session
+	err := s.write("TerminateSession", func(conn dbtx) (err error) {
+		session, err = scanSession(conn.QueryRow("DELETE FROM session WHERE sid=$1 RETURNING "+sessionColumns, sid))
+		return err
+	})
+	return session, err
+}
+
+func scanSession(row scanner) (*Session, error) {
+	var session Session
+	if err := row.Scan(
+		&session.SID,
+		&session.UserRef,
+		pq.Array(&session.Clients),
+		&session.AuthTime,
+		pq.Array(&session.AMR),
+		&session.ACR,
+		&session.LastSeen,
+	); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	return &session, nil
+}
+
+// nonNil returns an empty slice if in is nil, because pq.Array stores nil slices as NULL.
+func nonNil(in []string) []string {
+	if in == nil {
+		return []string{}
+	}
+	return in
+}
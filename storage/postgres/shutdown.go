@@ -0,0 +1,116 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// DefaultShutdownTimeout limits how long Close waits for operations in flight, unless configured with
+// WithShutdownTimeout.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// WithOwnedDB passes the ownership of the database to the storage: Close and Shutdown close it, like for storages
+// created with NewFromDSN.
+func WithOwnedDB() Option {
+	return func(s *Storage) {
+		s.ownsDB = true
+	}
+}
+
+// WithShutdownTimeout limits how long Close waits for operations in flight before it closes the storage.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(s *Storage) {
+		s.shutdownTimeout = timeout
+	}
+}
+
+// Shutdown closes the storage gracefully: operations started afterwards fail with ErrClosed, while operations in
+// flight, including transactions of WithTx, are waited for until they complete or ctx is done. Then the prepared
+// statements and, if the storage owns it, the database are closed. It returns an error wrapping the error of ctx
+// if operations were still in flight. Like Close, it does nothing for copies of the storage, e.g. from Clone.
+func (s *Storage) Shutdown(ctx context.Context) error {
+	if s.borrowed {
+		return nil
+	}
+
+	var err error
+	if s.drain != nil {
+		err = s.drain.wait(ctx)
+	}
+	if s.stmts != nil {
+		s.stmts.close()
+	}
+	if s.failover != nil {
+		s.failover.stop()
+	}
+	if s.ownsDB {
+		s.db.Close()
+	}
+	return err
+}
+
+// drain tracks the operations in flight for Shutdown.
+type drain struct {
+	mu      sync.Mutex
+	active  int
+	closing bool
+
+	// idle is closed when the storage is closing and no operation is in flight anymore.
+	idle chan struct{}
+}
+
+func newDrain() *drain {
+	return &drain{idle: make(chan struct{})}
+}
+
+// enter registers an operation of s, which must call leave when it completes. It fails with ErrClosed once the
+// storage is closing, unless s is bound to a transaction which is still in flight.
+func (s *Storage) enter() error {
+	if s.drain == nil {
+		return nil
+	}
+	d := s.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing && s.tx == nil {
+		return ErrClosed
+	}
+	d.active++
+	return nil
+}
+
+// leave marks an operation registered with enter as completed.
+func (s *Storage) leave() {
+	if s.drain == nil {
+		return
+	}
+	d := s.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active--
+	if d.closing && d.active == 0 {
+		close(d.idle)
+	}
+}
+
+// wait rejects new operations and waits until the operations in flight completed or ctx is done.
+func (d *drain) wait(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closing {
+		d.closing = true
+		if d.active == 0 {
+			close(d.idle)
+		}
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-d.idle:
+		return nil
+	case <-ctx.Done():
+		return errors.New(ctx.Err())
+	}
+}
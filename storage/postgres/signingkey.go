@@ -0,0 +1,169 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// SigningKey is a JSON Web Key used to sign tokens. It is shared between all instances using the same database,
+// so keys can be rotated without redeploying.
+type SigningKey struct {
+	// KID is the key id.
+	KID string
+
+	// Alg is the JWA algorithm, e.g. "RS256".
+	Alg string
+
+	// PublicKey is the public JWK in JSON representation, as published in the JWKS.
+	PublicKey string
+
+	// EncryptedPrivateKey is the private key. The storage does not encrypt the key itself, the caller must encrypt
+	// it before saving (e.g. with a KMS) and decrypt it after loading.
+	EncryptedPrivateKey []byte
+
+	// Active is true if the key is used for signing. There is at most one active key per algorithm, which is
+	// enforced by a unique index.
+	Active bool
+
+	// NotBefore is the date from which on the key may be used.
+	NotBefore time.Time
+
+	// NotAfter is the date after which the key must not be used anymore. The zero time means the key does not expire.
+	NotAfter time.Time
+}
+
+// IsValid returns true if the key may be used at the given time.
+func (k *SigningKey) IsValid(at time.Time) bool {
+	return !at.Before(k.NotBefore) && (k.NotAfter.IsZero() || at.Before(k.NotAfter))
+}
+
+const signingKeyColumns = "kid, alg, public_key, encrypted_private_key, active, not_before, not_after"
+
+// SaveSigningKey stores a new signing key. Use ActivateSigningKey to start signing with it.
+func (s *Storage) SaveSigningKey(k *SigningKey) error {
+	if err := s.write("SaveSigningKey", func(conn dbtx) error {
+		_, err := conn.Exec(
+			"INSERT INTO signing_key ("+signingKeyColumns+") VALUES ($1, $2, $3, $4, false, $5, $6)",
+			k.KID,
+			k.Alg,
+			k.PublicKey,
+			k.EncryptedPrivateKey,
+			k.NotBefore,
+			nullTime(k.NotAfter),
+		)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// GetSigningKey loads a signing key by its kid.
+func (s *Storage) GetSigningKey(kid string) (*SigningKey, error) {
+	var k *SigningKey
+	err := s.read("GetSigningKey", func(conn dbtx) (err error) {
+		k, err = scanSigningKey(conn.QueryRow("SELECT "+signingKeyColumns+" FROM signing_key WHERE kid=$1", kid))
+		return err
+	})
+	return k, err
+}
+
+// ActiveSigningKey loads the active signing key for the algorithm. Returns ErrNotFound if there is no active key
+// or it is not valid at the moment.
+func (s *Storage) ActiveSigningKey(alg string) (*SigningKey, error) {
+	var k *SigningKey
+	if err := s.read("ActiveSigningKey", func(conn dbtx) (err error) {
+		k, err = scanSigningKey(conn.QueryRow("SELECT "+signingKeyColumns+" FROM signing_key WHERE alg=$1 AND active", alg))
+		return err
+	}); err != nil {
+		return nil, err
+	} else if !k.IsValid(s.now()) {
+		return nil, ErrNotFound
+	}
+	return k, nil
+}
+
+// ActivateSigningKey makes the key the active key for its algorithm and deactivates the previously active key
+// in one transaction. The previous key remains valid for verification until it is retired. Returns
+// ErrSigningKeyNotValid if the key is not valid at the moment, see SigningKey.IsValid. Concurrent activations of
+// keys of the same algorithm cannot both succeed, as there is at most one active key per algorithm.
+func (s *Storage) ActivateSigningKey(kid string) error {
+	return s.inTx("ActivateSigningKey", func(tx dbtx) error {
+		k, err := scanSigningKey(tx.QueryRow("SELECT "+signingKeyColumns+" FROM signing_key WHERE kid=$1 FOR UPDATE", kid))
+		if err != nil {
+			return err
+		} else if !k.IsValid(s.now()) {
+			return ErrSigningKeyNotValid
+		}
+
+		if _, err := tx.Exec("UPDATE signing_key SET active=false WHERE active AND alg=$1 AND kid<>$2", k.Alg, kid); err != nil {
+			return errors.New(err)
+		}
+		if _, err := tx.Exec("UPDATE signing_key SET active=true WHERE kid=$1", kid); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+}
+
+// RetireSigningKey deactivates the key and sets its expiry to at. Pass a date in the future to keep publishing the
+// key for verification of already issued tokens.
+func (s *Storage) RetireSigningKey(kid string, at time.Time) error {
+	if n, err := s.writeCount("RetireSigningKey", "UPDATE signing_key SET active=false, not_after=$2 WHERE kid=$1", kid, at); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListVerificationKeys returns all keys valid at the moment, which should be published in the JWKS.
+func (s *Storage) ListVerificationKeys() ([]*SigningKey, error) {
+	var keys []*SigningKey
+	err := s.read("ListVerificationKeys", func(conn dbtx) error {
+		rows, err := conn.Query("SELECT "+signingKeyColumns+" FROM signing_key WHERE not_before <= $1 AND (not_after IS NULL OR not_after > $1) ORDER BY not_before DESC", s.now())
+		if err != nil {
+			return errors.New(err)
+		}
+		defer rows.Close()
+
+		keys = nil
+		for rows.Next() {
+			k, err := scanSigningKey(rows)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+		if err := rows.Err(); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// RemoveSigningKey removes a signing key.
+func (s *Storage) RemoveSigningKey(kid string) error {
+	if err := s.write("RemoveSigningKey", func(conn dbtx) error {
+		_, err := conn.Exec("DELETE FROM signing_key WHERE kid=$1", kid)
+		return err
+	}); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+func scanSigningKey(row scanner) (*SigningKey, error) {
+	var k SigningKey
+	var notAfter sql.NullTime
+	if err := row.Scan(&k.KID, &k.Alg, &k.PublicKey, &k.EncryptedPrivateKey, &k.Active, &k.NotBefore, &notAfter); err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	k.NotAfter = notAfter.Time
+	return &k, nil
+}
@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// TableStats are the statistics of a table returned by Stats.
+type TableStats struct {
+	// Rows is the number of rows.
+	Rows int64
+
+	// Expired is the number of expired rows which were not purged yet. It is zero for tables without expiry.
+	Expired int64
+
+	// Oldest and Newest are the earliest and latest creation dates. They are the zero time for empty tables and
+	// tables without creation date.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// tableStatsColumns defines how Stats determines the creation date and expiry of the rows of a table. The current
+// time is passed to expiry conditions as $1.
+var tableStatsColumns = []struct {
+	table   string
+	created string
+	expired string
+}{
+	{"client", "NULL::timestamptz", "false"},
+	{"authorize", "created_at", "expires_at < $1"},
+	{"access", "created_at", "expires_at < $1"},
+	{"refresh", "NULL::timestamptz", "false"},
+	{"par_request", "created_at", "created_at + expires_in * interval '1 second' < $1"},
+	{"backchannel_request", "created_at", "created_at + expires_in * interval '1 second' < $1"},
+	{"consent", "granted_at", "expires_at < $1"},
+	{"session", "auth_time", "false"},
+	{"signing_key", "not_before", "not_after < $1"},
+	{"nonce", "NULL::timestamptz", "expires_at < $1"},
+	{"jti_denylist", "NULL::timestamptz", "expires_at < $1"},
+	{"revocation", "revoked_at", "false"},
+	{"scope", "NULL::timestamptz", "false"},
+	{"client_scope", "NULL::timestamptz", "false"},
+	{"audit", "created_at", "false"},
+	{"token_usage", "first_used_at", "false"},
+	{"token_exchange", "created_at", "false"},
+	{"authorize_archive", "created_at", "false"},
+	{"access_archive", "created_at", "false"},
+	{"client_secret_history", "rotated_at", "false"},
+}
+
+// Stats returns the statistics of all tables by table name, e.g. for dashboards and capacity planning. It scans
+// every table, so avoid calling it at high frequency on large databases.
+func (s *Storage) Stats(ctx context.Context) (map[string]TableStats, error) {
+	stats := map[string]TableStats{}
+	if err := s.readContext(ctx, "Stats", func(conn dbtx) error {
+		for _, t := range tableStatsColumns {
+			var ts TableStats
+			var oldest, newest sql.NullTime
+			var args []interface{}
+			if strings.Contains(t.expired, "$1") {
+				args = append(args, s.now())
+			}
+			if err := conn.QueryRow(
+				"SELECT count(*), count(*) FILTER (WHERE "+t.expired+"), min("+t.created+"), max("+t.created+") FROM "+t.table,
+				args...,
+			).Scan(&ts.Rows, &ts.Expired, &oldest, &newest); err != nil {
+				return errors.New(err)
+			}
+			ts.Oldest, ts.Newest = oldest.Time, newest.Time
+			stats[t.table] = ts
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
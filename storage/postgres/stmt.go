@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// maxCachedStmts is the maximum number of statements a stmtCache holds. Further queries run unprepared.
+const maxCachedStmts = 500
+
+// stmtCache prepares each query once per database and reuses the statement for all later executions. database/sql
+// re-prepares statements transparently on connections they were not prepared on yet. The cache holds at most
+// maxCachedStmts statements and never evicts any, as closing a statement would fail the operations using it.
+// Queries built dynamically, e.g. with a varying number of conditions or rows, should not be cached at all, see
+// ctxConn.unprepared.
+type stmtCache struct {
+	// db is the database transactions belong to.
+	db *sql.DB
+
+	mu    sync.Mutex
+	stmts map[stmtKey]*sql.Stmt
+}
+
+type stmtKey struct {
+	db    *sql.DB
+	query string
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: map[stmtKey]*sql.Stmt{}}
+}
+
+// prepare returns the statement for query on db, preparing it if needed. It returns nil if the cache is full.
+func (c *stmtCache) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	key := stmtKey{db, query}
+	c.mu.Lock()
+	stmt, ok := c.stmts[key]
+	full := len(c.stmts) >= maxCachedStmts
+	c.mu.Unlock()
+	if ok || full {
+		return stmt, nil
+	}
+
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.stmts[key]; ok {
+		// Prepared concurrently, keep the first one.
+		stmt.Close()
+		return prev, nil
+	} else if len(c.stmts) >= maxCachedStmts {
+		stmt.Close()
+		return nil, nil
+	}
+	c.stmts[key] = stmt
+	return stmt, nil
+}
+
+// close closes all prepared statements. Statements are prepared again on next use.
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, stmt := range c.stmts {
+		stmt.Close()
+		delete(c.stmts, key)
+	}
+}
+
+// stmt returns the prepared statement for query on the connection or nil if statements are not cached, the cache
+// is full or preparing failed. In the latter case the query is run unprepared, which reports the same error.
+func (c ctxConn) stmt(query string) *sql.Stmt {
+	if c.stmts == nil {
+		return nil
+	}
+	switch conn := c.conn.(type) {
+	case *sql.DB:
+		stmt, _ := c.stmts.prepare(c.ctx, conn, query)
+		return stmt
+	case *sql.Tx:
+		stmt, _ := c.stmts.prepare(c.ctx, c.stmts.db, query)
+		if stmt == nil {
+			return nil
+		}
+		return conn.StmtContext(c.ctx, stmt)
+	}
+	return nil
+}
+
+// unprepared returns the connection without the statement cache, for statements which run only once.
+func (c ctxConn) unprepared() ctxConn {
+	c.stmts = nil
+	return c
+}
@@ -0,0 +1,195 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// DefaultTenantVariable is the session variable the tenant of a transaction is stored in, unless configured with
+// WithTenantVariable. The row level security policies and the default of the tenant_id columns read it.
+const DefaultTenantVariable = "osin.tenant"
+
+// tenantSharedKeys are the tables whose primary key is unique across tenants, so it is not scoped per tenant.
+var tenantSharedKeys = map[string]bool{"audit": true, "revocation": true, "client_secret_history": true}
+
+// tenantUniqueIndexes are the unique indexes besides primary keys, which are scoped per tenant by recreating them
+// with the given definition.
+var tenantUniqueIndexes = map[string][]string{
+	"signing_key": {"signing_key_active_idx ON signing_key (tenant_id, alg) WHERE active"},
+}
+
+// tenantStatements returns the statements EnableMultiTenancy runs for table. The default of the tenant_id column
+// and the policy are replaced, so they follow a changed variable. An unset or empty variable is NULL, so the
+// policy matches no rows and rows cannot be inserted without a tenant.
+func tenantStatements(table, variable string) []string {
+	tenant := fmt.Sprintf("NULLIF(current_setting('%s', true), '')", variable)
+	statements := []string{
+		// Existing rows belong to the tenant "", which only roles bypassing row level security can access.
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS tenant_id text NOT NULL DEFAULT ''", table),
+		fmt.Sprintf("ALTER TABLE %s ALTER COLUMN tenant_id SET DEFAULT %s", table, tenant),
+		fmt.Sprintf("ALTER TABLE %s ENABLE ROW LEVEL SECURITY, FORCE ROW LEVEL SECURITY", table),
+		fmt.Sprintf("DROP POLICY IF EXISTS tenant_isolation ON %s", table),
+		fmt.Sprintf("CREATE POLICY tenant_isolation ON %s USING (tenant_id = %s)", table, tenant),
+	}
+	for _, index := range tenantUniqueIndexes[table] {
+		statements = append(statements,
+			"DROP INDEX IF EXISTS "+strings.Fields(index)[0],
+			"CREATE UNIQUE INDEX "+index,
+		)
+	}
+	if !tenantSharedKeys[table] {
+		// Prepends tenant_id to the primary key, if the table has one and it is not scoped yet.
+		statements = append(statements, fmt.Sprintf(`DO $$ DECLARE pk name; cols text; BEGIN
+	SELECT c.conname, string_agg(quote_ident(a.attname), ', ' ORDER BY k.ord) INTO pk, cols
+	FROM pg_constraint c
+	CROSS JOIN LATERAL unnest(c.conkey) WITH ORDINALITY AS k(attnum, ord)
+	JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+	WHERE c.conrelid = '%[1]s'::regclass AND c.contype = 'p'
+	GROUP BY c.conname;
+	IF pk IS NOT NULL AND cols NOT LIKE 'tenant_id,%%' THEN
+		EXECUTE format('ALTER TABLE %%I DROP CONSTRAINT %%I, ADD PRIMARY KEY (tenant_id, %%s)', '%[1]s', pk, cols);
+	END IF;
+END $$`, table))
+	}
+	return statements
+}
+
+// EnableMultiTenancy converts the tables created by CreateSchemas or CreatePartitionedSchemas for serving several
+// isolated OAuth realms from one database. Every table gets a tenant_id column, primary keys and unique indexes are
+// scoped per tenant and row level security restricts the rows of a tenant to the storage returned by ForTenant. A
+// storage without tenant, or with the empty tenant, can neither read nor write any rows. Rows existing before the conversion belong
+// to the tenant "" and are only accessible to roles bypassing row level security. Run it again after upgrades
+// which added tables. Storages working with the converted tables must be created with WithMultiTenancy.
+//
+// Row level security does not apply to superusers and roles with the BYPASSRLS attribute, so the storage serving
+// tenants must connect as a different role. Cross-tenant maintenance, e.g. Cleanup, needs a storage of its own
+// connecting as a role with BYPASSRLS.
+func (s *Storage) EnableMultiTenancy() error {
+	if err := s.unsupported("EnableMultiTenancy"); err != nil {
+		return err
+	}
+	return s.inTx("EnableMultiTenancy", func(tx dbtx) error {
+		if err := lockSchema(tx); err != nil {
+			return err
+		}
+		for _, table := range tables() {
+			if err := execSchemas(tx, tenantStatements(table, s.tenantVariableName())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WithMultiTenancy adjusts the storage to tables converted by EnableMultiTenancy. Use ForTenant for the OAuth
+// operations of a tenant. The storage itself sets no tenant, so row level security hides all rows from it, unless
+// it connects as a role with BYPASSRLS for cross-tenant maintenance, e.g. Cleanup, see EnableMultiTenancy.
+func WithMultiTenancy() Option {
+	return func(s *Storage) {
+		s.multiTenant = true
+	}
+}
+
+// WithTenantVariable stores the tenant of a transaction in the session variable name instead of
+// DefaultTenantVariable, e.g. "app.tenant_id", so row level security policies of the application tables can share
+// it. The name must contain a dot. Pass the same option to the storage running EnableMultiTenancy and run it again
+// after changing the variable.
+func WithTenantVariable(name string) Option {
+	return func(s *Storage) {
+		s.tenantVariable = name
+	}
+}
+
+// tenantVariableName returns the session variable the tenant is stored in.
+func (s *Storage) tenantVariableName() string {
+	if s.tenantVariable == "" {
+		return DefaultTenantVariable
+	}
+	return s.tenantVariable
+}
+
+// ForTenant returns a copy of the storage restricted to the rows of tenant by row level security, see
+// EnableMultiTenancy. The empty tenant matches no rows. Client ids, codes and tokens are unique per tenant. Every operation of the copy runs in a
+// transaction, which sets the tenant. The copy does not use the client cache and does not track token usage. It
+// shares the prepared statements of s, so closing it does not close them.
+func (s *Storage) ForTenant(tenant string) *Storage {
+	c := *s
+	c.borrowed = true
+	c.multiTenant = true
+	c.tenant = tenant
+	c.clients = nil
+	c.usage = nil
+	if s.replicas != nil {
+		c.lastWrite = new(int64)
+	}
+	return &c
+}
+
+// Tenant returns the tenant the storage is restricted to with ForTenant, or "" if it is not restricted.
+func (s *Storage) Tenant() string {
+	return s.tenant
+}
+
+// conflictTarget returns the conflict target of an upsert on the primary key columns, which are scoped per tenant
+// with WithMultiTenancy.
+func (s *Storage) conflictTarget(columns string) string {
+	if s.multiTenant {
+		return "(tenant_id, " + columns + ")"
+	}
+	return "(" + columns + ")"
+}
+
+// setTenant sets the tenant of the storage for the rest of tx, like SET LOCAL does, if the storage is restricted to
+// a tenant. For a tenant schema, see ForTenantSchema, it sets the search path instead.
+func (s *Storage) setTenant(ctx context.Context, tx *sql.Tx) error {
+	if s.schema != "" {
+		if _, err := tx.ExecContext(ctx, "SELECT set_config('search_path', $1, true)", pq.QuoteIdentifier(s.schema)); err != nil {
+			return errors.New(err)
+		}
+	}
+	if s.tenant == "" {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", s.tenantVariableName(), s.tenant); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// scoped runs fn on conn. If the storage is restricted to a tenant or a tenant schema and conn is not a
+// transaction, fn runs within a new transaction on conn which sets the tenant.
+func (s *Storage) scoped(ctx context.Context, conn sqlConn, fn func(conn dbtx) error) error {
+	db, ok := conn.(*sql.DB)
+	if s.tenant == "" && s.schema == "" || !ok {
+		return fn(ctxConn{ctx, conn, s.stmts})
+	}
+
+	// Statements are cached for the primary only, see ctxConn.stmt.
+	stmts := s.stmts
+	if db != s.db {
+		stmts = nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New(err)
+	}
+	if err := s.setTenant(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(ctxConn{ctx, tx, stmts}); err != nil {
+		if rbe := tx.Rollback(); rbe != nil {
+			return errors.New(rbe)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package postgres
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// CreateTenantSchema creates the PostgreSQL schema name, if it does not exist, together with the tables of
+// CreateSchemas within it. Each tenant gets a schema of its own, for deployments whose data separation
+// requirements rule out the shared tables of EnableMultiTenancy. Run it again for every tenant after upgrades
+// which added tables. Use ForTenantSchema for the operations of the tenant.
+func (s *Storage) CreateTenantSchema(name string) error {
+	if name == "" {
+		return errors.New("tenant schema name must not be empty")
+	}
+	if err := s.inTx("CreateTenantSchema", func(tx dbtx) error {
+		_, err := tx.(ctxConn).unprepared().Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(name))
+		return err
+	}); err != nil {
+		return err
+	}
+	return s.ForTenantSchema(name).CreateSchemas()
+}
+
+// ForTenantSchema returns a copy of the storage working with the tables in the schema name, see
+// CreateTenantSchema. Every operation of the copy runs in a transaction, which sets the search path to the schema.
+// The copy does not use the client cache, prepared statements and usage tracking of s, and closing it does not
+// close s.
+func (s *Storage) ForTenantSchema(name string) *Storage {
+	c := *s
+	c.borrowed = true
+	c.schema = name
+	c.stmts = nil
+	c.clients = nil
+	c.usage = nil
+	if s.replicas != nil {
+		c.lastWrite = new(int64)
+	}
+	return &c
+}
+
+// TenantSchema returns the schema the storage is restricted to with ForTenantSchema, or "" if it is not
+// restricted.
+func (s *Storage) TenantSchema() string {
+	return s.schema
+}
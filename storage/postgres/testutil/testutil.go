@@ -0,0 +1,80 @@
+// Package testutil starts disposable PostgreSQL containers with testcontainers-go for integration tests against
+// the postgres storage. It requires a running Docker daemon.
+//
+//	func TestLogin(t *testing.T) {
+//		store := testutil.MustStorage(t)
+//		server := osin.NewServer(osin.NewServerConfig(), store)
+//		...
+//	}
+package testutil
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/testcontainers/testcontainers-go"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+// Image is the PostgreSQL image started by NewStorage.
+var Image = "postgres:15-alpine"
+
+// NewStorage starts a PostgreSQL container, creates the schemas and returns a storage configured with opts.
+// Call cleanup to close the storage and the database and to remove the container.
+func NewStorage(ctx context.Context, opts ...postgres.Option) (store *postgres.Storage, cleanup func(), err error) {
+	container, err := tcpostgres.RunContainer(ctx,
+		testcontainers.WithImage(Image),
+		tcpostgres.WithDatabase("osin"),
+		tcpostgres.WithUsername("osin"),
+		tcpostgres.WithPassword("osin"),
+		testcontainers.WithWaitStrategy(wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(time.Minute)),
+	)
+	if err != nil {
+		return nil, nil, errors.New(err)
+	}
+	terminate := func() {
+		container.Terminate(context.Background())
+	}
+
+	dsn, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		terminate()
+		return nil, nil, errors.New(err)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		terminate()
+		return nil, nil, errors.New(err)
+	}
+
+	store = postgres.New(db, opts...)
+	if err := store.CreateSchemas(); err != nil {
+		db.Close()
+		terminate()
+		return nil, nil, err
+	}
+
+	return store, func() {
+		store.Close()
+		db.Close()
+		terminate()
+	}, nil
+}
+
+// MustStorage is NewStorage for tests. It fails t if the container cannot be started and removes the container
+// when t and its subtests completed.
+func MustStorage(t testing.TB, opts ...postgres.Option) *postgres.Storage {
+	t.Helper()
+	store, cleanup, err := NewStorage(context.Background(), opts...)
+	if err != nil {
+		t.Fatalf("Could not start database: %v", err)
+	}
+	t.Cleanup(cleanup)
+	return store
+}
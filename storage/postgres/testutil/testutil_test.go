@@ -0,0 +1,24 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/optimisticninja/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+func TestMustStorage(t *testing.T) {
+	store := MustStorage(t, postgres.WithAudit())
+
+	client := &osin.DefaultClient{Id: "client", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, store.CreateClient(client))
+	require.Nil(t, store.SaveAccess(&osin.AccessData{Client: client, AccessToken: "access", ExpiresIn: 60, CreatedAt: time.Now()}))
+
+	loaded, err := store.LoadAccess("access")
+	require.Nil(t, err)
+	assert.Equal(t, "client", loaded.Client.GetId())
+}
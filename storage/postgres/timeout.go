@@ -0,0 +1,55 @@
+package postgres
+
+import (
+	"context"
+	"time"
+)
+
+// WithOperationTimeout limits the duration of the operation op, which is the name of a method of Storage,
+// e.g. "SaveAccess". The deadline covers all queries and retries of the operation. Queries exceeding it are
+// cancelled and the operation fails with an error wrapping context.DeadlineExceeded.
+func WithOperationTimeout(op string, timeout time.Duration) Option {
+	return func(s *Storage) {
+		if s.timeouts == nil {
+			s.timeouts = map[string]time.Duration{}
+		}
+		s.timeouts[op] = timeout
+	}
+}
+
+// WithDefaultTimeout limits the duration of every operation without a timeout of WithOperationTimeout, as a safety
+// net against network partitions blocking the goroutines of requests indefinitely. It does not apply to the
+// operations changing the schema and to the bulk operations in untimedOperations, which may take much longer. An
+// operation timeout of zero disables the default timeout for the operation.
+func WithDefaultTimeout(timeout time.Duration) Option {
+	return func(s *Storage) {
+		s.timeout = timeout
+	}
+}
+
+// untimedOperations are the operations WithDefaultTimeout does not apply to.
+var untimedOperations = map[string]bool{
+	"CreateSchemas":            true,
+	"CreatePartitionedSchemas": true,
+	"MaintainPartitions":       true,
+	"DropSchemas":              true,
+	"EnableMultiTenancy":       true,
+	"CreateTenantSchema":       true,
+	"ImportClients":            true,
+	"CopyClients":              true,
+	"CopyAccess":               true,
+	"ExportUserData":           true,
+}
+
+// context returns the context for the operation op derived from parent.
+func (s *Storage) context(parent context.Context, op string) (context.Context, context.CancelFunc) {
+	parent = s.startOperation(s.withQueryLog(parent, op), op)
+	timeout, ok := s.timeouts[op]
+	if !ok && !untimedOperations[op] {
+		timeout = s.timeout
+	}
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return parent, func() {}
+}
@@ -0,0 +1,149 @@
+package postgres
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// AccessSummary describes an access token returned by ListAccessByClient and ListAccessByUser. The token itself is
+// not returned.
+type AccessSummary struct {
+	// ClientID is the id of the client the token was issued to.
+	ClientID string
+
+	// MaskedToken is the token masked with MaskToken, to recognize it in support conversations.
+	MaskedToken string
+
+	// TokenHash is the SHA-256 hash of the token, see HashToken.
+	TokenHash string
+
+	// HasRefresh is true if the token has a refresh token.
+	HasRefresh bool
+
+	Scope     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// AccessListOptions restricts and paginates the tokens returned by ListAccessByClient and ListAccessByUser. Zero
+// values do not restrict the result.
+type AccessListOptions struct {
+	// Scope returns only tokens granted this scope.
+	Scope string
+
+	// IncludeExpired returns expired tokens as well.
+	IncludeExpired bool
+
+	// Offset skips the first Offset tokens, which can be used for pagination.
+	Offset int
+
+	// Limit is the maximum number of tokens returned. Defaults to 100.
+	Limit int
+}
+
+// ListAccessByClient returns summaries of the access tokens issued to the client matching opts, newest first, so
+// support engineers can inspect what a client currently holds.
+func (s *Storage) ListAccessByClient(clientID string, opts AccessListOptions) ([]*AccessSummary, error) {
+	return s.listAccess("ListAccessByClient", "client", clientID, opts)
+}
+
+// WithUserRef extracts the user reference of access tokens from their UserData, for tokens saved without
+// IssueMetadata.UserRef, e.g. the subject of a session stored as UserData. The empty reference stores no user.
+// Tokens saved by earlier versions have no user reference.
+func WithUserRef(extract func(userData interface{}) string) Option {
+	return func(s *Storage) {
+		s.userRef = extract
+	}
+}
+
+// userRefOf returns the user reference of an access token: explicit, if not empty, or extracted from userData.
+func (s *Storage) userRefOf(explicit string, userData interface{}) string {
+	if explicit == "" && s.userRef != nil {
+		return s.userRef(userData)
+	}
+	return explicit
+}
+
+// ListAccessByUser returns summaries of the access tokens of the user matching opts, newest first, e.g. for a
+// screen listing the active sessions and devices of a user. Tokens belong to the user passed as
+// IssueMetadata.UserRef or extracted from their UserData with WithUserRef.
+func (s *Storage) ListAccessByUser(userRef string, opts AccessListOptions) ([]*AccessSummary, error) {
+	return s.listAccess("ListAccessByUser", "user_ref", userRef, opts)
+}
+
+// listAccess runs the operation op, which lists the access tokens whose column equals value.
+func (s *Storage) listAccess(op, column, value string, opts AccessListOptions) ([]*AccessSummary, error) {
+	var where []string
+	args := []interface{}{value}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	where = append(where, column+" = $1")
+	if opts.Scope != "" {
+		add("? = ANY(string_to_array(scope, ' '))", opts.Scope)
+	}
+	if !opts.IncludeExpired {
+		add("expires_at >= ?", s.now())
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 100
+	}
+	args = append(args, opts.Limit, opts.Offset)
+
+	var summaries []*AccessSummary
+	err := s.read(op, func(conn dbtx) error {
+		summaries = nil
+		// The statements differ in their conditions, so they are not prepared.
+		return queryRows(conn.(ctxConn).unprepared(), func(row scanner) error {
+			var a AccessSummary
+			var token string
+			if err := row.Scan(&a.ClientID, &token, &a.HasRefresh, &a.Scope, &a.CreatedAt, &a.ExpiresAt); err != nil {
+				return err
+			}
+			a.MaskedToken, a.TokenHash = MaskToken(token), HashToken(token)
+			summaries = append(summaries, &a)
+			return nil
+		}, "SELECT client, access_token, refresh_token IS NOT NULL, COALESCE(scope, ''), created_at, expires_at FROM access WHERE "+
+			strings.Join(where, " AND ")+" ORDER BY created_at DESC, access_token LIMIT $"+strconv.Itoa(len(args)-1)+" OFFSET $"+strconv.Itoa(len(args)), args...)
+	})
+	return summaries, err
+}
+
+// MaskToken returns the first and last four characters of token with the characters in between replaced, e.g.
+// "abcd…wxyz". Tokens shorter than 16 characters are masked completely.
+func MaskToken(token string) string {
+	if len(token) < 16 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:4] + "…" + token[len(token)-4:]
+}
+
+// CountActiveAccess returns the number of access tokens of the client which are not expired, e.g. for dashboards
+// and quota checks.
+func (s *Storage) CountActiveAccess(clientID string) (int64, error) {
+	return s.count("CountActiveAccess", "SELECT count(*) FROM access WHERE client=$1 AND expires_at >= $2", clientID, s.now())
+}
+
+// CountActiveRefresh returns the number of refresh tokens of the client which can still be used: they are neither
+// expired, see WithRefreshExpiry, nor rotated before the grace period, see WithRefreshGracePeriod.
+func (s *Storage) CountActiveRefresh(clientID string) (int64, error) {
+	return s.count("CountActiveRefresh", `SELECT count(*) FROM refresh r JOIN access a ON a.access_token=r.access
+WHERE a.client=$1 AND `+refreshUnexpired("$2", "$3")+` AND (r.rotated_at IS NULL OR r.rotated_at > $4)`,
+		clientID, s.now(), s.slidingStart(), s.graceStart())
+}
+
+// count runs the operation op, which queries a single count.
+func (s *Storage) count(op, query string, args ...interface{}) (int64, error) {
+	var n int64
+	if err := s.read(op, func(conn dbtx) error {
+		return conn.QueryRow(query, args...).Scan(&n)
+	}); err != nil {
+		return 0, errors.New(err)
+	}
+	return n, nil
+}
@@ -0,0 +1,84 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+)
+
+// DB returns the database the storage was created with, e.g. to run queries of the application against it.
+func (s *Storage) DB() *sql.DB {
+	return s.db
+}
+
+// Tx returns the transaction the storage is bound to by WithTx or nil if it is not bound to a transaction.
+func (s *Storage) Tx() *sql.Tx {
+	return s.tx
+}
+
+// WithTx runs fn with a copy of the storage bound to a new transaction, which is committed if fn returns nil and
+// rolled back otherwise. All operations of the copy run within the transaction, and so do the queries of the
+// application on the *sql.Tx returned by its Tx method, e.g.
+//
+//	err := store.WithTx(ctx, func(tx osin.Storage) error {
+//		if err := tx.SaveAccess(data); err != nil {
+//			return err
+//		}
+//		_, err := tx.(*postgres.Storage).Tx().Exec("UPDATE account SET last_login=now() WHERE id=$1", id)
+//		return err
+//	})
+//
+// Hooks and cache updates of the operations run after the commit. The transaction is not retried, as fn may have
+// side effects. Return the error of a failed operation from fn: PostgreSQL aborts the transaction on errors. If the
+// storage is already bound to a transaction, fn runs with the storage itself.
+func (s *Storage) WithTx(ctx context.Context, fn func(s osin.Storage) error) (err error) {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.tx != nil {
+		return fn(s)
+	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.leave()
+
+	s.markWrite()
+	tx, err := s.db.BeginTx(ctx, s.txOptions("WithTx"))
+	if err != nil {
+		return classify(errors.New(err))
+	}
+	if err := s.setTenant(ctx, tx); err != nil {
+		tx.Rollback()
+		return classify(err)
+	}
+
+	var pending []func()
+	bound := *s
+	bound.borrowed = true
+	bound.tx = tx
+	bound.pending = &pending
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&bound); err != nil {
+		if rbe := tx.Rollback(); rbe != nil {
+			return errors.New(rbe)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return classify(errors.New(err))
+	}
+
+	for _, f := range pending {
+		f()
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package postgres
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// WithUnloggedTables makes CreateSchemas convert tables, e.g. "authorize" and "access", to UNLOGGED tables, which
+// are not written to the WAL. This cuts the write latency and WAL volume for ephemeral and development deployments,
+// where losing the rows does not matter: unlogged tables are truncated after a crash and not replicated to
+// standbys, so reads of them must not be served by WithReplicas. Tables not passed are left as they are, so
+// convert them back with ALTER TABLE ... SET LOGGED. Not supported with partitioned tables,
+// DialectCockroachDB and DialectYugabyteDB.
+func WithUnloggedTables(tables ...string) Option {
+	return func(s *Storage) {
+		s.unlogged = append(s.unlogged, tables...)
+	}
+}
+
+// unloggedStatements returns the statements converting the tables of WithUnloggedTables.
+func (s *Storage) unloggedStatements() ([]string, error) {
+	if len(s.unlogged) == 0 {
+		return nil, nil
+	}
+	if err := s.unsupported("WithUnloggedTables"); err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, table := range tables() {
+		known[table] = true
+	}
+	var statements []string
+	for _, table := range s.unlogged {
+		if !known[table] {
+			return nil, errors.Errorf("Unknown table %s", table)
+		}
+		statements = append(statements, "ALTER TABLE "+table+" SET UNLOGGED")
+	}
+	return statements, nil
+}
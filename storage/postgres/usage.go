@@ -0,0 +1,163 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/lib/pq"
+)
+
+// WithUsageTracking counts how often each access token is loaded by LoadAccess or introspected by Introspect.
+// Counts are collected in memory and written to the token_usage table in batches by FlushUsage, so that frequently
+// used tokens do not cause contention on their rows. Run RunUsageFlush in the background to flush periodically.
+// Tokens are recorded by their hash, see HashToken.
+func WithUsageTracking() Option {
+	return func(s *Storage) {
+		s.usage = &usageCounter{pending: map[string]*tokenUsage{}}
+	}
+}
+
+// ClientUsage summarizes the token usage of a client returned by ListClientUsage.
+type ClientUsage struct {
+	ClientID string
+
+	// Tokens is the number of distinct access tokens used.
+	Tokens int64
+
+	// Uses is the number of loads and introspections of all tokens.
+	Uses int64
+
+	// MaxUses is the highest number of uses of a single token.
+	MaxUses int64
+
+	// LastUsedAt is the time of the last use of any token.
+	LastUsedAt time.Time
+}
+
+// usageCounter collects the uses of tokens until they are flushed.
+type usageCounter struct {
+	mu      sync.Mutex
+	pending map[string]*tokenUsage
+}
+
+type tokenUsage struct {
+	client      string
+	uses        int64
+	first, last time.Time
+}
+
+// countUsage counts a use of the access token, if usage tracking is enabled.
+func (s *Storage) countUsage(token, clientID string) {
+	if s.usage == nil {
+		return
+	}
+	now := s.now()
+	hash := HashToken(token)
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	u, ok := s.usage.pending[hash]
+	if !ok {
+		u = &tokenUsage{client: clientID, first: now}
+		s.usage.pending[hash] = u
+	}
+	u.uses++
+	u.last = now
+}
+
+// FlushUsage writes the collected token uses to the database in a single statement. If the write fails, the uses
+// are collected again, so that they are written by the next flush.
+func (s *Storage) FlushUsage(ctx context.Context) error {
+	if s.usage == nil {
+		return nil
+	}
+
+	s.usage.mu.Lock()
+	pending := s.usage.pending
+	s.usage.pending = map[string]*tokenUsage{}
+	s.usage.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var hashes, clients []string
+	var uses []int64
+	var first, last []time.Time
+	for hash, u := range pending {
+		hashes = append(hashes, hash)
+		clients = append(clients, u.client)
+		uses = append(uses, u.uses)
+		first = append(first, u.first)
+		last = append(last, u.last)
+	}
+
+	err := s.writeContext(ctx, "FlushUsage", func(conn dbtx) error {
+		_, err := conn.Exec(`INSERT INTO token_usage (token_hash, client, uses, first_used_at, last_used_at)
+SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::timestamptz[], $5::timestamptz[])
+ON CONFLICT `+s.conflictTarget("token_hash")+` DO UPDATE SET uses=token_usage.uses+EXCLUDED.uses, last_used_at=GREATEST(token_usage.last_used_at, EXCLUDED.last_used_at)`,
+			pq.Array(hashes), pq.Array(clients), pq.Array(uses), pq.Array(first), pq.Array(last))
+		return err
+	})
+	if err != nil {
+		s.usage.mu.Lock()
+		for hash, u := range pending {
+			if current, ok := s.usage.pending[hash]; ok {
+				current.uses += u.uses
+				current.first = u.first
+			} else {
+				s.usage.pending[hash] = u
+			}
+		}
+		s.usage.mu.Unlock()
+		return errors.New(err)
+	}
+	return nil
+}
+
+// RunUsageFlush calls FlushUsage every interval until ctx is done and flushes a last time. Errors are passed to
+// onError, if not nil.
+func (s *Storage) RunUsageFlush(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.FlushUsage(context.Background()); err != nil && onError != nil {
+				onError(err)
+			}
+			return
+		case <-ticker.C:
+		}
+		if err := s.FlushUsage(ctx); err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+	}
+}
+
+// ListClientUsage returns the flushed token usage per client for the tokens used since since, most used first.
+func (s *Storage) ListClientUsage(since time.Time) ([]*ClientUsage, error) {
+	var usage []*ClientUsage
+	err := s.read("ListClientUsage", func(conn dbtx) error {
+		rows, err := conn.Query("SELECT client, count(*), sum(uses), max(uses), max(last_used_at) FROM token_usage WHERE last_used_at >= $1 GROUP BY client ORDER BY sum(uses) DESC", since)
+		if err != nil {
+			return errors.New(err)
+		}
+		defer rows.Close()
+
+		usage = nil
+		for rows.Next() {
+			var u ClientUsage
+			if err := rows.Scan(&u.ClientID, &u.Tokens, &u.Uses, &u.MaxUses, &u.LastUsedAt); err != nil {
+				return errors.New(err)
+			}
+			usage = append(usage, &u)
+		}
+		if err := rows.Err(); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,225 @@
+package postgres
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/pborman/uuid"
+)
+
+// Webhook signature headers. The signature is the hex encoded HMAC-SHA256 of the timestamp header value,
+// a dot and the request body, keyed with WebhookConfig.Secret.
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+// WebhookConfig configures a WebhookPublisher.
+type WebhookConfig struct {
+	// URLs are the endpoints every event is posted to.
+	URLs []string
+
+	// Secret is the key the payloads are signed with.
+	Secret []byte
+
+	// MaxAttempts is the maximum number of delivery attempts per URL and event. Defaults to 5.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It is doubled for every further retry. Retries are scheduled per
+	// delivery, so failing deliveries do not delay other events. Defaults to one second.
+	Backoff time.Duration
+
+	// QueueSize is the number of events buffered for delivery. Events are dropped if the queue is full.
+	// Defaults to 1000.
+	QueueSize int
+
+	// Client is the http client used for delivery. Defaults to a client with a ten second timeout.
+	Client *http.Client
+}
+
+// WebhookPayload is the JSON body posted to webhook endpoints. Codes and tokens are never sent in plain text.
+type WebhookPayload struct {
+	// ID identifies the event, so receivers can deduplicate retried deliveries.
+	ID string `json:"id"`
+
+	// Type is one of AuditClientCreated, AuditAccessIssued, AuditAccessRefreshed, AuditAccessRevoked or
+	// AuditRefreshRevoked.
+	Type string `json:"type"`
+
+	// ClientID is the id of the affected client, if known.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Subject is the client id for client events and the HashToken of the token otherwise.
+	Subject string `json:"subject"`
+
+	// CreatedAt is the time the event occurred.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookPublisher delivers storage events to webhook endpoints asynchronously. Register it with
+// WithHooks(publisher.Hooks()).
+type WebhookPublisher struct {
+	config WebhookConfig
+	queue  chan *WebhookPayload
+	wg     sync.WaitGroup
+
+	// mu guards closed and sending on queue, so that events published during Close are dropped instead of sent
+	// on the closed queue.
+	mu     sync.Mutex
+	closed bool
+}
+
+// webhookDelivery is the delivery of an event to one URL.
+type webhookDelivery struct {
+	id      string
+	url     string
+	body    []byte
+	attempt int
+	backoff time.Duration
+}
+
+// NewWebhookPublisher returns a publisher and starts its delivery goroutine. Call Close to stop it.
+func NewWebhookPublisher(config WebhookConfig) *WebhookPublisher {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = time.Second
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1000
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	p := &WebhookPublisher{config: config, queue: make(chan *WebhookPayload, config.QueueSize)}
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+// Hooks returns the hooks which publish events.
+func (p *WebhookPublisher) Hooks() Hooks {
+	return Hooks{
+		OnClientCreated: func(client osin.Client) {
+			p.publish(AuditClientCreated, client.GetId(), client.GetId())
+		},
+		OnAccessSaved: func(data *osin.AccessData) {
+			typ := AuditAccessIssued
+			if data.AccessData != nil {
+				typ = AuditAccessRefreshed
+			}
+			p.publish(typ, data.Client.GetId(), HashToken(data.AccessToken))
+		},
+		OnAccessRemoved: func(token string) {
+			p.publish(AuditAccessRevoked, "", HashToken(token))
+		},
+		OnRefreshRemoved: func(token string) {
+			p.publish(AuditRefreshRevoked, "", HashToken(token))
+		},
+	}
+}
+
+// Close stops accepting events and waits until all queued events were delivered or given up. Events published
+// afterwards are dropped. It can be called any number of times.
+func (p *WebhookPublisher) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *WebhookPublisher) publish(typ, clientID, subject string) {
+	payload := &WebhookPayload{ID: uuid.New(), Type: typ, ClientID: clientID, Subject: subject, CreatedAt: time.Now()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		log.Printf("Webhook publisher is closed, dropping event %s %s", payload.Type, payload.ID)
+		return
+	}
+	select {
+	case p.queue <- payload:
+	default:
+		log.Printf("Webhook queue is full, dropping event %s %s", payload.Type, payload.ID)
+	}
+}
+
+func (p *WebhookPublisher) run() {
+	defer p.wg.Done()
+	for payload := range p.queue {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Could not encode webhook event %s: %s", payload.ID, err)
+			continue
+		}
+		for _, url := range p.config.URLs {
+			p.deliver(&webhookDelivery{id: payload.ID, url: url, body: body, attempt: 1, backoff: p.config.Backoff})
+		}
+	}
+}
+
+// deliver posts the event to the url of d. If that fails, the next attempt is scheduled after the backoff of d,
+// which is doubled for every retry, until MaxAttempts is reached. Close waits for scheduled attempts.
+func (p *WebhookPublisher) deliver(d *webhookDelivery) {
+	err := p.post(d.url, d.body)
+	if err == nil {
+		return
+	}
+	if d.attempt >= p.config.MaxAttempts {
+		log.Printf("Could not deliver webhook event %s to %s: %s", d.id, d.url, err)
+		return
+	}
+
+	p.wg.Add(1)
+	time.AfterFunc(d.backoff, func() {
+		defer p.wg.Done()
+		d.attempt++
+		d.backoff *= 2
+		p.deliver(d)
+	})
+}
+
+func (p *WebhookPublisher) post(url string, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.New(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(p.config.Secret, timestamp, body))
+
+	resp, err := p.config.Client.Do(req)
+	if err != nil {
+		return errors.New(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature of a webhook payload, which receivers use to verify the payload.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
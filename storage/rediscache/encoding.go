@@ -0,0 +1,179 @@
+package rediscache
+
+import (
+	"time"
+
+	"github.com/optimisticninja/osin"
+
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+// The cached* types are the JSON representations of the osin types. Clients are referenced by id and resolved
+// on load. Entities whose UserData is not a string are not cached.
+
+type cachedClient struct {
+	ID          string `json:"id"`
+	Secret      string `json:"secret"`
+	RedirectURI string `json:"redirect_uri"`
+	UserData    string `json:"user_data"`
+
+	// Postgres is set for a *postgres.Client, which is restored with the fields below.
+	Postgres  bool                    `json:"postgres,omitempty"`
+	Trusted   bool                    `json:"trusted,omitempty"`
+	Metadata  postgres.ClientMetadata `json:"metadata"`
+	Disabled  bool                    `json:"disabled,omitempty"`
+	DeletedAt time.Time               `json:"deleted_at"`
+	Version   int64                   `json:"version,omitempty"`
+}
+
+type cachedAuthorize struct {
+	ClientID            string    `json:"client_id"`
+	Code                string    `json:"code"`
+	ExpiresIn           int32     `json:"expires_in"`
+	Scope               string    `json:"scope"`
+	RedirectURI         string    `json:"redirect_uri"`
+	State               string    `json:"state"`
+	CreatedAt           time.Time `json:"created_at"`
+	UserData            string    `json:"user_data"`
+	CodeChallenge       string    `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string    `json:"code_challenge_method,omitempty"`
+}
+
+type cachedAccess struct {
+	ClientID     string           `json:"client_id"`
+	Authorize    *cachedAuthorize `json:"authorize,omitempty"`
+	Previous     *cachedAccess    `json:"previous,omitempty"`
+	AccessToken  string           `json:"access_token"`
+	RefreshToken string           `json:"refresh_token"`
+	ExpiresIn    int32            `json:"expires_in"`
+	Scope        string           `json:"scope"`
+	RedirectURI  string           `json:"redirect_uri"`
+	CreatedAt    time.Time        `json:"created_at"`
+	UserData     string           `json:"user_data"`
+}
+
+func newCachedClient(c osin.Client) (*cachedClient, bool) {
+	data, ok := userData(c.GetUserData())
+	if !ok {
+		return nil, false
+	}
+	cached := &cachedClient{ID: c.GetId(), Secret: c.GetSecret(), RedirectURI: c.GetRedirectUri(), UserData: data}
+	if c, ok := c.(*postgres.Client); ok {
+		cached.Postgres = true
+		cached.Trusted, cached.Metadata, cached.Disabled, cached.DeletedAt, cached.Version = c.Trusted, c.Metadata, c.Disabled, c.DeletedAt, c.Version
+	}
+	return cached, true
+}
+
+func (c *cachedClient) client() osin.Client {
+	client := osin.DefaultClient{Id: c.ID, Secret: c.Secret, RedirectUri: c.RedirectURI, UserData: c.UserData}
+	if !c.Postgres {
+		return &client
+	}
+	return &postgres.Client{DefaultClient: client, Trusted: c.Trusted, Metadata: c.Metadata, Disabled: c.Disabled, DeletedAt: c.DeletedAt, Version: c.Version}
+}
+
+func newCachedAuthorize(d *osin.AuthorizeData) (*cachedAuthorize, bool) {
+	data, ok := userData(d.UserData)
+	if !ok || d.Client == nil {
+		return nil, false
+	}
+	return &cachedAuthorize{
+		ClientID:            d.Client.GetId(),
+		Code:                d.Code,
+		ExpiresIn:           d.ExpiresIn,
+		Scope:               d.Scope,
+		RedirectURI:         d.RedirectUri,
+		State:               d.State,
+		CreatedAt:           d.CreatedAt,
+		UserData:            data,
+		CodeChallenge:       d.CodeChallenge,
+		CodeChallengeMethod: d.CodeChallengeMethod,
+	}, true
+}
+
+func (c *cachedAuthorize) authorizeData(getClient func(id string) (osin.Client, error)) (*osin.AuthorizeData, error) {
+	client, err := getClient(c.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return &osin.AuthorizeData{
+		Client:              client,
+		Code:                c.Code,
+		ExpiresIn:           c.ExpiresIn,
+		Scope:               c.Scope,
+		RedirectUri:         c.RedirectURI,
+		State:               c.State,
+		CreatedAt:           c.CreatedAt,
+		UserData:            c.UserData,
+		CodeChallenge:       c.CodeChallenge,
+		CodeChallengeMethod: c.CodeChallengeMethod,
+	}, nil
+}
+
+func newCachedAccess(d *osin.AccessData) (*cachedAccess, bool) {
+	data, ok := userData(d.UserData)
+	if !ok || d.Client == nil {
+		return nil, false
+	}
+
+	c := &cachedAccess{
+		ClientID:     d.Client.GetId(),
+		AccessToken:  d.AccessToken,
+		RefreshToken: d.RefreshToken,
+		ExpiresIn:    d.ExpiresIn,
+		Scope:        d.Scope,
+		RedirectURI:  d.RedirectUri,
+		CreatedAt:    d.CreatedAt,
+		UserData:     data,
+	}
+	if d.AuthorizeData != nil {
+		if c.Authorize, ok = newCachedAuthorize(d.AuthorizeData); !ok {
+			return nil, false
+		}
+	}
+	if d.AccessData != nil {
+		if c.Previous, ok = newCachedAccess(d.AccessData); !ok {
+			return nil, false
+		}
+	}
+	return c, true
+}
+
+func (c *cachedAccess) accessData(getClient func(id string) (osin.Client, error)) (*osin.AccessData, error) {
+	client, err := getClient(c.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &osin.AccessData{
+		Client:       client,
+		AccessToken:  c.AccessToken,
+		RefreshToken: c.RefreshToken,
+		ExpiresIn:    c.ExpiresIn,
+		Scope:        c.Scope,
+		RedirectUri:  c.RedirectURI,
+		CreatedAt:    c.CreatedAt,
+		UserData:     c.UserData,
+	}
+	if c.Authorize != nil {
+		if d.AuthorizeData, err = c.Authorize.authorizeData(getClient); err != nil {
+			return nil, err
+		}
+	}
+	if c.Previous != nil {
+		if d.AccessData, err = c.Previous.accessData(getClient); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// userData returns UserData as string. nil is mapped to the empty string.
+func userData(in interface{}) (string, bool) {
+	if in == nil {
+		return "", true
+	}
+	data, ok := in.(string)
+	return data, ok
+}
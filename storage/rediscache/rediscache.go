@@ -0,0 +1,252 @@
+// Package rediscache is a caching decorator which fronts a storage with redis.
+//
+// GetClient, LoadAccess and LoadRefresh are read through the cache, all other methods are passed to the
+// decorated storage. Cached entries are invalidated when they are updated or removed through the decorator, and
+// with RunInvalidation when they are changed by any postgres storage sending change notifications, e.g. by
+// DisableClient, SoftDeleteClient or RevokeAllByClient.
+package rediscache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/optimisticninja/osin-postgres/storage"
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+// Config configures the cache. Zero values are replaced with defaults.
+type Config struct {
+	// Prefix is prepended to all keys. Defaults to "osin:".
+	Prefix string
+
+	// ClientTTL is the time clients are cached. Defaults to five minutes.
+	ClientTTL time.Duration
+
+	// AccessTTL is the maximum time access data is cached. Access data is never cached beyond its expiry.
+	// Defaults to one minute.
+	AccessTTL time.Duration
+
+	// RefreshTTL is the time the mapping of a refresh token to its access token is cached. Defaults to one minute.
+	RefreshTTL time.Duration
+}
+
+// Storage is a storage.Storage decorated with a redis cache.
+type Storage struct {
+	storage.Storage
+	redis  redis.UniversalClient
+	config Config
+}
+
+// New returns next decorated with a cache in client.
+func New(next storage.Storage, client redis.UniversalClient, config Config) *Storage {
+	if config.Prefix == "" {
+		config.Prefix = "osin:"
+	}
+	if config.ClientTTL <= 0 {
+		config.ClientTTL = 5 * time.Minute
+	}
+	if config.AccessTTL <= 0 {
+		config.AccessTTL = time.Minute
+	}
+	if config.RefreshTTL <= 0 {
+		config.RefreshTTL = time.Minute
+	}
+	return &Storage{Storage: next, redis: client, config: config}
+}
+
+// Clone returns the storage itself.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// GetClient loads the client by id from the cache or the decorated storage.
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	var cached cachedClient
+	if s.get(s.clientKey(id), &cached) {
+		return cached.client(), nil
+	}
+
+	c, err := s.Storage.GetClient(id)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := newCachedClient(c); ok {
+		s.set(s.clientKey(id), cached, s.config.ClientTTL)
+	}
+	return c, nil
+}
+
+// UpdateClient updates the client in the decorated storage and evicts it from the cache.
+func (s *Storage) UpdateClient(c osin.Client) error {
+	if err := s.Storage.UpdateClient(c); err != nil {
+		return err
+	}
+	return s.del(s.clientKey(c.GetId()))
+}
+
+// RemoveClient removes the client from the decorated storage and evicts it from the cache.
+func (s *Storage) RemoveClient(id string) error {
+	if err := s.Storage.RemoveClient(id); err != nil {
+		return err
+	}
+	return s.del(s.clientKey(id))
+}
+
+// LoadAccess retrieves access data by token from the cache or the decorated storage.
+func (s *Storage) LoadAccess(token string) (*osin.AccessData, error) {
+	var cached cachedAccess
+	if s.get(s.accessKey(token), &cached) {
+		if data, err := cached.accessData(s.GetClient); err == nil {
+			return data, nil
+		}
+	}
+
+	data, err := s.Storage.LoadAccess(token)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheAccess(data)
+	return data, nil
+}
+
+// RemoveAccess removes the access data from the decorated storage and evicts it from the cache.
+func (s *Storage) RemoveAccess(token string) error {
+	if err := s.Storage.RemoveAccess(token); err != nil {
+		return err
+	}
+	return s.del(s.accessKey(token))
+}
+
+// LoadRefresh retrieves refresh access data from the cache or the decorated storage.
+func (s *Storage) LoadRefresh(token string) (*osin.AccessData, error) {
+	var access string
+	if s.get(s.refreshKey(token), &access) {
+		return s.LoadAccess(access)
+	}
+
+	data, err := s.Storage.LoadRefresh(token)
+	if err != nil {
+		return nil, err
+	}
+	s.set(s.refreshKey(token), data.AccessToken, s.config.RefreshTTL)
+	s.cacheAccess(data)
+	return data, nil
+}
+
+// RemoveRefresh removes the refresh token from the decorated storage and evicts it from the cache.
+func (s *Storage) RemoveRefresh(token string) error {
+	if err := s.Storage.RemoveRefresh(token); err != nil {
+		return err
+	}
+	return s.del(s.refreshKey(token))
+}
+
+// RunInvalidation evicts entries from the cache when events receives an event of a client created, updated or
+// removed or of an access or refresh token revoked by a postgres storage configured with postgres.WithNotify,
+// until ctx is done or events is closed. All entries are evicted when the subscriber reconnected, as events may
+// have been lost. Use a subscriber of its own, as the events are consumed, e.g.
+//
+//	sub, err := postgres.NewSubscriber(dsn, "osin")
+//	...
+//	go cached.RunInvalidation(ctx, sub.Events())
+func (s *Storage) RunInvalidation(ctx context.Context, events <-chan postgres.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			switch e.Type {
+			case postgres.AuditClientCreated, postgres.AuditClientUpdated, postgres.AuditClientDeleted:
+				s.evict(ctx, s.clientKey(e.ClientID))
+			case postgres.AuditAccessRevoked:
+				// The subject is the hash of the token, like the key.
+				s.evict(ctx, s.config.Prefix+"access:"+e.Subject)
+			case postgres.AuditRefreshRevoked:
+				s.evict(ctx, s.config.Prefix+"refresh:"+e.Subject)
+			case postgres.EventReconnected:
+				s.evictAll(ctx)
+			}
+		}
+	}
+}
+
+// evict evicts key from the cache. Errors are ignored, the entry expires after its ttl at the latest.
+func (s *Storage) evict(ctx context.Context, key string) {
+	s.redis.Del(ctx, key)
+}
+
+// evictAll evicts all keys with the prefix of the cache.
+func (s *Storage) evictAll(ctx context.Context) {
+	iter := s.redis.Scan(ctx, 0, s.config.Prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		s.evict(ctx, iter.Val())
+	}
+}
+
+func (s *Storage) cacheAccess(data *osin.AccessData) {
+	ttl := time.Until(data.ExpireAt())
+	if ttl > s.config.AccessTTL {
+		ttl = s.config.AccessTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	if cached, ok := newCachedAccess(data); ok {
+		s.set(s.accessKey(data.AccessToken), cached, ttl)
+	}
+}
+
+// get decodes the cached value of key into v and returns true on a cache hit. Cache errors are treated as misses,
+// so that an unavailable cache does not take down the storage.
+func (s *Storage) get(key string, v interface{}) bool {
+	value, err := s.redis.Get(context.Background(), key).Bytes()
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(value, v) == nil
+}
+
+// set caches v for ttl. Errors are ignored, the value is read from the decorated storage next time.
+func (s *Storage) set(key string, v interface{}, ttl time.Duration) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	s.redis.Set(context.Background(), key, value, ttl)
+}
+
+// del evicts key from the cache. Unlike get and set, errors are returned, because the cache would be stale.
+func (s *Storage) del(key string) error {
+	if err := s.redis.Del(context.Background(), key).Err(); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+func (s *Storage) clientKey(id string) string {
+	return s.config.Prefix + "client:" + id
+}
+
+// accessKey and refreshKey hash the token, so that tokens do not show up in key listings.
+func (s *Storage) accessKey(token string) string {
+	return s.config.Prefix + "access:" + hash(token)
+}
+
+func (s *Storage) refreshKey(token string) string {
+	return s.config.Prefix + "refresh:" + hash(token)
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
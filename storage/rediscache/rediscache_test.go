@@ -0,0 +1,222 @@
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optimisticninja/osin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/optimisticninja/osin-postgres/storage"
+	"github.com/optimisticninja/osin-postgres/storage/memory"
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+func TestAccessEncoding(t *testing.T) {
+	client := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: "foo"}
+	authorize := &osin.AuthorizeData{
+		Client:        client,
+		Code:          "code",
+		ExpiresIn:     60,
+		Scope:         "scope",
+		RedirectUri:   "http://localhost/",
+		State:         "state",
+		CreatedAt:     time.Now().Round(time.Second).UTC(),
+		UserData:      "bar",
+		CodeChallenge: "challenge",
+	}
+	previous := &osin.AccessData{Client: client, AccessToken: "previous", ExpiresIn: 60, CreatedAt: time.Now().Round(time.Second).UTC(), UserData: "bar"}
+	access := &osin.AccessData{
+		Client:        client,
+		AuthorizeData: authorize,
+		AccessData:    previous,
+		AccessToken:   "access",
+		RefreshToken:  "refresh",
+		ExpiresIn:     60,
+		Scope:         "scope",
+		RedirectUri:   "http://localhost/",
+		CreatedAt:     time.Now().Round(time.Second).UTC(),
+		UserData:      "bar",
+	}
+
+	cached, ok := newCachedAccess(access)
+	require.True(t, ok)
+	encoded, err := json.Marshal(cached)
+	require.Nil(t, err)
+
+	var decoded cachedAccess
+	require.Nil(t, json.Unmarshal(encoded, &decoded))
+	result, err := decoded.accessData(func(id string) (osin.Client, error) {
+		assert.Equal(t, "1", id)
+		return client, nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, access, result)
+}
+
+func TestNonStringUserDataIsNotCached(t *testing.T) {
+	_, ok := newCachedClient(&osin.DefaultClient{Id: "1", UserData: struct{}{}})
+	assert.False(t, ok)
+	_, ok = newCachedAccess(&osin.AccessData{Client: &osin.DefaultClient{}, UserData: 1})
+	assert.False(t, ok)
+}
+
+func TestClientEncoding(t *testing.T) {
+	client := &postgres.Client{
+		DefaultClient: osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: "foo"},
+		Trusted:       true,
+		Metadata:      postgres.ClientMetadata{DisplayName: "Billing", LogoURI: "https://billing.example.com/logo.png"},
+		DeletedAt:     time.Now().Round(time.Second).UTC(),
+		Version:       3,
+	}
+	for _, c := range []osin.Client{client, &client.DefaultClient} {
+		cached, ok := newCachedClient(c)
+		require.True(t, ok)
+		encoded, err := json.Marshal(cached)
+		require.Nil(t, err)
+
+		var decoded cachedClient
+		require.Nil(t, json.Unmarshal(encoded, &decoded))
+		assert.Equal(t, c, decoded.client())
+	}
+}
+
+func TestReadThrough(t *testing.T) {
+	next := &countingStorage{Storage: memory.New()}
+	cache := New(next, newFakeRedis(), Config{})
+	client := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	access := &osin.AccessData{Client: client, AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 60, CreatedAt: time.Now(), UserData: ""}
+	require.Nil(t, cache.CreateClient(client))
+	require.Nil(t, cache.SaveAccess(access))
+
+	for i := 0; i < 2; i++ {
+		c, err := cache.GetClient("1")
+		require.Nil(t, err)
+		assert.Equal(t, "secret", c.GetSecret())
+		data, err := cache.LoadRefresh("refresh")
+		require.Nil(t, err)
+		assert.Equal(t, "access", data.AccessToken)
+		data, err = cache.LoadAccess("access")
+		require.Nil(t, err)
+		assert.Equal(t, "refresh", data.RefreshToken)
+	}
+	assert.Equal(t, 1, next.clients)
+	assert.Equal(t, 1, next.refresh)
+	assert.Equal(t, 0, next.access)
+
+	client.Secret = "rotated"
+	require.Nil(t, cache.UpdateClient(client))
+	c, err := cache.GetClient("1")
+	require.Nil(t, err)
+	assert.Equal(t, "rotated", c.GetSecret())
+	assert.Equal(t, 2, next.clients)
+
+	require.Nil(t, cache.RemoveAccess("access"))
+	_, err = cache.LoadAccess("access")
+	assert.NotNil(t, err)
+}
+
+func TestRunInvalidation(t *testing.T) {
+	next := &countingStorage{Storage: memory.New()}
+	redis := newFakeRedis()
+	cache := New(next, redis, Config{})
+	client := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	access := &osin.AccessData{Client: client, AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 60, CreatedAt: time.Now(), UserData: ""}
+	require.Nil(t, cache.CreateClient(client))
+	require.Nil(t, cache.SaveAccess(access))
+	_, err := cache.LoadRefresh("refresh")
+	require.Nil(t, err)
+	_, err = cache.GetClient("1")
+	require.Nil(t, err)
+	require.Len(t, redis.values, 3)
+
+	events := make(chan postgres.Event, 3)
+	events <- postgres.Event{Type: postgres.AuditClientUpdated, ClientID: "1", Subject: "1"}
+	events <- postgres.Event{Type: postgres.AuditAccessRevoked, ClientID: "1", Subject: postgres.HashToken("access")}
+	events <- postgres.Event{Type: postgres.AuditRefreshRevoked, ClientID: "1", Subject: postgres.HashToken("refresh")}
+	close(events)
+	cache.RunInvalidation(context.Background(), events)
+	assert.Empty(t, redis.values)
+
+	_, err = cache.LoadRefresh("refresh")
+	require.Nil(t, err)
+	_, err = cache.GetClient("1")
+	require.Nil(t, err)
+	require.Len(t, redis.values, 3)
+	redis.values["other:key"] = []byte("{}")
+	events = make(chan postgres.Event, 1)
+	events <- postgres.Event{Type: postgres.EventReconnected}
+	close(events)
+	cache.RunInvalidation(context.Background(), events)
+	assert.Equal(t, map[string][]byte{"other:key": []byte("{}")}, redis.values)
+}
+
+// countingStorage counts the loads which were not served by the cache.
+type countingStorage struct {
+	storage.Storage
+	clients, access, refresh int
+}
+
+func (s *countingStorage) GetClient(id string) (osin.Client, error) {
+	s.clients++
+	return s.Storage.GetClient(id)
+}
+
+func (s *countingStorage) LoadAccess(token string) (*osin.AccessData, error) {
+	s.access++
+	return s.Storage.LoadAccess(token)
+}
+
+func (s *countingStorage) LoadRefresh(token string) (*osin.AccessData, error) {
+	s.refresh++
+	return s.Storage.LoadRefresh(token)
+}
+
+// fakeRedis implements the commands used by the cache in memory. Expiry is not implemented.
+type fakeRedis struct {
+	redis.UniversalClient
+	values map[string][]byte
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: map[string][]byte{}}
+}
+
+func (r *fakeRedis) Get(_ context.Context, key string) *redis.StringCmd {
+	value, ok := r.values[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(string(value), nil)
+}
+
+func (r *fakeRedis) Set(_ context.Context, key string, value interface{}, _ time.Duration) *redis.StatusCmd {
+	r.values[key] = value.([]byte)
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (r *fakeRedis) Del(_ context.Context, keys ...string) *redis.IntCmd {
+	var n int64
+	for _, key := range keys {
+		if _, ok := r.values[key]; ok {
+			delete(r.values, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (r *fakeRedis) Scan(_ context.Context, _ uint64, match string, _ int64) *redis.ScanCmd {
+	var keys []string
+	for key := range r.values {
+		if strings.HasPrefix(key, strings.TrimSuffix(match, "*")) {
+			keys = append(keys, key)
+		}
+	}
+	return redis.NewScanCmdResult(keys, 0, nil)
+}
@@ -0,0 +1,433 @@
+// Package sqlite is a osin storage implementation for SQLite, e.g. for single binary or edge deployments.
+//
+// It implements the same storage.Storage interface and returns the same errors as the postgres package, so code
+// checking for postgres.ErrNotFound or postgres.ErrDuplicateKey works with both. The package uses
+// github.com/mattn/go-sqlite3, which requires cgo and registers the "sqlite3" driver. Open the database with a busy
+// timeout, as SQLite allows a single writer only:
+//
+//	db, err := sql.Open("sqlite3", "file:osin.db?_busy_timeout=5000&_foreign_keys=on")
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/mattn/go-sqlite3"
+	"github.com/optimisticninja/osin"
+
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+// migrations are applied in order by CreateSchemas. The number of applied migrations is stored in the
+// user_version pragma, so append new migrations and never change existing ones.
+var migrations = []string{`CREATE TABLE client (
+	id           text NOT NULL PRIMARY KEY,
+	secret       text NOT NULL,
+	extra        text NOT NULL,
+	redirect_uri text NOT NULL
+)`, `CREATE TABLE authorize (
+	client       text NOT NULL,
+	code         text NOT NULL PRIMARY KEY,
+	expires_in   int NOT NULL,
+	scope        text,
+	redirect_uri text,
+	state        text,
+	extra        text NOT NULL,
+	created_at   timestamp NOT NULL
+)`, `CREATE TABLE access (
+	client        text NOT NULL,
+	authorize     text,
+	previous      text,
+	access_token  text NOT NULL PRIMARY KEY,
+	refresh_token text,
+	expires_in    int NOT NULL,
+	scope         text,
+	redirect_uri  text,
+	extra         text NOT NULL,
+	created_at    timestamp NOT NULL
+)`, `CREATE TABLE refresh (
+	token         text NOT NULL PRIMARY KEY,
+	access        text NOT NULL
+)`, `CREATE INDEX refresh_access_idx ON refresh (access)`,
+	`ALTER TABLE authorize ADD COLUMN code_challenge text`,
+	`ALTER TABLE authorize ADD COLUMN code_challenge_method text`}
+
+// expired is the condition for expired rows of the authorize and access tables. Times are stored in UTC.
+const expired = "datetime(created_at, '+' || expires_in || ' seconds') < datetime('now')"
+
+// Storage implements interface "github.com/openshift/osin".Storage and interface "github.com/optimisticninja/osin-postgres/storage".Storage
+type Storage struct {
+	db *sql.DB
+}
+
+// New returns a new sqlite storage instance.
+func New(db *sql.DB) *Storage {
+	return &Storage{db: db}
+}
+
+// CreateSchemas applies all migrations which were not applied to the database yet in a single transaction.
+// It can be run any number of times.
+func (s *Storage) CreateSchemas() error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var version int
+		if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+			return errors.New(err)
+		}
+		for ; version < len(migrations); version++ {
+			if _, err := tx.Exec(migrations[version]); err != nil {
+				return errors.Errorf("Error applying migration %d: %s", version, err)
+			}
+		}
+		// PRAGMA does not support parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+			return errors.New(err)
+		}
+		return nil
+	})
+}
+
+// Clone the storage if needed. For example, using mgo, you can clone the session with session.Clone
+// to avoid concurrent access problems.
+// This is to avoid cloning the connection at each method access.
+// Can return itself if not a problem.
+func (s *Storage) Clone() osin.Storage {
+	return s
+}
+
+// Close the resources the Storage potentially holds (using Clone for example). The database is not closed.
+func (s *Storage) Close() {
+}
+
+// GetClient loads the client by id. Returns postgres.ErrClientNotFound if the client does not exist.
+func (s *Storage) GetClient(id string) (osin.Client, error) {
+	var c osin.DefaultClient
+	var extra string
+	if err := s.db.QueryRow("SELECT id, secret, redirect_uri, extra FROM client WHERE id=?", id).Scan(&c.Id, &c.Secret, &c.RedirectUri, &extra); err == sql.ErrNoRows {
+		return nil, postgres.ErrClientNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	c.UserData = extra
+	return &c, nil
+}
+
+// UpdateClient updates the client (identified by it's id) and replaces the values with the values of client.
+// The secret is kept if client implements postgres.SecretKeepingClient.
+// Returns postgres.ErrClientNotFound if the client does not exist.
+func (s *Storage) UpdateClient(c osin.Client) error {
+	data, err := assertToString(c.GetUserData())
+	if err != nil {
+		return err
+	}
+	var secret interface{} = c.GetSecret()
+	if postgres.KeepsSecret(c) {
+		secret = nil
+	}
+
+	res, err := s.db.Exec("UPDATE client SET secret=COALESCE(?, secret), redirect_uri=?, extra=? WHERE id=?", secret, c.GetRedirectUri(), data, c.GetId())
+	if err != nil {
+		return classify(err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.New(err)
+	} else if n == 0 {
+		return postgres.ErrClientNotFound
+	}
+	return nil
+}
+
+// CreateClient stores the client in the database and returns an error, if something went wrong.
+// Returns postgres.ErrDuplicateKey if a client with the same id exists.
+func (s *Storage) CreateClient(c osin.Client) error {
+	data, err := assertToString(c.GetUserData())
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec("INSERT INTO client (id, secret, redirect_uri, extra) VALUES (?, ?, ?, ?)", c.GetId(), c.GetSecret(), c.GetRedirectUri(), data); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// RemoveClient removes a client (identified by id) from the database. Returns an error if something went wrong.
+// Removing a client which does not exist is not an error.
+func (s *Storage) RemoveClient(id string) error {
+	if _, err := s.db.Exec("DELETE FROM client WHERE id=?", id); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// SaveAuthorize saves authorize data.
+func (s *Storage) SaveAuthorize(data *osin.AuthorizeData) error {
+	extra, err := assertToString(data.UserData)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(
+		"INSERT INTO authorize (client, code, expires_in, scope, redirect_uri, state, created_at, extra, code_challenge, code_challenge_method) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		data.Client.GetId(),
+		data.Code,
+		data.ExpiresIn,
+		nullString(data.Scope),
+		nullString(data.RedirectUri),
+		nullString(data.State),
+		data.CreatedAt.UTC(),
+		extra,
+		nullString(data.CodeChallenge),
+		nullString(data.CodeChallengeMethod),
+	); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// LoadAuthorize looks up AuthorizeData by a code. Returns postgres.ErrTokenNotFound if the code does not exist.
+// Client information MUST be loaded together.
+// Optionally can return error if expired.
+func (s *Storage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	var data osin.AuthorizeData
+	var extra string
+	var cid string
+	if err := s.db.QueryRow("SELECT client, code, expires_in, COALESCE(scope, ''), COALESCE(redirect_uri, ''), COALESCE(state, ''), created_at, extra, COALESCE(code_challenge, ''), COALESCE(code_challenge_method, '') FROM authorize WHERE code=? LIMIT 1", code).Scan(&cid, &data.Code, &data.ExpiresIn, &data.Scope, &data.RedirectUri, &data.State, &data.CreatedAt, &extra, &data.CodeChallenge, &data.CodeChallengeMethod); err == sql.ErrNoRows {
+		return nil, postgres.ErrTokenNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	data.UserData = extra
+
+	c, err := s.GetClient(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.ExpireAt().Before(time.Now()) {
+		return nil, errors.Errorf("Token expired at %s.", data.ExpireAt().String())
+	}
+
+	data.Client = c
+	return &data, nil
+}
+
+// RemoveAuthorize revokes or deletes the authorization code.
+func (s *Storage) RemoveAuthorize(code string) error {
+	if _, err := s.db.Exec("DELETE FROM authorize WHERE code=?", code); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// SaveAccess writes AccessData.
+// If RefreshToken is not blank, it must save in a way that can be loaded using LoadRefresh.
+func (s *Storage) SaveAccess(data *osin.AccessData) error {
+	prev := ""
+	authorizeData := &osin.AuthorizeData{}
+
+	if data.AccessData != nil {
+		prev = data.AccessData.AccessToken
+	}
+
+	if data.AuthorizeData != nil {
+		authorizeData = data.AuthorizeData
+	}
+
+	extra, err := assertToString(data.UserData)
+	if err != nil {
+		return err
+	}
+
+	if data.Client == nil {
+		return errors.New("data.Client must not be nil")
+	}
+
+	return s.inTx(func(tx *sql.Tx) error {
+		if data.RefreshToken != "" {
+			if _, err := tx.Exec("INSERT INTO refresh (token, access) VALUES (?, ?)", data.RefreshToken, data.AccessToken); err != nil {
+				return classify(err)
+			}
+		}
+
+		if _, err := tx.Exec("INSERT INTO access (client, authorize, previous, access_token, refresh_token, expires_in, scope, redirect_uri, created_at, extra) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", data.Client.GetId(), nullString(authorizeData.Code), nullString(prev), data.AccessToken, nullString(data.RefreshToken), data.ExpiresIn, nullString(data.Scope), nullString(data.RedirectUri), data.CreatedAt.UTC(), extra); err != nil {
+			return classify(err)
+		}
+		return nil
+	})
+}
+
+// LoadAccess retrieves access data by token. Returns postgres.ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
+// AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
+// Optionally can return error if expired.
+func (s *Storage) LoadAccess(code string) (*osin.AccessData, error) {
+	var extra, cid, prevAccessToken, authorizeCode string
+	var result osin.AccessData
+
+	if err := s.db.QueryRow(
+		"SELECT client, COALESCE(authorize, ''), COALESCE(previous, ''), access_token, COALESCE(refresh_token, ''), expires_in, COALESCE(scope, ''), COALESCE(redirect_uri, ''), created_at, extra FROM access WHERE access_token=? LIMIT 1",
+		code,
+	).Scan(
+		&cid,
+		&authorizeCode,
+		&prevAccessToken,
+		&result.AccessToken,
+		&result.RefreshToken,
+		&result.ExpiresIn,
+		&result.Scope,
+		&result.RedirectUri,
+		&result.CreatedAt,
+		&extra,
+	); err == sql.ErrNoRows {
+		return nil, postgres.ErrTokenNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+
+	result.UserData = extra
+	client, err := s.GetClient(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Client = client
+	if authorizeCode != "" {
+		result.AuthorizeData, _ = s.LoadAuthorize(authorizeCode)
+	}
+	if prevAccessToken != "" {
+		result.AccessData, _ = s.LoadAccess(prevAccessToken)
+	}
+	return &result, nil
+}
+
+// RemoveAccess revokes or deletes an AccessData.
+func (s *Storage) RemoveAccess(code string) error {
+	if _, err := s.db.Exec("DELETE FROM access WHERE access_token=?", code); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// LoadRefresh retrieves refresh AccessData. Returns postgres.ErrTokenNotFound if the token does not exist.
+// Client information MUST be loaded together.
+// AuthorizeData and AccessData DON'T NEED to be loaded if not easily available.
+// Optionally can return error if expired.
+func (s *Storage) LoadRefresh(code string) (*osin.AccessData, error) {
+	var access string
+	if err := s.db.QueryRow("SELECT access FROM refresh WHERE token=? LIMIT 1", code).Scan(&access); err == sql.ErrNoRows {
+		return nil, postgres.ErrTokenNotFound
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+	return s.LoadAccess(access)
+}
+
+// RemoveRefresh revokes or deletes refresh AccessData.
+func (s *Storage) RemoveRefresh(code string) error {
+	if _, err := s.db.Exec("DELETE FROM refresh WHERE token=?", code); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// RevokeAllByClient removes all access tokens, refresh tokens and authorize codes issued to the client in one
+// transaction. The client itself is not removed.
+func (s *Storage) RevokeAllByClient(clientID string) (*postgres.RevokeCounts, error) {
+	counts := &postgres.RevokeCounts{}
+	if err := s.inTx(func(tx *sql.Tx) (err error) {
+		if counts.Refresh, err = execCount(tx, "DELETE FROM refresh WHERE access IN (SELECT access_token FROM access WHERE client=?)", clientID); err != nil {
+			return err
+		}
+		if counts.Access, err = execCount(tx, "DELETE FROM access WHERE client=?", clientID); err != nil {
+			return err
+		}
+		counts.Authorize, err = execCount(tx, "DELETE FROM authorize WHERE client=?", clientID)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// PurgeExpiredTokens removes all expired authorize codes and all expired access tokens which cannot be refreshed
+// anymore, because they have no refresh token left. Run it periodically, as SQLite has no background jobs.
+func (s *Storage) PurgeExpiredTokens() (*postgres.RevokeCounts, error) {
+	counts := &postgres.RevokeCounts{}
+	if err := s.inTx(func(tx *sql.Tx) (err error) {
+		if counts.Authorize, err = execCount(tx, "DELETE FROM authorize WHERE "+expired); err != nil {
+			return err
+		}
+		counts.Access, err = execCount(tx, "DELETE FROM access WHERE "+expired+" AND NOT EXISTS (SELECT 1 FROM refresh WHERE refresh.access=access.access_token)")
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// inTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise.
+func (s *Storage) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.New(err)
+	}
+	if err := fn(tx); err != nil {
+		if rbe := tx.Rollback(); rbe != nil {
+			return errors.New(rbe)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// execCount executes query and returns the number of affected rows.
+func execCount(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, classify(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	return n, nil
+}
+
+// classify wraps err and maps constraint violations and lock contention to the errors of the postgres package.
+func classify(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch {
+		case sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique:
+			return errors.New(fmt.Errorf("%w: %w", postgres.ErrDuplicateKey, err))
+		case sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey:
+			return errors.New(fmt.Errorf("%w: %w", postgres.ErrForeignKeyViolation, err))
+		case sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked:
+			return errors.New(fmt.Errorf("%w: %w", postgres.ErrConflict, err))
+		}
+	}
+	return errors.New(err)
+}
+
+func assertToString(in interface{}) (string, error) {
+	var ok bool
+	var data string
+	if in == nil {
+		return "", nil
+	} else if data, ok = in.(string); ok {
+		return data, nil
+	} else if str, ok := in.(fmt.Stringer); ok {
+		return str.String(), nil
+	}
+	return "", errors.Errorf(`Could not assert "%v" to string`, in)
+}
+
+// nullString maps the empty string to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
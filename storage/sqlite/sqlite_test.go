@@ -0,0 +1,109 @@
+package sqlite
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/optimisticninja/osin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/optimisticninja/osin-postgres/storage"
+	"github.com/optimisticninja/osin-postgres/storage/osintest"
+	"github.com/optimisticninja/osin-postgres/storage/postgres"
+)
+
+var _ storage.Storage = (*Storage)(nil)
+
+func newStore(t *testing.T) *Storage {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	require.Nil(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	s := New(db)
+	require.Nil(t, s.CreateSchemas())
+	require.Nil(t, s.CreateSchemas())
+	return s
+}
+
+func TestCreateSchemas(t *testing.T) {
+	s := newStore(t)
+	var version int
+	require.Nil(t, s.db.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestClientOperations(t *testing.T) {
+	s := newStore(t)
+	client := &osin.DefaultClient{Id: "1", Secret: "secret", RedirectUri: "http://localhost/", UserData: "{}"}
+	require.Nil(t, s.CreateClient(client))
+	assert.True(t, errors.Is(s.CreateClient(client), postgres.ErrDuplicateKey))
+
+	client.Secret = "rotated"
+	require.Nil(t, s.UpdateClient(client))
+	loaded, err := s.GetClient("1")
+	require.Nil(t, err)
+	assert.EqualValues(t, client, loaded)
+
+	require.Nil(t, s.RemoveClient("1"))
+	_, err = s.GetClient("1")
+	assert.Equal(t, postgres.ErrClientNotFound, err)
+	assert.Equal(t, postgres.ErrClientNotFound, s.UpdateClient(client))
+}
+
+func TestTokenOperations(t *testing.T) {
+	s := newStore(t)
+	client := &osin.DefaultClient{Id: "2", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, s.CreateClient(client))
+
+	authorize := &osin.AuthorizeData{Client: client, Code: "code", ExpiresIn: 60, Scope: "scope", CreatedAt: time.Now().Round(time.Second), UserData: "user"}
+	require.Nil(t, s.SaveAuthorize(authorize))
+	loadedAuthorize, err := s.LoadAuthorize("code")
+	require.Nil(t, err)
+	assert.Equal(t, "scope", loadedAuthorize.Scope)
+	assert.True(t, authorize.CreatedAt.Equal(loadedAuthorize.CreatedAt))
+
+	access := &osin.AccessData{Client: client, AuthorizeData: authorize, AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 60, CreatedAt: time.Now(), UserData: "user"}
+	require.Nil(t, s.SaveAccess(access))
+	assert.True(t, errors.Is(s.SaveAccess(access), postgres.ErrDuplicateKey))
+
+	loaded, err := s.LoadRefresh("refresh")
+	require.Nil(t, err)
+	assert.Equal(t, "access", loaded.AccessToken)
+	assert.Equal(t, "code", loaded.AuthorizeData.Code)
+
+	require.Nil(t, s.RemoveRefresh("refresh"))
+	require.Nil(t, s.RemoveAccess("access"))
+	require.Nil(t, s.RemoveAuthorize("code"))
+	_, err = s.LoadAccess("access")
+	assert.Equal(t, postgres.ErrTokenNotFound, err)
+	_, err = s.LoadRefresh("refresh")
+	assert.Equal(t, postgres.ErrTokenNotFound, err)
+}
+
+func TestPurgeAndRevoke(t *testing.T) {
+	s := newStore(t)
+	client := &osin.DefaultClient{Id: "3", Secret: "secret", RedirectUri: "http://localhost/", UserData: ""}
+	require.Nil(t, s.CreateClient(client))
+
+	old := time.Now().Add(-time.Hour)
+	require.Nil(t, s.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "expired", ExpiresIn: 60, CreatedAt: old}))
+	require.Nil(t, s.SaveAuthorize(&osin.AuthorizeData{Client: client, Code: "valid", ExpiresIn: 60, CreatedAt: time.Now()}))
+	require.Nil(t, s.SaveAccess(&osin.AccessData{Client: client, AccessToken: "expired", ExpiresIn: 60, CreatedAt: old}))
+	require.Nil(t, s.SaveAccess(&osin.AccessData{Client: client, AccessToken: "refreshable", RefreshToken: "r", ExpiresIn: 60, CreatedAt: old}))
+
+	counts, err := s.PurgeExpiredTokens()
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.RevokeCounts{Authorize: 1, Access: 1}, counts)
+
+	counts, err = s.RevokeAllByClient(client.Id)
+	require.Nil(t, err)
+	assert.Equal(t, &postgres.RevokeCounts{Authorize: 1, Access: 1, Refresh: 1}, counts)
+}
+
+func TestOsinFlows(t *testing.T) {
+	osintest.Run(t, newStore(t))
+}